@@ -0,0 +1,163 @@
+package zipcar
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"os"
+
+	cid "github.com/ipfs/go-cid"
+)
+
+const (
+	// zip64Count and zip64Size are the values beyond which archive/zip writes Zip64 records for the entry count,
+	// and for sizes and offsets, respectively
+	zip64Count = 0xffff
+	zip64Size  = 0xffffffff
+)
+
+// AppendBlock adds a single block to the existing ZIP archive at `path` without instantiating a ZipDatastore or
+// rewriting the blocks already in it, for a process that receives blocks one at a time and wants each to be durable
+// as soon as it arrives. The new entry is written where the central directory begins, followed by the existing
+// central directory, extended with a record for the new entry, and the end of central directory record, with the
+// archive comment kept. The file is synced before returning. The entry is written as a rewrite of a ZipDatastore
+// with DefaultOptions() would write it. A block that is already in the archive, or that has an identity CID, is
+// not written again. An empty file is written as a new archive holding just the block. An integrity manifest in
+// the archive, see Options.WriteIntegrityManifest, isn't updated to list the block.
+//
+// The existing central directory is read to check for the block, so the cost of each call grows with the number of
+// entries, but not with the size of the blocks. Where the archive uses Zip64 records, or would need them once the
+// block is added, or has data preceding its first entry, AppendBlock falls back to a full rewrite.
+//
+// There must be only one writer: no other AppendBlock() call, and no ZipDatastore open for writing, may be working
+// on the same archive at the same time, and a ZipDatastore open for reading won't see the block until it is opened
+// again. An interruption part way through can leave the archive without a readable central directory, which
+// RebuildIndex() can recover.
+func AppendBlock(path string, c cid.Cid, data []byte) (err error) {
+	if _, ok := identityData(c); ok {
+		return nil
+	}
+	cidStr, err := cidToString(c)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		cerr := file.Close()
+		if err == nil {
+			err = cerr
+		}
+	}()
+	fileinfo, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	size := fileinfo.Size()
+
+	zipDs := &ZipDatastore{opts: DefaultOptions()}
+	header := zipDs.entryHeader(*cidStr, data, false)
+	if size == 0 {
+		writer := zip.NewWriter(file)
+		if err = writeEntry(writer, header, data); err != nil {
+			return err
+		}
+		if err = writer.Close(); err != nil {
+			return err
+		}
+		return file.Sync()
+	}
+
+	reader, err := zip.NewReader(file, size)
+	if err != nil {
+		return err
+	}
+	for _, f := range reader.File {
+		if name, ok := canonicalName(f.Name); ok && name == *cidStr {
+			return nil
+		}
+	}
+
+	end, endOffset, err := readDirectoryEnd(file, size)
+	if err != nil {
+		return err
+	}
+	count := binary.LittleEndian.Uint16(end[10:])
+	directorySize := binary.LittleEndian.Uint32(end[12:])
+	directoryOffset := binary.LittleEndian.Uint32(end[16:])
+	if int(count)+1 >= zip64Count || directorySize == zip64Size || directoryOffset == zip64Size ||
+		int64(directoryOffset)+int64(directorySize) != endOffset {
+		return appendRewrite(path, c, data)
+	}
+	directory := make([]byte, directorySize)
+	if _, err = file.ReadAt(directory, int64(directoryOffset)); err != nil {
+		return err
+	}
+
+	// write the entry as it would appear in place of the existing central directory, then take the entry and its
+	// central directory record from that
+	var buf bytes.Buffer
+	writer := zip.NewWriter(&buf)
+	writer.SetOffset(int64(directoryOffset))
+	if err = writeEntry(writer, header, data); err != nil {
+		return err
+	}
+	if err = writer.Close(); err != nil {
+		return err
+	}
+	written := buf.Bytes()
+	newEnd := written[len(written)-directoryEndLen:]
+	recordLen := int64(binary.LittleEndian.Uint32(newEnd[12:]))
+	newDirectoryOffset := int64(binary.LittleEndian.Uint32(newEnd[16:]))
+	if newDirectoryOffset == zip64Size || newDirectoryOffset+int64(directorySize)+recordLen >= zip64Size {
+		return appendRewrite(path, c, data)
+	}
+	entryLen := newDirectoryOffset - int64(directoryOffset)
+
+	out := append([]byte{}, written[:entryLen]...)
+	out = append(out, directory...)
+	out = append(out, written[entryLen:entryLen+recordLen]...)
+	end = append([]byte{}, end...)
+	binary.LittleEndian.PutUint16(end[8:], count+1)
+	binary.LittleEndian.PutUint16(end[10:], count+1)
+	binary.LittleEndian.PutUint32(end[12:], directorySize+uint32(recordLen))
+	binary.LittleEndian.PutUint32(end[16:], uint32(newDirectoryOffset))
+	out = append(out, end...)
+
+	if _, err = file.WriteAt(out, int64(directoryOffset)); err != nil {
+		return err
+	}
+	if err = file.Truncate(int64(directoryOffset) + int64(len(out))); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// writeEntry writes an entry with the header `fh` and content `data` to `writer`.
+func writeEntry(writer *zip.Writer, fh zip.FileHeader, data []byte) error {
+	f, err := writer.CreateHeader(&fh)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	return err
+}
+
+// appendRewrite adds a block to the archive at `path` for AppendBlock() where it can't append in place, by
+// rewriting the whole archive.
+func appendRewrite(path string, c cid.Cid, data []byte) (err error) {
+	zipDs, err := NewDatastore(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		cerr := zipDs.Close()
+		if err == nil {
+			err = cerr
+		}
+	}()
+	return zipDs.PutCid(c, data)
+}
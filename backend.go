@@ -0,0 +1,87 @@
+package zipcar
+
+import (
+	"archive/zip"
+	"io"
+	"os"
+	"time"
+)
+
+// Backend stores the archive of a ZipDatastore created with NewDatastoreWithBackend(), decoupling it from the
+// local filesystem so that it may be held in memory or in object storage instead. Blocks are read from the
+// archive as they are needed, with ReadAt(), and a modified archive is written in full, from start to finish,
+// when the ZipDatastore is synced or closed. NewFileBackend() returns the file-based implementation.
+type Backend interface {
+	// Open returns the current archive for reading along with its size in bytes. A size of 0 means that there is
+	// no archive yet. The ZipDatastore closes the reader once it is no longer needed, which is always before
+	// Create() is called.
+	Open() (ReaderAtCloser, int64, error)
+	// Create returns a writer for a new archive, which replaces the current one once the writer is closed without
+	// error. If writing fails, the writer is closed regardless, and the current archive should be left intact if
+	// possible.
+	Create() (io.WriteCloser, error)
+}
+
+// fileBackend is a Backend that stores the archive in the file at `path`.
+type fileBackend struct {
+	path string
+}
+
+// NewFileBackend returns a Backend that stores the archive in the file at `path`, which is created if it
+// doesn't exist. The file is truncated and rewritten by Create(). NewDatastore() uses a file directly, to which
+// this is equivalent other than that Options.Mmap can't be used and the file is closed and reopened when written.
+func NewFileBackend(path string) Backend {
+	return &fileBackend{path}
+}
+
+func (b *fileBackend) Open() (ReaderAtCloser, int64, error) {
+	file, err := os.OpenFile(b.path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, 0, err
+	}
+	fileinfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	return file, fileinfo.Size(), nil
+}
+
+func (b *fileBackend) Create() (io.WriteCloser, error) {
+	return os.OpenFile(b.path, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
+}
+
+// NewDatastoreWithBackend instantiates a new ZipDatastore whose archive is stored by `backend`, which is opened
+// immediately; an empty archive is treated as a new one. Any pending mutations are written with
+// Backend.Create() by Sync() and Close(). If `opts` is nil, DefaultOptions() are used; Options.Mmap is not
+// applicable and is ignored.
+//
+// Always call Close() on a ZipDatastore when it is no longer required
+func NewDatastoreWithBackend(backend Backend, opts *Options) (*ZipDatastore, error) {
+	var zipDs = ZipDatastore{opts: DefaultOptions(), backend: backend}
+	if opts != nil {
+		zipDs.opts = *opts
+	}
+	zipDs.opts.Mmap = false
+
+	zipDs.index = make(map[string]*zip.File)
+	zipDs.cache = make(map[string][]byte)
+	zipDs.entryComments = make(map[string]string)
+	zipDs.modTimes = make(map[string]time.Time)
+
+	file, size, err := backend.Open()
+	if err != nil {
+		return nil, err
+	}
+	if size == 0 {
+		zipDs.file = file
+		return &zipDs, nil
+	}
+	if zipDs.opts.LazyIndex {
+		zipDs.loadIndexLazily(file, size)
+	} else if err = zipDs.loadIndex(file, size); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &zipDs, nil
+}
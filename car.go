@@ -0,0 +1,315 @@
+package zipcar
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+
+	cid "github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
+)
+
+const (
+	// carV2HeaderLen is the length of the CARv2 header that follows the pragma: 16 bytes of characteristics and
+	// the data offset, data size and index offset
+	carV2HeaderLen = 40
+	// multihashIndexSorted is the multicodec of the CARv2 index format written by ExportCarV2(), the default of
+	// the reference implementation
+	multihashIndexSorted = 0x0401
+)
+
+// carV2Pragma is the fixed start of every CARv2 file, a CARv1 header declaring version 2.
+var carV2Pragma = []byte{0x0a, 0xa1, 0x67, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x02}
+
+// ErrNoRoots is returned when exporting a CAR without any root CIDs, which CAR readers reject.
+var ErrNoRoots = errors.New("zipcar: a CAR requires at least one root")
+
+// ExportCar writes the current contents of this ZipDatastore, including any pending mutations, to `w` as a CARv1
+// (https://ipld.io/specs/transport/car/carv1/) with the given roots. Blocks are written in the same order as
+// Query() produces them. Blocks with identity CIDs are not stored so are not written. The ZipDatastore and its
+// file are not modified.
+func (zipDs *ZipDatastore) ExportCar(roots []cid.Cid, w io.Writer) error {
+	zipDs.lock.Lock()
+	defer zipDs.lock.Unlock()
+
+	bw := bufio.NewWriter(w)
+	if err := zipDs.writeCar(roots, bw, nil); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// ExportCarV2 writes the current contents of this ZipDatastore, including any pending mutations, to `w` as a
+// CARv2 (https://ipld.io/specs/transport/car/carv2/): the CARv1 that ExportCar() would write, wrapped with a
+// header and followed by a sorted index of the offset of each block within it, for random access by CAR
+// tooling. The header is written last, once the offsets it records are known, which is why `w` must be seekable;
+// writing begins at its current position and `w` is left positioned at the end of what was written.
+func (zipDs *ZipDatastore) ExportCarV2(roots []cid.Cid, w io.WriteSeeker) error {
+	zipDs.lock.Lock()
+	defer zipDs.lock.Unlock()
+
+	start, err := w.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(carV2Pragma); err != nil {
+		return err
+	}
+	// a placeholder for the header
+	if _, err = w.Write(make([]byte, carV2HeaderLen)); err != nil {
+		return err
+	}
+
+	// index records by multihash code, then by digest length
+	records := make(map[uint64]map[int][]carIndexRecord)
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+	err = zipDs.writeCar(roots, cw, func(c cid.Cid, offset int64) error {
+		decoded, err := mh.Decode(c.Hash())
+		if err != nil {
+			return err
+		}
+		if records[decoded.Code] == nil {
+			records[decoded.Code] = make(map[int][]carIndexRecord)
+		}
+		width := len(decoded.Digest)
+		records[decoded.Code][width] = append(records[decoded.Code][width], carIndexRecord{decoded.Digest, offset})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	dataSize := cw.n
+	if err = writeCarIndex(cw, records); err != nil {
+		return err
+	}
+	if err = cw.w.(*bufio.Writer).Flush(); err != nil {
+		return err
+	}
+
+	dataOffset := int64(len(carV2Pragma) + carV2HeaderLen)
+	header := make([]byte, carV2HeaderLen)
+	binary.LittleEndian.PutUint64(header[16:], uint64(dataOffset))
+	binary.LittleEndian.PutUint64(header[24:], uint64(dataSize))
+	binary.LittleEndian.PutUint64(header[32:], uint64(dataOffset+dataSize))
+	if _, err = w.Seek(start+int64(len(carV2Pragma)), io.SeekStart); err != nil {
+		return err
+	}
+	if _, err = w.Write(header); err != nil {
+		return err
+	}
+	_, err = w.Seek(start+dataOffset+cw.n, io.SeekStart)
+	return err
+}
+
+// ExportKeysCar writes a CARv1 to `w` whose header lists the CID of every live block of this ZipDatastore,
+// including any pending mutations, as its roots, in the same order as Query(), and which contains no blocks. This
+// describes the set of blocks held without transferring any of them, which a peer can learn by reading just the
+// header. ErrNoRoots is returned if there are no blocks.
+func (zipDs *ZipDatastore) ExportKeysCar(w io.Writer) error {
+	zipDs.lock.Lock()
+	defer zipDs.lock.Unlock()
+
+	names, err := zipDs.liveNames()
+	if err != nil {
+		return err
+	}
+	roots := make([]cid.Cid, 0, len(names))
+	for _, name := range names {
+		c, err := cid.Decode(name)
+		if err != nil {
+			return err
+		}
+		roots = append(roots, c)
+	}
+	if len(roots) == 0 {
+		return ErrNoRoots
+	}
+
+	header := carHeader(roots)
+	if err := writeUvarint(w, uint64(len(header))); err != nil {
+		return err
+	}
+	_, err = w.Write(header)
+	return err
+}
+
+// carIndexRecord is an entry of a CARv2 index, the multihash digest of a block and the offset of its section
+// within the CARv1 data.
+type carIndexRecord struct {
+	digest []byte
+	offset int64
+}
+
+// writeCar writes a CARv1 of the live blocks to `w`, calling `section`, if not nil, with the CID of each block
+// and the offset at which its section begins, relative to the start of the CARv1.
+func (zipDs *ZipDatastore) writeCar(roots []cid.Cid, w io.Writer, section func(c cid.Cid, offset int64) error) error {
+	if len(roots) == 0 {
+		return ErrNoRoots
+	}
+	cw := &countingWriter{w: w}
+	header := carHeader(roots)
+	if err := writeUvarint(cw, uint64(len(header))); err != nil {
+		return err
+	}
+	if _, err := cw.Write(header); err != nil {
+		return err
+	}
+
+	return zipDs.eachBlock(func(c cid.Cid, data []byte) error {
+		if section != nil {
+			if err := section(c, cw.n); err != nil {
+				return err
+			}
+		}
+		cidBytes := c.Bytes()
+		if err := writeUvarint(cw, uint64(len(cidBytes)+len(data))); err != nil {
+			return err
+		}
+		if _, err := cw.Write(cidBytes); err != nil {
+			return err
+		}
+		_, err := cw.Write(data)
+		return err
+	})
+}
+
+// eachBlock calls `fn` with each live block, in the order of liveNames(). Blocks read from the archive are not
+// retained in the cache.
+func (zipDs *ZipDatastore) eachBlock(fn func(c cid.Cid, data []byte) error) error {
+	names, err := zipDs.liveNames()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		c, err := cid.Decode(name)
+		if err != nil {
+			return err
+		}
+		data, err := zipDs.get(name, false)
+		if err != nil {
+			return cidError(name, err)
+		}
+		if err = fn(c, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// liveNames returns the filenames of the live blocks in the same order as Query(): pending blocks in filename
+// order, then those of the archive in archive order.
+func (zipDs *ZipDatastore) liveNames() ([]string, error) {
+	names := zipDs.pendingNames()
+	files, err := zipDs.archiveFiles()
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		name, _ := zipDs.entryName(f.Name)
+		if has, _ := zipDs.has(&name); has {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// carHeader encodes the DAG-CBOR CARv1 header, {"roots": [...], "version": 1}, with its keys in canonical order.
+func carHeader(roots []cid.Cid) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(0xa2) // map of 2 entries
+	writeCborHead(&buf, 3, 5)
+	buf.WriteString("roots")
+	writeCborHead(&buf, 4, uint64(len(roots)))
+	for _, root := range roots {
+		buf.Write([]byte{0xd8, 0x2a}) // tag 42, a CID
+		cidBytes := root.Bytes()
+		writeCborHead(&buf, 2, uint64(len(cidBytes)+1))
+		buf.WriteByte(0) // the multibase identity prefix required for CIDs in DAG-CBOR
+		buf.Write(cidBytes)
+	}
+	writeCborHead(&buf, 3, 7)
+	buf.WriteString("version")
+	buf.WriteByte(0x01)
+	return buf.Bytes()
+}
+
+// writeCborHead writes the head of a CBOR data item of the given major type with argument `n`, in its shortest
+// form as DAG-CBOR requires.
+func writeCborHead(buf *bytes.Buffer, major byte, n uint64) {
+	major <<= 5
+	switch {
+	case n < 24:
+		buf.WriteByte(major | byte(n))
+	case n <= 0xff:
+		buf.Write([]byte{major | 24, byte(n)})
+	case n <= 0xffff:
+		buf.WriteByte(major | 25)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	case n <= 0xffffffff:
+		buf.WriteByte(major | 26)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	default:
+		buf.WriteByte(major | 27)
+		binary.Write(buf, binary.BigEndian, n)
+	}
+}
+
+// writeCarIndex writes a CARv2 MultihashIndexSorted index of the given records: the multicodec of the format,
+// then, for each multihash code in ascending order, the records for that code grouped by digest length, each
+// group sorted by digest.
+func writeCarIndex(w io.Writer, records map[uint64]map[int][]carIndexRecord) error {
+	if err := writeUvarint(w, multihashIndexSorted); err != nil {
+		return err
+	}
+	codes := make([]uint64, 0, len(records))
+	for code := range records {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+	if err := binary.Write(w, binary.LittleEndian, int32(len(codes))); err != nil {
+		return err
+	}
+
+	for _, code := range codes {
+		if err := binary.Write(w, binary.LittleEndian, code); err != nil {
+			return err
+		}
+		widths := make([]int, 0, len(records[code]))
+		for width := range records[code] {
+			widths = append(widths, width)
+		}
+		sort.Ints(widths)
+		if err := binary.Write(w, binary.LittleEndian, int32(len(widths))); err != nil {
+			return err
+		}
+		for _, width := range widths {
+			group := records[code][width]
+			sort.Slice(group, func(i, j int) bool { return bytes.Compare(group[i].digest, group[j].digest) < 0 })
+			recordLen := width + 8
+			if err := binary.Write(w, binary.LittleEndian, uint32(recordLen)); err != nil {
+				return err
+			}
+			if err := binary.Write(w, binary.LittleEndian, int64(len(group)*recordLen)); err != nil {
+				return err
+			}
+			for _, record := range group {
+				if _, err := w.Write(record.digest); err != nil {
+					return err
+				}
+				if err := binary.Write(w, binary.LittleEndian, uint64(record.offset)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func writeUvarint(w io.Writer, n uint64) error {
+	buf := make([]byte, binary.MaxVarintLen64)
+	_, err := w.Write(buf[:binary.PutUvarint(buf, n)])
+	return err
+}
@@ -0,0 +1,69 @@
+package zipcar
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+)
+
+const (
+	directoryEndSignature = 0x06054b50
+	directoryEndLen       = 22 // excluding the comment
+	maxCommentLen         = 0xffff
+)
+
+// ReadComment returns the archive comment of the ZIP archive at `path`, such as a root CID, without
+// instantiating a ZipDatastore. Only the end of central directory record at the end of the file is read, the
+// central directory itself is not, so this is much cheaper than NewDatastore() followed by Comment() for large
+// archives. zip.ErrFormat is returned if no end of central directory record is found.
+func ReadComment(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	fileinfo, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	record, _, err := readDirectoryEnd(file, fileinfo.Size())
+	if err != nil {
+		return "", err
+	}
+	return string(record[directoryEndLen:]), nil
+}
+
+// readDirectoryEnd returns the end of central directory record of the ZIP archive held in the first `size` bytes
+// of `r`, including the archive comment that follows it, and its offset. zip.ErrFormat is returned if no end of
+// central directory record is found.
+func readDirectoryEnd(r io.ReaderAt, size int64) ([]byte, int64, error) {
+	// the record is at the very end of the file unless there's a comment, which follows it
+	tailLen := int64(directoryEndLen + maxCommentLen)
+	if tailLen > size {
+		tailLen = size
+	}
+	tail := make([]byte, tailLen)
+	if _, err := r.ReadAt(tail, size-tailLen); err != nil {
+		return nil, 0, err
+	}
+
+	signature := make([]byte, 4)
+	binary.LittleEndian.PutUint32(signature, directoryEndSignature)
+	for end := len(tail); ; {
+		pos := bytes.LastIndex(tail[:end], signature)
+		if pos < 0 {
+			return nil, 0, zip.ErrFormat
+		}
+		if pos+directoryEndLen <= len(tail) {
+			commentLen := int(binary.LittleEndian.Uint16(tail[pos+20:]))
+			// a signature that appears within the comment itself won't have a comment that fits the file
+			if pos+directoryEndLen+commentLen <= len(tail) {
+				return tail[pos : pos+directoryEndLen+commentLen], size - tailLen + int64(pos), nil
+			}
+		}
+		end = pos + 3 // search again for an earlier signature, which may overlap this one
+	}
+}
@@ -0,0 +1,314 @@
+package zipcar
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	cid "github.com/ipfs/go-cid"
+)
+
+const (
+	// zipDeflateLevel is the compression level archive/zip uses for zip.Deflate, matched when compressing
+	// entries in memory so that the compressed data doesn't depend on how the archive is written
+	zipDeflateLevel = 5
+	// zipVersion20 is the "version made by" and "version needed to extract" archive/zip writes
+	zipVersion20 = 20
+	// extTimeExtraID is the ZIP extra field header ID of the extended timestamp archive/zip writes
+	extTimeExtraID = 0x5455
+	// zip64ExtraID is the ZIP extra field header ID of the Zip64 extended information archive/zip writes
+	zip64ExtraID = 0x0001
+)
+
+// Compatibility selects the ZIP features used when writing an archive, see Options.Compatibility.
+type Compatibility int
+
+const (
+	// CompatModern writes archives as archive/zip does by default: each entry is streamed, followed by a data
+	// descriptor holding its CRC-32 and sizes, and carries an extended timestamp extra field
+	CompatModern Compatibility = iota
+	// CompatMax writes archives readable by the widest range of ZIP tools, including old ones: the CRC-32 and
+	// sizes of each entry are recorded in its local header rather than in a data descriptor, and modification
+	// times are recorded only in MS-DOS form, at two second resolution, without an extended timestamp. Each
+	// block is compressed in memory before it is written
+	CompatMax
+)
+
+// compressedEntry is an entry prepared for writing with zip.Writer.CreateRaw().
+type compressedEntry struct {
+	header zip.FileHeader
+	data   []byte // compressed according to header.Method
+	err    error
+}
+
+// compressJob is a block to be prepared by a compression worker, the result of which is sent to `result`.
+type compressJob struct {
+	cidStr string
+	bytes  []byte
+	result chan<- compressedEntry
+}
+
+// compressEntries prepares the entries for the blocks with the given filenames on Options.CompressWorkers
+// goroutines, see writeArchive(). Blocks are read in order on a single goroutine, then compressed in parallel.
+// The returned channel yields a channel for the result of each entry, in the order of `names`; it is bounded so
+// that only a few entries per worker are held in memory at once. Closing `done` stops production early.
+func (zipDs *ZipDatastore) compressEntries(names []string, index map[string]*zip.File,
+	done <-chan struct{}) <-chan chan compressedEntry {
+	workers := zipDs.opts.CompressWorkers
+	ordered := make(chan chan compressedEntry, workers)
+	jobs := make(chan compressJob, workers)
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			compressor := newEntryCompressor()
+			for job := range jobs {
+				job.result <- zipDs.rawEntry(zipDs.entryHeader(job.cidStr, job.bytes, false), job.bytes, compressor)
+			}
+		}()
+	}
+
+	go func() {
+		defer close(ordered)
+		defer close(jobs)
+		for _, cidStr := range names {
+			result := make(chan compressedEntry, 1)
+			bytes := zipDs.cache[cidStr]
+			var entry compressedEntry
+			copied := false
+			if bytes == nil {
+				if entry, copied = zipDs.rawCopy(cidStr, index[cidStr]); !copied {
+					bytes, entry.err = zipDs.readFile(index[cidStr])
+				}
+			}
+			err := entry.err
+			if copied || err != nil {
+				// nothing for the compression workers to do
+				result <- entry
+			} else {
+				select {
+				case jobs <- compressJob{cidStr, bytes, result}:
+				case <-done:
+					return
+				}
+			}
+			select {
+			case ordered <- result:
+			case <-done:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	return ordered
+}
+
+// entryCompressor compresses entries in memory for rawEntry(), reusing its buffers from one entry to the next.
+type entryCompressor struct {
+	fw  *flate.Writer
+	buf bytes.Buffer
+}
+
+func newEntryCompressor() *entryCompressor {
+	compressor := &entryCompressor{}
+	compressor.fw, _ = flate.NewWriter(&compressor.buf, zipDeflateLevel) // only errors for an invalid level
+	return compressor
+}
+
+// rawEntry prepares an entry with the header `fh` and content `data` for zip.Writer.CreateRaw(), compressing it
+// with `compressor` if required and filling in the header fields that zip.Writer.CreateHeader() would, other
+// than those that Options.Compatibility excludes.
+func (zipDs *ZipDatastore) rawEntry(fh zip.FileHeader, data []byte, compressor *entryCompressor) compressedEntry {
+	entry := compressedEntry{header: fh, data: data}
+	if fh.Method == zip.Deflate {
+		compressor.buf.Reset()
+		compressor.fw.Reset(&compressor.buf)
+		if _, err := compressor.fw.Write(data); err != nil {
+			return compressedEntry{err: err}
+		}
+		if err := compressor.fw.Close(); err != nil {
+			return compressedEntry{err: err}
+		}
+		entry.data = append([]byte{}, compressor.buf.Bytes()...)
+	}
+
+	h := &entry.header
+	h.CRC32 = crc32.ChecksumIEEE(data)
+	h.UncompressedSize64 = uint64(len(data))
+	h.CompressedSize64 = uint64(len(entry.data))
+	h.CreatorVersion = zipVersion20
+	h.ReaderVersion = zipVersion20
+	if !h.Modified.IsZero() {
+		h.ModifiedDate, h.ModifiedTime = msDosTime(h.Modified)
+		if zipDs.opts.Compatibility != CompatMax {
+			h.Extra = append(h.Extra, extTimeExtra(h.Modified)...)
+		}
+	}
+	return entry
+}
+
+// extTimeExtra returns the extended timestamp extra field recording the modification time `t`, as archive/zip
+// writes it.
+func extTimeExtra(t time.Time) []byte {
+	extra := make([]byte, extTimeExtraLen)
+	binary.LittleEndian.PutUint16(extra, extTimeExtraID)
+	binary.LittleEndian.PutUint16(extra[2:], extTimeExtraLen-4)
+	extra[4] = 1 // modification time only
+	binary.LittleEndian.PutUint32(extra[5:], uint32(t.Unix()))
+	return extra
+}
+
+// rawCopy returns the entry of the block with the given filename as it is stored in the archive, for writing
+// with writeRawEntry(), or false if it must be read and compressed again instead, see Options.RawCopy. The
+// stored data is taken from zipDs.rawEntries if rewrite() has read it, otherwise from `f`. The header is that of
+// the stored entry brought up to date with copiedHeader().
+func (zipDs *ZipDatastore) rawCopy(cidStr string, f *zip.File) (compressedEntry, bool) {
+	if !zipDs.opts.RawCopy {
+		return compressedEntry{}, false
+	}
+	stored, ok := zipDs.rawEntries[cidStr]
+	if !ok {
+		if f == nil || f.Flags&flagEncrypted != 0 {
+			return compressedEntry{}, false
+		}
+		data, err := readRaw(f)
+		if err != nil {
+			return compressedEntry{err: err}, true
+		}
+		stored = compressedEntry{header: f.FileHeader, data: data}
+	}
+	stored.header = zipDs.copiedHeader(cidStr, stored.header)
+	return stored, true
+}
+
+// copiedHeader returns the header of a stored entry, `fh`, for the block with the given filename as rawCopy()
+// writes it: its CRC-32, sizes and compression method are kept, while its filename, entry comment, content type
+// and any modification time set with Touch() are those current, and fields that Options.Compatibility excludes
+// are dropped. Zip64 extra fields are dropped too, archive/zip adds them itself where they're needed.
+func (zipDs *ZipDatastore) copiedHeader(cidStr string, fh zip.FileHeader) zip.FileHeader {
+	fh.Name = zipDs.entryFilename(cidStr)
+	fh.Comment = zipDs.entryComments[cidStr]
+	modified, touched := zipDs.modTimes[cidStr]
+	if touched {
+		fh.Modified = modified
+		fh.ModifiedDate, fh.ModifiedTime = msDosTime(modified)
+	}
+	if zipDs.opts.Compatibility == CompatMax {
+		fh.Flags &^= flagDataDescriptor
+	}
+
+	var extras []byte
+	for extra := fh.Extra; len(extra) >= 4; {
+		id := binary.LittleEndian.Uint16(extra)
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		if len(extra) < 4+size {
+			break
+		}
+		dropped := id == zip64ExtraID || id == contentTypeExtraID ||
+			(id == extTimeExtraID && (touched || zipDs.opts.Compatibility == CompatMax))
+		if !dropped {
+			extras = append(extras, extra[:4+size]...)
+		}
+		extra = extra[4+size:]
+	}
+	if touched && zipDs.opts.Compatibility != CompatMax {
+		extras = append(extras, extTimeExtra(modified)...)
+	}
+	if contentType := zipDs.contentTypes[cidStr]; contentType != "" {
+		extras = append(extras, contentTypeExtra(contentType)...)
+	}
+	fh.Extra = extras
+	return fh
+}
+
+// readRaw reads the data of a ZIP file entry as it is stored, without decompressing it.
+func readRaw(f *zip.File) ([]byte, error) {
+	r, err := f.OpenRaw()
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+// writeRawEntry writes an entry prepared by rawEntry() to `writer`.
+func writeRawEntry(writer *zip.Writer, entry compressedEntry) error {
+	if entry.err != nil {
+		return entry.err
+	}
+	f, err := writer.CreateRaw(&entry.header)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(entry.data)
+	return err
+}
+
+// msDosTime converts `t` to the MS-DOS date and time fields of a ZIP header, as archive/zip does.
+func msDosTime(t time.Time) (date uint16, tm uint16) {
+	date = uint16(t.Day() + int(t.Month())<<5 + (t.Year()-1980)<<9)
+	tm = uint16(t.Second()/2 + t.Minute()<<5 + t.Hour()<<11)
+	return date, tm
+}
+
+// ReencodeTo writes the current contents of this ZipDatastore, including any pending mutations, to a new archive
+// at `destPath` with every block compressed using `method`, zip.Store or zip.Deflate, at the given flate
+// compression `level` (e.g. flate.BestCompression), which is ignored for zip.Store. Options.MinCompressSize does
+// not apply, so that the size returned, that of the new archive in bytes, reflects the choice of method and level
+// for all of the blocks. Entry and archive comments are carried over, entries that aren't blocks are not. This
+// ZipDatastore and its file are not modified. zip.ErrAlgorithm is returned for an unsupported method.
+func (zipDs *ZipDatastore) ReencodeTo(destPath string, method uint16, level int) (int64, error) {
+	if method != zip.Store && method != zip.Deflate {
+		return 0, zip.ErrAlgorithm
+	}
+	if _, err := flate.NewWriter(nil, level); err != nil && method == zip.Deflate {
+		return 0, err
+	}
+
+	zipDs.lock.Lock()
+	defer zipDs.lock.Unlock()
+
+	file, err := os.Create(destPath)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	bw := bufio.NewWriter(file)
+	cw := &countingWriter{w: bw}
+	writer := zip.NewWriter(cw)
+	writer.RegisterCompressor(zip.Deflate, func(w io.Writer) (io.WriteCloser, error) {
+		return flate.NewWriter(w, level)
+	})
+
+	err = zipDs.eachBlock(func(c cid.Cid, data []byte) error {
+		fh := zipDs.entryHeader(c.String(), data, false)
+		fh.Method = method
+		f, err := writer.CreateHeader(&fh)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(data)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err = writer.SetComment(zipDs.comment); err != nil {
+		return 0, err
+	}
+	if err = writer.Close(); err != nil {
+		return 0, err
+	}
+	if err = bw.Flush(); err != nil {
+		return 0, err
+	}
+	return cw.n, file.Close()
+}
@@ -0,0 +1,104 @@
+package zipcar
+
+import (
+	"archive/zip"
+	"encoding/binary"
+	"errors"
+
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+)
+
+const (
+	// contentTypeExtraID is the ZIP extra field header ID used to record the MIME type of an entry ("ZT")
+	contentTypeExtraID      = 0x545a
+	contentTypeExtraVersion = 1
+	maxContentTypeLen       = 255
+)
+
+// ErrContentTypeTooLong is returned by SetContentType() for a MIME type longer than 255 bytes.
+var ErrContentTypeTooLong = errors.New("zipcar: content type exceeds 255 bytes")
+
+// contentTypeExtra returns the extra field recording the MIME type of an entry.
+func contentTypeExtra(contentType string) []byte {
+	extra := make([]byte, 5+len(contentType))
+	binary.LittleEndian.PutUint16(extra, contentTypeExtraID)
+	binary.LittleEndian.PutUint16(extra[2:], uint16(1+len(contentType)))
+	extra[4] = contentTypeExtraVersion
+	copy(extra[5:], contentType)
+	return extra
+}
+
+// entryContentType returns the MIME type recorded in the central directory extra fields of `f`, or an empty
+// string if there isn't one.
+func entryContentType(f *zip.File) string {
+	for extra := f.Extra; len(extra) >= 4; {
+		id := binary.LittleEndian.Uint16(extra)
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		if len(extra) < 4+size {
+			return ""
+		}
+		field := extra[4 : 4+size]
+		if id == contentTypeExtraID && size >= 1 && field[0] == contentTypeExtraVersion {
+			return string(field[1:])
+		}
+		extra = extra[4+size:]
+	}
+	return ""
+}
+
+// ContentType returns the MIME type recorded for the block with the given CID with SetContentType(), or an empty
+// string if none has been recorded. A ds.ErrNotFound error is returned if the CID is not in the archive.
+func (zipDs *ZipDatastore) ContentType(cid cid.Cid) (string, error) {
+	zipDs.lock.Lock()
+	defer zipDs.lock.Unlock()
+
+	cidStr, err := cidToString(cid)
+	if err != nil {
+		return "", err
+	}
+
+	if has, _ := zipDs.has(cidStr); !has {
+		return "", ds.ErrNotFound
+	}
+
+	return zipDs.contentTypes[*cidStr], nil
+}
+
+// SetContentType records a MIME type, as determined by the caller, for the block with the given CID, such as for
+// the Content-Type header when serving blocks over HTTP. It is stored in an extra field of the ZIP file entry,
+// which other ZIP tools ignore. An empty string removes it. A ds.ErrNotFound error is returned if the CID is not
+// in the archive and ErrContentTypeTooLong is returned if the MIME type is longer than 255 bytes. As a mutation
+// operation, calling this method one or more times will trigger a full rewrite of the ZIP archive upon Close().
+func (zipDs *ZipDatastore) SetContentType(cid cid.Cid, contentType string) error {
+	zipDs.lock.Lock()
+	defer zipDs.lock.Unlock()
+
+	if zipDs.readOnly {
+		return ErrReadOnly
+	}
+	if len(contentType) > maxContentTypeLen {
+		return ErrContentTypeTooLong
+	}
+
+	cidStr, err := cidToString(cid)
+	if err != nil {
+		return err
+	}
+
+	if has, _ := zipDs.has(cidStr); !has {
+		return ds.ErrNotFound
+	}
+
+	if contentType == "" {
+		delete(zipDs.contentTypes, *cidStr)
+	} else {
+		if zipDs.contentTypes == nil {
+			zipDs.contentTypes = make(map[string]string)
+		}
+		zipDs.contentTypes[*cidStr] = contentType
+	}
+	zipDs.sizeEstimated = false
+	zipDs.markModified()
+	return nil
+}
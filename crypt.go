@@ -0,0 +1,122 @@
+package zipcar
+
+import (
+	"archive/zip"
+	"compress/flate"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+)
+
+var (
+	// ErrEncrypted indicates that an entry in the archive is encrypted and either no Options.ZipPassword was
+	// provided or the encryption scheme is not supported
+	ErrEncrypted = errors.New("zipcar: entry is encrypted")
+
+	// ErrBadPassword indicates that an encrypted entry could not be decrypted with Options.ZipPassword
+	ErrBadPassword = errors.New("zipcar: incorrect password for encrypted entry")
+)
+
+const (
+	flagEncrypted      = 0x1
+	flagDataDescriptor = 0x8
+	methodWinZipAES    = 99
+	zipCryptoHeaderLen = 12
+)
+
+// openEncrypted returns a reader for the decrypted, decompressed contents of an entry encrypted with the
+// traditional PKWARE "ZipCrypto" scheme. WinZip AES encrypted entries are not supported.
+func openEncrypted(f *zip.File, password []byte) (io.ReadCloser, error) {
+	if len(password) == 0 || f.Method == methodWinZipAES {
+		return nil, ErrEncrypted
+	}
+	raw, err := f.OpenRaw()
+	if err != nil {
+		return nil, err
+	}
+
+	keys := newZipCryptoKeys(password)
+	header := make([]byte, zipCryptoHeaderLen)
+	if _, err = io.ReadFull(raw, header); err != nil {
+		return nil, err
+	}
+	keys.decrypt(header)
+	// the last byte of the header is a check byte, the high byte of the CRC, or of the modified time if the CRC
+	// wasn't known when the header was written
+	check := byte(f.CRC32 >> 24)
+	if f.Flags&flagDataDescriptor != 0 {
+		check = byte(f.ModifiedTime >> 8)
+	}
+	if header[zipCryptoHeaderLen-1] != check {
+		return nil, ErrBadPassword
+	}
+
+	var rc io.ReadCloser
+	decrypted := &zipCryptoReader{r: raw, keys: keys}
+	switch f.Method {
+	case zip.Store:
+		rc = ioutil.NopCloser(decrypted)
+	case zip.Deflate:
+		rc = flate.NewReader(decrypted)
+	default:
+		return nil, zip.ErrAlgorithm
+	}
+	return &checksumReader{rc: rc, crc: f.CRC32}, nil
+}
+
+type zipCryptoKeys [3]uint32
+
+func newZipCryptoKeys(password []byte) *zipCryptoKeys {
+	keys := &zipCryptoKeys{0x12345678, 0x23456789, 0x34567890}
+	for _, b := range password {
+		keys.update(b)
+	}
+	return keys
+}
+
+func (keys *zipCryptoKeys) update(b byte) {
+	keys[0] = crc32.IEEETable[byte(keys[0])^b] ^ (keys[0] >> 8)
+	keys[1] = (keys[1]+(keys[0]&0xff))*134775813 + 1
+	keys[2] = crc32.IEEETable[byte(keys[2])^byte(keys[1]>>24)] ^ (keys[2] >> 8)
+}
+
+func (keys *zipCryptoKeys) decrypt(buf []byte) {
+	for i := range buf {
+		temp := uint16(keys[2]) | 2
+		buf[i] ^= byte((uint32(temp) * uint32(temp^1)) >> 8)
+		keys.update(buf[i])
+	}
+}
+
+type zipCryptoReader struct {
+	r    io.Reader
+	keys *zipCryptoKeys
+}
+
+func (r *zipCryptoReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.keys.decrypt(p[:n])
+	return n, err
+}
+
+// checksumReader verifies the CRC-32 of the decrypted contents once they have been read in full, as
+// archive/zip does for unencrypted entries.
+type checksumReader struct {
+	rc  io.ReadCloser
+	crc uint32
+	sum uint32
+}
+
+func (r *checksumReader) Read(p []byte) (int, error) {
+	n, err := r.rc.Read(p)
+	r.sum = crc32.Update(r.sum, crc32.IEEETable, p[:n])
+	if err == io.EOF && r.sum != r.crc {
+		return n, zip.ErrChecksum
+	}
+	return n, err
+}
+
+func (r *checksumReader) Close() error {
+	return r.rc.Close()
+}
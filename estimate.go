@@ -0,0 +1,117 @@
+package zipcar
+
+import (
+	"errors"
+
+	cid "github.com/ipfs/go-cid"
+)
+
+const (
+	// centralHeaderLen is the fixed part of a central directory header, as localHeaderLen (see repair.go) and
+	// directoryEndLen (see comment.go) are of their records, excluding filenames, extra fields and comments
+	centralHeaderLen = 46
+	// dataDescriptor64Len is the size of the data descriptor following each streamed entry, in its zip64 form
+	dataDescriptor64Len = 24
+	// extTimeExtraLen is the size of the extended timestamp extra field archive/zip writes for each entry
+	extTimeExtraLen = 9
+	// zip64ExtraLen is the size of the zip64 extra field written for an entry of 4 GiB or more
+	zip64ExtraLen = 28
+	// zip64EndLen is the size of the zip64 end of central directory record and locator, written for archives with
+	// too many entries, or too large, for the end of central directory record alone
+	zip64EndLen = 56 + 20
+	// storedBlockLen and storedBlockOverhead bound the growth of incompressible data by deflate, which falls back
+	// to stored blocks of at most 65535 bytes with a 5 byte header each
+	storedBlockLen      = 65535
+	storedBlockOverhead = 5
+	uint32Max           = 1<<32 - 1
+	uint16Max           = 1<<16 - 1
+)
+
+// ErrArchiveTooLarge is returned when adding a block would take the estimated size of the archive over
+// Options.MaxArchiveBytes.
+var ErrArchiveTooLarge = errors.New("zipcar: archive would exceed maximum size")
+
+// EstimatedSize returns an estimate of the size, in bytes, of the archive that Close() or Sync() would write,
+// including any pending mutations. Every block is assumed to be incompressible, so the estimate is no smaller
+// than the archive written unless it includes entries carried over with Options.PreserveExtras, which aren't
+// counted. Unlike SerializedSize(), nothing is read or compressed, and the estimate is maintained as blocks are
+// Put(), so it is cheap enough to consult for each block, see Options.MaxArchiveBytes.
+func (zipDs *ZipDatastore) EstimatedSize() (int64, error) {
+	zipDs.lock.Lock()
+	defer zipDs.lock.Unlock()
+
+	return zipDs.estimatedSize(0, 0)
+}
+
+// estimatedSize returns the estimate of EstimatedSize() with an additional `entries` entries totalling `size`
+// bytes, as estimated by entrySizeEstimate(). The estimate of the existing entries is computed on first use and
+// then kept up to date by put() until sizeEstimated is cleared by a mutation that changes it in another way.
+func (zipDs *ZipDatastore) estimatedSize(entries int64, size int64) (int64, error) {
+	if !zipDs.sizeEstimated {
+		zipDs.entryCount = 0
+		zipDs.entriesSize = 0
+		err := zipDs.eachSize(func(cidStr string, size int64) error {
+			zipDs.entryCount++
+			zipDs.entriesSize += zipDs.entrySizeEstimate(cidStr, size)
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+		zipDs.sizeEstimated = true
+	}
+
+	entries += zipDs.entryCount
+	size += zipDs.entriesSize + directoryEndLen + int64(len(zipDs.comment))
+	if zipDs.opts.WriteIntegrityManifest {
+		entries++
+		size += 2*(localHeaderLen+int64(len(IntegrityManifestName))+extTimeExtraLen) + centralHeaderLen +
+			dataDescriptor64Len + storedBlockOverhead
+	}
+	if meta, _ := zipDs.metaData(); meta != nil {
+		entries++
+		size += 2*(localHeaderLen+int64(len(MetaName))+extTimeExtraLen) + centralHeaderLen +
+			dataDescriptor64Len + int64(len(meta)) + storedBlockOverhead
+	}
+	if zipDs.opts.WriteFormatVersion {
+		entries++
+		size += 2*(localHeaderLen+int64(len(FormatVersionName))+extTimeExtraLen) + centralHeaderLen +
+			dataDescriptor64Len + int64(len(formatVersionData())) + storedBlockOverhead
+	}
+	if size >= uint32Max { // entries may then be at offsets that need a zip64 extra field too
+		size += zip64EndLen + entries*zip64ExtraLen
+	} else if entries >= uint16Max {
+		size += zip64EndLen
+	}
+	return size, nil
+}
+
+// entrySizeEstimate returns an estimate, assuming the block is incompressible, of the number of bytes written to
+// the archive for the block with the given filename and size, including its line of the integrity manifest.
+func (zipDs *ZipDatastore) entrySizeEstimate(cidStr string, size int64) int64 {
+	if size >= int64(zipDs.opts.MinCompressSize) {
+		size += storedBlockOverhead * (size/storedBlockLen + 1)
+	}
+	extraLen := int64(extTimeExtraLen)
+	if zipDs.opts.WriteVerificationHints {
+		extraLen += 4 + hintExtraLen
+	}
+	if contentType := zipDs.contentTypes[cidStr]; contentType != "" {
+		extraLen += int64(len(contentTypeExtra(contentType)))
+	}
+	if size >= uint32Max {
+		extraLen += zip64ExtraLen
+	}
+	nameLen := int64(len(zipDs.entryFilename(cidStr)))
+
+	estimate := 2*(nameLen+extraLen) + localHeaderLen + centralHeaderLen + dataDescriptor64Len + size +
+		int64(len(zipDs.entryComments[cidStr]))
+	if zipDs.opts.WriteIntegrityManifest {
+		if c, err := cid.Decode(cidStr); err == nil {
+			// "<cid> <hex multihash>\n"
+			manifestLen := int64(len(cidStr) + 2*len(c.Hash()) + 2)
+			estimate += manifestLen + storedBlockOverhead*(manifestLen/storedBlockLen+1)
+		}
+	}
+	return estimate
+}
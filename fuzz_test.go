@@ -0,0 +1,55 @@
+//go:build go1.18
+// +build go1.18
+
+package zipcar
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	datastore "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// FuzzNewDatastore opens arbitrary bytes as an archive and reads every block that it lists, which must fail
+// cleanly for a malformed archive rather than panic: go test -run XXX -fuzz FuzzNewDatastore
+func FuzzNewDatastore(f *testing.F) {
+	for _, fixture := range []string{"js.zcar", "golden.zcar", "appended.zcar", "stripped.zcar"} {
+		data, err := ioutil.ReadFile(fixture)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+		f.Add(data[:len(data)/2])
+		f.Add(data[len(data)/2:])
+	}
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		path := filepath.Join(t.TempDir(), "fuzz.zcar")
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		ds, err := NewDatastore(path)
+		if err != nil {
+			return
+		}
+		defer ds.Close()
+
+		results, err := ds.Query(dsq.Query{KeysOnly: true})
+		if err != nil {
+			return
+		}
+		entries, err := results.Rest()
+		if err != nil {
+			return
+		}
+		for _, entry := range entries {
+			ds.Get(datastore.RawKey(entry.Key))
+		}
+		ds.Stat()
+		ds.FormatVersion()
+		ds.VerifyIntegrityManifest()
+	})
+}
@@ -3,6 +3,7 @@ module zipcar
 go 1.12
 
 require (
+	github.com/ipfs/go-block-format v0.0.2
 	github.com/ipfs/go-cid v0.0.3
 	github.com/ipfs/go-datastore v0.0.5
 	github.com/ipfs/go-ipfs-ds-help v0.0.1
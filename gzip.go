@@ -0,0 +1,103 @@
+package zipcar
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrNoFile is returned by CloseGz() for a ZipDatastore that isn't backed by a file, such as one returned by
+// Clone() or NewDatastoreFromReaderAt().
+var ErrNoFile = errors.New("zipcar: datastore has no file")
+
+// CloseGz closes the ZipDatastore as Close() does, writing any pending mutations to the archive, then writes a
+// gzip-compressed copy of the archive to its path with ".gz" appended, for distribution as a single compressed
+// file. If the path already ends in ".gz", the archive is replaced by its compressed form instead, which can then
+// only be opened with NewDatastoreFromGzip(). The compressed file is written alongside and renamed into place, so
+// an existing file is never left partially written.
+//
+// As blocks are already compressed individually within the archive, compressing it again gains little for
+// archives of larger blocks, while costing the ability to read blocks without first decompressing the whole file.
+// It mainly benefits archives of many small blocks, where the ZIP headers and the filenames, repeated in the local
+// and central directory headers, make up much of the archive, and where the tooling at the other end expects
+// gzip. ErrNoFile is returned, after closing, if the ZipDatastore isn't backed by a file.
+func (zipDs *ZipDatastore) CloseGz() error {
+	zipDs.lock.Lock()
+	path := zipDs.path
+	zipDs.lock.Unlock()
+
+	if err := zipDs.Close(); err != nil {
+		return err
+	}
+	if path == "" {
+		return ErrNoFile
+	}
+	dest := path
+	if !strings.HasSuffix(dest, ".gz") {
+		dest += ".gz"
+	}
+	return gzipFile(path, dest)
+}
+
+// gzipFile writes a gzip-compressed copy of the file at `src` to `dest`, which may be the same path, via a
+// temporary file in the same directory.
+func gzipFile(src string, dest string) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := ioutil.TempFile(filepath.Dir(dest), filepath.Base(dest)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			out.Close()
+			os.Remove(out.Name())
+		}
+	}()
+
+	gw := gzip.NewWriter(out)
+	if _, err = io.Copy(gw, in); err != nil {
+		return err
+	}
+	if err = gw.Close(); err != nil {
+		return err
+	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+	in.Close()
+	return os.Rename(out.Name(), dest)
+}
+
+// NewDatastoreFromGzip instantiates a read-only ZipDatastore for a gzip-compressed ZIP archive, such as one
+// written by CloseGz(). As the blocks of a ZIP archive are read from where they lie in the file, the whole archive
+// is decompressed into memory, so this is only suitable for archives that fit in available memory; decompress it
+// to a file and use NewDatastore() for others, or to modify it. See NewDatastoreFromReaderAt() for the behaviour
+// of the returned ZipDatastore. If `opts` is nil, DefaultOptions() are used.
+//
+// Always call Close() on a ZipDatastore when it is no longer required
+func NewDatastoreFromGzip(path string, opts *Options) (*ZipDatastore, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	gr, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(gr)
+	if err != nil {
+		return nil, err
+	}
+	return NewDatastoreFromReaderAt(bytes.NewReader(data), int64(len(data)), opts)
+}
@@ -0,0 +1,163 @@
+package zipcar
+
+import (
+	"archive/zip"
+	"encoding/binary"
+	"hash/crc32"
+
+	cid "github.com/ipfs/go-cid"
+)
+
+const (
+	// hintExtraID is the ZIP extra field header ID used for verification hints ("ZC"), other tools skip extra
+	// fields with IDs they don't recognise
+	hintExtraID      = 0x435a
+	hintExtraVersion = 1
+	hintExtraLen     = 5 // version byte and CRC-32
+)
+
+// CheckReport describes the outcome of Check().
+type CheckReport struct {
+	// Checked is the number of blocks checked
+	Checked int
+	// Hinted is the number of the checked blocks whose multihash wasn't recomputed because their entry carried a
+	// verification hint matching their CRC-32, see Options.UseVerificationHints
+	Hinted int
+	// Mismatched lists the CIDs of the blocks whose content doesn't match their CID or their CRC-32
+	Mismatched []cid.Cid
+}
+
+// verificationHint returns the extra field recording that a block with the given content was verified against
+// its CID when it was written.
+func verificationHint(data []byte) []byte {
+	extra := make([]byte, 4+hintExtraLen)
+	binary.LittleEndian.PutUint16(extra, hintExtraID)
+	binary.LittleEndian.PutUint16(extra[2:], hintExtraLen)
+	extra[4] = hintExtraVersion
+	binary.LittleEndian.PutUint32(extra[5:], crc32.ChecksumIEEE(data))
+	return extra
+}
+
+// hasVerificationHint reports whether the central directory extra fields of `f` include a verification hint for
+// content with the CRC-32 recorded for the entry.
+func hasVerificationHint(f *zip.File) bool {
+	for extra := f.Extra; len(extra) >= 4; {
+		id := binary.LittleEndian.Uint16(extra)
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		if len(extra) < 4+size {
+			return false
+		}
+		field := extra[4 : 4+size]
+		if id == hintExtraID && size == hintExtraLen && field[0] == hintExtraVersion {
+			return binary.LittleEndian.Uint32(field[1:]) == f.CRC32
+		}
+		extra = extra[4+size:]
+	}
+	return false
+}
+
+// Check reads every block and verifies that its content matches its CID. Blocks in the archive are also checked
+// against the CRC-32 of their entry as they are read. With Options.UseVerificationHints, the multihash of a block
+// whose entry carries a verification hint written with Options.WriteVerificationHints is not recomputed, the
+// CRC-32 check, which is much cheaper for large blocks, establishes that it is the content that was verified when
+// the hint was written. Blocks that have been Put() but not yet written to the archive are always hashed.
+func (zipDs *ZipDatastore) Check() (*CheckReport, error) {
+	zipDs.lock.Lock()
+	defer zipDs.lock.Unlock()
+
+	report := CheckReport{}
+	check := func(cidStr string, data []byte) error {
+		c, err := cid.Decode(cidStr)
+		if err != nil {
+			return err
+		}
+		report.Checked++
+		if data == nil || !blockMatches(c, data) {
+			report.Mismatched = append(report.Mismatched, c)
+		}
+		return nil
+	}
+
+	for _, name := range zipDs.pendingNames() {
+		if err := check(name, zipDs.cache[name]); err != nil {
+			return nil, err
+		}
+	}
+
+	files, err := zipDs.archiveFiles()
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		name, _ := zipDs.entryName(f.Name)
+		if has, _ := zipDs.has(&name); !has {
+			continue
+		}
+		data, err := zipDs.readFile(f)
+		if err == zip.ErrChecksum {
+			data = nil
+		} else if err != nil {
+			return nil, cidError(name, err)
+		}
+		if data != nil && zipDs.opts.UseVerificationHints && hasVerificationHint(f) {
+			report.Checked++
+			report.Hinted++
+			continue
+		}
+		if err = check(name, data); err != nil {
+			return nil, err
+		}
+	}
+
+	return &report, nil
+}
+
+// VerifyFast verifies that the content of each block matches its CID in the same way as Check(), but stops at the
+// first block that doesn't, returning its CID along with a CidError wrapping ErrHashMismatch, or zip.ErrChecksum if
+// its entry fails the CRC-32 check. Any other error reading a block also stops the scan and is returned with the
+// CID of the block. cid.Undef and a nil error are returned if every block matches. This suits a fail-fast check of
+// whether an archive is valid at all, Check() reports every mismatched block.
+func (zipDs *ZipDatastore) VerifyFast() (cid.Cid, error) {
+	zipDs.lock.Lock()
+	defer zipDs.lock.Unlock()
+
+	verify := func(cidStr string, data []byte) (cid.Cid, error) {
+		c, err := cid.Decode(cidStr)
+		if err != nil {
+			return cid.Undef, err
+		}
+		if !blockMatches(c, data) {
+			return c, cidError(cidStr, ErrHashMismatch)
+		}
+		return cid.Undef, nil
+	}
+
+	for _, name := range zipDs.pendingNames() {
+		if c, err := verify(name, zipDs.cache[name]); err != nil {
+			return c, err
+		}
+	}
+
+	files, err := zipDs.archiveFiles()
+	if err != nil {
+		return cid.Undef, err
+	}
+	for _, f := range files {
+		name, _ := zipDs.entryName(f.Name)
+		if has, _ := zipDs.has(&name); !has {
+			continue
+		}
+		data, err := zipDs.readFile(f)
+		if err != nil {
+			c, _ := cid.Decode(name)
+			return c, cidError(name, err)
+		}
+		if zipDs.opts.UseVerificationHints && hasVerificationHint(f) {
+			continue
+		}
+		if c, err := verify(name, data); err != nil {
+			return c, err
+		}
+	}
+	return cid.Undef, nil
+}
@@ -0,0 +1,104 @@
+package zipcar
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// httpReadAhead is the minimum number of bytes fetched by each range request, so that the many small reads made
+// while parsing ZIP headers don't each become a request.
+const httpReadAhead = 64 << 10
+
+// NewHTTPDatastore instantiates a read-only ZipDatastore for the ZIP archive at `url` using HTTP range requests,
+// so that only the central directory and the blocks that are read are transferred rather than the whole archive.
+// The server must support range requests and report the length of the archive in response to a HEAD request.
+// See NewDatastoreFromReaderAt() for the behaviour of the returned ZipDatastore.
+//
+// Always call Close() on a ZipDatastore when it is no longer required
+func NewHTTPDatastore(url string) (*ZipDatastore, error) {
+	r := &httpReaderAt{url: url, client: http.DefaultClient}
+	size, err := r.size()
+	if err != nil {
+		return nil, err
+	}
+	return NewDatastoreFromReaderAt(r, size, nil)
+}
+
+// httpReaderAt is an io.ReaderAt that reads a remote file with HTTP range requests. The data from the most recent
+// request is retained to serve subsequent reads that fall within it.
+type httpReaderAt struct {
+	url    string
+	client *http.Client
+	lock   sync.Mutex
+	off    int64
+	buf    []byte
+}
+
+func (r *httpReaderAt) size() (int64, error) {
+	resp, err := r.client.Head(r.url)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("zipcar: unexpected HTTP status for %s: %s", r.url, resp.Status)
+	}
+	if resp.ContentLength < 0 {
+		return 0, fmt.Errorf("zipcar: no content length for %s", r.url)
+	}
+	return resp.ContentLength, nil
+}
+
+func (r *httpReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if off < r.off || off+int64(len(p)) > r.off+int64(len(r.buf)) {
+		length := int64(len(p))
+		if length < httpReadAhead {
+			length = httpReadAhead
+		}
+		buf, err := r.fetch(off, length)
+		if err != nil {
+			return 0, err
+		}
+		r.off, r.buf = off, buf
+	}
+
+	n := copy(p, r.buf[off-r.off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// fetch requests up to `length` bytes starting at `off`, fewer are returned if the file ends first.
+func (r *httpReaderAt) fetch(off int64, length int64) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, r.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+length-1))
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusRequestedRangeNotSatisfiable: // starts at or beyond the end
+		return []byte{}, nil
+	default:
+		return nil, fmt.Errorf("zipcar: range request for %s not satisfied: %s", r.url, resp.Status)
+	}
+
+	buf := make([]byte, length)
+	n, err := io.ReadFull(resp.Body, buf)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		err = nil
+	}
+	return buf[:n], err
+}
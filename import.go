@@ -0,0 +1,194 @@
+package zipcar
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	cid "github.com/ipfs/go-cid"
+)
+
+// ErrNotCarV1 is returned by ImportCar() for input that isn't a CARv1, including a CARv2.
+var ErrNotCarV1 = errors.New("zipcar: not a CARv1")
+
+// ImportCar stores every block of the CARv1 (https://ipld.io/specs/transport/car/carv1/) read from `r`, returning
+// the number of blocks newly added. Blocks already present are skipped, as with PutCid().
+//
+// If `checkpointPath` is not empty, the import can be resumed after an interruption: every `syncEvery` blocks
+// the archive is written with Sync() and the offset within the CAR that it has reached, along with the CID of the
+// last block written, is then recorded in a checkpoint file at `checkpointPath`. Calling ImportCar() again with
+// the same CAR and checkpoint file, on a ZipDatastore for the same archive, skips over the part of the CAR that
+// has already been imported rather than reading each block again, and continues from there. An error is returned
+// if the last block recorded in the checkpoint isn't in the archive, as it then belongs to a different import.
+// The checkpoint file is removed once the import completes. As each Sync() rewrites the whole archive,
+// `syncEvery` should be large enough for the time spent writing to be small relative to that spent importing;
+// a `syncEvery` of zero or less only writes the checkpoint once the import completes, which is then removed.
+//
+// The archive itself is only written by the periodic Sync() calls, or by Sync() or Close() as usual once the
+// import returns.
+func (zipDs *ZipDatastore) ImportCar(r io.Reader, checkpointPath string, syncEvery int) (int, error) {
+	br := bufio.NewReader(r)
+	cr := &countingReader{r: br}
+
+	headerLen, err := binary.ReadUvarint(cr)
+	if err != nil {
+		return 0, err
+	}
+	header := make([]byte, headerLen)
+	if _, err = io.ReadFull(cr, header); err != nil {
+		return 0, err
+	}
+	if headerLen == 0 || bytes.Equal(header, carV2Pragma[1:]) {
+		return 0, ErrNotCarV1
+	}
+
+	if checkpointPath != "" {
+		offset, last, err := readCheckpoint(checkpointPath)
+		if err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+		if err == nil {
+			has, err := zipDs.HasCid(last)
+			if err != nil {
+				return 0, err
+			}
+			if !has {
+				return 0, fmt.Errorf("zipcar: block %s recorded in import checkpoint is not in the archive", last)
+			}
+			if _, err = io.CopyN(ioutil.Discard, cr, offset-cr.n); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	imported, sinceSync := 0, 0
+	var last cid.Cid
+	for {
+		sectionLen, err := binary.ReadUvarint(cr)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return imported, err
+		}
+		section := make([]byte, sectionLen)
+		if _, err = io.ReadFull(cr, section); err != nil {
+			return imported, err
+		}
+		cidLen, err := carCidLen(section)
+		if err != nil {
+			return imported, err
+		}
+		c, err := cid.Cast(section[:cidLen])
+		if err != nil {
+			return imported, err
+		}
+		added, err := zipDs.PutCidResult(c, section[cidLen:])
+		if err != nil {
+			return imported, err
+		}
+		if added {
+			imported++
+		}
+		last = c
+
+		if sinceSync++; checkpointPath != "" && syncEvery > 0 && sinceSync >= syncEvery {
+			if err = zipDs.Sync(); err != nil {
+				return imported, err
+			}
+			if err = writeCheckpoint(checkpointPath, cr.n, last); err != nil {
+				return imported, err
+			}
+			sinceSync = 0
+		}
+	}
+
+	if checkpointPath != "" {
+		if err = os.Remove(checkpointPath); err != nil && !os.IsNotExist(err) {
+			return imported, err
+		}
+	}
+	return imported, nil
+}
+
+// carCidLen returns the length of the CID at the start of a CAR section, which is followed by the block data: a
+// CIDv0 is a bare sha2-256 multihash, a CIDv1 a varint version and codec followed by a multihash, itself a varint
+// code and digest length followed by the digest.
+func carCidLen(section []byte) (int, error) {
+	if len(section) >= 34 && section[0] == 0x12 && section[1] == 0x20 {
+		return 34, nil
+	}
+	pos := 0
+	var digestLen uint64
+	for i := 0; i < 4; i++ { // version, codec, multihash code, digest length
+		n, read := binary.Uvarint(section[pos:])
+		if read <= 0 {
+			return 0, fmt.Errorf("zipcar: malformed CID in CAR section")
+		}
+		pos += read
+		digestLen = n
+	}
+	if digestLen > uint64(len(section)-pos) {
+		return 0, fmt.Errorf("zipcar: malformed CID in CAR section")
+	}
+	return pos + int(digestLen), nil
+}
+
+// readCheckpoint reads an import checkpoint written by writeCheckpoint().
+func readCheckpoint(path string) (int64, cid.Cid, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, cid.Undef, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) != 2 {
+		return 0, cid.Undef, fmt.Errorf("zipcar: malformed import checkpoint %q", data)
+	}
+	offset, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return 0, cid.Undef, fmt.Errorf("zipcar: malformed import checkpoint offset: %v", err)
+	}
+	last, err := cid.Decode(fields[1])
+	if err != nil {
+		return 0, cid.Undef, fmt.Errorf("zipcar: malformed import checkpoint CID: %v", err)
+	}
+	return offset, last, nil
+}
+
+// writeCheckpoint records the offset reached within the CAR being imported and the CID of the last block written
+// to the archive, replacing the checkpoint file at `path` atomically so that an interruption never leaves it
+// partially written.
+func writeCheckpoint(path string, offset int64, last cid.Cid) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(fmt.Sprintf("%d %s\n", offset, last)), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// countingReader counts the bytes read through it, see countingWriter.
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+func (cr *countingReader) ReadByte() (byte, error) {
+	b, err := cr.r.ReadByte()
+	if err == nil {
+		cr.n++
+	}
+	return b, err
+}
@@ -0,0 +1,29 @@
+package zipcar
+
+// Logger receives log messages about the lifecycle of a ZipDatastore, such as archives being opened and
+// rewritten, see Options.Logger. Each method takes a format string and arguments as fmt.Printf() does, so most
+// logging libraries can be adapted with a thin wrapper. Methods may be called with the ZipDatastore locked, so
+// must not call back into it.
+type Logger interface {
+	// Debugf logs detail that is only of interest when debugging, such as an auto-flush with nothing to write
+	Debugf(format string, args ...interface{})
+	// Infof logs routine events, such as an archive being opened or rewritten
+	Infof(format string, args ...interface{})
+	// Warnf logs failures that are retried or returned later, and recovery from malformed archives
+	Warnf(format string, args ...interface{})
+}
+
+// nopLogger discards all log messages, used when Options.Logger isn't set.
+type nopLogger struct{}
+
+func (nopLogger) Debugf(format string, args ...interface{}) {}
+func (nopLogger) Infof(format string, args ...interface{})  {}
+func (nopLogger) Warnf(format string, args ...interface{})  {}
+
+// log returns Options.Logger, or a Logger that discards messages if it isn't set.
+func (zipDs *ZipDatastore) log() Logger {
+	if zipDs.opts.Logger == nil {
+		return nopLogger{}
+	}
+	return zipDs.opts.Logger
+}
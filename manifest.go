@@ -0,0 +1,114 @@
+package zipcar
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	cid "github.com/ipfs/go-cid"
+)
+
+// IntegrityManifestName is the filename of the entry written to the archive when
+// Options.WriteIntegrityManifest is set. As it isn't a CID, the entry is not visible as a block.
+const IntegrityManifestName = "zipcar-manifest.txt"
+
+// ErrNoIntegrityManifest is returned by VerifyIntegrityManifest() when the archive doesn't contain an integrity
+// manifest.
+var ErrNoIntegrityManifest = errors.New("zipcar: archive has no integrity manifest")
+
+// manifestData returns the content of the integrity manifest entry for the blocks with the given filenames. Each
+// line of the manifest holds a CID and the hex form of its multihash, separated by a space, in filename order.
+func manifestData(names []string) ([]byte, error) {
+	names = append([]string{}, names...)
+	sort.Strings(names)
+	var buf bytes.Buffer
+	for _, name := range names {
+		c, err := cid.Decode(name)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&buf, "%s %s\n", name, hex.EncodeToString(c.Hash()))
+	}
+	return buf.Bytes(), nil
+}
+
+// VerifyIntegrityManifest checks the archive on disk against the integrity manifest written to it when
+// Options.WriteIntegrityManifest is set. Every CID listed must be present in the archive with content that
+// hashes to it, and every block in the archive must be listed, so blocks that have been substituted, removed or
+// added since the manifest was written are detected even where their ZIP CRCs are intact. Pending mutations
+// that haven't been written to the archive yet are not considered. ErrNoIntegrityManifest is returned if the
+// archive has no manifest, otherwise an error describing the first discrepancy found.
+func (zipDs *ZipDatastore) VerifyIntegrityManifest() error {
+	zipDs.lock.Lock()
+	defer zipDs.lock.Unlock()
+
+	if zipDs.file == nil || zipDs.size == 0 {
+		return ErrNoIntegrityManifest
+	}
+	reader, err := zip.NewReader(zipDs.file, zipDs.size)
+	if err != nil {
+		return err
+	}
+	var manifest *zip.File
+	for _, f := range reader.File {
+		if f.Name == IntegrityManifestName {
+			manifest = f
+		}
+	}
+	if manifest == nil {
+		return ErrNoIntegrityManifest
+	}
+	data, err := zipDs.readFile(manifest)
+	if err != nil {
+		return err
+	}
+
+	index, _ := zipDs.indexEntries(reader.File)
+	listed := make(map[string]struct{}, len(index))
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			return fmt.Errorf("zipcar: malformed integrity manifest line %q", scanner.Text())
+		}
+		c, err := cid.Decode(fields[0])
+		if err != nil {
+			return fmt.Errorf("zipcar: malformed integrity manifest CID %q: %v", fields[0], err)
+		}
+		if hex.EncodeToString(c.Hash()) != fields[1] {
+			return fmt.Errorf("zipcar: integrity manifest multihash doesn't match CID %s", c)
+		}
+		cidStr, err := cidToString(c)
+		if err != nil {
+			return err
+		}
+		listed[*cidStr] = struct{}{}
+
+		f := index[*cidStr]
+		if f == nil {
+			return fmt.Errorf("zipcar: block %s in integrity manifest is not in the archive", c)
+		}
+		block, err := zipDs.readFile(f)
+		if err != nil {
+			return err
+		}
+		if !blockMatches(c, block) {
+			return fmt.Errorf("zipcar: block %s doesn't match its CID", c)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+
+	for name := range index {
+		if _, ok := listed[name]; !ok {
+			return fmt.Errorf("zipcar: block %s is not in the integrity manifest", name)
+		}
+	}
+	return nil
+}
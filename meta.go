@@ -0,0 +1,90 @@
+package zipcar
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+)
+
+// MetaName is the filename of the entry holding the archive metadata set with SetMeta(), a JSON object mapping
+// each key to its value. As it isn't a CID, the entry is not visible as a block.
+const MetaName = "zipcar-meta.json"
+
+// SetMeta sets the archive metadata value for `key`, such as the creator, creation time or name of the dataset the
+// archive holds, which is written to the archive as an entry named MetaName and loaded again when it is opened. An
+// empty `value` removes `key`. As a mutation operation, calling this method one or more times will trigger a full
+// rewrite of the ZIP archive upon Close(). It has no effect if the ZipDatastore is read-only.
+func (zipDs *ZipDatastore) SetMeta(key, value string) {
+	zipDs.lock.Lock()
+	defer zipDs.lock.Unlock()
+
+	if zipDs.readOnly {
+		return
+	}
+
+	if value == "" {
+		if _, ok := zipDs.meta[key]; !ok {
+			return
+		}
+		delete(zipDs.meta, key)
+	} else {
+		if zipDs.meta == nil {
+			zipDs.meta = make(map[string]string)
+		}
+		zipDs.meta[key] = value
+	}
+	zipDs.markModified()
+}
+
+// Meta returns the archive metadata value for `key` and whether one was set, see SetMeta().
+func (zipDs *ZipDatastore) Meta(key string) (string, bool) {
+	zipDs.lock.Lock()
+	defer zipDs.lock.Unlock()
+
+	value, ok := zipDs.meta[key]
+	return value, ok
+}
+
+// AllMeta returns a copy of all of the archive metadata, see SetMeta().
+func (zipDs *ZipDatastore) AllMeta() map[string]string {
+	zipDs.lock.Lock()
+	defer zipDs.lock.Unlock()
+
+	meta := make(map[string]string, len(zipDs.meta))
+	for key, value := range zipDs.meta {
+		meta[key] = value
+	}
+	return meta
+}
+
+// metaData returns the content of the metadata entry, or nil if there is no metadata to write. Keys are written
+// in sorted order so that the same metadata always produces the same entry.
+func (zipDs *ZipDatastore) metaData() ([]byte, error) {
+	if len(zipDs.meta) == 0 {
+		return nil, nil
+	}
+	return json.Marshal(zipDs.meta)
+}
+
+// readMeta returns the archive metadata held by the last entry named MetaName of `files`, or nil if there isn't
+// one.
+func (zipDs *ZipDatastore) readMeta(files []*zip.File) (map[string]string, error) {
+	var entry *zip.File
+	for _, f := range files {
+		if f.Name == MetaName {
+			entry = f
+		}
+	}
+	if entry == nil {
+		return nil, nil
+	}
+	data, err := zipDs.readFile(entry)
+	if err != nil {
+		return nil, err
+	}
+	var meta map[string]string
+	if err = json.Unmarshal(data, &meta); err != nil {
+		return nil, fmt.Errorf("zipcar: malformed archive metadata: %v", err)
+	}
+	return meta, nil
+}
@@ -0,0 +1,17 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package zipcar
+
+import (
+	"errors"
+	"os"
+)
+
+func mmapFile(file *os.File, size int64) ([]byte, error) {
+	return nil, errors.New("zipcar: Mmap is not supported on this platform")
+}
+
+func munmap(data []byte) error {
+	return nil
+}
@@ -0,0 +1,161 @@
+package zipcar
+
+import (
+	"archive/zip"
+	"sort"
+	"strings"
+)
+
+// NameTransform maps between the CIDs of blocks and the filenames of their entries in the archive, allowing
+// archives that follow other naming conventions to be used, see Options.NameTransform.
+type NameTransform interface {
+	// Name returns the filename for the entry of the block with the given CID, in its canonical string form
+	Name(cidStr string) string
+	// Cid returns the CID string embedded in the given filename, or false if it isn't the filename of a block;
+	// the CID string need not be in canonical form
+	Cid(name string) (cidStr string, ok bool)
+}
+
+// PrefixShard returns a NameTransform that places each entry in nested directories named for the leading
+// characters of its CID, in the manner of sharded on-disk block stores. There are `levels` directories, each
+// named for the next `width` characters, followed by the remainder of the CID, so PrefixShard(2, 2) stores the
+// block for "bafkqaaa..." as "ba/fk/qaaa...". As CIDs of the same version, codec and multihash function share
+// their leading characters, this is mainly useful for interoperability rather than for spreading entries out.
+func PrefixShard(levels int, width int) NameTransform {
+	return prefixShard{levels: levels, width: width}
+}
+
+type prefixShard struct {
+	levels int
+	width  int
+}
+
+func (p prefixShard) Name(cidStr string) string {
+	var name strings.Builder
+	for i := 0; i < p.levels && len(cidStr) > p.width; i++ {
+		name.WriteString(cidStr[:p.width])
+		name.WriteByte('/')
+		cidStr = cidStr[p.width:]
+	}
+	name.WriteString(cidStr)
+	return name.String()
+}
+
+func (p prefixShard) Cid(name string) (string, bool) {
+	parts := strings.Split(name, "/")
+	if len(parts) != p.levels+1 || parts[p.levels] == "" {
+		return "", false
+	}
+	for _, dir := range parts[:p.levels] {
+		if len(dir) != p.width {
+			return "", false
+		}
+	}
+	return strings.Join(parts, ""), true
+}
+
+// entryName converts a ZIP entry filename to the canonical string form of the CID it represents, applying
+// Options.NameTransform if set, see canonicalName(). `ok` is false if the filename isn't that of a block.
+func (zipDs *ZipDatastore) entryName(name string) (cidStr string, ok bool) {
+	if zipDs.opts.NameTransform != nil {
+		if name, ok = zipDs.opts.NameTransform.Cid(name); !ok {
+			return "", false
+		}
+	}
+	return canonicalName(name)
+}
+
+// isDirectory reports whether `f` is a directory entry, such as those added by ZIP tools for the directories of a
+// NameTransform like PrefixShard().
+func isDirectory(f *zip.File) bool {
+	return strings.HasSuffix(f.Name, "/")
+}
+
+// entryFilename returns the filename for the entry of the block with the given canonical CID string, applying
+// Options.NameTransform if set.
+func (zipDs *ZipDatastore) entryFilename(cidStr string) string {
+	if zipDs.opts.NameTransform != nil {
+		return zipDs.opts.NameTransform.Name(cidStr)
+	}
+	return cidStr
+}
+
+// DuplicatePolicy selects which entry is read for a block held by more than one entry of an archive, see
+// Options.DuplicatePolicy and DuplicateNames().
+type DuplicatePolicy int
+
+const (
+	// DuplicateReject refuses to open an archive holding duplicates, returning a DuplicateNamesError listing them
+	DuplicateReject DuplicatePolicy = iota
+	// DuplicateFirst reads the first entry for each block in archive order
+	DuplicateFirst
+	// DuplicateLast reads the last entry for each block in archive order, as when a ZIP archive has been appended
+	// to with an updated entry
+	DuplicateLast
+	// DuplicateLargestSize reads the entry for each block with the largest uncompressed size, the first of them if
+	// there's a tie
+	DuplicateLargestSize
+	// DuplicateVerifyHash reads each of the entries for a block and keeps the first whose content matches the CID,
+	// or the first of them if none do, which Check() will then report. Only blocks with duplicates are read
+	DuplicateVerifyHash
+)
+
+// DuplicateNames returns the CIDs, in canonical string form and sorted, of the blocks held by more than one entry
+// of the archive on disk, whether their filenames are identical or differently spelt variants of the same CID. Only
+// one entry for each is indexed, see canonicalName(), so a crafted archive could otherwise hide a substituted
+// block behind the one that is read. Pending mutations that haven't been written to the archive yet are not
+// considered, and an archive written by a ZipDatastore never holds duplicates. See Options.DuplicatePolicy.
+func (zipDs *ZipDatastore) DuplicateNames() ([]string, error) {
+	zipDs.lock.Lock()
+	defer zipDs.lock.Unlock()
+
+	if zipDs.file == nil || zipDs.size == 0 {
+		return nil, nil
+	}
+	reader, err := zip.NewReader(zipDs.file, zipDs.size)
+	if err != nil {
+		return nil, err
+	}
+	return zipDs.duplicateNames(reader.File), nil
+}
+
+// duplicateNames returns the canonical names of the blocks held by more than one of `files`, sorted.
+func (zipDs *ZipDatastore) duplicateNames(files []*zip.File) []string {
+	counts := make(map[string]int)
+	var names []string
+	for _, f := range files {
+		name, ok := zipDs.entryName(f.Name)
+		if !ok {
+			continue
+		}
+		if counts[name]++; counts[name] == 2 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// preferEntry reports whether `candidate`, a later entry of the archive for the same block as `current`, should be
+// read in its place according to Options.DuplicatePolicy. `matches` records whether the content of each entry
+// read for DuplicateVerifyHash matches its CID, so that no entry is read more than once.
+func (zipDs *ZipDatastore) preferEntry(cidStr string, current, candidate *zip.File, matches map[*zip.File]bool) bool {
+	switch zipDs.opts.DuplicatePolicy {
+	case DuplicateFirst:
+		return false
+	case DuplicateLargestSize:
+		return candidate.UncompressedSize64 > current.UncompressedSize64
+	case DuplicateVerifyHash:
+		verified := func(f *zip.File) bool {
+			if matched, ok := matches[f]; ok {
+				return matched
+			}
+			data, err := zipDs.readFile(f)
+			matches[f] = err == nil && verifyBlock(cidStr, data) == nil
+			return matches[f]
+		}
+		return !verified(current) && verified(candidate)
+	default: // DuplicateLast, and DuplicateReject once the archive has been accepted
+		return true
+	}
+}
@@ -0,0 +1,239 @@
+package zipcar
+
+import (
+	"context"
+	"fmt"
+
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	dshelp "github.com/ipfs/go-ipfs-ds-help"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	format "github.com/ipfs/go-ipld-format"
+	// registers the raw, dag-pb and dag-cbor decoders with the go-ipld-format registry
+	_ "github.com/ipfs/go-merkledag"
+)
+
+// GetNode retrieves the block for the given CID and decodes it into a format.Node using the go-ipld-format
+// block decoder registry, selecting the decoder for the CID's codec. Decoders for raw, dag-pb and dag-cbor are
+// registered by this package, others may be added with format.Register(). An error is returned if no decoder
+// is registered for the codec. A ds.ErrNotFound error is returned if the CID is not in the archive.
+func (zipDs *ZipDatastore) GetNode(c cid.Cid) (format.Node, error) {
+	data, err := zipDs.GetCid(c)
+	if err != nil {
+		return nil, err
+	}
+	return decodeNode(c, data)
+}
+
+func decodeNode(c cid.Cid, data []byte) (format.Node, error) {
+	block, err := blocks.NewBlockWithCid(data, c)
+	if err != nil {
+		return nil, err
+	}
+	return format.Decode(block)
+}
+
+// ExportDag copies the DAG rooted at `root`, that is, the root block and every block transitively reachable
+// through the links of decoded nodes, into the ZIP archive at `destPath`, which is created if it doesn't exist.
+// Each block must be decodable with GetNode(). A block that is linked to but missing from this archive results
+// in an error unless Options.SkipMissingLinks is set, in which case it is not exported. The root itself must
+// always be present.
+func (zipDs *ZipDatastore) ExportDag(root cid.Cid, destPath string) (err error) {
+	dest, err := NewDatastoreWithOptions(destPath, &zipDs.opts)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		cerr := dest.Close()
+		if err == nil {
+			err = cerr
+		}
+	}()
+
+	seen := cid.NewSet()
+	seen.Add(root)
+	queue := []cid.Cid{root}
+	for len(queue) > 0 {
+		c := queue[0]
+		queue = queue[1:]
+
+		node, err := zipDs.GetNode(c)
+		if isNotFound(err) && !c.Equals(root) {
+			if zipDs.opts.SkipMissingLinks {
+				continue
+			}
+			return fmt.Errorf("zipcar: linked block %s is not in the archive", c)
+		}
+		if err != nil {
+			return err
+		}
+		if err = dest.PutCid(c, node.RawData()); err != nil {
+			return err
+		}
+		for _, link := range node.Links() {
+			if seen.Visit(link.Cid) {
+				queue = append(queue, link.Cid)
+			}
+		}
+	}
+
+	return nil
+}
+
+// PruneToRoots deletes every block that is not reachable from at least one of the given roots by following the
+// links of decoded nodes, as a garbage collection for an archive used as a content store. Blocks that can't be
+// decoded, such as those with codecs that have no registered decoder, are kept if they are
+// reachable but are treated as leaves. Roots and links that aren't in the archive are ignored. The number of
+// blocks deleted is returned. As a mutation operation, deleting one or more blocks will trigger a full rewrite
+// of the ZIP archive upon Close().
+func (zipDs *ZipDatastore) PruneToRoots(roots []cid.Cid) (removed int, err error) {
+	reachable := cid.NewSet()
+	var queue []cid.Cid
+	for _, root := range roots {
+		if reachable.Visit(root) {
+			queue = append(queue, root)
+		}
+	}
+	for len(queue) > 0 {
+		c := queue[0]
+		queue = queue[1:]
+
+		data, err := zipDs.GetCid(c)
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		node, err := decodeNode(c, data)
+		if err != nil {
+			continue // can't be decoded, keep it as a leaf
+		}
+		for _, link := range node.Links() {
+			if reachable.Visit(link.Cid) {
+				queue = append(queue, link.Cid)
+			}
+		}
+	}
+
+	results, err := zipDs.Query(dsq.Query{KeysOnly: true})
+	if err != nil {
+		return 0, err
+	}
+	entries, err := results.Rest()
+	if err != nil {
+		return 0, err
+	}
+	for _, entry := range entries {
+		c, err := dshelp.DsKeyToCid(ds.RawKey(entry.Key))
+		if err != nil {
+			return removed, err
+		}
+		if reachable.Has(c) {
+			continue
+		}
+		if err = zipDs.DeleteCid(c); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+
+	return removed, nil
+}
+
+// CheckComplete reports whether the archive holds a complete set of DAGs, with no dangling links, such as before
+// distributing it as a self-contained archive. Every block with a dag-pb or dag-cbor CID is decoded and the CIDs it
+// links to that aren't in the archive are returned, each once, in the order they are first found. Blocks with
+// other codecs are treated as leaves and are not read. An error is returned if a block can't be read or decoded.
+func (zipDs *ZipDatastore) CheckComplete() (missing []cid.Cid, err error) {
+	zipDs.lock.Lock()
+	defer zipDs.lock.Unlock()
+
+	names, err := zipDs.liveNames()
+	if err != nil {
+		return nil, err
+	}
+	seen := cid.NewSet()
+	for _, name := range names {
+		c, err := cid.Decode(name)
+		if err != nil {
+			return nil, err
+		}
+		if c.Type() != cid.DagProtobuf && c.Type() != cid.DagCBOR {
+			continue
+		}
+		data, err := zipDs.get(name, false)
+		if err != nil {
+			return nil, cidError(name, err)
+		}
+		node, err := decodeNode(c, data)
+		if err != nil {
+			return nil, cidError(name, err)
+		}
+		for _, link := range node.Links() {
+			if !seen.Visit(link.Cid) {
+				continue
+			}
+			if _, ok := identityData(link.Cid); ok {
+				continue
+			}
+			linkStr, err := cidToString(link.Cid)
+			if err != nil {
+				return nil, cidError(name, err)
+			}
+			if has, _ := zipDs.has(zipDs.resolve(link.Cid, linkStr)); !has {
+				missing = append(missing, link.Cid)
+			}
+		}
+	}
+	return missing, nil
+}
+
+// RangeCbor decodes each block with a dag-cbor CID and calls `fn` with its CID and decoded node, in the same order
+// as Query(). Blocks with other codecs are skipped without being read. Iteration stops at the first error, which
+// is returned, whether it is returned by `fn`, results from a block that can't be read or decoded, or is that of
+// `ctx` once it is done. `fn` is called without the ZipDatastore being locked, so it may use the ZipDatastore.
+func (zipDs *ZipDatastore) RangeCbor(ctx context.Context, fn func(c cid.Cid, node *cbor.Node) error) error {
+	results, err := zipDs.QueryContext(ctx, dsq.Query{KeysOnly: true})
+	if err != nil {
+		return err
+	}
+	defer results.Close()
+
+	for {
+		result, ok := results.NextSync()
+		if !ok {
+			return nil
+		}
+		if result.Error != nil {
+			return result.Error
+		}
+		c, err := dshelp.DsKeyToCid(ds.RawKey(result.Key))
+		if err != nil {
+			return err
+		}
+		if c.Type() != cid.DagCBOR {
+			continue
+		}
+		data, err := zipDs.read(c.String())
+		if err == ds.ErrNotFound { // deleted since the iteration started
+			continue
+		}
+		if err != nil {
+			return cidError(c.String(), err)
+		}
+		block, err := blocks.NewBlockWithCid(data, c)
+		if err != nil {
+			return cidError(c.String(), err)
+		}
+		node, err := cbor.DecodeBlock(block)
+		if err != nil {
+			return cidError(c.String(), err)
+		}
+		if err = fn(c, node.(*cbor.Node)); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package zipcar
+
+import (
+	"time"
+
+	cid "github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
+)
+
+// Options control the behaviour of a ZipDatastore. Use DefaultOptions() as a starting point rather than a
+// zero-value Options so that sensible defaults are retained.
+type Options struct {
+	// CidPrefix describes the CID version, codec and multihash function used by ComputeCid() when
+	// generating a CID for raw bytes. Defaults to CIDv1, raw codec and sha2-256.
+	CidPrefix cid.Prefix
+
+	// CompactIndex retains only the set of CIDs in an existing archive rather than the full ZIP header of each
+	// entry, which greatly reduces the memory held for very large archives when they are mostly used for Has()
+	// checks. The trade-off is that reading a block from the archive requires the central directory to be
+	// read again to locate it. Defaults to false.
+	CompactIndex bool
+
+	// SkipMissingLinks causes ExportDag() to leave out blocks that are linked to but are not present in the
+	// archive, rather than failing. Defaults to false.
+	SkipMissingLinks bool
+
+	// MinCompressSize is the size, in bytes, below which blocks are written to the archive uncompressed (using
+	// the ZIP "store" method) rather than with deflate, as compressing very small blocks usually makes them
+	// larger. Defaults to 64.
+	MinCompressSize int
+
+	// AllowedCodecs restricts the blocks that can be stored with Put() and its variants to those whose CIDs
+	// have one of the listed codecs (e.g. cid.Raw, cid.DagCBOR), others are rejected with ErrCodecNotAllowed.
+	// Blocks already in an archive are not checked. Defaults to empty, which allows all codecs.
+	AllowedCodecs []uint64
+
+	// ZipPassword is used to decrypt entries in existing archives that were encrypted by other ZIP tools using
+	// the traditional PKWARE "ZipCrypto" scheme. WinZip AES encryption is not supported. Reading an encrypted
+	// entry without a password, or with an unsupported scheme, results in ErrEncrypted. Entries are always
+	// written unencrypted, so a rewrite of the archive will remove the encryption. Defaults to nil.
+	ZipPassword []byte
+
+	// Mmap opens an existing archive read-only and memory maps it. Get() then returns blocks stored
+	// uncompressed as slices of the mapped file rather than copies, which must not be modified and are only
+	// valid until Close() is called; compressed blocks are read as usual. Mutations return ErrReadOnly, or are
+	// ignored in the case of SetComment(), and the archive is never rewritten. Only supported on Unix-like
+	// platforms. Defaults to false.
+	Mmap bool
+
+	// LenientKeys accepts keys in formats used by other IPFS tooling in addition to the go-ipfs-ds-help form
+	// (e.g. `/CIQ...`) expected by default: namespaced keys such as `/blocks/CIQ...` and keys holding a plain
+	// CID string such as `/bafy...` or `/Qm...`. Keys produced by Query() are always in the go-ipfs-ds-help
+	// form. Defaults to false.
+	LenientKeys bool
+
+	// WriteIntegrityManifest adds an entry named IntegrityManifestName to the archive each time it is written,
+	// listing the CID and multihash of every block so that VerifyIntegrityManifest() can later check the whole
+	// set against the content addresses. Defaults to false.
+	WriteIntegrityManifest bool
+
+	// WriteFormatVersion adds an entry named FormatVersionName to the archive each time it is written, recording
+	// the .zcar format version and the name of this implementation, which FormatVersion() reads back. Defaults to
+	// false.
+	WriteFormatVersion bool
+
+	// DisableReadCache stops Get() from retaining the blocks it reads from the archive in memory, so that
+	// reading through an archive larger than available memory doesn't accumulate it all. Each Get() of a block
+	// that hasn't been Put() then reads it from the archive again, other than the most recently read compressed
+	// block, which is held so that repeated reads of it, such as with GetRange(), don't decompress it again.
+	// Query() never retains the blocks it reads. Defaults to false.
+	DisableReadCache bool
+
+	// WriteBufferSize is the size, in bytes, of the buffer placed between the ZIP writer and the file when the
+	// archive is rewritten, reducing the number of write calls made for archives with many small blocks. Zero
+	// or less writes without an additional buffer. Defaults to 1 MiB.
+	WriteBufferSize int
+
+	// StrictZcar refuses to open an existing archive unless the filename of every entry is a CID, returning a
+	// NotZcarError listing the others, so that an arbitrary ZIP file isn't mistaken for a block store. The
+	// entries written by Options.WriteIntegrityManifest, Options.WriteFormatVersion and SetMeta(), and directory
+	// entries, are permitted. Equivalent to a Validation of ValidateKeys, or ValidateStrict, which imply it.
+	// Defaults to false, in which case entries that aren't CIDs are ignored.
+	StrictZcar bool
+
+	// DuplicatePolicy selects which entry is read for a block held by more than one entry of an existing archive,
+	// whether their filenames are identical or differently spelt variants of the same CID, see DuplicateNames().
+	// A crafted archive could otherwise hide a substituted block behind the one that is read. Defaults to
+	// DuplicateReject, which refuses to open such an archive with a DuplicateNamesError.
+	DuplicatePolicy DuplicatePolicy
+
+	// MaxBlockSize is the size, in bytes, above which blocks are rejected by Put() and its variants with
+	// ErrBlockTooLarge before they are retained, bounding the memory that a single untrusted block can consume.
+	// Blocks already in an archive are not checked. Defaults to zero, which allows blocks of any size.
+	MaxBlockSize int
+
+	// MaxReadBytes is the uncompressed size, in bytes, above which entries of the archive are not read, so that an
+	// untrusted archive declaring an absurd size for an entry can't cause it to be allocated. Get() and the other
+	// methods that read such an entry return ErrEntryTooLarge instead. Uncompressed blocks of a memory mapped
+	// archive, see Options.Mmap, aren't copied so aren't limited. Defaults to 1 GiB; zero allows entries of any
+	// size.
+	MaxReadBytes int64
+
+	// WriteVerificationHints verifies each block against its CID as the archive is written and, where it
+	// matches, records that in an extra field of its entry along with the CRC-32 of the block, for use with
+	// UseVerificationHints. This moves the cost of hashing every block to the rewrite. Other ZIP tools ignore
+	// the extra field. Defaults to false.
+	WriteVerificationHints bool
+
+	// UseVerificationHints allows Check() to skip recomputing the multihash of a block whose entry has a
+	// verification hint written with WriteVerificationHints, relying instead on the block matching the CRC-32
+	// recorded with the hint. This is only as trustworthy as the process that wrote the archive. Defaults to
+	// false.
+	UseVerificationHints bool
+
+	// CopyOnGet makes Get() return a copy of each block rather than the slice held in memory for it, so that a
+	// caller modifying the returned slice can't alter the stored block. This includes blocks returned from a
+	// memory mapped archive with Mmap. Defaults to false.
+	CopyOnGet bool
+
+	// CopyOnPut makes Put() and its variants store a copy of each block rather than the caller's slice, so that
+	// a caller reusing or modifying the slice afterwards, such as one drawing buffers from a pool, can't alter
+	// the stored block. Disabling it saves a copy of each block where callers never reuse their slices.
+	// Defaults to true.
+	CopyOnPut bool
+
+	// NameTransform maps between CIDs and entry filenames for archives that don't simply name each entry for
+	// its CID, such as PrefixShard(2, 2) for entries sharded into directories. It applies both to the entries of
+	// existing archives and to those written. Defaults to nil, naming each entry for its CID.
+	NameTransform NameTransform
+
+	// PreserveExtras carries entries of an existing archive whose filenames aren't CIDs, such as a README added
+	// with a ZIP tool, through rewrites of the archive by copying them unchanged, rather than dropping them.
+	// They are written after the blocks. Defaults to false.
+	PreserveExtras bool
+
+	// DedupByMultihash makes Has(), Get() and GetSize() match a block stored under any CID with the same
+	// multihash as the one requested, regardless of CID version or codec, so the CIDv0 and CIDv1 forms of the
+	// same data are interchangeable for reads. A block stored under the exact CID requested is preferred. Other
+	// operations, including Put() and Delete(), still act on the exact CID. Defaults to false.
+	DedupByMultihash bool
+
+	// ModTime, if set, is the modification time written for every entry when the archive is written, rather than
+	// the time of writing, so that rewrites of the same blocks differ only where their content does. Times set
+	// for individual blocks with Touch() still take precedence. See WriteCanonical() for output that is fully
+	// determined by content. Defaults to nil.
+	ModTime *time.Time
+
+	// DistinguishDeleted makes Get() and GetSize() return ErrDeleted rather than ds.ErrNotFound for a block that
+	// has been deleted since the archive was last written, for diagnosing unexpected deletions. As callers of a
+	// Datastore expect ds.ErrNotFound for any missing key, this should only be set where the caller knows to
+	// check for ErrDeleted too. Defaults to false.
+	DistinguishDeleted bool
+
+	// CompressWorkers is the number of goroutines used to compress blocks when the archive is written, so that
+	// large rewrites can use multiple cores. Blocks are still read, and written to the archive, one at a time and
+	// in the same order, with only a few blocks per worker held compressed in memory awaiting their turn. Values
+	// of 0 or 1 compress each block as it is written. Defaults to 0.
+	CompressWorkers int
+
+	// SortEntries writes the entries of the blocks in lexicographic order of their filenames, so that readers which
+	// binary search the central directory by filename can locate a CID without scanning every entry. Entries that
+	// aren't blocks, such as the integrity manifest and foreign entries, follow those of the blocks. ZipDatastore
+	// itself indexes the entries in a map when an archive is opened so doesn't benefit, but external tools do.
+	// Defaults to false, in which case entries are written in no particular order.
+	SortEntries bool
+
+	// ScanWorkers is the number of goroutines across which AllKeysChan() splits the enumeration of the blocks,
+	// each handling a contiguous range of filenames, to speed up full scans of large archives on multi-core
+	// machines. CIDs are then produced in no particular order. Values of 0 or 1 enumerate the blocks on a single
+	// goroutine, in the same order as Query(). Defaults to 0.
+	ScanWorkers int
+
+	// KeepTombstoneData retains the content of each block removed with Delete() in memory, along with its entry
+	// comment and content type, so that the deletion can be undone with Undelete() without the block being read
+	// again. Deleted blocks are still excluded when the archive is written. Retained blocks are held until
+	// Close(), so this is intended for interactive sessions rather than bulk deletion. Defaults to false.
+	KeepTombstoneData bool
+
+	// Compatibility selects the ZIP features used when writing the archive. CompatMax avoids data descriptors and
+	// extended timestamps for the benefit of old ZIP tools, at the cost of holding each compressed block in memory
+	// before it is written. Zip64 records are only ever written where the archive is too large to do without them.
+	// Entries carried over with PreserveExtras are copied as they are. WriteCanonical() is not affected, its output
+	// is defined independently of this option. Defaults to CompatModern.
+	Compatibility Compatibility
+
+	// EntryNameValidator, if set, is called with the canonical CID string of every block, as used for its
+	// filename before any NameTransform, to enforce local policy on what may be stored, such as only CIDv1 or
+	// only a particular codec. Opening an archive fails with a CidError wrapping the first error returned for
+	// one of its blocks, and Put() and its variants return the error for a block without storing it. Entries
+	// whose filenames aren't CIDs, and blocks with identity CIDs, which aren't stored, are not checked. Defaults
+	// to nil.
+	EntryNameValidator func(name string) error
+
+	// LazyIndex makes NewDatastoreWithOptions() and NewDatastoreFromReaderAt() return as soon as an existing
+	// archive is opened, reading its central directory on a background goroutine rather than before returning,
+	// for interactive tools opening very large archives. Every method waits for the central directory to be read
+	// before proceeding, so the ZipDatastore can be used immediately. If it can't be read, the ZipDatastore
+	// behaves as an empty, read-only one, so that the archive isn't overwritten, and the error is returned by
+	// WaitIndex(), which should be checked before relying on the contents. Not applicable with Mmap. Defaults to
+	// false.
+	LazyIndex bool
+
+	// MaxArchiveBytes is the size, in bytes, above which Put() and its variants reject blocks with
+	// ErrArchiveTooLarge before they are retained, where adding the block would take the size of the archive, as
+	// estimated by EstimatedSize(), over it. This allows an archive to be filled up to a limit, such as the
+	// capacity of the medium it is destined for, with the overflow detected as it happens rather than when the
+	// archive is written. Defaults to zero, which allows archives of any size.
+	MaxArchiveBytes int64
+
+	// SkipCrcCheck stops Get(), its variants and Query() from verifying the CRC-32 of each block as it is read from
+	// the archive, saving the cost of computing it, which is significant for large blocks, where the archive is
+	// trusted and its integrity has been established by other means. Deflated blocks are still rejected if their
+	// compressed data is malformed, but corruption is otherwise only detected by hashing the block. Check(),
+	// VerifyIntegrityManifest() and Validate() always verify the CRC-32, as do rewrites of the archive for blocks
+	// they read, although a block already read by Get() and held in the read cache is written out as it was read,
+	// with a fresh CRC-32. Encrypted entries are always verified. Defaults to false, in which case every read is
+	// verified, including reads of a memory mapped archive with Mmap, as is appropriate for untrusted archives.
+	SkipCrcCheck bool
+
+	// RawCopy makes rewrites of the archive copy the entries of blocks that haven't been replaced since it was read
+	// as they are stored, still compressed, with the CRC-32 and sizes of their original headers, rather than
+	// decompressing and compressing each block again, which dominates the cost of rewriting an archive of large
+	// deflated blocks. Copied entries keep their original compression method, regardless of MinCompressSize, and
+	// their original modification time unless one has been set with Touch(); their filenames, entry comments and
+	// content types are those current at the time of writing. Their data isn't read back so their CRC-32 isn't
+	// verified, as it isn't with SkipCrcCheck. Encrypted entries are decrypted and written in the clear as usual.
+	// WriteTo() and SerializedSize() copy entries in the same way, WriteCanonical() and ReencodeTo() never do.
+	// Defaults to false.
+	RawCopy bool
+
+	// Validation selects how thoroughly entries are checked against their CIDs, from ValidateNone, which trusts the
+	// archive and the caller, through ValidateKeys and ValidateHashes to ValidateStrict, which checks everything on
+	// every operation at the cost of hashing every block read, see the Validation constants for what each checks
+	// and what it costs. Defaults to ValidateNone.
+	Validation Validation
+
+	// Logger receives log messages when the archive is opened, rewritten and closed, when an auto-flush runs or
+	// fails, when blocks held in memory are dropped once written, and when reading a malformed archive is
+	// recovered from, so that the behaviour of a ZipDatastore can be followed in production with whichever logging
+	// library the application uses. Defaults to nil, in which case nothing is logged.
+	Logger Logger
+}
+
+// DefaultOptions returns the Options used by NewDatastore(), and by NewDatastoreWithOptions() when it is
+// provided with nil Options. A new value is returned on each call so it can be modified freely.
+func DefaultOptions() Options {
+	return Options{
+		CidPrefix: cid.Prefix{
+			Version:  1,
+			Codec:    cid.Raw,
+			MhType:   mh.SHA2_256,
+			MhLength: -1,
+		},
+		MinCompressSize: 64,
+		WriteBufferSize: 1 << 20,
+		CopyOnPut:       true,
+		MaxReadBytes:    1 << 30,
+	}
+}
@@ -0,0 +1,241 @@
+package zipcar
+
+import (
+	"archive/zip"
+	"io"
+	"os"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// Overlay is a Datastore presenting several ZIP archives as a single store, such as a base archive and patches
+// distributed separately, without merging them. Archives are layered in the order they are provided, each later
+// layer shadowing those before it, although as blocks are content addressed, the same CID in two layers should
+// hold the same block. Mutations are made to an in-memory layer above the archives, which are never modified:
+// blocks that are Put() are held there, and blocks that are deleted are hidden from every layer. The blocks that
+// have been Put() can be written out as a new archive with WriteTo(), to be distributed as a further patch.
+// It is safe for concurrent use.
+type Overlay struct {
+	layers []*ZipDatastore // read-only, bottom first
+	top    *ZipDatastore   // in-memory, holding mutations
+}
+
+var _ ds.Datastore = (*Overlay)(nil)
+
+// NewOverlayDatastore opens the ZIP archives at `paths` read-only and layers them as an Overlay, the first at the
+// bottom and the last at the top. Each archive is opened as with NewDatastoreFromReaderAt(), reading only its
+// central directory up front.
+//
+// Always call Close() on an Overlay when it is no longer required
+func NewOverlayDatastore(paths ...string) (*Overlay, error) {
+	overlay := &Overlay{top: &ZipDatastore{
+		opts:          DefaultOptions(),
+		index:         make(map[string]*zip.File),
+		cache:         make(map[string][]byte),
+		entryComments: make(map[string]string),
+		modTimes:      make(map[string]time.Time),
+	}}
+	for _, path := range paths {
+		layer, err := openLayer(path)
+		if err != nil {
+			overlay.Close()
+			return nil, err
+		}
+		overlay.layers = append(overlay.layers, layer)
+	}
+	return overlay, nil
+}
+
+func openLayer(path string) (*ZipDatastore, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	fileinfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	layer, err := NewDatastoreFromReaderAt(file, fileinfo.Size(), nil)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return layer, nil
+}
+
+// layer returns the layer that the block for `key` should be read from, the in-memory layer first then the
+// archives from the top down, or nil if it is in none of them or has been deleted.
+func (o *Overlay) layer(key ds.Key) (*ZipDatastore, error) {
+	o.top.lock.Lock()
+	cidStr, err := o.top.dsKeyToCidString(key)
+	var value []byte
+	var mutated bool
+	if err == nil {
+		value, mutated = o.top.cache[*cidStr]
+	}
+	o.top.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if mutated {
+		if value == nil { // deleted
+			return nil, nil
+		}
+		return o.top, nil
+	}
+
+	if has, err := o.top.Has(key); err != nil || has { // an identity CID
+		return o.top, err
+	}
+	for i := len(o.layers) - 1; i >= 0; i-- {
+		if has, err := o.layers[i].Has(key); err != nil || has {
+			return o.layers[i], err
+		}
+	}
+	return nil, nil
+}
+
+// Get retrieves the block for the given key from the topmost layer holding it. A ds.ErrNotFound error is returned
+// if no layer holds it or it has been deleted.
+func (o *Overlay) Get(key ds.Key) ([]byte, error) {
+	layer, err := o.layer(key)
+	if err != nil {
+		return nil, err
+	}
+	if layer == nil {
+		return nil, ds.ErrNotFound
+	}
+	return layer.Get(key)
+}
+
+// Has determines whether any layer holds the block for the given key, and it hasn't been deleted.
+func (o *Overlay) Has(key ds.Key) (bool, error) {
+	layer, err := o.layer(key)
+	return layer != nil, err
+}
+
+// GetSize returns the size of the block for the given key from the topmost layer holding it. A ds.ErrNotFound
+// error is returned if no layer holds it or it has been deleted.
+func (o *Overlay) GetSize(key ds.Key) (int, error) {
+	layer, err := o.layer(key)
+	if err != nil {
+		return -1, err
+	}
+	if layer == nil {
+		return -1, ds.ErrNotFound
+	}
+	return layer.GetSize(key)
+}
+
+// Put stores a block in the in-memory layer, unless it is already present in one of the archives.
+func (o *Overlay) Put(key ds.Key, value []byte) error {
+	layer, err := o.layer(key)
+	if err != nil {
+		return err
+	}
+	if layer != nil && layer != o.top {
+		return nil
+	}
+	return o.top.Put(key, value)
+}
+
+// Delete hides the block for the given key in every layer. The archives themselves are not modified.
+func (o *Overlay) Delete(key ds.Key) error {
+	return o.top.Delete(key)
+}
+
+// Query searches the blocks of every layer, producing each CID once. Blocks that have been Put() are produced
+// first, then those of each archive from the top down, in archive order. Values are read from the layer that Get()
+// would read them from as they are produced.
+func (o *Overlay) Query(q dsq.Query) (dsq.Results, error) {
+	seen := make(map[string]struct{})
+	var names []string
+	var sources []*ZipDatastore
+	add := func(layer *ZipDatastore) error {
+		layer.lock.Lock()
+		defer layer.lock.Unlock()
+		layerNames, err := layer.liveNames()
+		if err != nil {
+			return err
+		}
+		for _, name := range layerNames {
+			if _, ok := seen[name]; !ok {
+				seen[name] = struct{}{}
+				names = append(names, name)
+				sources = append(sources, layer)
+			}
+		}
+		return nil
+	}
+
+	o.top.lock.Lock()
+	for name, value := range o.top.cache {
+		if value == nil { // deleted, hidden in every layer
+			seen[name] = struct{}{}
+		}
+	}
+	o.top.lock.Unlock()
+	if err := add(o.top); err != nil {
+		return nil, err
+	}
+	for i := len(o.layers) - 1; i >= 0; i-- {
+		if err := add(o.layers[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	var i int
+	next := func() (dsq.Result, bool) {
+		for i < len(names) {
+			name, source := names[i], sources[i]
+			i++
+			key, err := cidStringToDsKey(name)
+			if err != nil {
+				return dsq.Result{Error: err}, true
+			}
+			entry := dsq.Entry{Key: key.String()}
+			if !q.KeysOnly {
+				entry.Value, err = source.read(name)
+				if err == ds.ErrNotFound { // deleted since the query started
+					continue
+				}
+				if err != nil {
+					return dsq.Result{Error: err}, true
+				}
+			}
+			return dsq.Result{Entry: entry}, true
+		}
+		return dsq.Result{}, false
+	}
+
+	iter := dsq.Iterator{
+		Next: next,
+		Close: func() error {
+			i = len(names)
+			return nil
+		},
+	}
+	return dsq.NaiveQueryApply(q, dsq.ResultsFromIterator(q, iter)), nil
+}
+
+// WriteTo writes the blocks that have been Put() to `w` as a ZIP archive, which can be layered over the same
+// archives as a further patch. Deletions can't be represented in an archive so are not written. The number of
+// bytes written is returned.
+func (o *Overlay) WriteTo(w io.Writer) (int64, error) {
+	return o.top.WriteTo(w)
+}
+
+// Close closes each of the archives. Blocks that have been Put() and not written out with WriteTo() are
+// discarded.
+func (o *Overlay) Close() error {
+	err := o.top.Close()
+	for _, layer := range o.layers {
+		if cerr := layer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
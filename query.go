@@ -0,0 +1,516 @@
+package zipcar
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	dshelp "github.com/ipfs/go-ipfs-ds-help"
+)
+
+// Query searches the entries of the ZIP archive, see QueryContext().
+func (zipDs *ZipDatastore) Query(q dsq.Query) (dsq.Results, error) {
+	return zipDs.QueryContext(context.Background(), q)
+}
+
+// QueryContext searches the entries of the ZIP archive. Results are streamed: the index is walked one entry at a
+// time as results are pulled from the returned dsq.Results, either directly with NextSync() or via the goroutine
+// behind Next(), and, unless `q.KeysOnly` is set, block data is only read from the archive as each result is
+// produced. Memory use is therefore bounded regardless of the size of the archive, unless `q.Orders` is set,
+// which requires all results to be collected before they can be sorted. A consumer that stops early, by calling
+// Close() on the results or by cancelling `ctx`, halts production and never opens the blocks it didn't reach.
+// Blocks read by a query are never retained in the cache, regardless of Options.DisableReadCache, so a query
+// with values over an archive larger than available memory only holds the blocks the consumer is holding.
+//
+// Entries that have been Put() but not yet written to the archive are produced first, in filename order,
+// followed by the entries of the archive in the order they appear in it. Entries deleted after the query has
+// started are not produced if they haven't been reached yet, while entries added after it has started are not
+// produced at all.
+func (zipDs *ZipDatastore) QueryContext(ctx context.Context, q dsq.Query) (dsq.Results, error) {
+	zipDs.lock.Lock()
+	pending := zipDs.pendingNames()
+	files, err := zipDs.archiveFiles()
+	zipDs.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	pendingSet := make(map[string]struct{}, len(pending))
+	for _, name := range pending {
+		pendingSet[name] = struct{}{}
+	}
+
+	// nextName walks the pending entries then the archive entries, skipping any already produced
+	var i int
+	nextName := func() (string, bool) {
+		for i < len(pending)+len(files) {
+			j := i
+			i++
+			if j < len(pending) {
+				return pending[j], true
+			}
+			name, ok := zipDs.entryName(files[j-len(pending)].Name)
+			if _, isPending := pendingSet[name]; ok && !isPending {
+				return name, true
+			}
+		}
+		return "", false
+	}
+
+	var done bool
+	next := func() (dsq.Result, bool) {
+		for !done {
+			if err := ctx.Err(); err != nil {
+				done = true
+				return dsq.Result{Error: err}, true
+			}
+
+			name, ok := nextName()
+			if !ok {
+				done = true
+				break
+			}
+			key, err := cidStringToDsKey(name)
+			if err != nil {
+				done = true
+				return dsq.Result{Error: err}, true
+			}
+			// filter on the prefix now, there's no need to read blocks that won't be returned
+			if !strings.HasPrefix(key.String(), q.Prefix) {
+				continue
+			}
+
+			entry := dsq.Entry{Key: key.String()}
+			if q.KeysOnly {
+				zipDs.lock.Lock()
+				has, _ := zipDs.has(&name)
+				zipDs.lock.Unlock()
+				if !has { // deleted since the query started
+					continue
+				}
+			} else {
+				value, err := zipDs.read(name)
+				if err == ds.ErrNotFound { // deleted since the query started
+					continue
+				}
+				if err != nil {
+					done = true
+					return dsq.Result{Error: err}, true
+				}
+				entry.Value = value
+			}
+			return dsq.Result{Entry: entry}, true
+		}
+		return dsq.Result{}, false
+	}
+
+	iter := dsq.Iterator{
+		Next: next,
+		Close: func() error {
+			done = true
+			return nil
+		},
+	}
+
+	return dsq.NaiveQueryApply(q, dsq.ResultsFromIterator(q, iter)), nil
+}
+
+// AllKeysChan returns a channel producing the CID of every live block, as the AllKeysChan() of a blockstore
+// does, so that a blockstore adapter can enumerate the ZipDatastore directly. Blocks deleted after it has started
+// are not produced if they haven't been reached yet, while blocks added after it has started are not produced at
+// all. The channel is closed once every CID has been produced, or once `ctx` is cancelled.
+//
+// CIDs are produced in the same order as Query() unless Options.ScanWorkers is greater than 1, in which case the
+// filenames are sorted and split into that many contiguous ranges, each decoded on its own goroutine, and the
+// CIDs of all of the ranges are merged onto the channel in no particular order.
+func (zipDs *ZipDatastore) AllKeysChan(ctx context.Context) (<-chan cid.Cid, error) {
+	zipDs.lock.Lock()
+	names, err := zipDs.liveNames()
+	zipDs.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	ranges := [][]string{names}
+	if workers := zipDs.opts.ScanWorkers; workers > 1 && len(names) > 1 {
+		sort.Strings(names)
+		if workers > len(names) {
+			workers = len(names)
+		}
+		ranges = make([][]string, workers)
+		for i := range ranges {
+			ranges[i] = names[i*len(names)/workers : (i+1)*len(names)/workers]
+		}
+	}
+
+	out := make(chan cid.Cid)
+	var wg sync.WaitGroup
+	wg.Add(len(ranges))
+	for _, names := range ranges {
+		go func(names []string) {
+			defer wg.Done()
+			for _, name := range names {
+				zipDs.lock.Lock()
+				has, _ := zipDs.has(&name)
+				zipDs.lock.Unlock()
+				if !has { // deleted since the scan started
+					continue
+				}
+				c, err := cid.Decode(name)
+				if err != nil {
+					continue
+				}
+				select {
+				case out <- c:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(names)
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+	return out, nil
+}
+
+// ListCidsIn returns the CIDs of the blocks in the ZIP archive at `path`, in archive order, without instantiating
+// a ZipDatastore: only the central directory is read, and the file is closed before returning. Entries whose
+// filenames aren't CIDs are skipped, and a CID held by more than one entry is listed once. Filenames are read as
+// DefaultOptions() would read them, so the entries of an archive written with Options.NameTransform are skipped.
+// An error is returned if the file can't be opened or isn't a ZIP archive.
+func ListCidsIn(path string) ([]cid.Cid, error) {
+	reader, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	seen := make(map[string]struct{}, len(reader.File))
+	cids := make([]cid.Cid, 0, len(reader.File))
+	for _, f := range reader.File {
+		name, ok := canonicalName(f.Name)
+		if !ok {
+			continue
+		}
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		seen[name] = struct{}{}
+		c, err := cid.Decode(name)
+		if err != nil {
+			return nil, err
+		}
+		cids = append(cids, c)
+	}
+	return cids, nil
+}
+
+// FilterBySize returns the CIDs of the blocks whose size in bytes is within the inclusive range [`min`, `max`].
+// Only the sizes recorded in the headers of the archive entries are consulted, no blocks are read, while
+// blocks that have been Put() but not yet written to the archive are measured in memory. CIDs are returned in
+// the same order as Query() produces them.
+func (zipDs *ZipDatastore) FilterBySize(min, max int64) ([]cid.Cid, error) {
+	zipDs.lock.Lock()
+	defer zipDs.lock.Unlock()
+
+	var cids []cid.Cid
+	err := zipDs.eachSize(func(cidStr string, size int64) error {
+		if size < min || size > max {
+			return nil
+		}
+		c, err := cid.Decode(cidStr)
+		if err != nil {
+			return err
+		}
+		cids = append(cids, c)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return cids, nil
+}
+
+// eachSize calls `fn` with the filename and size of each live block, in the same order as Query() produces
+// them, using the entry headers for blocks in the archive and the in-memory length for those only in the cache.
+func (zipDs *ZipDatastore) eachSize(fn func(cidStr string, size int64) error) error {
+	for _, name := range zipDs.pendingNames() {
+		if err := fn(name, int64(len(zipDs.cache[name]))); err != nil {
+			return err
+		}
+	}
+	files, err := zipDs.archiveFiles()
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		name, _ := zipDs.entryName(f.Name)
+		if has, _ := zipDs.has(&name); !has {
+			continue
+		}
+		if err := fn(name, int64(f.UncompressedSize64)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IsModified reports whether there are mutations that haven't yet been written to the archive, so that Close()
+// or Sync() will rewrite it. Along with the blocks reported by PendingChanges(), this includes changes to the
+// archive comment, entry comments and modification times, which PendingChanges() doesn't report.
+func (zipDs *ZipDatastore) IsModified() bool {
+	zipDs.lock.Lock()
+	defer zipDs.lock.Unlock()
+
+	return zipDs.modified
+}
+
+// PendingChanges reports the blocks that will be added to and deleted from the archive when it is next written by
+// Close() or Sync(), in CID string order. Blocks that were Put() then deleted again before being written, and
+// deletions of blocks that were never in the archive, are not reported.
+func (zipDs *ZipDatastore) PendingChanges() (added, deleted []cid.Cid, err error) {
+	zipDs.lock.Lock()
+	defer zipDs.lock.Unlock()
+
+	for _, name := range zipDs.pendingNames() {
+		c, err := cid.Decode(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		added = append(added, c)
+	}
+
+	files, err := zipDs.archiveFiles()
+	if err != nil {
+		return nil, nil, err
+	}
+	var names []string
+	for _, f := range files {
+		name, _ := zipDs.entryName(f.Name)
+		if bytes, ok := zipDs.cache[name]; ok && bytes == nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c, err := cid.Decode(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		deleted = append(deleted, c)
+	}
+
+	return added, deleted, nil
+}
+
+// NewEntries returns the CIDs of the blocks added since this ZipDatastore was instantiated, with Put() or its
+// variants, that are still present, in CID string order, whether or not they have since been written to the
+// archive by Sync(). Blocks that were already present when they were Put() aren't included, while blocks that were
+// deleted then Put() again are. With CopyTo(), this produces an incremental archive of what has been added in
+// this session, for append-style replication. Only in-memory state is consulted.
+func (zipDs *ZipDatastore) NewEntries() ([]cid.Cid, error) {
+	zipDs.lock.Lock()
+	defer zipDs.lock.Unlock()
+
+	names := make([]string, 0, len(zipDs.added))
+	for name := range zipDs.added {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	cids := make([]cid.Cid, 0, len(names))
+	for _, name := range names {
+		c, err := cid.Decode(name)
+		if err != nil {
+			return nil, err
+		}
+		cids = append(cids, c)
+	}
+	return cids, nil
+}
+
+// CopyTo copies the blocks with the given CIDs, along with their entry comments and content types, into the ZIP
+// archive at `destPath`, which is created if it doesn't exist, using the Options of this ZipDatastore. Blocks
+// already in the destination are left as they are. A ds.ErrNotFound error is returned if a block isn't present.
+// Pending mutations are included. Blocks are read one at a time, they are not retained in the cache.
+func (zipDs *ZipDatastore) CopyTo(destPath string, cids []cid.Cid) (err error) {
+	dest, err := NewDatastoreWithOptions(destPath, &zipDs.opts)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		cerr := dest.Close()
+		if err == nil {
+			err = cerr
+		}
+	}()
+
+	for _, c := range cids {
+		data, comment, contentType, err := zipDs.readEntry(c)
+		if err != nil {
+			return err
+		}
+		added, err := dest.PutCidResult(c, data)
+		if err != nil {
+			return err
+		}
+		if !added {
+			continue
+		}
+		if comment != "" {
+			if err = dest.SetEntryComment(c, comment); err != nil {
+				return err
+			}
+		}
+		if contentType != "" {
+			if err = dest.SetContentType(c, contentType); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readEntry returns the data, entry comment and content type of the block with the CID `c`, without adding it to
+// the cache.
+func (zipDs *ZipDatastore) readEntry(c cid.Cid) (data []byte, comment string, contentType string, err error) {
+	zipDs.lock.Lock()
+	defer zipDs.lock.Unlock()
+
+	if data, ok := identityData(c); ok {
+		return data, "", "", nil
+	}
+	cidStr, err := cidToString(c)
+	if err != nil {
+		return nil, "", "", err
+	}
+	if data, err = zipDs.get(*cidStr, false); err != nil {
+		return nil, "", "", cidError(*cidStr, err)
+	}
+	return data, zipDs.entryComments[*cidStr], zipDs.contentTypes[*cidStr], nil
+}
+
+// MissingFrom returns the CIDs of the blocks in `other` that are not in this ZipDatastore, in CID string order,
+// which are those that would need to be copied from `other` for this ZipDatastore to hold all of its blocks. Only
+// the sets of CIDs are compared, no blocks are read. Pending mutations of both are included. The two are not
+// locked at the same time, so a change made to `other` while this runs may or may not be reflected.
+func (zipDs *ZipDatastore) MissingFrom(other *ZipDatastore) ([]cid.Cid, error) {
+	if other == zipDs {
+		return nil, nil
+	}
+
+	other.lock.Lock()
+	var names []string
+	other.eachName(func(name string) {
+		names = append(names, name)
+	})
+	other.lock.Unlock()
+	sort.Strings(names)
+
+	zipDs.lock.Lock()
+	defer zipDs.lock.Unlock()
+
+	var missing []cid.Cid
+	for _, name := range names {
+		if has, _ := zipDs.has(&name); has {
+			continue
+		}
+		c, err := cid.Decode(name)
+		if err != nil {
+			return nil, err
+		}
+		missing = append(missing, c)
+	}
+	return missing, nil
+}
+
+// ErrAmbiguousPrefix is returned by GetByPrefix() when more than one block matches the prefix.
+var ErrAmbiguousPrefix = errors.New("zipcar: prefix matches more than one block")
+
+// GetByPrefix retrieves the block whose CID string starts with `prefix`, returning its data and full CID, in the
+// manner of abbreviated git commit hashes, for interactive use. Only the filenames are scanned for a match, then
+// the one block is read, as by Get(). Pending mutations are included. ds.ErrNotFound is returned if no block
+// matches, and ErrAmbiguousPrefix if more than one does.
+func (zipDs *ZipDatastore) GetByPrefix(prefix string) ([]byte, cid.Cid, error) {
+	zipDs.lock.Lock()
+	defer zipDs.lock.Unlock()
+
+	var match string
+	matches := 0
+	zipDs.eachName(func(name string) {
+		if strings.HasPrefix(name, prefix) {
+			match = name
+			matches++
+		}
+	})
+	if matches == 0 {
+		return nil, cid.Undef, ds.ErrNotFound
+	}
+	if matches > 1 {
+		return nil, cid.Undef, ErrAmbiguousPrefix
+	}
+
+	c, err := cid.Decode(match)
+	if err != nil {
+		return nil, cid.Undef, cidError(match, err)
+	}
+	value, err := zipDs.get(match, !zipDs.opts.DisableReadCache)
+	if err != nil {
+		return nil, cid.Undef, cidError(match, err)
+	}
+	return zipDs.copyOnGet(value), c, nil
+}
+
+// read returns the data for the entry with the given filename without adding it to the cache.
+func (zipDs *ZipDatastore) read(cidStr string) ([]byte, error) {
+	zipDs.lock.Lock()
+	defer zipDs.lock.Unlock()
+
+	return zipDs.get(cidStr, false)
+}
+
+// pendingNames returns the sorted filenames of the entries that are in the cache but not the archive, i.e.
+// those that will be written on the next rewrite.
+func (zipDs *ZipDatastore) pendingNames() []string {
+	var names []string
+	for cidStr, bytes := range zipDs.cache {
+		if bytes != nil && zipDs.index[cidStr] == nil {
+			if _, ok := zipDs.members[cidStr]; !ok {
+				names = append(names, cidStr)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// archiveFiles returns the entries of the archive that were selected for the index when it was loaded, in
+// archive order, including any that have since been deleted. With Options.CompactIndex, this involves reading
+// the central directory of the archive again.
+func (zipDs *ZipDatastore) archiveFiles() ([]*zip.File, error) {
+	if zipDs.members == nil {
+		return zipDs.files, nil
+	}
+	reader, err := zip.NewReader(zipDs.file, zipDs.size)
+	if err != nil {
+		return nil, err
+	}
+	index, _ := zipDs.indexEntries(reader.File)
+	return zipDs.indexedFiles(reader.File, index), nil
+}
+
+func cidStringToDsKey(cidStr string) (ds.Key, error) {
+	c, err := cid.Decode(cidStr)
+	if err != nil {
+		return ds.Key{}, err
+	}
+	return dshelp.CidToDsKey(c), nil
+}
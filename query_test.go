@@ -0,0 +1,262 @@
+package zipcar
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"testing"
+
+	cid "github.com/ipfs/go-cid"
+	datastore "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	dshelp "github.com/ipfs/go-ipfs-ds-help"
+	dag "github.com/ipfs/go-merkledag"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuery(t *testing.T) {
+	os.Remove("query.zcar")
+	defer os.Remove("query.zcar")
+
+	ds, err := NewDatastore("query.zcar")
+	assert.NoError(t, err)
+	for _, raw := range []*dag.RawNode{rnd1, rnd2} {
+		assert.NoError(t, ds.PutCid(raw.Cid(), raw.RawData()))
+	}
+	assert.NoError(t, ds.Close())
+
+	ds, err = NewDatastore("query.zcar")
+	assert.NoError(t, err)
+	defer ds.Close()
+	// one block only in the archive, one only in the cache
+	assert.NoError(t, ds.PutCid(rnd3.Cid(), rnd3.RawData()))
+
+	expected := map[string][]byte{
+		dshelp.CidToDsKey(rnd1.Cid()).String(): rnd1.RawData(),
+		dshelp.CidToDsKey(rnd2.Cid()).String(): rnd2.RawData(),
+		dshelp.CidToDsKey(rnd3.Cid()).String(): rnd3.RawData(),
+	}
+
+	results, err := ds.Query(dsq.Query{KeysOnly: true})
+	assert.NoError(t, err)
+	entries, err := results.Rest()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(entries))
+	for _, e := range entries {
+		assert.Contains(t, expected, e.Key)
+		assert.Nil(t, e.Value)
+	}
+
+	results, err = ds.Query(dsq.Query{})
+	assert.NoError(t, err)
+	entries, err = results.Rest()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(entries))
+	for _, e := range entries {
+		assert.Equal(t, expected[e.Key], e.Value)
+	}
+
+	key := dshelp.CidToDsKey(rnd2.Cid()).String()
+	results, err = ds.Query(dsq.Query{Prefix: key})
+	assert.NoError(t, err)
+	entries, err = results.Rest()
+	assert.NoError(t, err)
+	assert.Equal(t, []dsq.Entry{{Key: key, Value: rnd2.RawData()}}, entries)
+
+	results, err = ds.Query(dsq.Query{Limit: 2})
+	assert.NoError(t, err)
+	entries, err = results.Rest()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(entries))
+}
+
+func TestQueryLazy(t *testing.T) {
+	os.Remove("querylazy.zcar")
+	defer os.Remove("querylazy.zcar")
+
+	ds, err := NewDatastore("querylazy.zcar")
+	assert.NoError(t, err)
+	defer ds.Close()
+	for _, raw := range []*dag.RawNode{rnd1, rnd2, rnd3, rndz} {
+		assert.NoError(t, ds.PutCid(raw.Cid(), raw.RawData()))
+	}
+
+	results, err := ds.Query(dsq.Query{KeysOnly: true})
+	assert.NoError(t, err)
+	keys, err := results.Rest()
+	assert.NoError(t, err)
+	assert.Equal(t, 4, len(keys))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	results, err = ds.QueryContext(ctx, dsq.Query{})
+	assert.NoError(t, err)
+
+	res, ok := results.NextSync()
+	assert.True(t, ok)
+	assert.NoError(t, res.Error)
+	assert.Equal(t, keys[0].Key, res.Key)
+
+	// blocks are read as they are pulled, so one deleted after the query started is not returned
+	assert.NoError(t, ds.Delete(datastore.RawKey(keys[1].Key)))
+	res, ok = results.NextSync()
+	assert.True(t, ok)
+	assert.NoError(t, res.Error)
+	assert.Equal(t, keys[2].Key, res.Key)
+
+	// nothing more is produced once the context is cancelled
+	cancel()
+	res, ok = results.NextSync()
+	assert.True(t, ok)
+	assert.Equal(t, context.Canceled, res.Error)
+	_, ok = results.NextSync()
+	assert.False(t, ok)
+	assert.NoError(t, results.Close())
+}
+
+func TestQueryStreaming(t *testing.T) {
+	os.Remove("querystream.zcar")
+	defer os.Remove("querystream.zcar")
+
+	const count = 2000
+	ds, err := NewDatastore("querystream.zcar")
+	assert.NoError(t, err)
+	for i := 0; i < count; i++ {
+		_, err := ds.PutData([]byte(fmt.Sprintf("block %d", i)))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, ds.Close())
+
+	ds, err = NewDatastore("querystream.zcar")
+	assert.NoError(t, err)
+	defer ds.Close()
+
+	results, err := ds.Query(dsq.Query{})
+	assert.NoError(t, err)
+	entries, err := results.Rest()
+	assert.NoError(t, err)
+	assert.Equal(t, count, len(entries))
+
+	// consume a few via the channel then Close(), which should halt the producer goroutine
+	for _, keysOnly := range []bool{false, true} {
+		results, err = ds.Query(dsq.Query{KeysOnly: keysOnly})
+		assert.NoError(t, err)
+		ch := results.Next()
+		for i := 0; i < 10; i++ {
+			res := <-ch
+			assert.NoError(t, res.Error)
+		}
+		assert.NoError(t, results.Close())
+		var remaining int
+		for range ch {
+			remaining++
+		}
+		assert.True(t, remaining <= dsq.KeysOnlyBufSize+1, "production continued after Close(): %d", remaining)
+	}
+}
+
+func TestQueryLargeValues(t *testing.T) {
+	os.Remove("querylarge.zcar")
+	defer os.Remove("querylarge.zcar")
+
+	const count = 256
+	const blockSize = 64 << 10
+	rng := rand.New(rand.NewSource(1))
+	ds, err := NewDatastore("querylarge.zcar")
+	assert.NoError(t, err)
+	for i := 0; i < count; i++ {
+		data := make([]byte, blockSize)
+		rng.Read(data)
+		_, err := ds.PutData(data)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, ds.Close())
+
+	for _, disableReadCache := range []bool{false, true} {
+		opts := DefaultOptions()
+		opts.DisableReadCache = disableReadCache
+		ds, err = NewDatastoreWithOptions("querylarge.zcar", &opts)
+		assert.NoError(t, err)
+
+		results, err := ds.Query(dsq.Query{})
+		assert.NoError(t, err)
+		var n, peak int
+		for res, ok := results.NextSync(); ok; res, ok = results.NextSync() {
+			assert.NoError(t, res.Error)
+			assert.Equal(t, blockSize, len(res.Value))
+			n++
+			if len(ds.cache) > peak {
+				peak = len(ds.cache)
+			}
+		}
+		assert.NoError(t, results.Close())
+		assert.Equal(t, count, n)
+		assert.Equal(t, 0, peak)
+
+		// Get() retains what it reads unless the read cache is disabled
+		results, err = ds.Query(dsq.Query{KeysOnly: true, Limit: 1})
+		assert.NoError(t, err)
+		res, ok := results.NextSync()
+		assert.True(t, ok)
+		key := datastore.RawKey(res.Key)
+		assert.NoError(t, results.Close())
+		_, err = ds.Get(key)
+		assert.NoError(t, err)
+		if disableReadCache {
+			assert.Equal(t, 0, len(ds.cache))
+		} else {
+			assert.Equal(t, 1, len(ds.cache))
+		}
+		assert.NoError(t, ds.Close())
+	}
+}
+
+func TestFilterBySize(t *testing.T) {
+	os.Remove("filtersize.zcar")
+	defer os.Remove("filtersize.zcar")
+
+	ds, err := NewDatastore("filtersize.zcar")
+	assert.NoError(t, err)
+	sizes := make(map[cid.Cid]int)
+	for _, size := range []int{0, 10, 100, 1000, 10000} {
+		c, err := ds.PutData(bytes.Repeat([]byte("a"), size))
+		assert.NoError(t, err)
+		sizes[c] = size
+	}
+	assert.NoError(t, ds.Close())
+
+	ds, err = NewDatastore("filtersize.zcar")
+	assert.NoError(t, err)
+	defer ds.Close()
+	// one only in the cache, one deleted from the archive
+	pending, err := ds.PutData(bytes.Repeat([]byte("b"), 500))
+	assert.NoError(t, err)
+	sizes[pending] = 500
+	deleted := dag.NewRawNode(bytes.Repeat([]byte("a"), 1000)).Cid()
+	assert.NoError(t, ds.DeleteCid(deleted))
+	delete(sizes, deleted)
+
+	check := func(min, max int64) {
+		cids, err := ds.FilterBySize(min, max)
+		assert.NoError(t, err)
+		var expected int
+		for c, size := range sizes {
+			if int64(size) >= min && int64(size) <= max {
+				expected++
+				assert.Contains(t, cids, c)
+			}
+		}
+		assert.Equal(t, expected, len(cids))
+	}
+
+	check(0, 0)
+	check(0, 100)
+	check(10, 10)
+	check(101, 1000)
+	check(500, 1<<20)
+	check(0, 1<<20)
+	cids, err := ds.FilterBySize(20000, 1<<20)
+	assert.NoError(t, err)
+	assert.Empty(t, cids)
+}
@@ -0,0 +1,284 @@
+package zipcar
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"strings"
+
+	cid "github.com/ipfs/go-cid"
+)
+
+const (
+	localHeaderSignature    = 0x04034b50
+	dataDescriptorSignature = 0x08074b50
+	localHeaderLen          = 30
+	dataDescriptorLen       = 16 // including the optional signature
+)
+
+// RebuildReport describes the outcome of RebuildIndex().
+type RebuildReport struct {
+	// Recovered lists the CIDs of the blocks that were found intact and written to the rebuilt archive
+	Recovered []cid.Cid
+	// Unrecoverable lists the filenames of the entries that were found but couldn't be read, didn't have a CID
+	// filename, or whose data didn't match their CID
+	Unrecoverable []string
+}
+
+// RebuildIndex repairs the ZIP archive at `path` when its central directory is damaged but the entries
+// themselves are intact. Rather than reading the central directory, the file is scanned for the local file
+// header that precedes each entry and the data following it is read, checked against the CRC where one is
+// available and verified against the CID in its filename. The archive is then rewritten from scratch with only
+// the verified blocks and a fresh central directory. Where there are multiple entries for the same CID, the
+// last wins. Entry comments and the archive comment are only stored in the central directory so are not
+// recovered.
+//
+// The whole file is read into memory to do this, so it is not suitable for archives larger than available
+// memory.
+func RebuildIndex(path string) (*RebuildReport, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	report := RebuildReport{}
+	recovered := make(map[string][]byte)
+	sig := make([]byte, 4)
+	binary.LittleEndian.PutUint32(sig, localHeaderSignature)
+
+	for pos := 0; ; {
+		i := bytes.Index(buf[pos:], sig)
+		if i < 0 {
+			break
+		}
+		pos += i
+
+		name, data, end, ok := readLocalEntry(buf, pos)
+		if name == "" { // not a plausible local header, possibly a coincidental signature
+			pos++
+			continue
+		}
+		pos = end
+
+		cidStr, isCid := canonicalName(name)
+		if !ok || !isCid {
+			report.Unrecoverable = append(report.Unrecoverable, name)
+			continue
+		}
+		c, err := cid.Decode(cidStr)
+		if err != nil || !blockMatches(c, data) {
+			report.Unrecoverable = append(report.Unrecoverable, name)
+			continue
+		}
+		if _, ok := recovered[cidStr]; !ok {
+			report.Recovered = append(report.Recovered, c)
+		}
+		recovered[cidStr] = data
+	}
+
+	zipDs := ZipDatastore{
+		index:         make(map[string]*zip.File),
+		cache:         recovered,
+		entryComments: make(map[string]string),
+		path:          path,
+		modified:      true,
+		opts:          DefaultOptions(),
+	}
+	file, _, err := zipDs.rewrite()
+	if err != nil {
+		return nil, err
+	}
+	if err = file.Close(); err != nil {
+		return nil, err
+	}
+
+	return &report, nil
+}
+
+// readLocalEntry parses the local file header at `pos` in `buf` and reads the entry data following it. The
+// returned name is empty if no plausible header was found. Otherwise, `end` is the position just past the entry
+// and `ok` indicates whether the data could be read and passed its CRC check.
+func readLocalEntry(buf []byte, pos int) (name string, data []byte, end int, ok bool) {
+	if len(buf)-pos < localHeaderLen {
+		return "", nil, 0, false
+	}
+	hdr := buf[pos : pos+localHeaderLen]
+	flags := binary.LittleEndian.Uint16(hdr[6:])
+	method := binary.LittleEndian.Uint16(hdr[8:])
+	crc := binary.LittleEndian.Uint32(hdr[14:])
+	csize := int(binary.LittleEndian.Uint32(hdr[18:]))
+	nameLen := int(binary.LittleEndian.Uint16(hdr[26:]))
+	extraLen := int(binary.LittleEndian.Uint16(hdr[28:]))
+
+	start := pos + localHeaderLen + nameLen + extraLen
+	if nameLen == 0 || start > len(buf) || (method != zip.Store && method != zip.Deflate) {
+		return "", nil, 0, false
+	}
+	name = string(buf[pos+localHeaderLen : pos+localHeaderLen+nameLen])
+	end = start
+
+	descriptor := flags&0x8 != 0
+	if descriptor && method == zip.Store {
+		// the size of stored data is only recorded after it, find a data descriptor that fits
+		found := false
+		for i := start; i+dataDescriptorLen <= len(buf) && !found; i++ {
+			if binary.LittleEndian.Uint32(buf[i:]) == dataDescriptorSignature &&
+				int(binary.LittleEndian.Uint32(buf[i+8:])) == i-start &&
+				binary.LittleEndian.Uint32(buf[i+4:]) == crc32.ChecksumIEEE(buf[start:i]) {
+				csize, found = i-start, true
+			}
+		}
+		if !found {
+			return name, nil, start, false
+		}
+	}
+
+	if method == zip.Store || !descriptor {
+		if start+csize > len(buf) {
+			return name, nil, start, false
+		}
+		end = start + csize
+	}
+
+	if method == zip.Store {
+		data = buf[start:end]
+	} else {
+		// a bytes.Reader is an io.ByteReader so flate won't read past the end of the compressed stream, which
+		// tells us where the entry ends when the size is only recorded after it
+		br := bytes.NewReader(buf[start:])
+		if !descriptor {
+			br = bytes.NewReader(buf[start:end])
+		}
+		fr := flate.NewReader(br)
+		var err error
+		data, err = ioutil.ReadAll(fr)
+		fr.Close()
+		if err != nil {
+			return name, nil, start, false
+		}
+		if descriptor {
+			end = len(buf) - br.Len()
+		}
+	}
+
+	if descriptor {
+		// skip the data descriptor, which may or may not have a signature, and take the CRC from it
+		if end+4 <= len(buf) && binary.LittleEndian.Uint32(buf[end:]) == dataDescriptorSignature {
+			end += 4
+		}
+		if end+12 > len(buf) {
+			return name, nil, end, false
+		}
+		crc = binary.LittleEndian.Uint32(buf[end:])
+		end += 12
+	}
+
+	return name, data, end, crc32.ChecksumIEEE(data) == crc
+}
+
+// CorruptBlocksError is returned by Repair() if any blocks were found to be corrupt, as opposed to misnamed, so
+// couldn't be repaired.
+type CorruptBlocksError struct {
+	// Cids lists the CIDs of the corrupt blocks, in the same order as Query() produces them
+	Cids []cid.Cid
+}
+
+func (e *CorruptBlocksError) Error() string {
+	names := make([]string, len(e.Cids))
+	for i, c := range e.Cids {
+		names[i] = c.String()
+	}
+	return "zipcar: blocks are corrupt: " + strings.Join(names, ", ")
+}
+
+// Repair finds blocks whose content doesn't match their CID, as Check() does, and where the content is intact,
+// having been read from the archive with a matching CRC-32 or having been Put() but not yet written, treats the
+// CID as wrong rather than the content: the block is moved to the CID computed from its content with the same
+// version, codec and hash function, keeping its entry comment, content type and any time set with Touch(). If a
+// block with the correct CID is already present, the misnamed one is simply deleted. The correct CIDs of the
+// misnamed blocks are returned. Blocks whose CRC-32 doesn't match are corrupt rather than misnamed and
+// are left as they are, and reported with a CorruptBlocksError once the others have been repaired. As a mutation
+// operation, repairing one or more blocks will trigger a full rewrite of the ZIP archive upon Close().
+func (zipDs *ZipDatastore) Repair() (fixed []cid.Cid, err error) {
+	zipDs.lock.Lock()
+	defer zipDs.lock.Unlock()
+
+	if zipDs.readOnly {
+		return nil, ErrReadOnly
+	}
+	names, err := zipDs.liveNames()
+	if err != nil {
+		return nil, err
+	}
+
+	var corrupt []cid.Cid
+	for _, name := range names {
+		c, err := cid.Decode(name)
+		if err != nil {
+			return fixed, err
+		}
+		// read with the CRC-32 verified regardless of Options.SkipCrcCheck
+		data := zipDs.cache[name]
+		if data == nil {
+			f, err := zipDs.lookup(name)
+			if err != nil {
+				return fixed, cidError(name, err)
+			}
+			data, err = zipDs.readFile(f)
+			if err == zip.ErrChecksum {
+				corrupt = append(corrupt, c)
+				continue
+			}
+			if err != nil {
+				return fixed, cidError(name, err)
+			}
+		}
+		if blockMatches(c, data) {
+			continue
+		}
+
+		correct, err := c.Prefix().Sum(data)
+		if err != nil {
+			corrupt = append(corrupt, c)
+			continue
+		}
+		comment, contentType := zipDs.entryComments[name], zipDs.contentTypes[name]
+		modTime, touched := zipDs.modTimes[name]
+		zipDs.remove(name)
+		zipDs.markModified()
+		added, err := zipDs.put(correct, data)
+		if err != nil {
+			return fixed, cidError(correct.String(), err)
+		}
+		if added {
+			correctStr := correct.String()
+			if comment != "" {
+				zipDs.entryComments[correctStr] = comment
+			}
+			if contentType != "" {
+				if zipDs.contentTypes == nil {
+					zipDs.contentTypes = make(map[string]string)
+				}
+				zipDs.contentTypes[correctStr] = contentType
+			}
+			if touched {
+				zipDs.modTimes[correctStr] = modTime
+			}
+		}
+		fixed = append(fixed, correct)
+	}
+
+	if len(corrupt) > 0 {
+		return fixed, &CorruptBlocksError{Cids: corrupt}
+	}
+	return fixed, nil
+}
+
+// blockMatches reports whether `data` hashes to the multihash of `c` using the hash function of `c`.
+func blockMatches(c cid.Cid, data []byte) bool {
+	sum, err := c.Prefix().Sum(data)
+	return err == nil && sum.Equals(c)
+}
@@ -0,0 +1,193 @@
+package zipcar
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	cid "github.com/ipfs/go-cid"
+)
+
+// reportBucketLimits are the upper bounds, in bytes, of the size histogram buckets of a Report.
+var reportBucketLimits = []int64{0, 64, 256, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, math.MaxInt64}
+
+// Report summarises the contents of a ZipDatastore, see Profile().
+type Report struct {
+	// Entries is the number of blocks
+	Entries int
+	// TotalBytes is the sum of the uncompressed sizes of the blocks
+	TotalBytes int64
+	// Sizes is a histogram of block sizes, with a fixed set of buckets in ascending order, including empty ones
+	Sizes []SizeBucket
+	// Codecs is the number of blocks with each codec, keyed by the codec of their CIDs (e.g. cid.Raw)
+	Codecs map[uint64]int
+}
+
+// SizeBucket is a bucket of the size histogram of a Report, counting the blocks whose size is greater than that
+// of the previous bucket, or zero for the first, and no greater than Max.
+type SizeBucket struct {
+	Max   int64
+	Count int
+}
+
+// CountByPrefix groups the blocks in the ZipDatastore by the first `n` characters of their filename, the
+// canonical string form of their CID, returning the number of blocks with each prefix, for choosing shard
+// boundaries. Filenames no longer than `n` are counted under the whole filename. As the leading characters of a
+// CID encode its version, codec and multihash function, `n` should extend past them to distinguish blocks by
+// hash, e.g. beyond "bafkrei" for CIDv1 raw sha2-256 blocks. Only the in-memory index is consulted, so this is
+// fast even for large archives. Blocks that have been Put() but not yet written to the archive are included.
+func (zipDs *ZipDatastore) CountByPrefix(n int) map[string]int {
+	zipDs.lock.Lock()
+	defer zipDs.lock.Unlock()
+
+	counts := make(map[string]int)
+	zipDs.eachName(func(name string) {
+		if len(name) > n {
+			name = name[:n]
+		}
+		counts[name]++
+	})
+	return counts
+}
+
+// HashFunctions returns the number of blocks in the ZipDatastore that were hashed with each multihash function,
+// keyed by multihash code (e.g. mh.SHA2_256), for spotting blocks that don't use the function expected of the
+// archive. Only the filenames are decoded, the blocks aren't read or verified. Blocks that have been Put() but
+// not yet written to the archive are included.
+func (zipDs *ZipDatastore) HashFunctions() (map[uint64]int, error) {
+	zipDs.lock.Lock()
+	defer zipDs.lock.Unlock()
+
+	counts := make(map[uint64]int)
+	var err error
+	zipDs.eachName(func(name string) {
+		if err != nil {
+			return
+		}
+		var c cid.Cid
+		if c, err = cid.Decode(name); err == nil {
+			counts[c.Prefix().MhType]++
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// ArchiveStat describes the archive of a ZipDatastore, see Stat().
+type ArchiveStat struct {
+	// Path is the path of the archive file, or empty if the ZipDatastore isn't backed by a file, such as one
+	// created with NewDatastoreFromReaderAt() or Clone()
+	Path string
+	// Size is the size of the archive in bytes, which for a file is its current size on disk, not including any
+	// pending mutations
+	Size int64
+	// ModTime is the modification time of the archive file, or the zero time if it isn't backed by a file
+	ModTime time.Time
+	// Entries is the number of blocks, including any pending mutations
+	Entries int
+	// Modified reports whether there are pending mutations, see IsModified()
+	Modified bool
+	// Comment is the archive comment, see Comment()
+	Comment string
+}
+
+// Stat summarises the archive of this ZipDatastore in a single call, for tooling such as an "info" command. Only
+// the in-memory index is consulted for the number of blocks, no entries are read, and for a file, only its
+// metadata is read.
+func (zipDs *ZipDatastore) Stat() (ArchiveStat, error) {
+	zipDs.lock.Lock()
+	defer zipDs.lock.Unlock()
+
+	stat := ArchiveStat{
+		Path:     zipDs.path,
+		Size:     zipDs.size,
+		Modified: zipDs.modified,
+		Comment:  zipDs.comment,
+	}
+	zipDs.eachName(func(string) {
+		stat.Entries++
+	})
+	if zipDs.path != "" {
+		fileinfo, err := os.Stat(zipDs.path)
+		if err != nil {
+			return ArchiveStat{}, err
+		}
+		stat.Size = fileinfo.Size()
+		stat.ModTime = fileinfo.ModTime()
+	}
+	return stat, nil
+}
+
+// Profile reports the number of blocks in the ZipDatastore, their total size, a histogram of their sizes and the
+// number with each codec. Only the entry headers and filenames are read, not the blocks themselves. Blocks that
+// have been Put() but not yet written to the archive are included.
+func (zipDs *ZipDatastore) Profile() (Report, error) {
+	zipDs.lock.Lock()
+	defer zipDs.lock.Unlock()
+
+	report := Report{Codecs: make(map[uint64]int)}
+	for _, max := range reportBucketLimits {
+		report.Sizes = append(report.Sizes, SizeBucket{Max: max})
+	}
+
+	err := zipDs.eachSize(func(cidStr string, size int64) error {
+		c, err := cid.Decode(cidStr)
+		if err != nil {
+			return err
+		}
+		report.Entries++
+		report.TotalBytes += size
+		report.Codecs[c.Type()]++
+		i := sort.Search(len(report.Sizes), func(i int) bool { return report.Sizes[i].Max >= size })
+		report.Sizes[i].Count++
+		return nil
+	})
+	if err != nil {
+		return Report{}, err
+	}
+
+	return report, nil
+}
+
+// String formats the Report as a multi-line summary, omitting empty histogram buckets.
+func (r Report) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "entries: %d\n", r.Entries)
+	fmt.Fprintf(&sb, "bytes: %d\n", r.TotalBytes)
+
+	sb.WriteString("sizes:\n")
+	for i, bucket := range r.Sizes {
+		if bucket.Count == 0 {
+			continue
+		}
+		switch {
+		case i == 0:
+			fmt.Fprintf(&sb, "  %d: %d\n", bucket.Max, bucket.Count)
+		case bucket.Max == math.MaxInt64:
+			fmt.Fprintf(&sb, "  > %d: %d\n", r.Sizes[i-1].Max, bucket.Count)
+		default:
+			fmt.Fprintf(&sb, "  <= %d: %d\n", bucket.Max, bucket.Count)
+		}
+	}
+
+	codecs := make([]uint64, 0, len(r.Codecs))
+	for codec := range r.Codecs {
+		codecs = append(codecs, codec)
+	}
+	sort.Slice(codecs, func(i, j int) bool { return codecs[i] < codecs[j] })
+	sb.WriteString("codecs:\n")
+	for _, codec := range codecs {
+		name, ok := cid.CodecToStr[codec]
+		if !ok {
+			name = fmt.Sprintf("0x%x", codec)
+		}
+		fmt.Fprintf(&sb, "  %s: %d\n", name, r.Codecs[codec])
+	}
+
+	return sb.String()
+}
@@ -0,0 +1,58 @@
+package zipcar
+
+import (
+	"archive/zip"
+	"io"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+)
+
+// WriteStream writes a ZIP archive of the blocks received from `blocks` to `w` as they arrive, finishing the
+// archive with its central directory once the channel is closed. Blocks are not retained after they are written,
+// so memory use is bounded by the number of blocks rather than their size; only the central directory entry and
+// CID of each block are held. Later blocks with the same CID as an earlier one, and blocks with identity CIDs, are
+// skipped. Entries are written in the same way as a rewrite of a ZipDatastore with DefaultOptions().
+//
+// If an error is returned, the remainder of the channel is not consumed, so a producer should also be able to
+// stop in that case.
+func WriteStream(w io.Writer, blocks <-chan blocks.Block) (err error) {
+	writer := zip.NewWriter(w)
+	defer func() {
+		ierr := writer.Close()
+		if err == nil {
+			err = ierr
+		}
+	}()
+
+	opts := DefaultOptions()
+	seen := make(map[string]struct{})
+	for block := range blocks {
+		if _, ok := identityData(block.Cid()); ok {
+			continue
+		}
+		cidStr, err := cidToString(block.Cid())
+		if err != nil {
+			return err
+		}
+		if _, ok := seen[*cidStr]; ok {
+			continue
+		}
+		seen[*cidStr] = struct{}{}
+
+		data := block.RawData()
+		method := zip.Deflate
+		if len(data) < opts.MinCompressSize {
+			method = zip.Store
+		}
+		f, err := writer.CreateHeader(&zip.FileHeader{Name: *cidStr, Method: method, Modified: time.Now()})
+		if err != nil {
+			return err
+		}
+		if _, err = f.Write(data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,136 @@
+package zipcar
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"strings"
+
+	cid "github.com/ipfs/go-cid"
+)
+
+// Validation selects how thoroughly a ZipDatastore checks that its entries are what they claim to be, see
+// Options.Validation.
+type Validation int
+
+const (
+	// ValidateNone trusts the archive and the caller: entries whose filenames aren't CIDs are ignored, unless
+	// Options.StrictZcar is set, and blocks are neither hashed when stored nor when read. This costs nothing
+	// beyond the CRC-32 check made as each block is read from the archive
+	ValidateNone Validation = iota
+	// ValidateKeys refuses to open an archive unless the filename of every entry is a CID, as Options.StrictZcar
+	// does. This costs nothing beyond reading the central directory, which is read regardless
+	ValidateKeys
+	// ValidateHashes hashes blocks to check that their content matches their CID: Put() and its variants reject a
+	// mismatched block with ErrHashMismatch, as do Get(), Query() and other reads for a block read from the
+	// archive. Each block is hashed once as it is stored or first read, blocks held in memory aren't hashed
+	// again. Hashing costs more than the CRC-32 check, in proportion to the size of the blocks, so this suits
+	// archives from untrusted sources
+	ValidateHashes
+	// ValidateStrict combines ValidateKeys and ValidateHashes and, further, hashes a block on every read, including
+	// those served from memory, guarding against blocks modified in memory by a caller that retained them with
+	// Options.CopyOnPut or Options.CopyOnGet unset. Every read pays the cost of hashing the block
+	ValidateStrict
+)
+
+// ErrHashMismatch is returned, wrapped in a CidError, for a block whose content doesn't match its CID with
+// Options.Validation set to ValidateHashes or ValidateStrict.
+var ErrHashMismatch = errors.New("zipcar: block content doesn't match its CID")
+
+// keys reports whether the filenames of an archive's entries must be CIDs.
+func (v Validation) keys() bool {
+	return v == ValidateKeys || v == ValidateStrict
+}
+
+// hashes reports whether blocks must be hashed as they are stored and read.
+func (v Validation) hashes() bool {
+	return v == ValidateHashes || v == ValidateStrict
+}
+
+// verifyBlock returns ErrHashMismatch if `data` doesn't match the CID with the string form `cidStr`.
+func verifyBlock(cidStr string, data []byte) error {
+	c, err := cid.Decode(cidStr)
+	if err != nil {
+		return err
+	}
+	if !blockMatches(c, data) {
+		return ErrHashMismatch
+	}
+	return nil
+}
+
+// ValidationError is returned by Validate() when an archive is not a valid .zcar, describing every problem found.
+type ValidationError struct {
+	// NotCids lists the filenames of entries that aren't CIDs, other than an integrity manifest
+	NotCids []string
+	// Mismatched lists the CIDs of the blocks whose content doesn't match their CID or their CRC-32
+	Mismatched []cid.Cid
+	// Unreadable lists the filenames of the blocks that couldn't be read, such as encrypted entries
+	Unreadable []string
+}
+
+func (e *ValidationError) Error() string {
+	var problems []string
+	if len(e.NotCids) > 0 {
+		problems = append(problems, fmt.Sprintf("entries that aren't CIDs: %s", strings.Join(e.NotCids, ", ")))
+	}
+	if len(e.Mismatched) > 0 {
+		cids := make([]string, len(e.Mismatched))
+		for i, c := range e.Mismatched {
+			cids[i] = c.String()
+		}
+		problems = append(problems, fmt.Sprintf("blocks that don't match their CIDs: %s", strings.Join(cids, ", ")))
+	}
+	if len(e.Unreadable) > 0 {
+		problems = append(problems, fmt.Sprintf("unreadable blocks: %s", strings.Join(e.Unreadable, ", ")))
+	}
+	return "zipcar: invalid archive: " + strings.Join(problems, "; ")
+}
+
+// Validate checks the ZIP archive at `path` without instantiating a ZipDatastore for it. The filename of every
+// entry must be a CID, other than an integrity manifest (see Options.WriteIntegrityManifest), and, if
+// `checkHashes` is set, every block is read and must match its CID and its CRC-32. A ValidationError listing
+// every problem is returned if the archive is not valid, other errors if it can't be read as a ZIP archive.
+func Validate(path string, checkHashes bool) error {
+	reader, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	zipDs := ZipDatastore{opts: DefaultOptions()} // for reading entries only
+	verr := ValidationError{}
+	for _, f := range reader.File {
+		cidStr, ok := canonicalName(f.Name)
+		if !ok {
+			if !reservedName(f.Name) {
+				verr.NotCids = append(verr.NotCids, f.Name)
+			}
+			continue
+		}
+		if !checkHashes {
+			continue
+		}
+		c, err := cid.Decode(cidStr)
+		if err != nil {
+			return err
+		}
+		data, err := zipDs.readFile(f)
+		if err == zip.ErrChecksum {
+			verr.Mismatched = append(verr.Mismatched, c)
+			continue
+		}
+		if err != nil {
+			verr.Unreadable = append(verr.Unreadable, f.Name)
+			continue
+		}
+		if !blockMatches(c, data) {
+			verr.Mismatched = append(verr.Mismatched, c)
+		}
+	}
+
+	if len(verr.NotCids) > 0 || len(verr.Mismatched) > 0 || len(verr.Unreadable) > 0 {
+		return &verr
+	}
+	return nil
+}
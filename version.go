@@ -0,0 +1,78 @@
+package zipcar
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// FormatVersionName is the filename of the entry written to the archive when Options.WriteFormatVersion is
+	// set. As it isn't a CID, the entry is not visible as a block.
+	FormatVersionName = "zipcar-version.txt"
+	// ZcarFormatVersion is the version of the .zcar format written by this implementation, see FormatVersion()
+	ZcarFormatVersion = "1"
+	// ImplementationName identifies this implementation in the entries written with Options.WriteFormatVersion
+	ImplementationName = "go-datastore-zipcar"
+)
+
+// ErrNoFormatVersion is returned by FormatVersion() when the archive doesn't record a format version.
+var ErrNoFormatVersion = errors.New("zipcar: archive has no format version")
+
+// formatVersionData returns the content of the format version entry. Each line holds a field name and its value,
+// separated by a space: the format version, then the name of the implementation that wrote the archive.
+func formatVersionData() []byte {
+	return []byte(fmt.Sprintf("format %s\nimplementation %s\n", ZcarFormatVersion, ImplementationName))
+}
+
+// reservedName reports whether `name` is the filename of an entry that this implementation writes to the archive
+// alongside the blocks, such as the integrity manifest or the archive metadata, so that it isn't treated as a
+// foreign entry.
+func reservedName(name string) bool {
+	return name == IntegrityManifestName || name == FormatVersionName || name == MetaName
+}
+
+// FormatVersion returns the .zcar format version recorded in the archive on disk when it was written with
+// Options.WriteFormatVersion set, which readers can compare with ZcarFormatVersion to warn about archives written
+// by a newer or incompatible implementation. Pending mutations that haven't been written to the archive yet are
+// not considered. ErrNoFormatVersion is returned if the archive records no format version.
+func (zipDs *ZipDatastore) FormatVersion() (string, error) {
+	zipDs.lock.Lock()
+	defer zipDs.lock.Unlock()
+
+	if zipDs.file == nil || zipDs.size == 0 {
+		return "", ErrNoFormatVersion
+	}
+	reader, err := zip.NewReader(zipDs.file, zipDs.size)
+	if err != nil {
+		return "", err
+	}
+	var entry *zip.File
+	for _, f := range reader.File {
+		if f.Name == FormatVersionName {
+			entry = f
+		}
+	}
+	if entry == nil {
+		return "", ErrNoFormatVersion
+	}
+	data, err := zipDs.readFile(entry)
+	if err != nil {
+		return "", err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "format" {
+			return fields[1], nil
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("zipcar: malformed format version entry %q", data)
+}
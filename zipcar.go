@@ -15,42 +15,185 @@ it has lots of tests!)
 Entries are stored with their stringified key/CID as the filename and the binary data as the file contents.
 Version 0 CIDs are converted to base58btc strings while version 1 CIDs are converted to base32 strings.
 
+Existing archives may contain entries added by other ZIP tools, such as with `zip foo.zcar <cid>` on the command
+line. Entries with CID filenames are available as blocks like any other. Entries whose filenames are not CIDs
+(e.g. a README) are ignored: they are not visible via Has(), Get() or Query() and are not carried over when
+the archive is rewritten.
+
 Calling any mutation operation, Put() or Delete(), will cause the ZIP archive to be written or rewritten when
-Close() is called. This may become expensive for large archives as the contents are stored in memory until the
-new file is written, so care should be taken.
+Close() or Sync() is called. This may become expensive for large archives as the contents are stored in memory
+until the new file is written, so care should be taken.
 */
 package zipcar
 
 import (
 	"archive/zip"
+	"bufio"
+	"compress/flate"
 	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	cid "github.com/ipfs/go-cid"
 	ds "github.com/ipfs/go-datastore"
-	dsq "github.com/ipfs/go-datastore/query"
 	dshelp "github.com/ipfs/go-ipfs-ds-help"
 	mbase "github.com/multiformats/go-multibase"
+	mh "github.com/multiformats/go-multihash"
 )
 
 var (
 	// ErrUnimplemented indicates that the method being called has not yet been implemented (but could, send a PR!)
 	ErrUnimplemented = errors.New("zipcar: unimplemented operation")
+
+	// ErrClosed indicates that the operation can't be performed because Close() has been called
+	ErrClosed = errors.New("zipcar: datastore is closed")
+
+	// ErrCommentTooLong indicates that a comment exceeds the 65535 byte limit imposed by the ZIP format
+	ErrCommentTooLong = errors.New("zipcar: comment exceeds 65535 bytes")
+
+	// ErrCodecNotAllowed indicates that a block can't be stored because the codec of its CID is not one of
+	// Options.AllowedCodecs
+	ErrCodecNotAllowed = errors.New("zipcar: codec not allowed")
+
+	// ErrReadOnly indicates that a mutation can't be performed because the ZipDatastore was opened read-only,
+	// see Options.Mmap and NewDatastoreFromReaderAt()
+	ErrReadOnly = errors.New("zipcar: datastore is read-only")
+
+	// ErrBlockTooLarge indicates that a block can't be stored because it exceeds Options.MaxBlockSize
+	ErrBlockTooLarge = errors.New("zipcar: block exceeds maximum size")
+
+	// ErrDeleted is returned in place of ds.ErrNotFound by Get() and GetSize() for a block that has been deleted
+	// since the archive was last written, when Options.DistinguishDeleted is set
+	ErrDeleted = errors.New("zipcar: block has been deleted")
+
+	// ErrEntryTooLarge indicates that an entry can't be read because the uncompressed size declared by the archive
+	// exceeds Options.MaxReadBytes
+	ErrEntryTooLarge = errors.New("zipcar: entry exceeds maximum read size")
+
+	// ErrInvalidRange indicates that GetRange() was called with a negative offset or length
+	ErrInvalidRange = errors.New("zipcar: invalid range")
 )
 
+// CidError is returned by the methods that operate on a single block when they fail for a reason other than the
+// block not being found, identifying the block in question. ds.ErrNotFound, and ErrDeleted, are always returned
+// unwrapped so that they can be compared directly, as the Datastore interface requires.
+type CidError struct {
+	// Cid is the string form of the CID of the block
+	Cid string
+	// Err is the underlying error
+	Err error
+}
+
+func (e *CidError) Error() string {
+	return e.Cid + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error so that CidErrors can be inspected with errors.Is() and errors.As().
+func (e *CidError) Unwrap() error {
+	return e.Err
+}
+
+// NotZcarError is returned when opening an archive with Options.StrictZcar set if it contains entries whose
+// filenames aren't CIDs.
+type NotZcarError struct {
+	// Names lists the filenames of the offending entries, in archive order
+	Names []string
+}
+
+func (e *NotZcarError) Error() string {
+	return "zipcar: archive has entries that aren't CIDs: " + strings.Join(e.Names, ", ")
+}
+
+// DuplicateNamesError is returned when opening an archive in which more than one entry holds the same block,
+// unless Options.DuplicatePolicy chooses between them.
+type DuplicateNamesError struct {
+	// Names lists the CIDs held by more than one entry, in canonical string form, sorted
+	Names []string
+}
+
+func (e *DuplicateNamesError) Error() string {
+	return "zipcar: archive has more than one entry for: " + strings.Join(e.Names, ", ")
+}
+
+// cidError wraps `err` in a CidError for the given CID string, unless it is nil, ds.ErrNotFound or ErrDeleted.
+func cidError(cidStr string, err error) error {
+	if err == nil || err == ds.ErrNotFound || err == ErrDeleted {
+		return err
+	}
+	return &CidError{Cid: cidStr, Err: err}
+}
+
 // ZipDatastore is an implementation of a Datastore (https://github.com/ipfs/go-datastore) that operates
-// on ZIP files.
+// on ZIP files. It is safe for concurrent use.
 type ZipDatastore struct {
-	index    map[string]*zip.File
-	cache    map[string][]byte
-	file     *os.File
-	comment  string
-	modified bool
+	index         map[string]*zip.File
+	files         []*zip.File         // the entries in index, in archive order
+	members       map[string]struct{} // in place of index when Options.CompactIndex is set
+	cache         map[string][]byte
+	entryComments map[string]string
+	contentTypes  map[string]string          // see SetContentType()
+	modTimes      map[string]time.Time       // set by Touch()
+	multihashes   map[string]string          // multihash -> filename of a live block, see resolve()
+	deleted       map[string]deletedBlock    // see Options.KeepTombstoneData
+	rawEntries    map[string]compressedEntry // stored entries read by rewrite(), see Options.RawCopy
+	added         map[string]struct{}        // blocks added since instantiation, see NewEntries()
+	filling       map[string]*fillCall       // see GetOrPut()
+	inflated      inflatedEntry              // see get()
+	file          ReaderAtCloser
+	backend       Backend // see NewDatastoreWithBackend()
+	mapped        []byte  // the memory mapped file, see Options.Mmap
+	readOnly      bool    // see Options.Mmap and NewDatastoreFromReaderAt()
+	size          int64
+	path          string
+	comment       string
+	meta          map[string]string // see SetMeta()
+	modified      bool
+	opts          Options
+	lock          sync.Mutex
+	closed        bool
+	flushStop     chan struct{}
+	flushDone     chan struct{}
+	flushErr      error
+	indexErr      error // see Options.LazyIndex
+	sizeEstimated bool  // entryCount and entriesSize are current, see estimatedSize()
+	entryCount    int64
+	entriesSize   int64
+	mutations     uint64 // incremented by markModified(), see Rewrite()
+	rewrites      uint64 // incremented by rewrite(), see Rewrite()
 }
 
 var _ ds.Datastore = (*ZipDatastore)(nil)
+var _ ds.GCDatastore = (*ZipDatastore)(nil)
+
+// ReaderAtCloser is the source of an existing archive, usually an *os.File, see Backend.
+type ReaderAtCloser interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// ComputeCid generates a CID for the provided bytes using the CidPrefix in the Options this ZipDatastore
+// was created with (CIDv1, raw codec, sha2-256 by default). The bytes are not stored.
+func (zipDs *ZipDatastore) ComputeCid(data []byte) (cid.Cid, error) {
+	return zipDs.opts.CidPrefix.Sum(data)
+}
+
+// PutData is a utility method that computes a CID for the provided bytes using ComputeCid() and stores them
+// with PutCid(). The computed CID is returned so the block can be retrieved later with GetCid().
+func (zipDs *ZipDatastore) PutData(data []byte) (cid.Cid, error) {
+	c, err := zipDs.ComputeCid(data)
+	if err != nil {
+		return cid.Undef, err
+	}
+	return c, zipDs.PutCid(c, data)
+}
 
 // PutCid is a utility method that calls Put() with the provided CID converted to a ds.Key.
 func (zipDs *ZipDatastore) PutCid(cid cid.Cid, value []byte) (err error) {
@@ -58,22 +201,192 @@ func (zipDs *ZipDatastore) PutCid(cid cid.Cid, value []byte) (err error) {
 }
 
 // Put stores the given key/value pair as a file in the underlying ZIP archive. `key` must be a string formatted CID.
+// Keys that don't decode to a CID are rejected with an error rather than stored, so the filename of every entry is
+// the string form of a CID, which is always a legal ZIP filename and never needs escaping.
+// A CID using the identity multihash function embeds its data, so is not stored, and Get(), Has() and GetSize()
+// always answer for such CIDs from the data they embed without consulting the archive.
+// A nil or empty `value` stores an empty block, which is retrieved as a zero-length, non-nil slice. Unless
+// Options.CopyOnPut is disabled, `value` is copied so the caller may reuse it afterwards.
+// ErrCodecNotAllowed is returned if Options.AllowedCodecs is set and doesn't include the codec of the CID, and
+// ErrBlockTooLarge if Options.MaxBlockSize is set and `value` exceeds it.
 // As a mutation operation, calling this method one or more times will trigger a full rewrite of the ZIP archive upon
 // Close().
 func (zipDs *ZipDatastore) Put(key ds.Key, value []byte) (err error) {
-	cidStr, err := dsKeyToCidString(key)
+	zipDs.lock.Lock()
+	defer zipDs.lock.Unlock()
+
+	c, err := zipDs.dsKeyToCid(key)
 	if err != nil {
 		return err
 	}
 
+	_, err = zipDs.put(c, value)
+	return cidError(c.String(), err)
+}
+
+// PutCidResult is a utility method that stores a block in the same way as PutCid() but also reports whether the
+// block was newly added (true) or was already present and therefore ignored (false).
+func (zipDs *ZipDatastore) PutCidResult(cid cid.Cid, value []byte) (added bool, err error) {
+	zipDs.lock.Lock()
+	defer zipDs.lock.Unlock()
+
+	added, err = zipDs.put(cid, value)
+	return added, cidError(cid.String(), err)
+}
+
+func (zipDs *ZipDatastore) put(c cid.Cid, value []byte) (bool, error) {
+	if zipDs.readOnly {
+		return false, ErrReadOnly
+	}
+	if len(zipDs.opts.AllowedCodecs) > 0 {
+		allowed := false
+		for _, codec := range zipDs.opts.AllowedCodecs {
+			allowed = allowed || codec == c.Type()
+		}
+		if !allowed {
+			return false, ErrCodecNotAllowed
+		}
+	}
+	if zipDs.opts.MaxBlockSize > 0 && len(value) > zipDs.opts.MaxBlockSize {
+		return false, ErrBlockTooLarge
+	}
+
+	if _, ok := identityData(c); ok { // the CID holds the data, there's nothing to store
+		return false, nil
+	}
+
+	cidStr, err := cidToString(c)
+	if err != nil {
+		return false, err
+	}
+	if validate := zipDs.opts.EntryNameValidator; validate != nil {
+		if err := validate(*cidStr); err != nil {
+			return false, err
+		}
+	}
+
 	if has, _ := zipDs.has(cidStr); has { // dupe, assume CID is correct and ignore
-		return nil
+		return false, nil
+	}
+	if zipDs.opts.Validation.hashes() && !blockMatches(c, value) {
+		return false, ErrHashMismatch
 	}
 
-	zipDs.modified = true
+	var estimate int64
+	if zipDs.opts.MaxArchiveBytes > 0 {
+		estimate = zipDs.entrySizeEstimate(*cidStr, int64(len(value)))
+		size, err := zipDs.estimatedSize(1, estimate)
+		if err != nil {
+			return false, err
+		}
+		if size > zipDs.opts.MaxArchiveBytes {
+			return false, ErrArchiveTooLarge
+		}
+	}
+
+	if value == nil || zipDs.opts.CopyOnPut {
+		// a nil entry in the cache means deleted, an empty block is stored as an empty slice
+		value = append([]byte{}, value...)
+	}
+
+	zipDs.markModified()
 	zipDs.cache[*cidStr] = value
+	if zipDs.added == nil {
+		zipDs.added = make(map[string]struct{})
+	}
+	zipDs.added[*cidStr] = struct{}{}
+	zipDs.multihashes = nil
+	if zipDs.sizeEstimated {
+		if estimate == 0 {
+			estimate = zipDs.entrySizeEstimate(*cidStr, int64(len(value)))
+		}
+		zipDs.entryCount++
+		zipDs.entriesSize += estimate
+	}
 
-	return nil
+	return true, nil
+}
+
+// fillCall is a call to the `fill` function of GetOrPut() in progress, which concurrent callers for the same CID
+// wait on rather than making their own.
+type fillCall struct {
+	done  chan struct{}
+	value []byte
+	err   error
+}
+
+// GetOrPut returns the block with the given CID if it is present, otherwise calls `fill` to produce it, stores it
+// as Put() would and returns it. Concurrent callers for the same CID that isn't present wait for a single call to
+// `fill` and share its result, including any error, so an expensive fetch is only made once. `fill` is called
+// without the ZipDatastore being locked, so other operations, including GetOrPut() for other CIDs, proceed while
+// it runs, and it may itself use the ZipDatastore. The errors of Put() are returned if the block can't be
+// stored, in which case it is not retained.
+func (zipDs *ZipDatastore) GetOrPut(c cid.Cid, fill func() ([]byte, error)) ([]byte, error) {
+	zipDs.lock.Lock()
+	if data, ok := identityData(c); ok {
+		zipDs.lock.Unlock()
+		return data, nil
+	}
+	cidStr, err := cidToString(c)
+	if err != nil {
+		zipDs.lock.Unlock()
+		return nil, err
+	}
+	value, err := zipDs.get(*zipDs.resolve(c, cidStr), !zipDs.opts.DisableReadCache)
+	if err != ds.ErrNotFound {
+		zipDs.lock.Unlock()
+		if err != nil {
+			return nil, cidError(*cidStr, err)
+		}
+		return zipDs.copyOnGet(value), nil
+	}
+
+	call, waiting := zipDs.filling[*cidStr]
+	if !waiting {
+		call = &fillCall{done: make(chan struct{})}
+		if zipDs.filling == nil {
+			zipDs.filling = make(map[string]*fillCall)
+		}
+		zipDs.filling[*cidStr] = call
+	}
+	zipDs.lock.Unlock()
+	if waiting {
+		<-call.done
+		return zipDs.copyOnGet(call.value), call.err
+	}
+
+	filled := false
+	defer func() {
+		if !filled { // fill() panicked, release the waiters before the panic continues
+			zipDs.lock.Lock()
+			delete(zipDs.filling, *cidStr)
+			zipDs.lock.Unlock()
+			call.err = errors.New("zipcar: GetOrPut fill function panicked")
+			close(call.done)
+		}
+	}()
+	call.value, call.err = fill()
+	filled = true
+	zipDs.lock.Lock()
+	if call.err == nil {
+		if _, err = zipDs.put(c, call.value); err != nil {
+			call.value, call.err = nil, cidError(*cidStr, err)
+		} else if stored := zipDs.cache[*cidStr]; stored != nil {
+			call.value = stored
+		}
+	}
+	delete(zipDs.filling, *cidStr)
+	zipDs.lock.Unlock()
+	close(call.done)
+	return zipDs.copyOnGet(call.value), call.err
+}
+
+// copyOnGet returns a copy of `value` if Options.CopyOnGet is set, otherwise `value` itself.
+func (zipDs *ZipDatastore) copyOnGet(value []byte) []byte {
+	if zipDs.opts.CopyOnGet && value != nil {
+		return append([]byte{}, value...)
+	}
+	return value
 }
 
 // GetCid is a utility method that calls Get() with the provided CID converted to a ds.Key.
@@ -82,49 +395,186 @@ func (zipDs *ZipDatastore) GetCid(cid cid.Cid) (value []byte, err error) {
 }
 
 // Get retrieves the given `key` if it exists in the underlying ZIP archive. A ds.ErrNotFound error is
-// returned if it is not found, otherwise the binary data is returned. `key` must be a string formatted CID.
+// returned if it is not found, or ErrDeleted if it was deleted and Options.DistinguishDeleted is set, otherwise the
+// binary data is returned. `key` must be a string formatted CID.
+// Unless Options.CopyOnGet is set, the returned slice may be the one held in memory for the block, which is also
+// what will be written to the archive, so it must not be modified.
 func (zipDs *ZipDatastore) Get(key ds.Key) (value []byte, err error) {
-	cidStr, err := dsKeyToCidString(key)
+	zipDs.lock.Lock()
+	defer zipDs.lock.Unlock()
+
+	c, err := zipDs.dsKeyToCid(key)
+	if err != nil {
+		return nil, err
+	}
+	if data, ok := identityData(c); ok {
+		return data, nil
+	}
+	cidStr, err := cidToString(c)
 	if err != nil {
 		return nil, err
 	}
 
-	if zipDs.cache[*cidStr] != nil {
-		return zipDs.cache[*cidStr], nil
+	value, err = zipDs.get(*zipDs.resolve(c, cidStr), !zipDs.opts.DisableReadCache)
+	if err == ds.ErrNotFound {
+		return nil, zipDs.notFound(*cidStr)
+	}
+	if err != nil {
+		return nil, cidError(*cidStr, err)
 	}
+	return zipDs.copyOnGet(value), nil
+}
 
-	f := zipDs.index[*cidStr]
-	if f == nil {
-		return nil, ds.ErrNotFound
+// GetRange returns up to `length` bytes of the block with the given CID, starting at `offset`, fewer if the block
+// ends first, and an empty slice if it ends before `offset`. The whole block is read, and decompressed, on the
+// first call for it, after which it is retained as Get() would retain it, or, with Options.DisableReadCache, held
+// until another compressed block is read, so that a series of range reads into the same large block decompress it
+// only once. Errors are returned as they are by Get(), and ErrInvalidRange for a negative `offset` or `length`.
+// Unless Options.CopyOnGet is set, the returned slice may share the memory held for the block, so it must not be
+// modified.
+func (zipDs *ZipDatastore) GetRange(c cid.Cid, offset, length int64) ([]byte, error) {
+	if offset < 0 || length < 0 {
+		return nil, ErrInvalidRange
+	}
+
+	zipDs.lock.Lock()
+	defer zipDs.lock.Unlock()
+
+	value, ok := identityData(c)
+	if !ok {
+		cidStr, err := cidToString(c)
+		if err != nil {
+			return nil, err
+		}
+		value, err = zipDs.get(*zipDs.resolve(c, cidStr), !zipDs.opts.DisableReadCache)
+		if err == ds.ErrNotFound {
+			return nil, zipDs.notFound(*cidStr)
+		}
+		if err != nil {
+			return nil, cidError(*cidStr, err)
+		}
+	}
+
+	if offset > int64(len(value)) {
+		offset = int64(len(value))
+	}
+	if length > int64(len(value))-offset {
+		length = int64(len(value)) - offset
+	}
+	return zipDs.copyOnGet(value[offset : offset+length : offset+length]), nil
+}
+
+// notFound returns the error for a block that isn't present: ErrDeleted if Options.DistinguishDeleted is set and
+// the block has been deleted since the archive was last written, otherwise ds.ErrNotFound.
+func (zipDs *ZipDatastore) notFound(cidStr string) error {
+	if value, ok := zipDs.cache[cidStr]; ok && value == nil && zipDs.opts.DistinguishDeleted {
+		return ErrDeleted
+	}
+	return ds.ErrNotFound
+}
+
+// isNotFound reports whether `err` indicates that a block isn't present, including ErrDeleted.
+func isNotFound(err error) bool {
+	return err == ds.ErrNotFound || err == ErrDeleted
+}
+
+// get returns the data for the entry with the given filename, from the cache if present, otherwise from the
+// archive, in which case it is retained in the cache if `retain` is set, or held as zipDs.inflated if it is
+// compressed and not retained. Blocks read from a memory mapped archive are never retained. Blocks are hashed as
+// Options.Validation requires.
+func (zipDs *ZipDatastore) get(cidStr string, retain bool) (_ []byte, err error) {
+	defer zipDs.recoverMalformed(&err)
+	if value := zipDs.cache[cidStr]; value != nil {
+		if zipDs.opts.Validation == ValidateStrict {
+			if err := verifyBlock(cidStr, value); err != nil {
+				return nil, err
+			}
+		}
+		return value, nil
 	}
 
-	rc, err := f.Open()
+	f, err := zipDs.lookup(cidStr)
 	if err != nil {
 		return nil, err
 	}
-	defer rc.Close()
+	if f == nil {
+		return nil, ds.ErrNotFound
+	}
+	if f.CompressedSize64 > uint64(zipDs.size) {
+		// the entry can't fit in the archive, so its sizes are corrupt
+		return nil, zip.ErrFormat
+	}
+	if zipDs.inflated.f == f {
+		if zipDs.opts.Validation == ValidateStrict {
+			if err := verifyBlock(cidStr, zipDs.inflated.data); err != nil {
+				return nil, err
+			}
+		}
+		return zipDs.inflated.data, nil
+	}
 
-	zipDs.cache[*cidStr], err = ioutil.ReadAll(rc)
+	var value []byte
+	mapped := zipDs.mapped != nil && f.Method == zip.Store && f.Flags&flagEncrypted == 0
+	switch {
+	case mapped:
+		value, err = zipDs.mappedData(f)
+	case zipDs.opts.SkipCrcCheck:
+		value, err = zipDs.readFileUnchecked(f)
+	default:
+		value, err = zipDs.readFile(f)
+	}
 	if err != nil {
 		return nil, err
 	}
+	if zipDs.opts.Validation.hashes() {
+		if err = verifyBlock(cidStr, value); err != nil {
+			return nil, err
+		}
+	}
+	if retain && !mapped {
+		zipDs.cache[cidStr] = value
+	} else if !mapped && f.Method == zip.Deflate {
+		zipDs.inflated = inflatedEntry{f, value}
+	}
+	return value, nil
+}
 
-	return zipDs.cache[*cidStr], nil
+// inflatedEntry holds the content of the last compressed entry that get() read from the archive without retaining
+// it in the cache, so that repeated reads of the same block, such as a series of GetRange() calls over a large
+// block with Options.DisableReadCache set, don't decompress it from the start each time. Only one block is held,
+// and it is only served for the same *zip.File, so it is never stale once the archive has been rewritten.
+type inflatedEntry struct {
+	f    *zip.File
+	data []byte
 }
 
 // Has returns a bool indicating whether the given key exists in the underlying ZIP archive.
 // `key` must be a string formatted CID.
 func (zipDs *ZipDatastore) Has(key ds.Key) (bool, error) {
-	cidStr, err := dsKeyToCidString(key)
+	zipDs.lock.Lock()
+	defer zipDs.lock.Unlock()
+
+	c, err := zipDs.dsKeyToCid(key)
+	if err != nil {
+		return false, err
+	}
+	if _, ok := identityData(c); ok {
+		return true, nil
+	}
+	cidStr, err := cidToString(c)
 	if err != nil {
 		return false, err
 	}
 
-	return zipDs.has(cidStr)
+	return zipDs.has(zipDs.resolve(c, cidStr))
 }
 
 func (zipDs *ZipDatastore) has(cidStr *string) (bool, error) {
-	return zipDs.cache[*cidStr] != nil || zipDs.index[*cidStr] != nil, nil
+	if zipDs.cache[*cidStr] != nil || zipDs.index[*cidStr] != nil {
+		return true, nil
+	}
+	_, ok := zipDs.members[*cidStr]
+	return ok, nil
 }
 
 // HasCid is a utility method that calls Has() with the provided CID converted to a ds.Key.
@@ -132,6 +582,82 @@ func (zipDs *ZipDatastore) HasCid(cid cid.Cid) (bool, error) {
 	return zipDs.Has(dshelp.CidToDsKey(cid))
 }
 
+// HasRaw reports whether the block with the provided CID is present, like HasCid() but without the round trip
+// through a ds.Key, which dominates the cost of existence checks in tight loops. The CID is converted to its
+// filename form once and looked up directly. As a CID can always be converted, no error is returned; false is
+// returned for an undefined CID.
+func (zipDs *ZipDatastore) HasRaw(cid cid.Cid) bool {
+	if !cid.Defined() {
+		return false
+	}
+	if _, ok := identityData(cid); ok {
+		return true
+	}
+	cidStr, err := cidToString(cid)
+	if err != nil {
+		return false
+	}
+
+	zipDs.lock.Lock()
+	defer zipDs.lock.Unlock()
+	has, _ := zipDs.has(zipDs.resolve(cid, cidStr))
+	return has
+}
+
+// eachName calls `fn` with the filename of each live block, in no particular order, from the in-memory index
+// alone.
+func (zipDs *ZipDatastore) eachName(fn func(name string)) {
+	for name, value := range zipDs.cache {
+		if value != nil {
+			fn(name)
+		}
+	}
+	for name, f := range zipDs.index {
+		if f != nil && zipDs.cache[name] == nil {
+			fn(name)
+		}
+	}
+	for name := range zipDs.members {
+		if zipDs.cache[name] == nil {
+			fn(name)
+		}
+	}
+}
+
+// resolve returns the filename of the block to read for the CID `c` with the filename `cidStr`. This is
+// `cidStr` itself unless Options.DedupByMultihash is set and there is no block for it, in which case it is the
+// filename of a block with the same multihash, if there is one. Where several blocks share the multihash, the
+// first filename in sort order is used so the choice is stable.
+func (zipDs *ZipDatastore) resolve(c cid.Cid, cidStr *string) *string {
+	if !zipDs.opts.DedupByMultihash {
+		return cidStr
+	}
+	if has, _ := zipDs.has(cidStr); has {
+		return cidStr
+	}
+
+	if zipDs.multihashes == nil {
+		// built on demand and discarded on mutation, so only lookups that miss pay for it
+		zipDs.multihashes = make(map[string]string)
+		add := func(name string) {
+			other, err := cid.Decode(name)
+			if err != nil {
+				return
+			}
+			key := string(other.Hash())
+			if existing, ok := zipDs.multihashes[key]; !ok || name < existing {
+				zipDs.multihashes[key] = name
+			}
+		}
+		zipDs.eachName(add)
+	}
+
+	if name, ok := zipDs.multihashes[string(c.Hash())]; ok {
+		return &name
+	}
+	return cidStr
+}
+
 // DeleteCid is a utility method that calls Delete() with the provided CID converted to a ds.Key.
 func (zipDs *ZipDatastore) DeleteCid(cid cid.Cid) error {
 	return zipDs.Delete(dshelp.CidToDsKey(cid))
@@ -140,12 +666,104 @@ func (zipDs *ZipDatastore) DeleteCid(cid cid.Cid) error {
 // Delete removes the given key's record from the ZIP archive. As a mutation operation, calling this method
 // one or more times will trigger a full rewrite of the ZIP archive upon Close().
 func (zipDs *ZipDatastore) Delete(key ds.Key) error {
-	cidStr, err := dsKeyToCidString(key)
+	zipDs.lock.Lock()
+	defer zipDs.lock.Unlock()
+
+	cidStr, err := zipDs.dsKeyToCidString(key)
+	if err != nil {
+		return err
+	}
+	if zipDs.readOnly {
+		return cidError(*cidStr, ErrReadOnly)
+	}
+	if has, _ := zipDs.has(cidStr); has {
+		if zipDs.opts.KeepTombstoneData {
+			block := deletedBlock{comment: zipDs.entryComments[*cidStr], contentType: zipDs.contentTypes[*cidStr]}
+			if block.data, err = zipDs.get(*cidStr, false); err != nil {
+				return cidError(*cidStr, err)
+			}
+			block.modTime, block.touched = zipDs.modTimes[*cidStr]
+			_, block.added = zipDs.added[*cidStr]
+			if zipDs.deleted == nil {
+				zipDs.deleted = make(map[string]deletedBlock)
+			}
+			zipDs.deleted[*cidStr] = block
+		}
+		zipDs.markModified()
+	}
+	zipDs.remove(*cidStr)
+	return nil
+}
+
+// remove marks the block with the given filename as deleted, along with its entry comment, content type and any
+// time set with Touch(), see Delete().
+func (zipDs *ZipDatastore) remove(cidStr string) {
+	zipDs.cache[cidStr] = nil
+	zipDs.index[cidStr] = nil
+	delete(zipDs.members, cidStr)
+	zipDs.multihashes = nil
+	zipDs.sizeEstimated = false
+	delete(zipDs.entryComments, cidStr)
+	delete(zipDs.contentTypes, cidStr)
+	delete(zipDs.modTimes, cidStr)
+	delete(zipDs.added, cidStr)
+}
+
+// deletedBlock is a block retained after Delete() so that it can be restored by Undelete(), see
+// Options.KeepTombstoneData.
+type deletedBlock struct {
+	data        []byte
+	comment     string
+	contentType string
+	modTime     time.Time
+	touched     bool // modTime was set by Touch()
+	added       bool // see NewEntries()
+}
+
+// Undelete restores a block removed by Delete(), along with its entry comment, content type and any time set with
+// Touch(), as if it had not been deleted. Options.KeepTombstoneData must be set for the block to have been
+// retained; a ds.ErrNotFound error is returned if it wasn't, or if no block with this CID has been deleted since
+// the ZipDatastore was instantiated. Undeleting a block that has since been Put() again has no effect. Deleted blocks
+// remain available to Undelete() after the archive is written, until Close().
+func (zipDs *ZipDatastore) Undelete(cid cid.Cid) error {
+	zipDs.lock.Lock()
+	defer zipDs.lock.Unlock()
+
+	cidStr, err := cidToString(cid)
 	if err != nil {
 		return err
 	}
-	zipDs.cache[*cidStr] = nil
-	zipDs.index[*cidStr] = nil
+	if zipDs.readOnly {
+		return cidError(*cidStr, ErrReadOnly)
+	}
+	block, ok := zipDs.deleted[*cidStr]
+	if !ok {
+		return ds.ErrNotFound
+	}
+	delete(zipDs.deleted, *cidStr)
+	if has, _ := zipDs.has(cidStr); has {
+		return nil
+	}
+
+	zipDs.cache[*cidStr] = block.data
+	if block.comment != "" {
+		zipDs.entryComments[*cidStr] = block.comment
+	}
+	if block.contentType != "" {
+		if zipDs.contentTypes == nil {
+			zipDs.contentTypes = make(map[string]string)
+		}
+		zipDs.contentTypes[*cidStr] = block.contentType
+	}
+	if block.touched {
+		zipDs.modTimes[*cidStr] = block.modTime
+	}
+	if block.added {
+		zipDs.added[*cidStr] = struct{}{}
+	}
+	zipDs.multihashes = nil
+	zipDs.sizeEstimated = false
+	zipDs.markModified()
 	return nil
 }
 
@@ -155,82 +773,812 @@ func (zipDs *ZipDatastore) GetSizeCid(cid cid.Cid) (int, error) {
 }
 
 // GetSize returns the size of the binary data for the given key, where the size is the number of bytes.
-// A ds.ErrNotFound error is returned if it is not found. `key` must be a string formatted CID.
+// A ds.ErrNotFound error is returned if it is not found, or ErrDeleted if it was deleted and
+// Options.DistinguishDeleted is set. `key` must be a string formatted CID.
 func (zipDs *ZipDatastore) GetSize(key ds.Key) (int, error) {
-	cidStr, err := dsKeyToCidString(key)
+	zipDs.lock.Lock()
+	defer zipDs.lock.Unlock()
+
+	c, err := zipDs.dsKeyToCid(key)
+	if err != nil {
+		return 0, err
+	}
+	if data, ok := identityData(c); ok {
+		return len(data), nil
+	}
+	cidStr, err := cidToString(c)
 	if err != nil {
 		return 0, err
 	}
 
+	cidStr = zipDs.resolve(c, cidStr)
 	if zipDs.cache[*cidStr] != nil {
 		return len(zipDs.cache[*cidStr]), nil
 	}
 
-	f := zipDs.index[*cidStr]
+	f, err := zipDs.lookup(*cidStr)
+	if err != nil {
+		return 0, cidError(*cidStr, err)
+	}
 	if f == nil {
-		return 0, ds.ErrNotFound
+		return 0, zipDs.notFound(*cidStr)
 	}
 
 	return int(f.FileInfo().Size()), nil
 }
 
+// MethodNotWritten is the compression method reported by SizeInfo() for blocks that have been Put() but not yet
+// written to the archive.
+const MethodNotWritten uint16 = 0xffff
+
+// SizeInfo returns the size of the block with the given CID as stored in the archive, both `uncompressed` and
+// `compressed`, along with the ZIP compression `method` of its entry (zip.Store or zip.Deflate for archives
+// written by this package), all from the entry header without reading the block. For blocks that have only been
+// Put() and not yet written to the archive, both sizes are the length of the block and `method` is
+// MethodNotWritten. A ds.ErrNotFound error is returned if the block is not found.
+func (zipDs *ZipDatastore) SizeInfo(cid cid.Cid) (uncompressed int64, compressed int64, method uint16, err error) {
+	zipDs.lock.Lock()
+	defer zipDs.lock.Unlock()
+
+	cidStr, err := cidToString(cid)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	f, err := zipDs.lookup(*cidStr)
+	if err != nil {
+		return 0, 0, 0, cidError(*cidStr, err)
+	}
+	if f != nil {
+		return int64(f.UncompressedSize64), int64(f.CompressedSize64), f.Method, nil
+	}
+	if zipDs.cache[*cidStr] != nil {
+		size := int64(len(zipDs.cache[*cidStr]))
+		return size, size, MethodNotWritten, nil
+	}
+	return 0, 0, 0, ds.ErrNotFound
+}
+
+// EntryLocations returns the offset in the archive at which the data of the entry for each block begins, for
+// building external indexes or for tools that seek directly into the file for a given CID. The data is
+// compressed if the entry's method is zip.Deflate, see SizeInfo(). Only blocks that have been written to the
+// archive on disk are included, those that have only been Put() since it was last written are absent, as are
+// deleted blocks. Only entry headers are read, not block data.
+func (zipDs *ZipDatastore) EntryLocations() (map[cid.Cid]int64, error) {
+	zipDs.lock.Lock()
+	defer zipDs.lock.Unlock()
+
+	index, err := zipDs.archiveIndex()
+	if err != nil {
+		return nil, err
+	}
+	locations := make(map[cid.Cid]int64, len(index))
+	for cidStr, f := range index {
+		if f == nil { // deleted
+			continue
+		}
+		c, err := cid.Decode(cidStr)
+		if err != nil {
+			return nil, err
+		}
+		offset, err := f.DataOffset()
+		if err != nil {
+			return nil, cidError(cidStr, err)
+		}
+		locations[c] = offset
+	}
+	return locations, nil
+}
+
 // Comment retrieves the archive comment, if one was set
 func (zipDs *ZipDatastore) Comment() string {
+	zipDs.lock.Lock()
+	defer zipDs.lock.Unlock()
+
 	return zipDs.comment
 }
 
 // SetComment sets the archive comment. As a mutation operation, calling this method
-// one or more times will trigger a full rewrite of the ZIP archive upon Close().
+// one or more times will trigger a full rewrite of the ZIP archive upon Close(). It has no effect if the
+// ZipDatastore is read-only.
 func (zipDs *ZipDatastore) SetComment(comment string) {
+	zipDs.lock.Lock()
+	defer zipDs.lock.Unlock()
+
+	if zipDs.readOnly {
+		return
+	}
+
 	zipDs.comment = comment
-	zipDs.modified = true
+	zipDs.markModified()
 }
 
-// Query is not implemented, it will always return an error when called
-func (zipDs *ZipDatastore) Query(q dsq.Query) (dsq.Results, error) {
-	return nil, ErrUnimplemented
-}
+// EntryComment retrieves the comment attached to the ZIP file entry for the given CID, if one was set.
+// A ds.ErrNotFound error is returned if the CID is not in the archive.
+func (zipDs *ZipDatastore) EntryComment(cid cid.Cid) (string, error) {
+	zipDs.lock.Lock()
+	defer zipDs.lock.Unlock()
 
-// Close should be called after ZipDatastore is no longer needed in order to ensure a
-// properly formatted ZIP archive.
-func (zipDs *ZipDatastore) Close() (err error) {
-	if zipDs.modified {
-		// load everything into cache that's not already so we can write it out again
-		for cidStr, f := range zipDs.index {
-			if f == nil { // deleted
-				continue
-			}
-			if zipDs.cache[cidStr] == nil {
-				rc, err := f.Open()
-				if err != nil {
-					return err
-				}
-				zipDs.cache[cidStr], err = ioutil.ReadAll(rc)
-				rc.Close()
-			}
-		}
+	cidStr, err := cidToString(cid)
+	if err != nil {
+		return "", err
 	}
 
-	err = zipDs.file.Close()
+	if has, _ := zipDs.has(cidStr); !has {
+		return "", ds.ErrNotFound
+	}
 
-	if err != nil || !zipDs.modified {
-		// if it wasn't modified, no need for the rewrite below
-		return err
+	return zipDs.entryComments[*cidStr], nil
+}
+
+// SetEntryComment attaches a comment to the ZIP file entry for the given CID, useful for small annotations
+// such as a human readable label or a source URL. A ds.ErrNotFound error is returned if the CID is not in the
+// archive and ErrCommentTooLong is returned if the comment is longer than the ZIP format allows. As a mutation
+// operation, calling this method one or more times will trigger a full rewrite of the ZIP archive upon Close().
+func (zipDs *ZipDatastore) SetEntryComment(cid cid.Cid, comment string) error {
+	zipDs.lock.Lock()
+	defer zipDs.lock.Unlock()
+
+	if zipDs.readOnly {
+		return ErrReadOnly
+	}
+	if len(comment) > 0xffff {
+		return ErrCommentTooLong
 	}
 
-	// write the file from scratch, truncate if it exists
-	zipDs.file, err = os.OpenFile(zipDs.file.Name(), os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
+	cidStr, err := cidToString(cid)
 	if err != nil {
 		return err
 	}
-	defer func() {
-		ierr := zipDs.file.Close()
-		if err == nil {
-			err = ierr
+
+	if has, _ := zipDs.has(cidStr); !has {
+		return ds.ErrNotFound
+	}
+
+	zipDs.entryComments[*cidStr] = comment
+	zipDs.sizeEstimated = false
+	zipDs.markModified()
+	return nil
+}
+
+// Touch sets the modified time recorded in the ZIP file entry for the given CID when the archive is next
+// written, without changing its data. Entries that aren't touched are written with the time of the rewrite. A
+// ds.ErrNotFound error is returned if the CID is not in the archive. As a mutation operation, calling this method
+// one or more times will trigger a full rewrite of the ZIP archive upon Close().
+func (zipDs *ZipDatastore) Touch(cid cid.Cid, t time.Time) error {
+	zipDs.lock.Lock()
+	defer zipDs.lock.Unlock()
+
+	if zipDs.readOnly {
+		return ErrReadOnly
+	}
+
+	cidStr, err := cidToString(cid)
+	if err != nil {
+		return err
+	}
+
+	if has, _ := zipDs.has(cidStr); !has {
+		return ds.ErrNotFound
+	}
+
+	zipDs.modTimes[*cidStr] = t
+	zipDs.markModified()
+	return nil
+}
+
+// Clone returns a new ZipDatastore holding a copy of all of the live entries and the archive comment of this
+// ZipDatastore. The clone is held entirely in memory and is not backed by a file, so calling Close() on it will
+// not write anything. Block data is copied so that mutations to one will not be visible in the other.
+func (zipDs *ZipDatastore) Clone() (*ZipDatastore, error) {
+	zipDs.lock.Lock()
+	defer zipDs.lock.Unlock()
+
+	var clone = ZipDatastore{comment: zipDs.comment, opts: zipDs.opts}
+
+	clone.index = make(map[string]*zip.File)
+	clone.cache = make(map[string][]byte)
+	clone.entryComments = make(map[string]string)
+	clone.modTimes = make(map[string]time.Time)
+
+	for cidStr, comment := range zipDs.entryComments {
+		clone.entryComments[cidStr] = comment
+	}
+	clone.contentTypes = make(map[string]string, len(zipDs.contentTypes))
+	for cidStr, contentType := range zipDs.contentTypes {
+		clone.contentTypes[cidStr] = contentType
+	}
+	for cidStr, t := range zipDs.modTimes {
+		clone.modTimes[cidStr] = t
+	}
+	clone.meta = make(map[string]string, len(zipDs.meta))
+	for key, value := range zipDs.meta {
+		clone.meta[key] = value
+	}
+
+	index, err := zipDs.archiveIndex()
+	if err != nil {
+		return nil, err
+	}
+	for cidStr, f := range index {
+		if f == nil || zipDs.cache[cidStr] != nil { // deleted, or cached and copied below
+			continue
+		}
+		bytes, err := zipDs.readFile(f)
+		if err != nil {
+			return nil, err
+		}
+		clone.cache[cidStr] = bytes
+	}
+
+	for cidStr, bytes := range zipDs.cache {
+		if bytes == nil { // deleted
+			continue
+		}
+		clone.cache[cidStr] = make([]byte, len(bytes))
+		copy(clone.cache[cidStr], bytes)
+	}
+
+	return &clone, nil
+}
+
+// Sync writes any pending mutations to the ZIP archive on disk without closing the ZipDatastore, so it can
+// continue to be used afterward. As with Close(), this involves a full rewrite of the ZIP archive and is a
+// no-op if there are no pending mutations. ErrClosed is returned if Close() has been called.
+func (zipDs *ZipDatastore) Sync() error {
+	zipDs.lock.Lock()
+	defer zipDs.lock.Unlock()
+
+	if zipDs.closed {
+		return ErrClosed
+	}
+	return zipDs.sync()
+}
+
+func (zipDs *ZipDatastore) sync() error {
+	if !zipDs.modified || zipDs.inMemory() {
+		return nil
+	}
+
+	// on failure below, the cache still holds every entry, so leaving this modified allows a later Sync() or
+	// Close() to retry
+	file, size, err := zipDs.rewrite()
+	if err != nil {
+		return err
+	}
+
+	// everything is on disk now, start afresh from the new archive
+	if err = zipDs.loadIndex(file, size); err != nil {
+		file.Close()
+		return err
+	}
+	zipDs.log().Debugf("zipcar: dropped %d blocks held in memory now that they are in the archive", len(zipDs.cache))
+	zipDs.cache = make(map[string][]byte)
+	zipDs.rawEntries = nil
+	zipDs.modified = false
+
+	return nil
+}
+
+// markModified records a mutation that will trigger a rewrite of the archive.
+func (zipDs *ZipDatastore) markModified() {
+	zipDs.modified = true
+	zipDs.mutations++
+}
+
+// Rewrite writes any pending mutations to the ZIP archive on disk, as Sync() does, but without blocking other
+// operations while the new archive is written, for processes that serve reads while periodically persisting
+// mutations. The new archive is written to a temporary file alongside the existing one from a snapshot of the
+// contents, reading the blocks of the existing archive as it goes, while other operations proceed against the
+// existing archive. It is then renamed into place, and the index switched to it, in a single step, so that
+// operations see either the old archive or the new one, never one partially written. Blocks pending in memory are
+// held by the snapshot until the switch.
+//
+// If the ZipDatastore is mutated, or the archive written by another Sync(), Rewrite() or Compact(), while the new
+// archive is being written, it no longer reflects the contents and is discarded, and any mutations are written by
+// Sync() instead, blocking other operations as it does. The same applies to a ZipDatastore created with
+// NewDatastoreWithBackend(), which has no path to rename into. ErrClosed is returned if Close() has been called,
+// including while the new archive was being written, in which case Close() has written the mutations.
+func (zipDs *ZipDatastore) Rewrite() error {
+	zipDs.lock.Lock()
+	if zipDs.closed {
+		zipDs.lock.Unlock()
+		return ErrClosed
+	}
+	if !zipDs.modified || zipDs.path == "" {
+		defer zipDs.lock.Unlock()
+		return zipDs.sync()
+	}
+	snapshot, index, extras, err := zipDs.snapshot()
+	mutations, rewrites, path := zipDs.mutations, zipDs.rewrites, zipDs.path
+	zipDs.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	file, err := snapshot.writeTemp(path, index, extras)
+
+	zipDs.lock.Lock()
+	defer zipDs.lock.Unlock()
+	if zipDs.closed || zipDs.mutations != mutations || zipDs.rewrites != rewrites {
+		if file != nil {
+			file.Close()
+			os.Remove(file.Name())
+		}
+		if zipDs.closed {
+			return ErrClosed
+		}
+		return zipDs.sync()
+	}
+	if err != nil {
+		return err
+	}
+	return zipDs.swap(file)
+}
+
+// snapshot returns a ZipDatastore holding copies of the state that writeArchive() uses, along with the index and
+// extra entries of the archive, so that the archive can be written without holding the lock while zipDs remains
+// in use, see Rewrite(). Blocks are shared with the cache rather than copied as they're never modified in place.
+func (zipDs *ZipDatastore) snapshot() (*ZipDatastore, map[string]*zip.File, []extraEntry, error) {
+	archiveIndex, err := zipDs.archiveIndex()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	extras, err := zipDs.extraEntries()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	snapshot := &ZipDatastore{
+		cache:         make(map[string][]byte),
+		entryComments: make(map[string]string, len(zipDs.entryComments)),
+		contentTypes:  make(map[string]string, len(zipDs.contentTypes)),
+		modTimes:      make(map[string]time.Time, len(zipDs.modTimes)),
+		rawEntries:    make(map[string]compressedEntry, len(zipDs.rawEntries)),
+		file:          zipDs.file,
+		size:          zipDs.size,
+		comment:       zipDs.comment,
+		meta:          make(map[string]string, len(zipDs.meta)),
+		opts:          zipDs.opts,
+	}
+	for cidStr, bytes := range zipDs.cache {
+		if bytes != nil { // not deleted
+			snapshot.cache[cidStr] = bytes
+		}
+	}
+	for cidStr, comment := range zipDs.entryComments {
+		snapshot.entryComments[cidStr] = comment
+	}
+	for cidStr, contentType := range zipDs.contentTypes {
+		snapshot.contentTypes[cidStr] = contentType
+	}
+	for cidStr, t := range zipDs.modTimes {
+		snapshot.modTimes[cidStr] = t
+	}
+	for key, value := range zipDs.meta {
+		snapshot.meta[key] = value
+	}
+	for cidStr, entry := range zipDs.rawEntries {
+		snapshot.rawEntries[cidStr] = entry
+	}
+	index := make(map[string]*zip.File, len(archiveIndex))
+	for cidStr, f := range archiveIndex {
+		if f != nil && snapshot.cache[cidStr] == nil { // not deleted, and not superseded by the cache
+			index[cidStr] = f
+		}
+	}
+	return snapshot, index, extras, nil
+}
+
+// writeTemp writes the archive to a new temporary file in the same directory as `path`, with the permissions of
+// the file at `path`, returning it open. The file is removed if writing fails.
+func (zipDs *ZipDatastore) writeTemp(path string, index map[string]*zip.File, extras []extraEntry) (
+	file *os.File, err error) {
+	fileinfo, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	file, err = ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			file.Close()
+			os.Remove(file.Name())
+			file = nil
 		}
 	}()
 
-	writer := zip.NewWriter(zipDs.file)
+	if err = file.Chmod(fileinfo.Mode().Perm()); err != nil {
+		return nil, err
+	}
+	if err = zipDs.writeBuffered(file, index, extras); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// swap renames the archive written by writeTemp() into place at zipDs.path and loads it in place of the existing
+// archive, whose file is closed, see Rewrite(). The new archive is read before it is renamed, so that a malformed
+// one is discarded rather than replacing the existing archive.
+func (zipDs *ZipDatastore) swap(file *os.File) error {
+	fileinfo, err := file.Stat()
+	if err == nil {
+		_, err = zip.NewReader(file, fileinfo.Size())
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), zipDs.path)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+
+	previous := zipDs.file
+	if err = zipDs.loadIndex(file, fileinfo.Size()); err != nil {
+		file.Close()
+		return err
+	}
+	zipDs.cache = make(map[string][]byte)
+	zipDs.rawEntries = nil
+	zipDs.modified = false
+	zipDs.rewrites++
+	if previous != nil {
+		return previous.Close()
+	}
+	return nil
+}
+
+// Compact rewrites the ZIP archive on disk even if there are no pending mutations, dropping deleted blocks along
+// with entries that aren't visible through the ZipDatastore, such as those superseded by a later entry for the
+// same CID or whose filenames aren't CIDs. The number of bytes by which the archive shrank is returned, which is
+// negative if pending additions made it grow. ErrClosed is returned if Close() has been called, and ErrReadOnly
+// if the ZipDatastore is read-only.
+func (zipDs *ZipDatastore) Compact() (int64, error) {
+	zipDs.lock.Lock()
+	defer zipDs.lock.Unlock()
+
+	if zipDs.closed {
+		return 0, ErrClosed
+	}
+	if zipDs.readOnly {
+		return 0, ErrReadOnly
+	}
+	if zipDs.inMemory() {
+		return 0, nil
+	}
+
+	before := zipDs.size
+	zipDs.markModified()
+	if err := zipDs.sync(); err != nil {
+		return 0, err
+	}
+	return before - zipDs.size, nil
+}
+
+// CollectGarbage implements ds.GCDatastore by calling Compact().
+func (zipDs *ZipDatastore) CollectGarbage() error {
+	_, err := zipDs.Compact()
+	return err
+}
+
+// StartAutoFlush starts a background goroutine that calls Sync() every `interval` so that mutations are
+// periodically persisted without needing to Close(). Any previously started auto-flush is stopped first. Errors
+// encountered in the background are retained and returned by StopAutoFlush() or Close(). Close() stops the
+// auto-flush and performs a final write.
+func (zipDs *ZipDatastore) StartAutoFlush(interval time.Duration) error {
+	if interval <= 0 {
+		return errors.New("zipcar: auto-flush interval must be greater than zero")
+	}
+
+	for {
+		zipDs.lock.Lock()
+		if zipDs.closed {
+			zipDs.lock.Unlock()
+			return ErrClosed
+		}
+		if zipDs.flushStop == nil {
+			stop := make(chan struct{})
+			done := make(chan struct{})
+			zipDs.flushStop, zipDs.flushDone = stop, done
+			zipDs.log().Infof("zipcar: starting auto-flush of %q every %v", zipDs.path, interval)
+			zipDs.lock.Unlock()
+			go zipDs.autoFlush(interval, stop, done)
+			return nil
+		}
+		// stop the existing auto-flush outside of the lock as it may be waiting on it to Sync(), then check
+		// again in case another caller has started one in the meantime
+		stop, done := zipDs.flushStop, zipDs.flushDone
+		zipDs.flushStop, zipDs.flushDone = nil, nil
+		zipDs.lock.Unlock()
+		close(stop)
+		<-done
+	}
+}
+
+func (zipDs *ZipDatastore) autoFlush(interval time.Duration, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			zipDs.lock.Lock()
+			zipDs.log().Debugf("zipcar: auto-flush of %q, modified: %v", zipDs.path, zipDs.modified)
+			if err := zipDs.sync(); err != nil {
+				zipDs.log().Warnf("zipcar: auto-flush of %q failed, will retry: %v", zipDs.path, err)
+				zipDs.flushErr = err
+			}
+			zipDs.lock.Unlock()
+		}
+	}
+}
+
+// StopAutoFlush stops a background auto-flush started with StartAutoFlush(), waiting for any in-progress
+// Sync() to complete. The last error encountered by the background goroutine, if any, is returned.
+func (zipDs *ZipDatastore) StopAutoFlush() error {
+	zipDs.lock.Lock()
+	stop, done := zipDs.flushStop, zipDs.flushDone
+	zipDs.flushStop, zipDs.flushDone = nil, nil
+	zipDs.lock.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+
+	zipDs.lock.Lock()
+	defer zipDs.lock.Unlock()
+
+	err := zipDs.flushErr
+	zipDs.flushErr = nil
+	return err
+}
+
+// Close should be called after ZipDatastore is no longer needed in order to ensure a
+// properly formatted ZIP archive. Any auto-flush is stopped first; if the final write succeeds but a
+// background flush had failed, the background error is returned.
+func (zipDs *ZipDatastore) Close() (err error) {
+	zipDs.lock.Lock()
+	zipDs.closed = true
+	zipDs.lock.Unlock()
+
+	// a failed background flush leaves the datastore modified, so the final write below retries it
+	flushErr := zipDs.StopAutoFlush()
+	defer func() {
+		if err == nil {
+			err = flushErr
+		}
+	}()
+
+	zipDs.lock.Lock()
+	defer zipDs.lock.Unlock()
+
+	zipDs.log().Infof("zipcar: closing archive %q, modified: %v", zipDs.path, zipDs.modified)
+	if zipDs.mapped != nil {
+		err = munmap(zipDs.mapped)
+		zipDs.mapped = nil
+		if err != nil {
+			return err
+		}
+	}
+
+	if !zipDs.modified || zipDs.inMemory() {
+		// if it wasn't modified, or it's in-memory only (see Clone()), no need for a rewrite
+		if zipDs.file == nil {
+			return nil
+		}
+		err = zipDs.file.Close()
+		zipDs.file = nil
+		return err
+	}
+
+	file, _, err := zipDs.rewrite()
+	if err != nil {
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	zipDs.rawEntries = nil
+	zipDs.modified = false
+	return nil
+}
+
+// inMemory reports whether this ZipDatastore has nowhere to write its archive, see Clone().
+func (zipDs *ZipDatastore) inMemory() bool {
+	return zipDs.path == "" && zipDs.backend == nil
+}
+
+// rewrite writes the full archive to zipDs.path, or through zipDs.backend, from scratch. Every live entry is
+// loaded into the cache first, or into zipDs.rawEntries with Options.RawCopy, so if the write fails, a later
+// rewrite can be attempted from memory alone. If zipDs.file is the open file at zipDs.path, it is truncated and
+// written in place on the same descriptor rather than closed and reopened, so there is no window in which the
+// path could be replaced by another file. On success the written archive is returned open for reading, along with
+// its size, for the caller to close or load; either way zipDs.file is left nil.
+func (zipDs *ZipDatastore) rewrite() (written ReaderAtCloser, size int64, err error) {
+	zipDs.rewrites++
+	start := time.Now()
+	blocks := 0
+	zipDs.eachName(func(string) { blocks++ })
+	zipDs.log().Debugf("zipcar: rewriting archive %q with %d blocks", zipDs.path, blocks)
+	defer func() {
+		if err != nil {
+			zipDs.log().Warnf("zipcar: rewrite of archive %q failed: %v", zipDs.path, err)
+		} else {
+			zipDs.log().Infof("zipcar: rewrote archive %q with %d blocks in %d bytes in %v", zipDs.path, blocks,
+				size, time.Since(start))
+		}
+	}()
+
+	// load everything into cache that's not already so we can write it out again
+	index, err := zipDs.archiveIndex()
+	if err != nil {
+		return nil, 0, err
+	}
+	for cidStr, f := range index {
+		if f == nil { // deleted
+			continue
+		}
+		if zipDs.cache[cidStr] != nil {
+			continue
+		}
+		if zipDs.opts.RawCopy && f.Flags&flagEncrypted == 0 {
+			// held as stored, with the header it was read with, see rawCopy()
+			if _, ok := zipDs.rawEntries[cidStr]; !ok {
+				data, err := readRaw(f)
+				if err != nil {
+					return nil, 0, err
+				}
+				if zipDs.rawEntries == nil {
+					zipDs.rawEntries = make(map[string]compressedEntry)
+				}
+				zipDs.rawEntries[cidStr] = compressedEntry{header: f.FileHeader, data: data}
+			}
+			continue
+		}
+		if zipDs.cache[cidStr], err = zipDs.readFile(f); err != nil {
+			return nil, 0, err
+		}
+	}
+	extras, err := zipDs.extraEntries()
+	if err != nil {
+		return nil, 0, err
+	}
+	if zipDs.backend != nil {
+		return zipDs.rewriteBackend(index, extras)
+	}
+
+	// write the file from scratch, truncating it if it exists
+	file, ok := zipDs.file.(*os.File)
+	if ok {
+		if err = file.Truncate(0); err == nil {
+			_, err = file.Seek(0, io.SeekStart)
+		}
+	} else {
+		if zipDs.file != nil {
+			if err = zipDs.file.Close(); err != nil {
+				zipDs.file = nil
+				return nil, 0, err
+			}
+		}
+		file, err = os.OpenFile(zipDs.path, os.O_TRUNC|os.O_CREATE|os.O_RDWR, 0644)
+	}
+	zipDs.file = nil
+	if err != nil {
+		if file != nil {
+			file.Close()
+		}
+		return nil, 0, err
+	}
+	defer func() {
+		if err != nil {
+			file.Close()
+		}
+	}()
+
+	if err = zipDs.writeBuffered(file, index, extras); err != nil {
+		return nil, 0, err
+	}
+	fileinfo, err := file.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	return file, fileinfo.Size(), nil
+}
+
+// rewriteBackend completes rewrite() for a ZipDatastore created with NewDatastoreWithBackend(): the current
+// archive is closed, the new one written with Backend.Create(), then opened again with Backend.Open().
+func (zipDs *ZipDatastore) rewriteBackend(index map[string]*zip.File, extras []extraEntry) (ReaderAtCloser, int64, error) {
+	if zipDs.file != nil {
+		err := zipDs.file.Close()
+		zipDs.file = nil
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	w, err := zipDs.backend.Create()
+	if err != nil {
+		return nil, 0, err
+	}
+	if err = zipDs.writeBuffered(w, index, extras); err != nil {
+		w.Close()
+		return nil, 0, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, 0, err
+	}
+	return zipDs.backend.Open()
+}
+
+// writeBuffered writes the full archive to `w` with writeArchive(), through a buffer of
+// Options.WriteBufferSize if set.
+func (zipDs *ZipDatastore) writeBuffered(w io.Writer, index map[string]*zip.File, extras []extraEntry) error {
+	if zipDs.opts.WriteBufferSize <= 0 {
+		return zipDs.writeArchive(w, index, extras, false)
+	}
+	// the ZIP writer only buffers a few KB itself, batch the many small writes of small blocks further
+	bw := bufio.NewWriterSize(w, zipDs.opts.WriteBufferSize)
+	if err := zipDs.writeArchive(bw, index, extras, false); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// extraEntry is an entry of an archive that isn't a block, carried through rewrites with Options.PreserveExtras.
+type extraEntry struct {
+	header zip.FileHeader
+	raw    []byte // the entry data as stored, i.e. still compressed and possibly encrypted
+}
+
+// extraEntries reads, if Options.PreserveExtras is set, the entries of the existing archive that aren't blocks,
+// other than an integrity manifest, with their raw data, in archive order. Of entries with identical filenames,
+// only the last is returned.
+func (zipDs *ZipDatastore) extraEntries() ([]extraEntry, error) {
+	if !zipDs.opts.PreserveExtras || zipDs.file == nil || zipDs.size == 0 {
+		return nil, nil
+	}
+	reader, err := zip.NewReader(zipDs.file, zipDs.size)
+	if err != nil {
+		return nil, err
+	}
+
+	last := make(map[string]*zip.File)
+	for _, f := range reader.File {
+		last[f.Name] = f
+	}
+	var extras []extraEntry
+	for _, f := range reader.File {
+		if _, ok := zipDs.entryName(f.Name); ok || reservedName(f.Name) || last[f.Name] != f {
+			continue
+		}
+		rc, err := f.OpenRaw()
+		if err != nil {
+			return nil, err
+		}
+		raw, err := ioutil.ReadAll(rc)
+		if err != nil {
+			return nil, err
+		}
+		extras = append(extras, extraEntry{header: f.FileHeader, raw: raw})
+	}
+	return extras, nil
+}
+
+// writeArchive writes a complete ZIP archive of the live entries, the `extras` and the archive comment to `w`.
+// Entries that aren't in the cache are read from `index`, the live entries of the existing archive, without being
+// added to the cache. `index` may be nil if all live entries are in the cache.
+//
+// With `canonical` set, the output depends only on the contents: entries are written in filename order,
+// uncompressed, and without modification times, see WriteCanonical().
+func (zipDs *ZipDatastore) writeArchive(w io.Writer, index map[string]*zip.File, extras []extraEntry,
+	canonical bool) (err error) {
+	writer := zip.NewWriter(w)
 	defer func() {
 		ierr := writer.Close()
 		if err == nil {
@@ -238,32 +1586,297 @@ func (zipDs *ZipDatastore) Close() (err error) {
 		}
 	}()
 
+	var names []string
 	for cidStr, bytes := range zipDs.cache {
-		if bytes == nil { // deleted
-			continue
+		if bytes != nil { // not deleted
+			names = append(names, cidStr)
+		}
+	}
+	for cidStr, f := range index {
+		if f != nil && zipDs.cache[cidStr] == nil { // not deleted, or cached and listed above
+			names = append(names, cidStr)
+		}
+	}
+	if canonical {
+		sort.Strings(names)
+	} else if zipDs.opts.SortEntries {
+		sort.Slice(names, func(i, j int) bool {
+			return zipDs.entryFilename(names[i]) < zipDs.entryFilename(names[j])
+		})
+	}
+
+	// entries are compressed in memory and written raw where the archive/zip streaming writer can't be used
+	raw := !canonical && (zipDs.opts.CompressWorkers > 1 || zipDs.opts.Compatibility == CompatMax)
+	var compressor *entryCompressor
+	writeEntry := func(fh zip.FileHeader, data []byte) error {
+		if raw {
+			if compressor == nil {
+				compressor = newEntryCompressor()
+			}
+			return writeRawEntry(writer, zipDs.rawEntry(fh, data, compressor))
+		}
+		f, err := writer.CreateHeader(&fh)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(data)
+		return err
+	}
+
+	if raw && zipDs.opts.CompressWorkers > 1 {
+		done := make(chan struct{})
+		defer close(done)
+		for result := range zipDs.compressEntries(names, index, done) {
+			if err = writeRawEntry(writer, <-result); err != nil {
+				return err
+			}
+		}
+	} else {
+		for _, cidStr := range names {
+			bytes := zipDs.cache[cidStr]
+			if bytes == nil && !canonical {
+				if entry, ok := zipDs.rawCopy(cidStr, index[cidStr]); ok {
+					if err = writeRawEntry(writer, entry); err != nil {
+						return err
+					}
+					continue
+				}
+			}
+			if bytes == nil {
+				if bytes, err = zipDs.readFile(index[cidStr]); err != nil {
+					return err
+				}
+			}
+			if err = writeEntry(zipDs.entryHeader(cidStr, bytes, canonical), bytes); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, extra := range extras {
+		header := extra.header
+		f, err := writer.CreateRaw(&header)
+		if err != nil {
+			return err
+		}
+		if _, err = f.Write(extra.raw); err != nil {
+			return err
+		}
+	}
+
+	if zipDs.opts.WriteIntegrityManifest {
+		data, err := manifestData(names)
+		if err != nil {
+			return err
+		}
+		if err = writeEntry(zip.FileHeader{Name: IntegrityManifestName, Method: zip.Deflate}, data); err != nil {
+			return err
 		}
-		fh := zip.FileHeader{Name: cidStr, Method: zip.Deflate, Modified: time.Now()}
-		f, err := writer.CreateHeader(&fh)
-		if err != nil {
+	}
+
+	if meta, err := zipDs.metaData(); err != nil {
+		return err
+	} else if meta != nil {
+		if err = writeEntry(zip.FileHeader{Name: MetaName, Method: zip.Deflate}, meta); err != nil {
 			return err
 		}
-		_, err = f.Write(bytes)
-		if err != nil {
+	}
+
+	if zipDs.opts.WriteFormatVersion {
+		if err = writeEntry(zip.FileHeader{Name: FormatVersionName, Method: zip.Deflate}, formatVersionData()); err != nil {
 			return err
 		}
 	}
 
-	writer.SetComment(zipDs.comment)
+	return writer.SetComment(zipDs.comment)
+}
 
-	return err
+// entryHeader returns the header for the entry of the block with the given filename and content, see
+// writeArchive().
+func (zipDs *ZipDatastore) entryHeader(cidStr string, bytes []byte, canonical bool) zip.FileHeader {
+	method := zip.Deflate
+	if len(bytes) < zipDs.opts.MinCompressSize || canonical {
+		method = zip.Store
+	}
+	modified, ok := zipDs.modTimes[cidStr]
+	if !ok && zipDs.opts.ModTime != nil {
+		modified = *zipDs.opts.ModTime
+	} else if !ok {
+		modified = time.Now()
+	}
+	if canonical {
+		modified = time.Time{}
+	}
+	fh := zip.FileHeader{
+		Name:     zipDs.entryFilename(cidStr),
+		Method:   method,
+		Modified: modified,
+		Comment:  zipDs.entryComments[cidStr],
+	}
+	if zipDs.opts.WriteVerificationHints {
+		if c, err := cid.Decode(cidStr); err == nil && blockMatches(c, bytes) {
+			fh.Extra = verificationHint(bytes)
+		}
+	}
+	if contentType := zipDs.contentTypes[cidStr]; contentType != "" {
+		fh.Extra = append(fh.Extra, contentTypeExtra(contentType)...)
+	}
+	return fh
+}
+
+// WriteTo writes a complete ZIP archive of the current contents of this ZipDatastore, including any pending
+// mutations, to `w`, exactly as a rewrite on Close() or Sync() would write it to the file. The ZipDatastore and
+// its file are not modified. The number of bytes written is returned.
+func (zipDs *ZipDatastore) WriteTo(w io.Writer) (int64, error) {
+	zipDs.lock.Lock()
+	defer zipDs.lock.Unlock()
+
+	index, err := zipDs.archiveIndex()
+	if err != nil {
+		return 0, err
+	}
+	extras, err := zipDs.extraEntries()
+	if err != nil {
+		return 0, err
+	}
+	cw := &countingWriter{w: w}
+	err = zipDs.writeArchive(cw, index, extras, false)
+	return cw.n, err
+}
+
+// WriteCanonical writes a ZIP archive of the current contents of this ZipDatastore, including any pending
+// mutations, to `w` in a canonical form that depends only on the blocks, entry comments and archive comment it
+// holds, so that the same contents always produce byte-identical output, including from other implementations
+// following the same rules: entries are sorted by filename, every entry is stored uncompressed, and no
+// modification times are recorded. Options that add to the archive, such as WriteIntegrityManifest, still apply.
+// The ZipDatastore and its file are not modified. The number of bytes written is returned.
+func (zipDs *ZipDatastore) WriteCanonical(w io.Writer) (int64, error) {
+	zipDs.lock.Lock()
+	defer zipDs.lock.Unlock()
+
+	index, err := zipDs.archiveIndex()
+	if err != nil {
+		return 0, err
+	}
+	extras, err := zipDs.extraEntries()
+	if err != nil {
+		return 0, err
+	}
+	cw := &countingWriter{w: w}
+	err = zipDs.writeArchive(cw, index, extras, true)
+	return cw.n, err
+}
+
+// SerializedSize returns the exact size in bytes of the ZIP archive that WriteTo() would write, and that a
+// rewrite on Close() or Sync() would produce, by performing the serialization and discarding the output. This
+// involves reading and compressing every live block so is as expensive as a rewrite, but doesn't touch the file.
+func (zipDs *ZipDatastore) SerializedSize() (int64, error) {
+	return zipDs.WriteTo(ioutil.Discard)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// readFile reads the full contents of a ZIP file entry, decrypting it with Options.ZipPassword if it is
+// encrypted.
+func (zipDs *ZipDatastore) readFile(f *zip.File) ([]byte, error) {
+	if err := zipDs.checkReadSize(f); err != nil {
+		return nil, err
+	}
+	var rc io.ReadCloser
+	var err error
+	if f.Flags&flagEncrypted != 0 {
+		rc, err = openEncrypted(f, zipDs.opts.ZipPassword)
+	} else {
+		rc, err = f.Open()
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	return ioutil.ReadAll(rc)
+}
+
+// checkReadSize returns ErrEntryTooLarge if the uncompressed size that the archive declares for `f` exceeds
+// Options.MaxReadBytes, before anything is allocated to read it.
+func (zipDs *ZipDatastore) checkReadSize(f *zip.File) error {
+	if max := zipDs.opts.MaxReadBytes; max > 0 && f.UncompressedSize64 > uint64(max) {
+		return ErrEntryTooLarge
+	}
+	return nil
+}
+
+// readFileUnchecked reads the full contents of a ZIP file entry as readFile() does, but without verifying its
+// CRC-32, see Options.SkipCrcCheck. Entries that are encrypted or use a method other than store or deflate are
+// read with readFile().
+func (zipDs *ZipDatastore) readFileUnchecked(f *zip.File) ([]byte, error) {
+	if f.Flags&flagEncrypted != 0 || (f.Method != zip.Store && f.Method != zip.Deflate) {
+		return zipDs.readFile(f)
+	}
+	if err := zipDs.checkReadSize(f); err != nil {
+		return nil, err
+	}
+	raw, err := f.OpenRaw()
+	if err != nil {
+		return nil, err
+	}
+	if f.Method == zip.Store {
+		return ioutil.ReadAll(raw)
+	}
+	rc := flate.NewReader(raw)
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
 }
 
-func dsKeyToCidString(key ds.Key) (*string, error) {
-	cid, err := dshelp.DsKeyToCid(key)
+func (zipDs *ZipDatastore) dsKeyToCidString(key ds.Key) (*string, error) {
+	cid, err := zipDs.dsKeyToCid(key)
 	if err != nil {
 		return nil, err
 	}
+	return cidToString(cid)
+}
+
+// dsKeyToCid decodes a key in the go-ipfs-ds-help form (`/` followed by the uppercase base32 of the binary CID).
+// With Options.LenientKeys, keys that don't decode that way have any namespaces stripped and the final
+// component is decoded in the ds-help form, which covers `/blocks/CIQ...` keys, or as a CID string, which
+// covers bare `/bafy...` and `/Qm...` keys.
+func (zipDs *ZipDatastore) dsKeyToCid(key ds.Key) (cid.Cid, error) {
+	c, err := dshelp.DsKeyToCid(key)
+	if err == nil || !zipDs.opts.LenientKeys {
+		return c, err
+	}
+	name := key.BaseNamespace()
+	if c, lerr := dshelp.DsKeyToCid(ds.RawKey("/" + name)); lerr == nil {
+		return c, nil
+	}
+	if c, lerr := cid.Decode(name); lerr == nil {
+		return c, nil
+	}
+	return cid.Undef, err
+}
+
+// identityData returns the data embedded in `c` if its multihash uses the identity function, in which case `ok`
+// is true.
+func identityData(c cid.Cid) (data []byte, ok bool) {
+	decoded, err := mh.Decode(c.Hash())
+	if err != nil || decoded.Code != mh.ID {
+		return nil, false
+	}
+	return decoded.Digest, true
+}
+
+func cidToString(cid cid.Cid) (*string, error) {
 	var cidStr string
+	var err error
 	if cid.Version() == 0 {
 		cidStr, err = cid.StringOfBase(mbase.Base58BTC)
 	} else {
@@ -275,45 +1888,464 @@ func dsKeyToCidString(key ds.Key) (*string, error) {
 	return &cidStr, nil
 }
 
+// canonicalName converts a ZIP entry filename to the canonical string form of the CID it represents so that
+// lookups match regardless of the casing used by the tool that wrote the archive (e.g. uppercase base32), or
+// whether it stripped the multibase prefix from CIDv1 strings (e.g. "afkrei..." for "bafkrei..."). `ok` is false
+// if the filename can't be decoded as a CID.
+//
+// Where an archive contains more than one entry that maps to the same canonical name, whether their filenames are
+// identical or differently spelt variants (e.g. uppercase base32), Options.DuplicatePolicy decides which one is
+// indexed. Entries that lose are not indexed and are dropped on rewrite.
+func canonicalName(name string) (cidStr string, ok bool) {
+	c, err := cid.Decode(name)
+	if err != nil {
+		// base32 is case-insensitive, so a mixed-case name may still decode once lowercased
+		c, err = cid.Decode(strings.ToLower(name))
+	}
+	if err != nil {
+		if c, ok = decodeStripped(name); !ok {
+			return "", false
+		}
+	}
+	canonical, err := cidToString(c)
+	if err != nil {
+		return "", false
+	}
+	return *canonical, true
+}
+
+// decodeStripped decodes a CIDv1 string whose multibase prefix has been stripped by trying the prefixes of
+// base32 and base58btc, the bases CIDv1 strings are usually written in. As a CIDv0 has no prefix, it can't be the
+// result.
+func decodeStripped(name string) (cid.Cid, bool) {
+	for _, prefixed := range []string{"b" + strings.ToLower(name), "z" + name} {
+		if c, err := cid.Decode(prefixed); err == nil && c.Version() == 1 {
+			return c, true
+		}
+	}
+	return cid.Undef, false
+}
+
 // NewDatastore instantiates a ZipDatastore for a given path on the filesystem. If the file exists and is
-// a ZIP archive, its contents will be made available, otherwise a new, empty ZIP archive will be created.
+// a ZIP archive, its contents will be made available, otherwise a new, empty ZIP archive will be created. An
+// existing file that is empty is treated in the same way as one that doesn't exist. Create(), Open() and
+// OpenReadOnly() express each of these intents separately: Create() for a file that must not exist yet, Open() for
+// one that must, and OpenReadOnly() for one that must exist and is never written.
 //
 // Always call Close() on a ZipDatastore when it is no longer required
 func NewDatastore(path string) (*ZipDatastore, error) {
-	var zipDs = ZipDatastore{modified: false}
+	return NewDatastoreWithOptions(path, nil)
+}
+
+// Create instantiates a ZipDatastore for a new, empty ZIP archive at the given path on the filesystem, which must
+// not already exist; an error satisfying os.IsExist() is returned if it does. NewDatastore() would instead open the
+// existing file.
+//
+// Always call Close() on a ZipDatastore when it is no longer required
+func Create(path string) (*ZipDatastore, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err = file.Close(); err != nil {
+		return nil, err
+	}
+	return openDatastore(path, 0, nil)
+}
+
+// Open instantiates a ZipDatastore for the existing ZIP archive at the given path on the filesystem, for reading
+// and writing, as NewDatastore() does, but returns an error satisfying os.IsNotExist() if there is no file there
+// rather than creating a new archive. An existing file that is empty is treated as a new archive.
+//
+// Always call Close() on a ZipDatastore when it is no longer required
+func Open(path string) (*ZipDatastore, error) {
+	fileinfo, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	return openDatastore(path, fileinfo.Size(), nil)
+}
+
+// OpenReadOnly instantiates a read-only ZipDatastore for the existing ZIP archive at the given path on the
+// filesystem, which is opened for reading only and never written to. Mutations return ErrReadOnly, or are ignored
+// in the case of SetComment() and SetMeta(), as with NewDatastoreFromReaderAt(). An error satisfying
+// os.IsNotExist() is returned if there is no file there, and zip.ErrFormat if it is empty.
+//
+// Always call Close() on a ZipDatastore when it is no longer required
+func OpenReadOnly(path string) (*ZipDatastore, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	fileinfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	zipDs, err := NewDatastoreFromReaderAt(file, fileinfo.Size(), nil)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	zipDs.path = path
+	return zipDs, nil
+}
+
+// NewDatastoreWithOptions instantiates a ZipDatastore for a given path on the filesystem, in the same way as
+// NewDatastore(), but with the provided Options. If `opts` is nil, DefaultOptions() are used.
+//
+// Always call Close() on a ZipDatastore when it is no longer required
+func NewDatastoreWithOptions(path string, opts *Options) (*ZipDatastore, error) {
+	return openDatastore(path, -1, opts)
+}
+
+// NewDatastoreWithSize instantiates a ZipDatastore for a given path on the filesystem, in the same way as
+// NewDatastore(), for a file whose size in bytes the caller already knows, such as from a prior Stat() or an HTTP
+// Content-Length, so that it isn't looked up again. A `size` of 0 is treated as a file that is empty or doesn't
+// exist, while a `size` that doesn't match the file will generally fail to open as a ZIP archive.
+//
+// Always call Close() on a ZipDatastore when it is no longer required
+func NewDatastoreWithSize(path string, size int64) (*ZipDatastore, error) {
+	if size < 0 {
+		return nil, fmt.Errorf("zipcar: invalid archive size %d", size)
+	}
+	return openDatastore(path, size, nil)
+}
+
+// openDatastore implements NewDatastoreWithOptions() and NewDatastoreWithSize(), looking up the size of the file
+// at `path` only if `size` is negative.
+func openDatastore(path string, size int64, opts *Options) (*ZipDatastore, error) {
+	var zipDs = ZipDatastore{modified: false, opts: DefaultOptions()}
 	var err error
-	var exists = true
+
+	if opts != nil {
+		zipDs.opts = *opts
+	}
 
 	zipDs.index = make(map[string]*zip.File)
 	zipDs.cache = make(map[string][]byte)
+	zipDs.entryComments = make(map[string]string)
+	zipDs.modTimes = make(map[string]time.Time)
 
-	fileinfo, err := os.Stat(path)
-	if err != nil {
-		if os.IsNotExist(err) {
-			exists = false
+	if size < 0 {
+		fileinfo, err := os.Stat(path)
+		if err == nil {
+			size = fileinfo.Size()
+		} else if os.IsNotExist(err) {
+			size = 0
 		} else {
 			return nil, err
 		}
 	}
 
-	zipDs.file, err = os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	zipDs.path = path
+	if zipDs.opts.Mmap {
+		zipDs.readOnly = true
+		if err = zipDs.openMapped(); err != nil {
+			return nil, err
+		}
+		return &zipDs, nil
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
 	if err != nil {
 		return nil, err
 	}
 
-	if exists {
-		// read in existing keys
-		reader, err := zip.NewReader(zipDs.file, fileinfo.Size())
-		if err != nil {
+	if size > 0 {
+		// read in existing keys, an empty file (e.g. left by an interrupted create) is treated as a new archive
+		if zipDs.opts.LazyIndex {
+			zipDs.loadIndexLazily(file, size)
+		} else if err = zipDs.loadIndex(file, size); err != nil {
+			file.Close()
 			return nil, err
 		}
+	} else {
+		zipDs.file = file
+	}
+
+	return &zipDs, nil
+}
+
+// NewDatastoreFromReaderAt instantiates a read-only ZipDatastore for an existing ZIP archive of `size` bytes
+// that is read through `r`, such as one held in memory or fetched remotely, see NewHTTPDatastore(). Only the
+// central directory is read up front, each block is read from `r` when it is first needed. Mutations return
+// ErrReadOnly, or are ignored in the case of SetComment(). If `r` is also an io.Closer, it is closed by
+// Close(). If `opts` is nil, DefaultOptions() are used; Options.Mmap is not applicable and is ignored.
+//
+// Always call Close() on a ZipDatastore when it is no longer required
+func NewDatastoreFromReaderAt(r io.ReaderAt, size int64, opts *Options) (*ZipDatastore, error) {
+	var zipDs = ZipDatastore{opts: DefaultOptions(), readOnly: true}
+	if opts != nil {
+		zipDs.opts = *opts
+	}
+	zipDs.opts.Mmap = false
+
+	zipDs.index = make(map[string]*zip.File)
+	zipDs.cache = make(map[string][]byte)
+	zipDs.entryComments = make(map[string]string)
+	zipDs.modTimes = make(map[string]time.Time)
+
+	rc, ok := r.(ReaderAtCloser)
+	if !ok {
+		rc = nopCloser{r}
+	}
+	if zipDs.opts.LazyIndex {
+		zipDs.loadIndexLazily(rc, size)
+	} else if err := zipDs.loadIndex(rc, size); err != nil {
+		return nil, err
+	}
+	return &zipDs, nil
+}
+
+// NewDatastoreFromSection instantiates a read-only ZipDatastore for a ZIP archive embedded within a larger file
+// or blob, occupying the `size` bytes of `r` starting at `offset`, such as the payload of a container format that
+// bundles an archive after its own header. Offsets within the archive are relative to `offset`, and nothing
+// outside of the section is read. As with NewDatastoreFromReaderAt(), mutations return ErrReadOnly, so the host
+// is never written to. `r` is not closed by Close(), it remains the responsibility of the caller and must remain
+// open until the ZipDatastore is closed. If `opts` is nil, DefaultOptions() are used.
+//
+// Always call Close() on a ZipDatastore when it is no longer required
+func NewDatastoreFromSection(r io.ReaderAt, offset int64, size int64, opts *Options) (*ZipDatastore, error) {
+	return NewDatastoreFromReaderAt(io.NewSectionReader(r, offset, size), size, opts)
+}
+
+// nopCloser adapts an io.ReaderAt that doesn't need closing to a ReaderAtCloser.
+type nopCloser struct {
+	io.ReaderAt
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// openMapped opens the existing file at zipDs.path read-only and memory maps it, see Options.Mmap.
+func (zipDs *ZipDatastore) openMapped() error {
+	file, err := os.Open(zipDs.path)
+	if err != nil {
+		return err
+	}
+	fileinfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if fileinfo.Size() == 0 { // an empty file is an empty archive, and can't be mapped
+		zipDs.file = file
+		return nil
+	}
+	if err = zipDs.loadIndex(file, fileinfo.Size()); err != nil {
+		file.Close()
+		return err
+	}
+	if zipDs.mapped, err = mmapFile(file, fileinfo.Size()); err != nil {
+		file.Close()
+		return err
+	}
+	return nil
+}
+
+// mappedData returns the contents of an uncompressed, unencrypted entry as a slice of the memory mapped file,
+// having verified its CRC-32.
+func (zipDs *ZipDatastore) mappedData(f *zip.File) ([]byte, error) {
+	offset, err := f.DataOffset()
+	if err != nil {
+		return nil, err
+	}
+	end := offset + int64(f.CompressedSize64)
+	if offset < 0 || end < offset || end > int64(len(zipDs.mapped)) || f.CompressedSize64 != f.UncompressedSize64 {
+		return nil, zip.ErrFormat
+	}
+	data := zipDs.mapped[offset:end:end]
+	if !zipDs.opts.SkipCrcCheck && crc32.ChecksumIEEE(data) != f.CRC32 {
+		return nil, zip.ErrChecksum
+	}
+	return data, nil
+}
 
+// loadIndex reads the central directory of the ZIP archive in `file` and, only if that succeeds, replaces the
+// file, index, entry comments and archive comment of zipDs with those of the archive.
+func (zipDs *ZipDatastore) loadIndex(file ReaderAtCloser, size int64) (err error) {
+	defer zipDs.recoverMalformed(&err)
+
+	reader, err := zip.NewReader(file, size)
+	if err != nil {
+		return err
+	}
+
+	if zipDs.opts.StrictZcar || zipDs.opts.Validation.keys() {
+		var names []string
 		for _, f := range reader.File {
-			zipDs.index[f.Name] = f
+			if _, ok := zipDs.entryName(f.Name); !ok && !reservedName(f.Name) && !isDirectory(f) {
+				names = append(names, f.Name)
+			}
+		}
+		if len(names) > 0 {
+			return &NotZcarError{Names: names}
+		}
+	}
+
+	if zipDs.opts.DuplicatePolicy == DuplicateReject {
+		if names := zipDs.duplicateNames(reader.File); len(names) > 0 {
+			return &DuplicateNamesError{Names: names}
 		}
+	}
 
-		zipDs.comment = reader.Comment
+	index, entryComments := zipDs.indexEntries(reader.File)
+	files := zipDs.indexedFiles(reader.File, index)
+	meta, err := zipDs.readMeta(reader.File)
+	if err != nil {
+		return err
 	}
 
-	return &zipDs, nil
+	if validate := zipDs.opts.EntryNameValidator; validate != nil {
+		for _, f := range files {
+			name, _ := zipDs.entryName(f.Name)
+			if err := validate(name); err != nil {
+				return &CidError{Cid: name, Err: err}
+			}
+		}
+	}
+
+	zipDs.file = file
+	zipDs.size = size
+	zipDs.index = index
+	zipDs.files = files
+	zipDs.members = nil
+	zipDs.multihashes = nil
+	zipDs.sizeEstimated = false
+	zipDs.entryComments = entryComments
+	zipDs.contentTypes = make(map[string]string)
+	for _, f := range files {
+		if contentType := entryContentType(f); contentType != "" {
+			name, _ := zipDs.entryName(f.Name)
+			zipDs.contentTypes[name] = contentType
+		}
+	}
+	zipDs.comment = reader.Comment
+	zipDs.meta = meta
+	zipDs.inflated = inflatedEntry{}
+
+	if zipDs.opts.CompactIndex {
+		// retain only the names, the headers are found again by lookup() when needed
+		zipDs.members = make(map[string]struct{}, len(index))
+		for name := range index {
+			zipDs.members[name] = struct{}{}
+		}
+		zipDs.index = make(map[string]*zip.File)
+		zipDs.files = nil
+	}
+
+	zipDs.log().Infof("zipcar: opened archive %q of %d bytes holding %d blocks", zipDs.path, size, len(files))
+	return nil
+}
+
+// recoverMalformed recovers from a panic while reading a malformed archive, which an archive crafted to defeat
+// the checks of archive/zip or of this package may cause, and sets `err` to an error describing it instead, so
+// that untrusted archives can be read safely. It must be deferred.
+func (zipDs *ZipDatastore) recoverMalformed(err *error) {
+	if r := recover(); r != nil {
+		*err = fmt.Errorf("zipcar: malformed archive: %v", r)
+		zipDs.log().Warnf("zipcar: recovered from reading malformed archive %q: %v", zipDs.path, r)
+	}
+}
+
+// loadIndexLazily calls loadIndex() on a new goroutine, holding the lock until it is done so that every other
+// operation waits for the index, see Options.LazyIndex. If it fails, the ZipDatastore is left empty and read-only
+// so that the archive can't be overwritten, and the error is held for WaitIndex().
+func (zipDs *ZipDatastore) loadIndexLazily(file ReaderAtCloser, size int64) {
+	zipDs.lock.Lock()
+	go func() {
+		defer zipDs.lock.Unlock()
+		if err := zipDs.loadIndex(file, size); err != nil {
+			zipDs.log().Warnf("zipcar: reading the index of %q failed, leaving it empty and read-only: %v", zipDs.path, err)
+			zipDs.indexErr = err
+			zipDs.readOnly = true
+			zipDs.file = file // still closed by Close()
+		}
+	}()
+}
+
+// WaitIndex waits for the central directory of an archive opened with Options.LazyIndex to be read, returning
+// the error that prevented it from being read, if any. Without Options.LazyIndex, the central directory has
+// already been read by the time the ZipDatastore is returned, so this returns nil immediately.
+func (zipDs *ZipDatastore) WaitIndex() error {
+	zipDs.lock.Lock()
+	defer zipDs.lock.Unlock()
+
+	return zipDs.indexErr
+}
+
+// indexEntries maps the canonical CID filename of each of the ZIP file entries provided to its entry, along with
+// any entry comments. Entries whose filenames aren't CIDs, after Options.NameTransform, are skipped. See
+// canonicalName() for how duplicate names are resolved.
+func (zipDs *ZipDatastore) indexEntries(files []*zip.File) (map[string]*zip.File, map[string]string) {
+	index := make(map[string]*zip.File)
+	entryComments := make(map[string]string)
+	matches := make(map[*zip.File]bool) // see preferEntry()
+	for _, f := range files {
+		name, ok := zipDs.entryName(f.Name)
+		if !ok {
+			// not a block, e.g. a README added with a ZIP tool, so not accessible via the Datastore
+			continue
+		}
+		if current := index[name]; current != nil && !zipDs.preferEntry(name, current, f, matches) {
+			continue
+		}
+		index[name] = f
+		if f.Comment != "" {
+			entryComments[name] = f.Comment
+		} else {
+			delete(entryComments, name)
+		}
+	}
+
+	return index, entryComments
+}
+
+// indexedFiles returns the entries of `files` that were selected for the index by indexEntries(), in the same
+// order.
+func (zipDs *ZipDatastore) indexedFiles(files []*zip.File, index map[string]*zip.File) []*zip.File {
+	var indexed []*zip.File
+	for _, f := range files {
+		if name, ok := zipDs.entryName(f.Name); ok && index[name] == f {
+			indexed = append(indexed, f)
+		}
+	}
+	return indexed
+}
+
+// lookup returns the ZIP file entry for the given filename, or nil if it is not in the archive or has been
+// deleted. With Options.CompactIndex, this involves reading the central directory of the archive again.
+func (zipDs *ZipDatastore) lookup(cidStr string) (*zip.File, error) {
+	if zipDs.members == nil {
+		return zipDs.index[cidStr], nil
+	}
+	if _, ok := zipDs.members[cidStr]; !ok {
+		return nil, nil
+	}
+	index, err := zipDs.archiveIndex()
+	if err != nil {
+		return nil, err
+	}
+	return index[cidStr], nil
+}
+
+// archiveIndex returns the ZIP file entries in the archive that are still live, keyed by filename. Unless
+// Options.CompactIndex is set, this is zipDs.index, which may also contain nil entries for deleted files.
+func (zipDs *ZipDatastore) archiveIndex() (map[string]*zip.File, error) {
+	if zipDs.members == nil {
+		return zipDs.index, nil
+	}
+	reader, err := zip.NewReader(zipDs.file, zipDs.size)
+	if err != nil {
+		return nil, err
+	}
+	index, _ := zipDs.indexEntries(reader.File)
+	for cidStr := range index {
+		if _, ok := zipDs.members[cidStr]; !ok {
+			delete(index, cidStr)
+		}
+	}
+	return index, nil
 }
@@ -1,11 +1,36 @@
 package zipcar
 
 import (
+	"archive/zip"
 	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	blocks "github.com/ipfs/go-block-format"
 	cid "github.com/ipfs/go-cid"
+	datastore "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	dshelp "github.com/ipfs/go-ipfs-ds-help"
 	cbor "github.com/ipfs/go-ipld-cbor"
 	format "github.com/ipfs/go-ipld-format"
 	dag "github.com/ipfs/go-merkledag"
@@ -195,10 +220,4698 @@ func TestReadJS(t *testing.T) {
 	verifyComment(t, ds, false)
 }
 
+func TestComputeCid(t *testing.T) {
+	ds, err := NewDatastore("compute.zcar")
+	assert.NoError(t, err)
+	defer os.Remove("compute.zcar")
+	defer ds.Close()
+
+	// default is CIDv1, raw, sha2-256, the same as a dag.RawNode
+	c, err := ds.ComputeCid(rnd1.RawData())
+	assert.NoError(t, err)
+	assert.Equal(t, rnd1.Cid(), c)
+
+	has, err := ds.HasCid(c)
+	assert.NoError(t, err)
+	assert.False(t, has, "ComputeCid() should not store the block")
+
+	opts := DefaultOptions()
+	opts.CidPrefix = cid.Prefix{Version: 0, Codec: cid.DagProtobuf, MhType: mh.SHA2_256, MhLength: -1}
+	ds2, err := NewDatastoreWithOptions("compute2.zcar", &opts)
+	assert.NoError(t, err)
+	defer os.Remove("compute2.zcar")
+	defer ds2.Close()
+
+	c, err = ds2.ComputeCid(rnd1.RawData())
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), c.Version())
+	assert.Equal(t, rnd1.Cid().Hash(), c.Hash())
+}
+
+func TestPutData(t *testing.T) {
+	ds, err := NewDatastore("putdata.zcar")
+	assert.NoError(t, err)
+	defer os.Remove("putdata.zcar")
+	defer ds.Close()
+
+	c, err := ds.PutData(rnd2.RawData())
+	assert.NoError(t, err)
+	assert.Equal(t, rnd2.Cid(), c)
+
+	data, err := ds.GetCid(c)
+	assert.NoError(t, err)
+	assert.Equal(t, rnd2.RawData(), data)
+}
+
+func TestClone(t *testing.T) {
+	copyFixture(t, "js.zcar", "clone.zcar")
+	defer os.Remove("clone.zcar")
+
+	ds, err := NewDatastore("clone.zcar")
+	assert.NoError(t, err)
+	defer ds.Close()
+
+	err = ds.DeleteCid(rnd2.Cid())
+	assert.NoError(t, err)
+
+	clone, err := ds.Clone()
+	assert.NoError(t, err)
+
+	verifyHas(t, clone, rnd1.Cid(), "rnd1")
+	verifyHas(t, clone, pnd3.Cid(), "pnd3")
+	verifyHas(t, clone, cnd3.Cid(), "cnd3")
+	has, err := clone.HasCid(rnd2.Cid())
+	assert.NoError(t, err)
+	assert.False(t, has, "deleted entry should not be cloned")
+	assert.Equal(t, ds.Comment(), clone.Comment())
+
+	// mutating the clone's bytes or entries should not affect the original
+	data, err := clone.GetCid(rnd1.Cid())
+	assert.NoError(t, err)
+	data[0] = 'x'
+	err = clone.DeleteCid(rnd3.Cid())
+	assert.NoError(t, err)
+	err = clone.PutCid(rndz.Cid(), rndz.RawData())
+	assert.NoError(t, err)
+
+	data, err = ds.GetCid(rnd1.Cid())
+	assert.NoError(t, err)
+	assert.Equal(t, rnd1.RawData(), data)
+	verifyHas(t, ds, rnd3.Cid(), "rnd3")
+	has, err = ds.HasCid(rndz.Cid())
+	assert.NoError(t, err)
+	assert.False(t, has, "entry put to clone should not be in original")
+
+	assert.NoError(t, clone.Close())
+}
+
+func TestEntryComment(t *testing.T) {
+	ds, err := NewDatastore("comment.zcar")
+	assert.NoError(t, err)
+	defer os.Remove("comment.zcar")
+
+	for _, raw := range []*dag.RawNode{rnd1, rnd2} {
+		err = ds.PutCid(raw.Cid(), raw.RawData())
+		assert.NoError(t, err)
+	}
+
+	err = ds.SetEntryComment(rnd1.Cid(), "https://example.com/aaaa")
+	assert.NoError(t, err)
+	err = ds.SetEntryComment(rnd3.Cid(), "not here")
+	assert.Equal(t, datastore.ErrNotFound, err)
+	err = ds.SetEntryComment(rnd2.Cid(), strings.Repeat("x", 70000))
+	assert.Equal(t, ErrCommentTooLong, err)
+
+	comment, err := ds.EntryComment(rnd1.Cid())
+	assert.NoError(t, err)
+	assert.Equal(t, "https://example.com/aaaa", comment)
+
+	assert.NoError(t, ds.Close())
+
+	ds, err = NewDatastore("comment.zcar")
+	assert.NoError(t, err)
+	defer ds.Close()
+
+	comment, err = ds.EntryComment(rnd1.Cid())
+	assert.NoError(t, err)
+	assert.Equal(t, "https://example.com/aaaa", comment)
+	comment, err = ds.EntryComment(rnd2.Cid())
+	assert.NoError(t, err)
+	assert.Equal(t, "", comment)
+	_, err = ds.EntryComment(rnd3.Cid())
+	assert.Equal(t, datastore.ErrNotFound, err)
+}
+
+func TestUppercaseBase32(t *testing.T) {
+	// simulate an archive written by a tool that used uppercase base32 for its CID filenames
+	writeFixture(t, "upper.zcar", map[string][]byte{
+		strings.ToUpper(rnd1.Cid().String()):           rnd1.RawData(),
+		"b" + strings.ToUpper(rnd2.Cid().String()[1:]): rnd2.RawData(),
+	})
+	defer os.Remove("upper.zcar")
+
+	ds, err := NewDatastore("upper.zcar")
+	assert.NoError(t, err)
+	defer ds.Close()
+
+	for _, raw := range []*dag.RawNode{rnd1, rnd2} {
+		data, err := ds.GetCid(raw.Cid())
+		assert.NoError(t, err)
+		assert.Equal(t, raw.RawData(), data)
+	}
+}
+
+func TestCaseVariantCollision(t *testing.T) {
+	// entries for the same CID that only differ by case are duplicates, resolved by Options.DuplicatePolicy
+	// regardless of spelling
+	file, err := os.Create("variant.zcar")
+	assert.NoError(t, err)
+	defer os.Remove("variant.zcar")
+	writer := zip.NewWriter(file)
+	for _, entry := range []struct{ name, data string }{
+		{strings.ToUpper(rnd1.Cid().String()), "first"},
+		{rnd1.Cid().String(), "second"},
+		{strings.ToUpper(rnd1.Cid().String()), "third"},
+	} {
+		f, err := writer.Create(entry.name)
+		assert.NoError(t, err)
+		_, err = f.Write([]byte(entry.data))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, writer.Close())
+	assert.NoError(t, file.Close())
+
+	_, err = NewDatastore("variant.zcar")
+	assert.IsType(t, &DuplicateNamesError{}, err)
+
+	opts := DefaultOptions()
+	opts.DuplicatePolicy = DuplicateFirst
+	ds, err := NewDatastoreWithOptions("variant.zcar", &opts)
+	assert.NoError(t, err)
+	data, err := ds.GetCid(rnd1.Cid())
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("first"), data)
+	assert.NoError(t, ds.Close())
+
+	opts.DuplicatePolicy = DuplicateLast
+	ds, err = NewDatastoreWithOptions("variant.zcar", &opts)
+	assert.NoError(t, err)
+	data, err = ds.GetCid(rnd1.Cid())
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("third"), data)
+
+	// a rewrite unifies them into a single canonically named entry
+	ds.SetComment("rewrite")
+	assert.NoError(t, ds.Close())
+
+	reader, err := zip.OpenReader("variant.zcar")
+	assert.NoError(t, err)
+	defer reader.Close()
+	assert.Equal(t, 1, len(reader.File))
+	assert.Equal(t, rnd1.Cid().String(), reader.File[0].Name)
+}
+
+func TestSync(t *testing.T) {
+	os.Remove("sync.zcar")
+	defer os.Remove("sync.zcar")
+
+	ds, err := NewDatastore("sync.zcar")
+	assert.NoError(t, err)
+
+	err = ds.PutCid(rnd1.Cid(), rnd1.RawData())
+	assert.NoError(t, err)
+	assert.NoError(t, ds.Sync())
+
+	reader, err := zip.OpenReader("sync.zcar")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(reader.File))
+	reader.Close()
+
+	// still usable after a Sync(), reading from the new archive
+	verifyHas(t, ds, rnd1.Cid(), "rnd1")
+	data, err := ds.GetCid(rnd1.Cid())
+	assert.NoError(t, err)
+	assert.Equal(t, rnd1.RawData(), data)
+
+	err = ds.PutCid(rnd2.Cid(), rnd2.RawData())
+	assert.NoError(t, err)
+	err = ds.DeleteCid(rnd1.Cid())
+	assert.NoError(t, err)
+	assert.NoError(t, ds.Close())
+
+	assert.Equal(t, ErrClosed, ds.Sync())
+	assert.NoError(t, ds.Close(), "a second Close() should be a no-op")
+
+	ds, err = NewDatastore("sync.zcar")
+	assert.NoError(t, err)
+	verifyHas(t, ds, rnd2.Cid(), "rnd2")
+	has, err := ds.HasCid(rnd1.Cid())
+	assert.NoError(t, err)
+	assert.False(t, has, "rnd1 should have been deleted")
+
+	// a Delete() on its own is a mutation that Sync() should persist
+	err = ds.DeleteCid(rnd2.Cid())
+	assert.NoError(t, err)
+	assert.NoError(t, ds.Sync())
+
+	ds2, err := NewDatastore("sync.zcar")
+	assert.NoError(t, err)
+	has, err = ds2.HasCid(rnd2.Cid())
+	assert.NoError(t, err)
+	assert.False(t, has, "rnd2 should have been deleted")
+	assert.NoError(t, ds2.Close())
+	assert.NoError(t, ds.Close())
+}
+
+func TestSyncFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zipcar")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "fail.zcar")
+
+	ds, err := NewDatastore(path)
+	assert.NoError(t, err)
+	err = ds.PutCid(rnd1.Cid(), rnd1.RawData())
+	assert.NoError(t, err)
+	hideFile(ds)
+
+	// move the directory out from under the datastore so the rewrite can't create the file
+	assert.NoError(t, os.Rename(dir, dir+".moved"))
+	defer os.RemoveAll(dir + ".moved")
+	assert.Error(t, ds.Sync())
+	assert.NoError(t, os.Rename(dir+".moved", dir))
+
+	// the failed write should not prevent a later one
+	err = ds.PutCid(rnd2.Cid(), rnd2.RawData())
+	assert.NoError(t, err)
+	assert.NoError(t, ds.Close())
+
+	ds, err = NewDatastore(path)
+	assert.NoError(t, err)
+	defer ds.Close()
+	verifyHas(t, ds, rnd1.Cid(), "rnd1")
+	verifyHas(t, ds, rnd2.Cid(), "rnd2")
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	os.Remove("concurrent.zcar")
+	defer os.Remove("concurrent.zcar")
+
+	ds, err := NewDatastore("concurrent.zcar")
+	assert.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c, err := ds.PutData([]byte(fmt.Sprintf("block %d", i)))
+			assert.NoError(t, err)
+			_, err = ds.GetCid(c)
+			assert.NoError(t, err)
+			if i%2 == 0 {
+				assert.NoError(t, ds.Sync())
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.NoError(t, ds.Close())
+
+	reader, err := zip.OpenReader("concurrent.zcar")
+	assert.NoError(t, err)
+	defer reader.Close()
+	assert.Equal(t, 8, len(reader.File))
+}
+
+func TestAutoFlush(t *testing.T) {
+	os.Remove("flush.zcar")
+	defer os.Remove("flush.zcar")
+
+	ds, err := NewDatastore("flush.zcar")
+	assert.NoError(t, err)
+
+	assert.Error(t, ds.StartAutoFlush(0))
+	assert.NoError(t, ds.StartAutoFlush(10*time.Millisecond))
+	// restarting replaces the existing auto-flush
+	assert.NoError(t, ds.StartAutoFlush(10*time.Millisecond))
+
+	err = ds.PutCid(rnd1.Cid(), rnd1.RawData())
+	assert.NoError(t, err)
+
+	// wait for the background flush to write the entry without us calling Close()
+	var flushed bool
+	for i := 0; i < 100 && !flushed; i++ {
+		time.Sleep(10 * time.Millisecond)
+		if reader, err := zip.OpenReader("flush.zcar"); err == nil {
+			flushed = len(reader.File) == 1 && reader.File[0].Name == rnd1.Cid().String()
+			reader.Close()
+		}
+	}
+	assert.True(t, flushed, "archive was not flushed in the background")
+
+	// still usable after a flush, and Close() should stop the goroutine and write the rest
+	verifyHas(t, ds, rnd1.Cid(), "rnd1")
+	err = ds.PutCid(rnd2.Cid(), rnd2.RawData())
+	assert.NoError(t, err)
+	assert.NoError(t, ds.Close())
+	assert.Equal(t, ErrClosed, ds.StartAutoFlush(10*time.Millisecond))
+
+	reader, err := zip.OpenReader("flush.zcar")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(reader.File))
+	reader.Close()
+}
+
+func TestAutoFlushFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zipcar")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer os.RemoveAll(dir + ".moved")
+	path := filepath.Join(dir, "fail.zcar")
+
+	// flush in the background for long enough to see a failure, then report it
+	flushUntilErr := func(ds *ZipDatastore) error {
+		for i := 0; i < 20; i++ {
+			assert.NoError(t, ds.StartAutoFlush(5*time.Millisecond))
+			time.Sleep(25 * time.Millisecond)
+			if err := ds.StopAutoFlush(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	ds, err := NewDatastore(path)
+	assert.NoError(t, err)
+	err = ds.PutCid(rnd1.Cid(), rnd1.RawData())
+	assert.NoError(t, err)
+	hideFile(ds)
+
+	// move the directory out from under the datastore so the background rewrite can't create the file
+	assert.NoError(t, os.Rename(dir, dir+".moved"))
+	assert.Error(t, flushUntilErr(ds))
+	assert.NoError(t, ds.StopAutoFlush(), "error should only be reported once")
+	assert.NoError(t, os.Rename(dir+".moved", dir))
+
+	// the error has been reported, so Close() succeeds and writes everything
+	assert.NoError(t, ds.Close())
+
+	ds, err = NewDatastore(path)
+	assert.NoError(t, err)
+	verifyHas(t, ds, rnd1.Cid(), "rnd1")
+	err = ds.PutCid(rnd2.Cid(), rnd2.RawData())
+	assert.NoError(t, err)
+	hideFile(ds)
+
+	// an unreported background error is returned by Close(), which still writes the archive
+	assert.NoError(t, os.Rename(dir, dir+".moved"))
+	assert.NoError(t, ds.StartAutoFlush(5*time.Millisecond))
+	time.Sleep(100 * time.Millisecond) // plenty of failed ticks
+	assert.NoError(t, os.Rename(dir+".moved", dir))
+	assert.Error(t, ds.Close())
+
+	ds, err = NewDatastore(path)
+	assert.NoError(t, err)
+	defer ds.Close()
+	verifyHas(t, ds, rnd1.Cid(), "rnd1")
+	verifyHas(t, ds, rnd2.Cid(), "rnd2")
+}
+
+func TestCompactIndex(t *testing.T) {
+	copyFixture(t, "js.zcar", "compact.zcar")
+	defer os.Remove("compact.zcar")
+
+	opts := DefaultOptions()
+	opts.CompactIndex = true
+	ds, err := NewDatastoreWithOptions("compact.zcar", &opts)
+	assert.NoError(t, err)
+
+	verifyHasEntries(t, ds, false)
+	verifyRawNodes(t, ds, false)
+	verifyProtoNodes(t, ds, false)
+	verifyCborNodes(t, ds, false)
+	verifyComment(t, ds, false)
+
+	// mutations behave as they do with the full index
+	for _, c := range []cid.Cid{rnd2.Cid(), pnd2.Cid(), cnd2.Cid()} {
+		assert.NoError(t, ds.DeleteCid(c))
+	}
+	assert.NoError(t, ds.PutCid(rndz.Cid(), rndz.RawData()))
+	assert.NoError(t, ds.Close())
+
+	ds, err = NewDatastoreWithOptions("compact.zcar", &opts)
+	assert.NoError(t, err)
+	defer ds.Close()
+	verifyHasEntries(t, ds, true)
+	verifyRawNodes(t, ds, true)
+}
+
+func TestGetNode(t *testing.T) {
+	ds, err := NewDatastore("js.zcar")
+	assert.NoError(t, err)
+	defer ds.Close()
+
+	for _, expected := range []format.Node{rnd1, pnd1, pnd2, cnd1} {
+		node, err := ds.GetNode(expected.Cid())
+		assert.NoError(t, err)
+		assert.Equal(t, expected.Cid(), node.Cid())
+		assert.Equal(t, len(expected.Links()), len(node.Links()))
+		assert.Equal(t, expected.RawData(), node.RawData())
+	}
+
+	_, err = ds.GetNode(rndz.Cid())
+	assert.Equal(t, datastore.ErrNotFound, err)
+}
+
+func TestGetNodeUnknownCodec(t *testing.T) {
+	os.Remove("node.zcar")
+	defer os.Remove("node.zcar")
+
+	ds, err := NewDatastore("node.zcar")
+	assert.NoError(t, err)
+	defer ds.Close()
+
+	c, err := cid.Prefix{Version: 1, Codec: cid.GitRaw, MhType: mh.SHA2_256, MhLength: -1}.Sum([]byte("git"))
+	assert.NoError(t, err)
+	assert.NoError(t, ds.PutCid(c, []byte("git")))
+
+	_, err = ds.GetNode(c)
+	assert.Error(t, err)
+}
+
+func TestExportDag(t *testing.T) {
+	defer os.Remove("dag.zcar")
+	defer os.Remove("partial.zcar")
+	os.Remove("dag.zcar")
+	os.Remove("partial.zcar")
+
+	ds, err := NewDatastore("js.zcar")
+	assert.NoError(t, err)
+	assert.NoError(t, ds.ExportDag(pnd2.Cid(), "dag.zcar"))
+	assert.NoError(t, ds.Close())
+
+	reader, err := zip.OpenReader("dag.zcar")
+	assert.NoError(t, err)
+	var names []string
+	for _, f := range reader.File {
+		names = append(names, f.Name)
+	}
+	reader.Close()
+	assert.ElementsMatch(t, []string{
+		pnd2.Cid().String(),
+		pnd1.Cid().String(),
+		rnd1.Cid().String(),
+		rnd2.Cid().String(),
+	}, names)
+
+	// an archive holding only part of the DAG
+	ds, err = NewDatastore("dag.zcar")
+	assert.NoError(t, err)
+	assert.NoError(t, ds.DeleteCid(rnd1.Cid()))
+	assert.Error(t, ds.ExportDag(pnd2.Cid(), "partial.zcar"))
+	_, err = os.Stat("partial.zcar")
+	assert.NoError(t, err)
+	os.Remove("partial.zcar")
+	assert.NoError(t, ds.Close())
+
+	opts := DefaultOptions()
+	opts.SkipMissingLinks = true
+	ds, err = NewDatastoreWithOptions("dag.zcar", &opts)
+	assert.NoError(t, err)
+	defer ds.Close()
+	assert.NoError(t, ds.ExportDag(pnd2.Cid(), "partial.zcar"))
+	assert.Equal(t, datastore.ErrNotFound, ds.ExportDag(rnd3.Cid(), "partial.zcar"))
+
+	partial, err := NewDatastore("partial.zcar")
+	assert.NoError(t, err)
+	defer partial.Close()
+	verifyHas(t, partial, pnd2.Cid(), "pnd2")
+	verifyHas(t, partial, pnd1.Cid(), "pnd1")
+	verifyHas(t, partial, rnd2.Cid(), "rnd2")
+	has, err := partial.HasCid(rnd1.Cid())
+	assert.NoError(t, err)
+	assert.False(t, has)
+}
+
+func TestMinCompressSize(t *testing.T) {
+	os.Remove("compress.zcar")
+	defer os.Remove("compress.zcar")
+
+	large := dag.NewRawNode(bytes.Repeat([]byte("large "), 20))
+	ds, err := NewDatastore("compress.zcar")
+	assert.NoError(t, err)
+	for _, raw := range []*dag.RawNode{rnd1, large} {
+		assert.NoError(t, ds.PutCid(raw.Cid(), raw.RawData()))
+	}
+	assert.NoError(t, ds.Close())
+
+	methods := func() map[string]uint16 {
+		reader, err := zip.OpenReader("compress.zcar")
+		assert.NoError(t, err)
+		defer reader.Close()
+		methods := make(map[string]uint16)
+		for _, f := range reader.File {
+			methods[f.Name] = f.Method
+		}
+		return methods
+	}
+
+	assert.Equal(t, map[string]uint16{
+		rnd1.Cid().String():  zip.Store,
+		large.Cid().String(): zip.Deflate,
+	}, methods())
+
+	opts := DefaultOptions()
+	opts.MinCompressSize = 0
+	ds, err = NewDatastoreWithOptions("compress.zcar", &opts)
+	assert.NoError(t, err)
+	ds.SetComment("rewrite")
+	assert.NoError(t, ds.Close())
+
+	assert.Equal(t, map[string]uint16{
+		rnd1.Cid().String():  zip.Deflate,
+		large.Cid().String(): zip.Deflate,
+	}, methods())
+
+	ds, err = NewDatastore("compress.zcar")
+	assert.NoError(t, err)
+	defer ds.Close()
+	for _, raw := range []*dag.RawNode{rnd1, large} {
+		data, err := ds.GetCid(raw.Cid())
+		assert.NoError(t, err)
+		assert.Equal(t, raw.RawData(), data)
+	}
+}
+
+func TestRebuildIndex(t *testing.T) {
+	os.Remove("rebuild.zcar")
+	defer os.Remove("rebuild.zcar")
+
+	large := dag.NewRawNode(bytes.Repeat([]byte("large "), 20))
+	ds, err := NewDatastore("rebuild.zcar")
+	assert.NoError(t, err)
+	// a mix of stored and deflated entries
+	for _, raw := range []*dag.RawNode{rnd1, rnd2, large} {
+		assert.NoError(t, ds.PutCid(raw.Cid(), raw.RawData()))
+	}
+	assert.NoError(t, ds.Close())
+
+	// append a deflated entry that doesn't match its CID, and one without a CID filename
+	data, err := ioutil.ReadFile("rebuild.zcar")
+	assert.NoError(t, err)
+	cdStart := bytes.Index(data, []byte("PK\x01\x02"))
+	assert.True(t, cdStart > 0)
+	var buf bytes.Buffer
+	writer := zip.NewWriter(&buf)
+	for _, entry := range []struct{ name, data string }{
+		{rnd3.Cid().String(), "not cccc"},
+		{"README", "not a block"},
+	} {
+		f, err := writer.Create(entry.name)
+		assert.NoError(t, err)
+		_, err = f.Write([]byte(entry.data))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, writer.Close())
+
+	// and destroy the central directory
+	data = append(data[:cdStart], buf.Bytes()...)
+	copy(data[len(data)-22:], make([]byte, 22))
+	assert.NoError(t, ioutil.WriteFile("rebuild.zcar", data, 0644))
+	_, err = NewDatastore("rebuild.zcar")
+	assert.Error(t, err)
+
+	report, err := RebuildIndex("rebuild.zcar")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []cid.Cid{rnd1.Cid(), rnd2.Cid(), large.Cid()}, report.Recovered)
+	assert.ElementsMatch(t, []string{rnd3.Cid().String(), "README"}, report.Unrecoverable)
+
+	ds, err = NewDatastore("rebuild.zcar")
+	assert.NoError(t, err)
+	defer ds.Close()
+	for _, raw := range []*dag.RawNode{rnd1, rnd2, large} {
+		data, err := ds.GetCid(raw.Cid())
+		assert.NoError(t, err)
+		assert.Equal(t, raw.RawData(), data)
+	}
+	has, err := ds.HasCid(rnd3.Cid())
+	assert.NoError(t, err)
+	assert.False(t, has)
+}
+
+func TestPutCidResult(t *testing.T) {
+	os.Remove("putresult.zcar")
+	defer os.Remove("putresult.zcar")
+
+	ds, err := NewDatastore("putresult.zcar")
+	assert.NoError(t, err)
+	added, err := ds.PutCidResult(rnd1.Cid(), rnd1.RawData())
+	assert.NoError(t, err)
+	assert.True(t, added)
+	added, err = ds.PutCidResult(rnd1.Cid(), rnd1.RawData())
+	assert.NoError(t, err)
+	assert.False(t, added, "duplicate in the cache")
+	assert.NoError(t, ds.Close())
+
+	ds, err = NewDatastore("putresult.zcar")
+	assert.NoError(t, err)
+	defer ds.Close()
+	added, err = ds.PutCidResult(rnd1.Cid(), rnd1.RawData())
+	assert.NoError(t, err)
+	assert.False(t, added, "duplicate in the archive")
+	assert.NoError(t, ds.DeleteCid(rnd1.Cid()))
+	added, err = ds.PutCidResult(rnd1.Cid(), rnd1.RawData())
+	assert.NoError(t, err)
+	assert.True(t, added, "re-added after a delete")
+}
+
+func TestReadAppended(t *testing.T) {
+	// appended.zcar is js.zcar with a block for rndz and a README.txt appended using `zip -j` on the command line
+	copyFixture(t, "appended.zcar", "appended-copy.zcar")
+	defer os.Remove("appended-copy.zcar")
+
+	ds, err := NewDatastore("appended-copy.zcar")
+	assert.NoError(t, err)
+
+	verifyHasEntries(t, ds, false)
+	verifyProtoNodes(t, ds, false)
+	verifyCborNodes(t, ds, false)
+	verifyComment(t, ds, false)
+	for _, raw := range []*dag.RawNode{rnd1, rnd2, rnd3, rndz} {
+		data, err := ds.GetCid(raw.Cid())
+		assert.NoError(t, err)
+		assert.Equal(t, raw.RawData(), data)
+	}
+
+	// the README isn't a block so isn't visible
+	results, err := ds.Query(dsq.Query{KeysOnly: true})
+	assert.NoError(t, err)
+	entries, err := results.Rest()
+	assert.NoError(t, err)
+	assert.Equal(t, 10, len(entries))
+
+	// and is dropped on rewrite
+	ds.SetComment("rewrite")
+	assert.NoError(t, ds.Close())
+	reader, err := zip.OpenReader("appended-copy.zcar")
+	assert.NoError(t, err)
+	defer reader.Close()
+	assert.Equal(t, 10, len(reader.File))
+	for _, f := range reader.File {
+		assert.NotEqual(t, "README.txt", f.Name)
+	}
+}
+
+func TestMaxBlockSize(t *testing.T) {
+	os.Remove("maxsize.zcar")
+	defer os.Remove("maxsize.zcar")
+
+	opts := DefaultOptions()
+	opts.MaxBlockSize = 16
+	ds, err := NewDatastoreWithOptions("maxsize.zcar", &opts)
+	assert.NoError(t, err)
+	defer ds.Close()
+
+	exact := dag.NewRawNode(bytes.Repeat([]byte("a"), 16))
+	over := dag.NewRawNode(bytes.Repeat([]byte("a"), 17))
+	assert.NoError(t, ds.PutCid(exact.Cid(), exact.RawData()))
+	err = ds.PutCid(over.Cid(), over.RawData())
+	assert.Equal(t, &CidError{Cid: over.Cid().String(), Err: ErrBlockTooLarge}, err)
+	_, err = ds.PutData(over.RawData())
+	assert.True(t, errors.Is(err, ErrBlockTooLarge))
+
+	verifyHas(t, ds, exact.Cid(), "exact")
+	has, err := ds.HasCid(over.Cid())
+	assert.NoError(t, err)
+	assert.False(t, has)
+}
+
+func TestAllowedCodecs(t *testing.T) {
+	os.Remove("codecs.zcar")
+	defer os.Remove("codecs.zcar")
+
+	opts := DefaultOptions()
+	opts.AllowedCodecs = []uint64{cid.Raw, cid.DagCBOR}
+	ds, err := NewDatastoreWithOptions("codecs.zcar", &opts)
+	assert.NoError(t, err)
+	defer ds.Close()
+
+	assert.NoError(t, ds.PutCid(rnd1.Cid(), rnd1.RawData()))
+	assert.NoError(t, ds.PutCid(cnd1.Cid(), cnd1.RawData()))
+	// the offending CID is identified and the cause can still be matched
+	err = ds.PutCid(pnd1.Cid(), pnd1.RawData())
+	assert.Equal(t, &CidError{Cid: pnd1.Cid().String(), Err: ErrCodecNotAllowed}, err)
+	assert.EqualError(t, err, pnd1.Cid().String()+": zipcar: codec not allowed")
+	assert.True(t, errors.Is(err, ErrCodecNotAllowed))
+	var cidErr *CidError
+	assert.True(t, errors.As(err, &cidErr))
+	assert.Equal(t, pnd1.Cid().String(), cidErr.Cid)
+	_, err = ds.PutCidResult(pnd1.Cid(), pnd1.RawData())
+	assert.Equal(t, &CidError{Cid: pnd1.Cid().String(), Err: ErrCodecNotAllowed}, err)
+
+	has, err := ds.HasCid(pnd1.Cid())
+	assert.NoError(t, err)
+	assert.False(t, has)
+}
+
+func TestZipPassword(t *testing.T) {
+	// encrypted.zcar was created with `zip -P secret`, containing rnd1 (stored) and a larger deflated block
+	copyFixture(t, "encrypted.zcar", "encrypted-copy.zcar")
+	defer os.Remove("encrypted-copy.zcar")
+	large := dag.NewRawNode(bytes.Repeat([]byte("large "), 20))
+
+	ds, err := NewDatastore("encrypted-copy.zcar")
+	assert.NoError(t, err)
+	verifyHas(t, ds, rnd1.Cid(), "rnd1")
+	_, err = ds.GetCid(rnd1.Cid())
+	assert.Equal(t, &CidError{Cid: rnd1.Cid().String(), Err: ErrEncrypted}, err)
+	assert.NoError(t, ds.Close())
+
+	opts := DefaultOptions()
+	opts.ZipPassword = []byte("wrong")
+	ds, err = NewDatastoreWithOptions("encrypted-copy.zcar", &opts)
+	assert.NoError(t, err)
+	_, err = ds.GetCid(large.Cid())
+	assert.Error(t, err)
+	assert.NoError(t, ds.Close())
+
+	opts.ZipPassword = []byte("secret")
+	ds, err = NewDatastoreWithOptions("encrypted-copy.zcar", &opts)
+	assert.NoError(t, err)
+	for _, raw := range []*dag.RawNode{rnd1, large} {
+		data, err := ds.GetCid(raw.Cid())
+		assert.NoError(t, err)
+		assert.Equal(t, raw.RawData(), data)
+	}
+
+	// a rewrite removes the encryption
+	assert.NoError(t, ds.PutCid(rnd2.Cid(), rnd2.RawData()))
+	assert.NoError(t, ds.Close())
+	ds, err = NewDatastore("encrypted-copy.zcar")
+	assert.NoError(t, err)
+	defer ds.Close()
+	for _, raw := range []*dag.RawNode{rnd1, rnd2, large} {
+		data, err := ds.GetCid(raw.Cid())
+		assert.NoError(t, err)
+		assert.Equal(t, raw.RawData(), data)
+	}
+}
+
+func TestPruneToRoots(t *testing.T) {
+	copyFixture(t, "js.zcar", "prune.zcar")
+	defer os.Remove("prune.zcar")
+
+	ds, err := NewDatastore("prune.zcar")
+	assert.NoError(t, err)
+
+	// a block that can't be decoded is kept if it is a root, an orphan raw block is pruned
+	gitRaw, err := cid.Prefix{Version: 1, Codec: cid.GitRaw, MhType: mh.SHA2_256, MhLength: -1}.Sum([]byte("git"))
+	assert.NoError(t, err)
+	assert.NoError(t, ds.PutCid(gitRaw, []byte("git")))
+	assert.NoError(t, ds.PutCid(rndz.Cid(), rndz.RawData()))
+
+	removed, err := ds.PruneToRoots([]cid.Cid{pnd3.Cid(), gitRaw, rnd2.Cid(), dag.NewRawNode([]byte("nope")).Cid()})
+	assert.NoError(t, err)
+	assert.Equal(t, 4, removed) // cnd1, cnd2, cnd3 and rndz
+	assert.NoError(t, ds.Close())
+
+	ds, err = NewDatastore("prune.zcar")
+	assert.NoError(t, err)
+	defer ds.Close()
+	for _, c := range []cid.Cid{pnd3.Cid(), pnd2.Cid(), pnd1.Cid(), rnd1.Cid(), rnd2.Cid(), rnd3.Cid(), gitRaw} {
+		verifyHas(t, ds, c, c.String())
+	}
+	for _, c := range []cid.Cid{cnd1.Cid(), cnd2.Cid(), cnd3.Cid(), rndz.Cid()} {
+		has, err := ds.HasCid(c)
+		assert.NoError(t, err)
+		assert.Falsef(t, has, "%s should have been pruned", c)
+	}
+}
+
+func TestSerializedSize(t *testing.T) {
+	copyFixture(t, "js.zcar", "size.zcar")
+	defer os.Remove("size.zcar")
+	original, err := ioutil.ReadFile("size.zcar")
+	assert.NoError(t, err)
+
+	ds, err := NewDatastore("size.zcar")
+	assert.NoError(t, err)
+	assert.NoError(t, ds.DeleteCid(rnd2.Cid()))
+	assert.NoError(t, ds.PutCid(rndz.Cid(), rndz.RawData()))
+
+	size, err := ds.SerializedSize()
+	assert.NoError(t, err)
+
+	var buf bytes.Buffer
+	n, err := ds.WriteTo(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, size, n)
+	assert.Equal(t, size, int64(buf.Len()))
+	reader, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	assert.NoError(t, err)
+	assert.Equal(t, 9, len(reader.File))
+
+	// the file is untouched until Close()
+	current, err := ioutil.ReadFile("size.zcar")
+	assert.NoError(t, err)
+	assert.Equal(t, original, current)
+
+	assert.NoError(t, ds.Close())
+	fileinfo, err := os.Stat("size.zcar")
+	assert.NoError(t, err)
+	assert.Equal(t, size, fileinfo.Size())
+}
+
+func TestMmap(t *testing.T) {
+	os.Remove("mmap.zcar")
+	defer os.Remove("mmap.zcar")
+	large := dag.NewRawNode(bytes.Repeat([]byte("large "), 20))
+
+	ds, err := NewDatastore("mmap.zcar")
+	assert.NoError(t, err)
+	for _, raw := range []*dag.RawNode{rnd1, rnd2, large} {
+		assert.NoError(t, ds.PutCid(raw.Cid(), raw.RawData()))
+	}
+	assert.NoError(t, ds.Close())
+	original, err := ioutil.ReadFile("mmap.zcar")
+	assert.NoError(t, err)
+
+	opts := DefaultOptions()
+	opts.Mmap = true
+	_, err = NewDatastoreWithOptions("mmap-missing.zcar", &opts)
+	assert.True(t, os.IsNotExist(err))
+
+	ds, err = NewDatastoreWithOptions("mmap.zcar", &opts)
+	assert.NoError(t, err)
+	for _, raw := range []*dag.RawNode{rnd1, rnd2, large} { // stored and deflated
+		data, err := ds.GetCid(raw.Cid())
+		assert.NoError(t, err)
+		assert.Equal(t, raw.RawData(), data)
+	}
+
+	results, err := ds.Query(dsq.Query{})
+	assert.NoError(t, err)
+	entries, err := results.Rest()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(entries))
+
+	assert.Equal(t, &CidError{Cid: rnd3.Cid().String(), Err: ErrReadOnly}, ds.PutCid(rnd3.Cid(), rnd3.RawData()))
+	assert.Equal(t, &CidError{Cid: rnd1.Cid().String(), Err: ErrReadOnly}, ds.DeleteCid(rnd1.Cid()))
+	assert.Equal(t, ErrReadOnly, ds.SetEntryComment(rnd1.Cid(), "nope"))
+	ds.SetComment("nope")
+	assert.NoError(t, ds.Sync())
+	assert.NoError(t, ds.Close())
+
+	current, err := ioutil.ReadFile("mmap.zcar")
+	assert.NoError(t, err)
+	assert.Equal(t, original, current)
+}
+
+func TestTouch(t *testing.T) {
+	os.Remove("touch.zcar")
+	defer os.Remove("touch.zcar")
+
+	ds, err := NewDatastore("touch.zcar")
+	assert.NoError(t, err)
+	for _, raw := range []*dag.RawNode{rnd1, rnd2} {
+		assert.NoError(t, ds.PutCid(raw.Cid(), raw.RawData()))
+	}
+	touched := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	assert.NoError(t, ds.Touch(rnd1.Cid(), touched))
+	assert.Equal(t, datastore.ErrNotFound, ds.Touch(rnd3.Cid(), touched))
+	assert.NoError(t, ds.Close())
+
+	reader, err := zip.OpenReader("touch.zcar")
+	assert.NoError(t, err)
+	defer reader.Close()
+	for _, f := range reader.File {
+		if f.Name == rnd1.Cid().String() {
+			assert.True(t, touched.Equal(f.Modified), "unexpected modified time %v", f.Modified)
+		} else {
+			assert.True(t, f.Modified.After(touched))
+		}
+	}
+
+	ds, err = NewDatastore("touch.zcar")
+	assert.NoError(t, err)
+	defer ds.Close()
+	data, err := ds.GetCid(rnd1.Cid())
+	assert.NoError(t, err)
+	assert.Equal(t, rnd1.RawData(), data)
+}
+
+func TestEmptyBlock(t *testing.T) {
+	os.Remove("empty.zcar")
+	defer os.Remove("empty.zcar")
+
+	empty := dag.NewRawNode([]byte{})
+	ds, err := NewDatastore("empty.zcar")
+	assert.NoError(t, err)
+	c, err := ds.PutData(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, empty.Cid(), c)
+
+	verify := func(ds *ZipDatastore) {
+		verifyHas(t, ds, empty.Cid(), "empty")
+		data, err := ds.GetCid(empty.Cid())
+		assert.NoError(t, err)
+		assert.NotNil(t, data)
+		assert.Equal(t, 0, len(data))
+		size, err := ds.GetSizeCid(empty.Cid())
+		assert.NoError(t, err)
+		assert.Equal(t, 0, size)
+	}
+
+	verify(ds)
+	assert.NoError(t, ds.Close())
+
+	ds, err = NewDatastore("empty.zcar")
+	assert.NoError(t, err)
+	verify(ds)
+
+	// still distinct from a deleted block
+	assert.NoError(t, ds.DeleteCid(empty.Cid()))
+	has, err := ds.HasCid(empty.Cid())
+	assert.NoError(t, err)
+	assert.False(t, has)
+	_, err = ds.GetCid(empty.Cid())
+	assert.Equal(t, datastore.ErrNotFound, err)
+	assert.NoError(t, ds.PutCid(empty.Cid(), []byte{}))
+	verify(ds)
+	assert.NoError(t, ds.Close())
+}
+
+func TestLenientKeys(t *testing.T) {
+	os.Remove("lenient.zcar")
+	defer os.Remove("lenient.zcar")
+
+	blocksKey := datastore.NewKey("/blocks").Child(dshelp.CidToDsKey(pnd1.Cid()))
+	bareKey := datastore.NewKey(rnd1.Cid().String())
+	bareV0Key := datastore.NewKey(pnd2.Cid().String())
+
+	// the ds-help form is the only one accepted by default
+	ds, err := NewDatastore("lenient.zcar")
+	assert.NoError(t, err)
+	for _, key := range []datastore.Key{blocksKey, bareKey, bareV0Key} {
+		assert.Error(t, ds.Put(key, []byte("nope")))
+		_, err = ds.Has(key)
+		assert.Error(t, err)
+	}
+	assert.NoError(t, ds.Close())
+
+	opts := DefaultOptions()
+	opts.LenientKeys = true
+	ds, err = NewDatastoreWithOptions("lenient.zcar", &opts)
+	assert.NoError(t, err)
+	assert.NoError(t, ds.Put(blocksKey, pnd1.RawData()))
+	assert.NoError(t, ds.Put(bareKey, rnd1.RawData()))
+	assert.NoError(t, ds.Put(bareV0Key, pnd2.RawData()))
+
+	// each is stored under its CID and can be fetched with any of the key styles
+	verifyHas(t, ds, pnd1.Cid(), "pnd1")
+	verifyHas(t, ds, rnd1.Cid(), "rnd1")
+	verifyHas(t, ds, pnd2.Cid(), "pnd2")
+	for key, expected := range map[datastore.Key][]byte{
+		blocksKey:                                pnd1.RawData(),
+		datastore.NewKey(pnd1.Cid().String()):    pnd1.RawData(),
+		datastore.NewKey("/ipfs").Child(bareKey): rnd1.RawData(),
+		dshelp.CidToDsKey(pnd2.Cid()):            pnd2.RawData(),
+	} {
+		data, err := ds.Get(key)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, data)
+	}
+
+	_, err = ds.Get(datastore.NewKey("/blocks/notacid"))
+	assert.Error(t, err)
+	assert.NoError(t, ds.Delete(bareKey))
+	has, err := ds.HasCid(rnd1.Cid())
+	assert.NoError(t, err)
+	assert.False(t, has)
+	assert.NoError(t, ds.Close())
+}
+
+func TestIntegrityManifest(t *testing.T) {
+	copyFixture(t, "js.zcar", "manifest.zcar")
+	defer os.Remove("manifest.zcar")
+
+	// no manifest in an archive written without the option
+	ds, err := NewDatastore("manifest.zcar")
+	assert.NoError(t, err)
+	assert.Equal(t, ErrNoIntegrityManifest, ds.VerifyIntegrityManifest())
+	assert.NoError(t, ds.Close())
+
+	opts := DefaultOptions()
+	opts.WriteIntegrityManifest = true
+	ds, err = NewDatastoreWithOptions("manifest.zcar", &opts)
+	assert.NoError(t, err)
+	assert.NoError(t, ds.PutCid(rndz.Cid(), rndz.RawData()))
+	assert.NoError(t, ds.Close())
+
+	ds, err = NewDatastoreWithOptions("manifest.zcar", &opts)
+	assert.NoError(t, err)
+	assert.NoError(t, ds.VerifyIntegrityManifest())
+	// the manifest isn't a block
+	results, err := ds.Query(dsq.Query{KeysOnly: true})
+	assert.NoError(t, err)
+	entries, err := results.Rest()
+	assert.NoError(t, err)
+	assert.Equal(t, 10, len(entries))
+	assert.NoError(t, ds.Close())
+
+	reader, err := zip.OpenReader("manifest.zcar")
+	assert.NoError(t, err)
+	archive := make(map[string][]byte)
+	for _, f := range reader.File {
+		rc, err := f.Open()
+		assert.NoError(t, err)
+		archive[f.Name], err = ioutil.ReadAll(rc)
+		assert.NoError(t, err)
+		rc.Close()
+	}
+	reader.Close()
+	assert.Contains(t, string(archive[IntegrityManifestName]), rndz.Cid().String()+" "+hex.EncodeToString(rndz.Cid().Hash())+"\n")
+
+	tamper := func(change func(entries map[string][]byte)) error {
+		entries := make(map[string][]byte)
+		for name, data := range archive {
+			entries[name] = data
+		}
+		change(entries)
+		writeFixture(t, "manifest.zcar", entries)
+		ds, err := NewDatastore("manifest.zcar")
+		assert.NoError(t, err)
+		defer ds.Close()
+		return ds.VerifyIntegrityManifest()
+	}
+
+	// a substituted block has a valid CRC but doesn't match its CID
+	err = tamper(func(entries map[string][]byte) {
+		entries[rnd1.Cid().String()] = rnd2.RawData()
+	})
+	assert.EqualError(t, err, "zipcar: block "+rnd1.Cid().String()+" doesn't match its CID")
+	err = tamper(func(entries map[string][]byte) {
+		delete(entries, rnd1.Cid().String())
+	})
+	assert.EqualError(t, err, "zipcar: block "+rnd1.Cid().String()+" in integrity manifest is not in the archive")
+	extra := dag.NewRawNode([]byte("extra"))
+	err = tamper(func(entries map[string][]byte) {
+		entries[extra.Cid().String()] = extra.RawData()
+	})
+	assert.EqualError(t, err, "zipcar: block "+extra.Cid().String()+" is not in the integrity manifest")
+	assert.NoError(t, tamper(func(entries map[string][]byte) {}))
+}
+
+func TestStrictZcar(t *testing.T) {
+	opts := DefaultOptions()
+	opts.StrictZcar = true
+
+	ds, err := NewDatastoreWithOptions("js.zcar", &opts)
+	assert.NoError(t, err)
+	verifyHasEntries(t, ds, false)
+	assert.NoError(t, ds.Close())
+
+	// appended.zcar includes a README.txt
+	ds, err = NewDatastoreWithOptions("appended.zcar", &opts)
+	assert.Nil(t, ds)
+	assert.Equal(t, &NotZcarError{Names: []string{"README.txt"}}, err)
+	assert.EqualError(t, err, "zipcar: archive has entries that aren't CIDs: README.txt")
+
+	writeFixture(t, "strict.zcar", map[string][]byte{
+		rnd1.Cid().String():   rnd1.RawData(),
+		"notacid":             []byte("nope"),
+		IntegrityManifestName: []byte{},
+	})
+	defer os.Remove("strict.zcar")
+	_, err = NewDatastoreWithOptions("strict.zcar", &opts)
+	assert.Equal(t, &NotZcarError{Names: []string{"notacid"}}, err)
+}
+
+func TestSizeInfo(t *testing.T) {
+	os.Remove("sizeinfo.zcar")
+	defer os.Remove("sizeinfo.zcar")
+
+	large := dag.NewRawNode(bytes.Repeat([]byte("large "), 100))
+	ds, err := NewDatastore("sizeinfo.zcar")
+	assert.NoError(t, err)
+	assert.NoError(t, ds.PutCid(rnd1.Cid(), rnd1.RawData()))
+	assert.NoError(t, ds.PutCid(large.Cid(), large.RawData()))
+
+	uncompressed, compressed, method, err := ds.SizeInfo(large.Cid())
+	assert.NoError(t, err)
+	assert.Equal(t, int64(600), uncompressed)
+	assert.Equal(t, int64(600), compressed)
+	assert.Equal(t, MethodNotWritten, method)
+	assert.NoError(t, ds.Close())
+
+	ds, err = NewDatastore("sizeinfo.zcar")
+	assert.NoError(t, err)
+	defer ds.Close()
+
+	uncompressed, compressed, method, err = ds.SizeInfo(rnd1.Cid())
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4), uncompressed)
+	assert.Equal(t, int64(4), compressed)
+	assert.Equal(t, zip.Store, method)
+
+	uncompressed, compressed, method, err = ds.SizeInfo(large.Cid())
+	assert.NoError(t, err)
+	assert.Equal(t, int64(600), uncompressed)
+	assert.True(t, compressed < uncompressed)
+	assert.Equal(t, zip.Deflate, method)
+	// unchanged once the block has been read
+	_, err = ds.GetCid(large.Cid())
+	assert.NoError(t, err)
+	_, _, method, err = ds.SizeInfo(large.Cid())
+	assert.NoError(t, err)
+	assert.Equal(t, zip.Deflate, method)
+
+	assert.NoError(t, ds.DeleteCid(large.Cid()))
+	_, _, _, err = ds.SizeInfo(large.Cid())
+	assert.Equal(t, datastore.ErrNotFound, err)
+	_, _, _, err = ds.SizeInfo(rnd2.Cid())
+	assert.Equal(t, datastore.ErrNotFound, err)
+}
+
+func TestNewDatastoreFromReaderAt(t *testing.T) {
+	data, err := ioutil.ReadFile("js.zcar")
+	assert.NoError(t, err)
+
+	ds, err := NewDatastoreFromReaderAt(bytes.NewReader(data), int64(len(data)), nil)
+	assert.NoError(t, err)
+	verifyHasEntries(t, ds, false)
+	verifyRawNodes(t, ds, false)
+	verifyProtoNodes(t, ds, false)
+	verifyCborNodes(t, ds, false)
+	verifyComment(t, ds, false)
+
+	assert.Equal(t, &CidError{Cid: rndz.Cid().String(), Err: ErrReadOnly}, ds.PutCid(rndz.Cid(), rndz.RawData()))
+	assert.Equal(t, &CidError{Cid: rnd1.Cid().String(), Err: ErrReadOnly}, ds.DeleteCid(rnd1.Cid()))
+	assert.NoError(t, ds.Close())
+
+	_, err = NewDatastoreFromReaderAt(bytes.NewReader(data[:100]), 100, nil)
+	assert.Error(t, err)
+}
+
+func TestNewHTTPDatastore(t *testing.T) {
+	data, err := ioutil.ReadFile("js.zcar")
+	assert.NoError(t, err)
+
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/js.zcar" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method == http.MethodGet && r.Header.Get("Range") == "" {
+			http.Error(w, "range requests only", http.StatusForbidden)
+			return
+		}
+		requests++
+		http.ServeContent(w, r, "js.zcar", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+
+	ds, err := NewHTTPDatastore(server.URL + "/js.zcar")
+	assert.NoError(t, err)
+	verifyHasEntries(t, ds, false)
+	verifyRawNodes(t, ds, false)
+	verifyProtoNodes(t, ds, false)
+	verifyCborNodes(t, ds, false)
+	verifyComment(t, ds, false)
+	// reads are served from the data fetched by earlier range requests where they can be, a small archive
+	// needs no more than one for the central directory and one for the entries after the initial HEAD
+	assert.True(t, requests <= 3, "too many requests: %d", requests)
+	assert.Equal(t, &CidError{Cid: rndz.Cid().String(), Err: ErrReadOnly}, ds.PutCid(rndz.Cid(), rndz.RawData()))
+	assert.NoError(t, ds.Close())
+
+	_, err = NewHTTPDatastore(server.URL + "/missing.zcar")
+	assert.EqualError(t, err, "zipcar: unexpected HTTP status for "+server.URL+"/missing.zcar: 404 Not Found")
+}
+
+func TestProfile(t *testing.T) {
+	copyFixture(t, "js.zcar", "profile.zcar")
+	defer os.Remove("profile.zcar")
+
+	ds, err := NewDatastore("profile.zcar")
+	assert.NoError(t, err)
+	defer ds.Close()
+	large := dag.NewRawNode(bytes.Repeat([]byte("large "), 1000))
+	assert.NoError(t, ds.PutCid(large.Cid(), large.RawData()))
+	assert.NoError(t, ds.DeleteCid(rnd1.Cid()))
+
+	report, err := ds.Profile()
+	assert.NoError(t, err)
+	assert.Equal(t, 9, report.Entries)
+	assert.Equal(t, int64(291-4+6000), report.TotalBytes)
+	assert.Equal(t, map[uint64]int{cid.Raw: 3, cid.DagProtobuf: 3, cid.DagCBOR: 3}, report.Codecs)
+	assert.Equal(t, SizeBucket{Max: 64, Count: 6}, report.Sizes[1])
+	assert.Equal(t, SizeBucket{Max: 256, Count: 2}, report.Sizes[2])
+	assert.Equal(t, SizeBucket{Max: 16 << 10, Count: 1}, report.Sizes[5])
+
+	expected := `entries: 9
+bytes: 6287
+sizes:
+  <= 64: 6
+  <= 256: 2
+  <= 16384: 1
+codecs:
+  raw: 3
+  protobuf: 3
+  cbor: 3
+`
+	assert.Equal(t, expected, report.String())
+}
+
+func TestVerificationHints(t *testing.T) {
+	copyFixture(t, "js.zcar", "hints.zcar")
+	defer os.Remove("hints.zcar")
+
+	ds, err := NewDatastore("hints.zcar")
+	assert.NoError(t, err)
+	report, err := ds.Check()
+	assert.NoError(t, err)
+	assert.Equal(t, &CheckReport{Checked: 9}, report)
+	assert.NoError(t, ds.Close())
+
+	opts := DefaultOptions()
+	opts.WriteVerificationHints = true
+	ds, err = NewDatastoreWithOptions("hints.zcar", &opts)
+	assert.NoError(t, err)
+	// a block that doesn't match its CID is reported, and isn't given a hint when written
+	assert.NoError(t, ds.PutCid(rndz.Cid(), []byte("wrong")))
+	report, err = ds.Check()
+	assert.NoError(t, err)
+	assert.Equal(t, &CheckReport{Checked: 10, Mismatched: []cid.Cid{rndz.Cid()}}, report)
+	assert.NoError(t, ds.Close())
+
+	ds, err = NewDatastore("hints.zcar")
+	assert.NoError(t, err)
+	report, err = ds.Check()
+	assert.NoError(t, err)
+	assert.Equal(t, &CheckReport{Checked: 10, Mismatched: []cid.Cid{rndz.Cid()}}, report)
+	assert.NoError(t, ds.Close())
+
+	opts = DefaultOptions()
+	opts.UseVerificationHints = true
+	ds, err = NewDatastoreWithOptions("hints.zcar", &opts)
+	assert.NoError(t, err)
+	report, err = ds.Check()
+	assert.NoError(t, err)
+	assert.Equal(t, &CheckReport{Checked: 10, Hinted: 9, Mismatched: []cid.Cid{rndz.Cid()}}, report)
+	assert.NoError(t, ds.Close())
+
+	// a hint doesn't vouch for content that has been substituted since it was written
+	file, err := os.Create("hints.zcar")
+	assert.NoError(t, err)
+	writer := zip.NewWriter(file)
+	for _, raw := range []*dag.RawNode{rnd1, rnd2} {
+		data := raw.RawData()
+		if raw == rnd2 {
+			data = rnd3.RawData()
+		}
+		f, err := writer.CreateHeader(&zip.FileHeader{Name: raw.Cid().String(), Extra: verificationHint(raw.RawData())})
+		assert.NoError(t, err)
+		_, err = f.Write(data)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, writer.Close())
+	assert.NoError(t, file.Close())
+
+	ds, err = NewDatastoreWithOptions("hints.zcar", &opts)
+	assert.NoError(t, err)
+	defer ds.Close()
+	report, err = ds.Check()
+	assert.NoError(t, err)
+	assert.Equal(t, &CheckReport{Checked: 2, Hinted: 1, Mismatched: []cid.Cid{rnd2.Cid()}}, report)
+}
+
+func TestWriteCanonical(t *testing.T) {
+	os.Remove("canonical.zcar")
+	defer os.Remove("canonical.zcar")
+
+	large := dag.NewRawNode(bytes.Repeat([]byte("large "), 100))
+	blocks := []*dag.RawNode{rnd1, rnd2, rnd3, large}
+
+	canonical := func(ds *ZipDatastore) []byte {
+		var buf bytes.Buffer
+		n, err := ds.WriteCanonical(&buf)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(buf.Len()), n)
+		return buf.Bytes()
+	}
+
+	ds, err := NewDatastore("canonical.zcar")
+	assert.NoError(t, err)
+	for _, raw := range blocks {
+		assert.NoError(t, ds.PutCid(raw.Cid(), raw.RawData()))
+	}
+	ds.SetComment("golden")
+	assert.NoError(t, ds.Touch(rnd1.Cid(), time.Now()))
+	expected := canonical(ds)
+	assert.NoError(t, ds.Close())
+
+	// a golden hash, shared with other implementations, of the archive for these blocks and comment
+	sum := sha256.Sum256(expected)
+	assert.Equal(t, "14d7c43652cb61978686c5ce343692ade37d99717ab2194b4af42cc06d5f2a47", hex.EncodeToString(sum[:]))
+
+	// the same contents reached a different way, partly from the archive and in a different order
+	ds, err = NewDatastore("canonical.zcar")
+	assert.NoError(t, err)
+	assert.NoError(t, ds.DeleteCid(rnd2.Cid()))
+	assert.NoError(t, ds.PutCid(rndz.Cid(), rndz.RawData()))
+	assert.NoError(t, ds.DeleteCid(rndz.Cid()))
+	assert.NoError(t, ds.PutCid(rnd2.Cid(), rnd2.RawData()))
+	assert.Equal(t, expected, canonical(ds))
+	assert.NoError(t, ds.Close())
+
+	ds, err = NewDatastore("canonical.zcar")
+	assert.NoError(t, err)
+	defer ds.Close()
+	assert.Equal(t, expected, canonical(ds))
+
+	reader, err := zip.NewReader(bytes.NewReader(expected), int64(len(expected)))
+	assert.NoError(t, err)
+	assert.Equal(t, "golden", reader.Comment)
+	var names []string
+	for _, f := range reader.File {
+		names = append(names, f.Name)
+		assert.Equal(t, zip.Store, f.Method)
+	}
+	assert.True(t, sort.StringsAreSorted(names))
+	assert.Equal(t, 4, len(names))
+}
+
+func TestPendingChanges(t *testing.T) {
+	copyFixture(t, "js.zcar", "pending.zcar")
+	defer os.Remove("pending.zcar")
+
+	for _, compact := range []bool{false, true} {
+		opts := DefaultOptions()
+		opts.CompactIndex = compact
+		ds, err := NewDatastoreWithOptions("pending.zcar", &opts)
+		assert.NoError(t, err)
+
+		added, deleted, err := ds.PendingChanges()
+		assert.NoError(t, err)
+		assert.Empty(t, added)
+		assert.Empty(t, deleted)
+		assert.False(t, ds.IsModified())
+
+		extra := dag.NewRawNode([]byte("extra"))
+		assert.NoError(t, ds.PutCid(rndz.Cid(), rndz.RawData()))
+		assert.NoError(t, ds.PutCid(extra.Cid(), extra.RawData()))
+		assert.NoError(t, ds.DeleteCid(extra.Cid())) // never written, so not a change
+		assert.NoError(t, ds.DeleteCid(rnd2.Cid()))
+		assert.NoError(t, ds.DeleteCid(rnd1.Cid()))
+		assert.NoError(t, ds.DeleteCid(dag.NewRawNode([]byte("absent")).Cid()))
+		// reading a block doesn't make it a change
+		_, err = ds.GetCid(rnd3.Cid())
+		assert.NoError(t, err)
+
+		added, deleted, err = ds.PendingChanges()
+		assert.NoError(t, err)
+		assert.Equal(t, []cid.Cid{rndz.Cid()}, added)
+		assert.Equal(t, []cid.Cid{rnd1.Cid(), rnd2.Cid()}, deleted)
+		assert.True(t, ds.IsModified())
+
+		// nothing is pending once written
+		assert.NoError(t, ds.Sync())
+		added, deleted, err = ds.PendingChanges()
+		assert.NoError(t, err)
+		assert.Empty(t, added)
+		assert.Empty(t, deleted)
+		assert.False(t, ds.IsModified())
+
+		// modified without any blocks changing
+		ds.SetComment("changed")
+		added, deleted, err = ds.PendingChanges()
+		assert.NoError(t, err)
+		assert.Empty(t, added)
+		assert.Empty(t, deleted)
+		assert.True(t, ds.IsModified())
+		assert.NoError(t, ds.Close())
+		copyFixture(t, "js.zcar", "pending.zcar")
+	}
+}
+
+func TestEmptyFile(t *testing.T) {
+	defer os.Remove("emptyfile.zcar")
+
+	for _, mmap := range []bool{false, true} {
+		assert.NoError(t, ioutil.WriteFile("emptyfile.zcar", []byte{}, 0644))
+		opts := DefaultOptions()
+		opts.Mmap = mmap
+		ds, err := NewDatastoreWithOptions("emptyfile.zcar", &opts)
+		assert.NoError(t, err)
+		has, err := ds.HasCid(rnd1.Cid())
+		assert.NoError(t, err)
+		assert.False(t, has)
+		results, err := ds.Query(dsq.Query{KeysOnly: true})
+		assert.NoError(t, err)
+		entries, err := results.Rest()
+		assert.NoError(t, err)
+		assert.Empty(t, entries)
+		assert.NoError(t, ds.Close())
+	}
+
+	// usable as a new archive
+	ds, err := NewDatastore("emptyfile.zcar")
+	assert.NoError(t, err)
+	assert.NoError(t, ds.PutCid(rnd1.Cid(), rnd1.RawData()))
+	assert.NoError(t, ds.Close())
+	ds, err = NewDatastore("emptyfile.zcar")
+	assert.NoError(t, err)
+	defer ds.Close()
+	verifyHas(t, ds, rnd1.Cid(), "rnd1")
+}
+
+func TestCopyOnGet(t *testing.T) {
+	copyFixture(t, "js.zcar", "copyonget.zcar")
+	defer os.Remove("copyonget.zcar")
+
+	opts := DefaultOptions()
+	opts.CopyOnGet = true
+	ds, err := NewDatastoreWithOptions("copyonget.zcar", &opts)
+	assert.NoError(t, err)
+	assert.NoError(t, ds.PutCid(rndz.Cid(), rndz.RawData()))
+
+	// one from the archive and one only in memory
+	for _, raw := range []*dag.RawNode{rnd1, rndz} {
+		data, err := ds.GetCid(raw.Cid())
+		assert.NoError(t, err)
+		data[0] = 'x'
+		data, err = ds.GetCid(raw.Cid())
+		assert.NoError(t, err)
+		assert.Equal(t, raw.RawData(), data)
+	}
+	assert.NoError(t, ds.Close())
+
+	ds, err = NewDatastoreWithOptions("copyonget.zcar", &opts)
+	assert.NoError(t, err)
+	defer ds.Close()
+	verifyRawNodes(t, ds, false)
+	data, err := ds.GetCid(rndz.Cid())
+	assert.NoError(t, err)
+	assert.Equal(t, rndz.RawData(), data)
+}
+
+func TestCopyOnPut(t *testing.T) {
+	os.Remove("copyonput.zcar")
+	defer os.Remove("copyonput.zcar")
+
+	ds, err := NewDatastore("copyonput.zcar")
+	assert.NoError(t, err)
+	buf := append([]byte{}, rnd1.RawData()...)
+	assert.NoError(t, ds.PutCid(rnd1.Cid(), buf))
+	// the buffer is reused for the next block
+	copy(buf, rnd2.RawData())
+	assert.NoError(t, ds.PutCid(rnd2.Cid(), buf))
+
+	verify := func() {
+		for _, raw := range []*dag.RawNode{rnd1, rnd2} {
+			data, err := ds.GetCid(raw.Cid())
+			assert.NoError(t, err)
+			assert.Equal(t, raw.RawData(), data)
+		}
+	}
+	verify()
+	assert.NoError(t, ds.Close())
+	ds, err = NewDatastore("copyonput.zcar")
+	assert.NoError(t, err)
+	verify()
+	assert.NoError(t, ds.Close())
+
+	// without the copy, the caller's slice is retained
+	opts := DefaultOptions()
+	opts.CopyOnPut = false
+	ds, err = NewDatastoreWithOptions("copyonput.zcar", &opts)
+	assert.NoError(t, err)
+	defer ds.Close()
+	buf = append([]byte{}, rnd3.RawData()...)
+	assert.NoError(t, ds.PutCid(rnd3.Cid(), buf))
+	buf[0] = 'x'
+	data, err := ds.GetCid(rnd3.Cid())
+	assert.NoError(t, err)
+	assert.Equal(t, buf, data)
+}
+
+func TestValidate(t *testing.T) {
+	assert.NoError(t, Validate("js.zcar", false))
+	assert.NoError(t, Validate("js.zcar", true))
+
+	err := Validate("appended.zcar", false)
+	assert.Equal(t, &ValidationError{NotCids: []string{"README.txt"}}, err)
+	assert.EqualError(t, err, "zipcar: invalid archive: entries that aren't CIDs: README.txt")
+
+	err = Validate("encrypted.zcar", true)
+	assert.Equal(t, 2, len(err.(*ValidationError).Unreadable))
+	assert.NoError(t, Validate("encrypted.zcar", false))
+
+	defer os.Remove("validate.zcar")
+	writeFixture(t, "validate.zcar", map[string][]byte{
+		rnd1.Cid().String():   rnd1.RawData(),
+		rnd2.Cid().String():   rnd3.RawData(),
+		"notacid":             []byte("nope"),
+		IntegrityManifestName: []byte{},
+	})
+	err = Validate("validate.zcar", false)
+	assert.Equal(t, &ValidationError{NotCids: []string{"notacid"}}, err)
+	err = Validate("validate.zcar", true)
+	assert.Equal(t, &ValidationError{NotCids: []string{"notacid"}, Mismatched: []cid.Cid{rnd2.Cid()}}, err)
+	assert.EqualError(t, err, "zipcar: invalid archive: entries that aren't CIDs: notacid; blocks that don't match their CIDs: "+rnd2.Cid().String())
+
+	assert.NoError(t, ioutil.WriteFile("validate.zcar", []byte("not a zip"), 0644))
+	err = Validate("validate.zcar", false)
+	assert.Equal(t, zip.ErrFormat, err)
+	assert.True(t, os.IsNotExist(Validate("nonexistent.zcar", false)))
+}
+
+func TestIdentityCid(t *testing.T) {
+	os.Remove("identity.zcar")
+	defer os.Remove("identity.zcar")
+
+	prefix := cid.Prefix{Version: 1, Codec: cid.Raw, MhType: mh.ID, MhLength: -1}
+	inline, err := prefix.Sum([]byte("inline"))
+	assert.NoError(t, err)
+
+	ds, err := NewDatastore("identity.zcar")
+	assert.NoError(t, err)
+	// available without having been stored
+	verifyHas(t, ds, inline, "inline")
+	data, err := ds.GetCid(inline)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("inline"), data)
+	size, err := ds.GetSizeCid(inline)
+	assert.NoError(t, err)
+	assert.Equal(t, 6, size)
+
+	// storing is a no-op
+	added, err := ds.PutCidResult(inline, []byte("inline"))
+	assert.NoError(t, err)
+	assert.False(t, added)
+	assert.NoError(t, ds.PutCid(inline, []byte("inline")))
+	assert.NoError(t, ds.PutCid(rnd1.Cid(), rnd1.RawData()))
+	assert.NoError(t, ds.Close())
+
+	reader, err := zip.OpenReader("identity.zcar")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(reader.File))
+	assert.Equal(t, rnd1.Cid().String(), reader.File[0].Name)
+	reader.Close()
+
+	ds, err = NewDatastore("identity.zcar")
+	assert.NoError(t, err)
+	defer ds.Close()
+	data, err = ds.GetCid(inline)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("inline"), data)
+}
+
+func TestNameTransform(t *testing.T) {
+	os.Remove("sharded.zcar")
+	defer os.Remove("sharded.zcar")
+
+	shard := PrefixShard(2, 2)
+	name := shard.Name(rnd1.Cid().String())
+	assert.Equal(t, rnd1.Cid().String()[:2]+"/"+rnd1.Cid().String()[2:4]+"/"+rnd1.Cid().String()[4:], name)
+	cidStr, ok := shard.Cid(name)
+	assert.True(t, ok)
+	assert.Equal(t, rnd1.Cid().String(), cidStr)
+	for _, name := range []string{rnd1.Cid().String(), "ba/", "ba/fk/", "bafk/re/xyz", "ba/fk/re/xyz"} {
+		_, ok = shard.Cid(name)
+		assert.False(t, ok, name)
+	}
+
+	opts := DefaultOptions()
+	opts.NameTransform = shard
+	ds, err := NewDatastoreWithOptions("sharded.zcar", &opts)
+	assert.NoError(t, err)
+	for _, raw := range []*dag.RawNode{rnd1, rnd2, rnd3} {
+		assert.NoError(t, ds.PutCid(raw.Cid(), raw.RawData()))
+	}
+	assert.NoError(t, ds.Close())
+
+	reader, err := zip.OpenReader("sharded.zcar")
+	assert.NoError(t, err)
+	for _, f := range reader.File {
+		assert.Equal(t, 2, strings.Count(f.Name, "/"), f.Name)
+	}
+	reader.Close()
+
+	ds, err = NewDatastoreWithOptions("sharded.zcar", &opts)
+	assert.NoError(t, err)
+	verifyRawNodes(t, ds, false)
+	results, err := ds.Query(dsq.Query{KeysOnly: true})
+	assert.NoError(t, err)
+	entries, err := results.Rest()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(entries))
+	assert.NoError(t, ds.Close())
+
+	// the entries aren't blocks without the transform
+	ds, err = NewDatastore("sharded.zcar")
+	assert.NoError(t, err)
+	has, err := ds.HasCid(rnd1.Cid())
+	assert.NoError(t, err)
+	assert.False(t, has)
+	assert.NoError(t, ds.Close())
+
+	// as written by a ZIP tool, with directory entries
+	cidStr = rndz.Cid().String()
+	writeFixture(t, "sharded.zcar", map[string][]byte{
+		cidStr[:2] + "/":                              nil,
+		cidStr[:2] + "/" + cidStr[2:4] + "/":          nil,
+		shard.Name(strings.ToUpper(cidStr)):           rndz.RawData(),
+		cidStr[:2] + "/" + cidStr[2:4] + "/README.md": []byte("not a block"),
+	})
+	opts.StrictZcar = true
+	_, err = NewDatastoreWithOptions("sharded.zcar", &opts)
+	assert.Equal(t, &NotZcarError{Names: []string{cidStr[:2] + "/" + cidStr[2:4] + "/README.md"}}, err)
+	opts.StrictZcar = false
+	ds, err = NewDatastoreWithOptions("sharded.zcar", &opts)
+	assert.NoError(t, err)
+	defer ds.Close()
+	data, err := ds.GetCid(rndz.Cid())
+	assert.NoError(t, err)
+	assert.Equal(t, rndz.RawData(), data)
+}
+
+func TestWriteStream(t *testing.T) {
+	os.Remove("stream.zcar")
+	defer os.Remove("stream.zcar")
+
+	file, err := os.Create("stream.zcar")
+	assert.NoError(t, err)
+	ch := make(chan blocks.Block)
+	errCh := make(chan error)
+	go func() {
+		errCh <- WriteStream(file, ch)
+	}()
+	for _, block := range []blocks.Block{rnd1, pnd1, cnd1, rnd1, rnd2, dag.NewRawNode(bytes.Repeat([]byte("large "), 100))} {
+		ch <- block
+	}
+	close(ch)
+	assert.NoError(t, <-errCh)
+	assert.NoError(t, file.Close())
+
+	reader, err := zip.OpenReader("stream.zcar")
+	assert.NoError(t, err)
+	assert.Equal(t, 5, len(reader.File)) // rnd1 once
+	assert.Equal(t, zip.Store, reader.File[0].Method)
+	assert.Equal(t, zip.Deflate, reader.File[4].Method)
+	reader.Close()
+
+	ds, err := NewDatastore("stream.zcar")
+	assert.NoError(t, err)
+	defer ds.Close()
+	for _, block := range []blocks.Block{rnd1, rnd2, pnd1, cnd1} {
+		data, err := ds.GetCid(block.Cid())
+		assert.NoError(t, err)
+		assert.Equal(t, block.RawData(), data)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	copyFixture(t, "appended.zcar", "compact.zcar")
+	defer os.Remove("compact.zcar")
+	size := func() int64 {
+		fileinfo, err := os.Stat("compact.zcar")
+		assert.NoError(t, err)
+		return fileinfo.Size()
+	}
+
+	ds, err := NewDatastore("compact.zcar")
+	assert.NoError(t, err)
+	// with no mutations, the README and superseded entries are dropped
+	before := size()
+	reclaimed, err := ds.Compact()
+	assert.NoError(t, err)
+	assert.Equal(t, before-reclaimed, size())
+	reader, err := zip.OpenReader("compact.zcar")
+	assert.NoError(t, err)
+	assert.Equal(t, 10, len(reader.File))
+	reader.Close()
+
+	// via the ds.GCDatastore interface
+	assert.NoError(t, ds.DeleteCid(rnd1.Cid()))
+	assert.NoError(t, ds.DeleteCid(rnd2.Cid()))
+	before = size()
+	var gc datastore.GCDatastore = ds
+	assert.NoError(t, gc.CollectGarbage())
+	assert.True(t, size() < before)
+	reader, err = zip.OpenReader("compact.zcar")
+	assert.NoError(t, err)
+	assert.Equal(t, 8, len(reader.File))
+	reader.Close()
+
+	verifyHas(t, ds, rnd3.Cid(), "rnd3")
+	assert.NoError(t, ds.Close())
+	_, err = ds.Compact()
+	assert.Equal(t, ErrClosed, err)
+}
+
+func TestPreserveExtras(t *testing.T) {
+	readme := func(path string) []byte {
+		reader, err := zip.OpenReader(path)
+		assert.NoError(t, err)
+		defer reader.Close()
+		for _, f := range reader.File {
+			if f.Name == "README.txt" {
+				rc, err := f.Open()
+				assert.NoError(t, err)
+				defer rc.Close()
+				data, err := ioutil.ReadAll(rc)
+				assert.NoError(t, err)
+				return data
+			}
+		}
+		return nil
+	}
+	original := readme("appended.zcar")
+	assert.NotNil(t, original)
+
+	copyFixture(t, "appended.zcar", "extras.zcar")
+	defer os.Remove("extras.zcar")
+	opts := DefaultOptions()
+	opts.PreserveExtras = true
+	ds, err := NewDatastoreWithOptions("extras.zcar", &opts)
+	assert.NoError(t, err)
+	assert.NoError(t, ds.DeleteCid(rnd1.Cid()))
+	assert.NoError(t, ds.Close())
+	assert.Equal(t, original, readme("extras.zcar"))
+
+	// survives repeated rewrites, and WriteTo()
+	ds, err = NewDatastoreWithOptions("extras.zcar", &opts)
+	assert.NoError(t, err)
+	assert.NoError(t, ds.DeleteCid(rnd2.Cid()))
+	var buf bytes.Buffer
+	_, err = ds.WriteTo(&buf)
+	assert.NoError(t, err)
+	assert.NoError(t, ds.Close())
+	assert.Equal(t, original, readme("extras.zcar"))
+	assert.NoError(t, ioutil.WriteFile("extras.zcar", buf.Bytes(), 0644))
+	assert.Equal(t, original, readme("extras.zcar"))
+
+	// dropped without the option
+	ds, err = NewDatastore("extras.zcar")
+	assert.NoError(t, err)
+	assert.NoError(t, ds.DeleteCid(rnd3.Cid()))
+	assert.NoError(t, ds.Close())
+	assert.Nil(t, readme("extras.zcar"))
+}
+
+func TestHasRaw(t *testing.T) {
+	copyFixture(t, "js.zcar", "hasraw.zcar")
+	defer os.Remove("hasraw.zcar")
+	ds, err := NewDatastore("hasraw.zcar")
+	assert.NoError(t, err)
+	defer ds.Close()
+	for _, block := range []blocks.Block{rnd1, rnd2, rnd3} {
+		has, err := ds.HasCid(block.Cid())
+		assert.NoError(t, err)
+		assert.Equal(t, has, ds.HasRaw(block.Cid()))
+		assert.True(t, has)
+	}
+	assert.False(t, ds.HasRaw(dag.NewRawNode([]byte("not here")).Cid()))
+	assert.False(t, ds.HasRaw(cid.Undef))
+
+	assert.NoError(t, ds.DeleteCid(rnd1.Cid()))
+	assert.False(t, ds.HasRaw(rnd1.Cid()))
+}
+
+func TestRewriteInPlace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zipcar")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer os.RemoveAll(dir + ".moved")
+	path := filepath.Join(dir, "inplace.zcar")
+
+	ds, err := NewDatastore(path)
+	assert.NoError(t, err)
+	assert.NoError(t, ds.PutCid(rnd1.Cid(), rnd1.RawData()))
+	file := ds.file
+	assert.NoError(t, ds.Sync())
+	assert.True(t, file == ds.file, "rewrite should keep the same descriptor")
+	verifyHas(t, ds, rnd1.Cid(), "rnd1")
+
+	// the rewrite follows the open file rather than its former path
+	assert.NoError(t, ds.PutCid(rnd2.Cid(), rnd2.RawData()))
+	assert.NoError(t, os.Rename(dir, dir+".moved"))
+	assert.NoError(t, ds.Sync())
+	assert.True(t, file == ds.file, "rewrite should keep the same descriptor")
+	assert.NoError(t, ds.DeleteCid(rnd1.Cid()))
+	assert.NoError(t, ds.Close())
+
+	ds, err = NewDatastore(filepath.Join(dir+".moved", "inplace.zcar"))
+	assert.NoError(t, err)
+	defer ds.Close()
+	verifyHas(t, ds, rnd2.Cid(), "rnd2")
+	has, err := ds.HasCid(rnd1.Cid())
+	assert.NoError(t, err)
+	assert.False(t, has)
+}
+
+func TestDedupByMultihash(t *testing.T) {
+	os.Remove("dedup.zcar")
+	defer os.Remove("dedup.zcar")
+	assert.Equal(t, uint64(0), pnd1.Cid().Version())
+	v1 := cid.NewCidV1(cid.DagProtobuf, pnd1.Cid().Hash())
+	raw := cid.NewCidV1(cid.Raw, rnd1.Cid().Hash())
+	v0 := cid.NewCidV0(rnd1.Cid().Hash())
+
+	ds, err := NewDatastore("dedup.zcar")
+	assert.NoError(t, err)
+	assert.NoError(t, ds.PutCid(pnd1.Cid(), pnd1.RawData()))
+	assert.NoError(t, ds.PutCid(rnd1.Cid(), rnd1.RawData()))
+	has, err := ds.HasCid(v1)
+	assert.NoError(t, err)
+	assert.False(t, has, "CIDv1 form should not match without DedupByMultihash")
+	assert.NoError(t, ds.Close())
+
+	opts := DefaultOptions()
+	opts.DedupByMultihash = true
+	ds, err = NewDatastoreWithOptions("dedup.zcar", &opts)
+	assert.NoError(t, err)
+	defer ds.Close()
+	for _, c := range []cid.Cid{v1, pnd1.Cid()} {
+		verifyHas(t, ds, c, c.String())
+		assert.True(t, ds.HasRaw(c))
+		data, err := ds.GetCid(c)
+		assert.NoError(t, err)
+		assert.Equal(t, pnd1.RawData(), data)
+		size, err := ds.GetSizeCid(c)
+		assert.NoError(t, err)
+		assert.Equal(t, len(pnd1.RawData()), size)
+	}
+	// from CIDv1 to CIDv0, across codecs
+	for _, c := range []cid.Cid{raw, v0} {
+		data, err := ds.GetCid(c)
+		assert.NoError(t, err)
+		assert.Equal(t, rnd1.RawData(), data)
+	}
+
+	// an exact match is preferred
+	assert.NoError(t, ds.PutCid(v0, []byte("different")))
+	data, err := ds.GetCid(v0)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("different"), data)
+	data, err = ds.GetCid(raw)
+	assert.NoError(t, err)
+	assert.Equal(t, rnd1.RawData(), data)
+
+	// deletes apply to the exact CID only, and are reflected in lookups by multihash
+	assert.NoError(t, ds.DeleteCid(v1))
+	verifyHas(t, ds, v1, "v1")
+	assert.NoError(t, ds.DeleteCid(pnd1.Cid()))
+	has, err = ds.HasCid(v1)
+	assert.NoError(t, err)
+	assert.False(t, has)
+	_, err = ds.GetCid(v1)
+	assert.Equal(t, datastore.ErrNotFound, err)
+}
+
+func TestEntryLocations(t *testing.T) {
+	defer os.Remove("locations.zcar")
+
+	for _, compact := range []bool{false, true} {
+		copyFixture(t, "js.zcar", "locations.zcar")
+		opts := DefaultOptions()
+		opts.CompactIndex = compact
+		ds, err := NewDatastoreWithOptions("locations.zcar", &opts)
+		assert.NoError(t, err)
+		assert.NoError(t, ds.DeleteCid(rnd1.Cid()))
+		assert.NoError(t, ds.PutCid(rndz.Cid(), rndz.RawData()))
+
+		locations, err := ds.EntryLocations()
+		assert.NoError(t, err)
+		assert.Equal(t, 8, len(locations))
+		_, ok := locations[rnd1.Cid()]
+		assert.False(t, ok, "deleted block should be absent")
+		_, ok = locations[rndz.Cid()]
+		assert.False(t, ok, "unwritten block should be absent")
+
+		// the block can be read directly from the file at its offset
+		file, err := os.Open("locations.zcar")
+		assert.NoError(t, err)
+		for _, block := range []blocks.Block{rnd2, pnd1, cnd1} {
+			offset, ok := locations[block.Cid()]
+			assert.True(t, ok)
+			_, compressed, method, err := ds.SizeInfo(block.Cid())
+			assert.NoError(t, err)
+			var r io.Reader = io.NewSectionReader(file, offset, compressed)
+			if method == zip.Deflate {
+				r = flate.NewReader(r)
+			}
+			data, err := ioutil.ReadAll(r)
+			assert.NoError(t, err)
+			assert.Equal(t, block.RawData(), data)
+		}
+		assert.NoError(t, file.Close())
+		assert.NoError(t, ds.Close())
+	}
+}
+
+func TestModTime(t *testing.T) {
+	copyFixture(t, "js.zcar", "modtime.zcar")
+	defer os.Remove("modtime.zcar")
+	modTime := time.Date(2019, 7, 1, 12, 30, 0, 0, time.UTC)
+	touched := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+
+	opts := DefaultOptions()
+	opts.ModTime = &modTime
+	ds, err := NewDatastoreWithOptions("modtime.zcar", &opts)
+	assert.NoError(t, err)
+	assert.NoError(t, ds.PutCid(rndz.Cid(), rndz.RawData()))
+	assert.NoError(t, ds.Touch(rnd1.Cid(), touched))
+	assert.NoError(t, ds.Close())
+
+	reader, err := zip.OpenReader("modtime.zcar")
+	assert.NoError(t, err)
+	defer reader.Close()
+	rnd1Name, _ := cidToString(rnd1.Cid())
+	assert.Equal(t, 10, len(reader.File))
+	for _, f := range reader.File {
+		expected := modTime
+		if f.Name == *rnd1Name {
+			expected = touched
+		}
+		assert.Truef(t, expected.Equal(f.Modified), "%s modified %v, expected %v", f.Name, f.Modified, expected)
+	}
+}
+
+// updateGolden regenerates golden.zcar from js.zcar rather than checking against it, for deliberate changes to the
+// archive layout, which must be matched by the JavaScript implementation: go test -run TestGoldenJS -update-golden
+var updateGolden = flag.Bool("update-golden", false, "rewrite golden.zcar")
+
+func TestGoldenJS(t *testing.T) {
+	ds, err := NewDatastore("js.zcar")
+	assert.NoError(t, err)
+	defer ds.Close()
+	var buf bytes.Buffer
+	_, err = ds.WriteCanonical(&buf)
+	assert.NoError(t, err)
+	actual := buf.Bytes()
+
+	if *updateGolden {
+		assert.NoError(t, ioutil.WriteFile("golden.zcar", actual, 0644))
+	}
+	expected, err := ioutil.ReadFile("golden.zcar")
+	assert.NoError(t, err)
+
+	// compare the structure first so a mismatch is described, then every byte
+	assert.Equal(t, zipLayout(t, expected), zipLayout(t, actual))
+	assert.Equal(t, expected, actual, "golden.zcar doesn't match, see -update-golden")
+
+	// the contract with the JavaScript implementation: the same blocks and comment have the same entry names, all
+	// at the root of the archive, and the comment is the archive comment
+	jsReader, err := zip.OpenReader("js.zcar")
+	assert.NoError(t, err)
+	defer jsReader.Close()
+	goldenReader, err := zip.NewReader(bytes.NewReader(expected), int64(len(expected)))
+	assert.NoError(t, err)
+	var jsNames, goldenNames []string
+	for _, f := range jsReader.File {
+		jsNames = append(jsNames, f.Name)
+	}
+	for _, f := range goldenReader.File {
+		assert.NotContains(t, f.Name, "/")
+		goldenNames = append(goldenNames, f.Name)
+	}
+	assert.True(t, sort.StringsAreSorted(goldenNames), "canonical entries should be in filename order")
+	sort.Strings(jsNames)
+	assert.Equal(t, jsNames, goldenNames)
+	assert.Equal(t, jsReader.Comment, goldenReader.Comment)
+}
+
+// zipLayout describes the entries of the ZIP archive in `data`, one line each in archive order, followed by the
+// archive comment.
+func zipLayout(t *testing.T, data []byte) []string {
+	reader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	var layout []string
+	for _, f := range reader.File {
+		offset, err := f.DataOffset()
+		assert.NoError(t, err)
+		layout = append(layout, fmt.Sprintf("%s method=%d flags=%#x size=%d compressed=%d crc=%08x offset=%d modified=%s",
+			f.Name, f.Method, f.Flags, f.UncompressedSize64, f.CompressedSize64, f.CRC32, offset,
+			f.Modified.UTC().Format(time.RFC3339)))
+	}
+	return append(layout, fmt.Sprintf("comment=%q", reader.Comment))
+}
+
+func TestReadComment(t *testing.T) {
+	comment, err := ReadComment("js.zcar")
+	assert.NoError(t, err)
+	assert.Equal(t, "bafyreih34u3kglyunorqexbllnkkejmxtvrbwivtz63iaujzf5w47nbvka", comment)
+
+	os.Remove("comment.zcar")
+	defer os.Remove("comment.zcar")
+	for _, expected := range []string{"", "root", strings.Repeat("long comment ", 5000)} {
+		ds, err := NewDatastore("comment.zcar")
+		assert.NoError(t, err)
+		assert.NoError(t, ds.PutCid(rnd1.Cid(), rnd1.RawData()))
+		ds.SetComment(expected)
+		assert.NoError(t, ds.Close())
+		comment, err = ReadComment("comment.zcar")
+		assert.NoError(t, err)
+		assert.Equal(t, expected, comment)
+	}
+
+	assert.NoError(t, ioutil.WriteFile("comment.zcar", []byte("not a zip archive"), 0644))
+	_, err = ReadComment("comment.zcar")
+	assert.Equal(t, zip.ErrFormat, err)
+	_, err = ReadComment("nonexistent.zcar")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestExportCar(t *testing.T) {
+	copyFixture(t, "js.zcar", "export.zcar")
+	defer os.Remove("export.zcar")
+	ds, err := NewDatastore("export.zcar")
+	assert.NoError(t, err)
+	defer ds.Close()
+	assert.NoError(t, ds.DeleteCid(rnd1.Cid()))
+	assert.NoError(t, ds.PutCid(rndz.Cid(), rndz.RawData()))
+	expected := map[cid.Cid][]byte{rndz.Cid(): rndz.RawData()}
+	for _, block := range []blocks.Block{rnd2, rnd3, pnd1, pnd2, pnd3, cnd1, cnd2, cnd3} {
+		expected[block.Cid()] = block.RawData()
+	}
+	roots := []cid.Cid{cnd3.Cid(), pnd3.Cid()}
+
+	err = ds.ExportCar(nil, ioutil.Discard)
+	assert.Equal(t, ErrNoRoots, err)
+
+	var buf bytes.Buffer
+	assert.NoError(t, ds.ExportCar(roots, &buf))
+	car := buf.Bytes()
+	actualRoots, actual, _ := readCarV1(t, car)
+	assert.Equal(t, roots, actualRoots)
+	assert.Equal(t, expected, actual)
+
+	// CARv2, written after some existing content to check offsets are relative to where it starts
+	file, err := ioutil.TempFile("", "zipcar")
+	assert.NoError(t, err)
+	defer os.Remove(file.Name())
+	defer file.Close()
+	_, err = file.Write([]byte("prefix"))
+	assert.NoError(t, err)
+	assert.NoError(t, ds.ExportCarV2(roots, file))
+	end, err := file.Seek(0, io.SeekCurrent)
+	assert.NoError(t, err)
+	data, err := ioutil.ReadFile(file.Name())
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(data)), end)
+	data = data[len("prefix"):]
+
+	assert.Equal(t, carV2Pragma, data[:11])
+	dataOffset := binary.LittleEndian.Uint64(data[11+16:])
+	dataSize := binary.LittleEndian.Uint64(data[11+24:])
+	indexOffset := binary.LittleEndian.Uint64(data[11+32:])
+	assert.Equal(t, uint64(51), dataOffset)
+	assert.Equal(t, dataOffset+dataSize, indexOffset)
+	assert.Equal(t, car, data[dataOffset:indexOffset], "CARv2 should wrap the same CARv1")
+	_, _, offsets := readCarV1(t, car)
+
+	// the index, with all blocks using sha2-256 a single code and width
+	index := bytes.NewReader(data[indexOffset:])
+	codec, err := binary.ReadUvarint(index)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0x0401), codec)
+	var codes, widths int32
+	var code uint64
+	var width uint32
+	var length int64
+	for _, v := range []interface{}{&codes, &code, &widths, &width, &length} {
+		assert.NoError(t, binary.Read(index, binary.LittleEndian, v))
+	}
+	assert.Equal(t, int32(1), codes)
+	assert.Equal(t, uint64(mh.SHA2_256), code)
+	assert.Equal(t, int32(1), widths)
+	assert.Equal(t, uint32(32+8), width)
+	assert.Equal(t, int64(len(expected)*40), length)
+	var previous []byte
+	for i := 0; i < len(expected); i++ {
+		record := make([]byte, 40)
+		_, err = io.ReadFull(index, record)
+		assert.NoError(t, err)
+		digest, offset := record[:32], binary.LittleEndian.Uint64(record[32:])
+		assert.True(t, bytes.Compare(previous, digest) < 0, "index records should be sorted")
+		previous = digest
+		c, ok := offsets[int64(offset)]
+		assert.Truef(t, ok, "no section at offset %d", offset)
+		assert.Equal(t, []byte(c.Hash())[2:], digest)
+	}
+	assert.Equal(t, 0, index.Len())
+}
+
+// readCarV1 parses the CARv1 in `data`, returning its roots, blocks and the CID of the section at each offset.
+func readCarV1(t *testing.T, data []byte) ([]cid.Cid, map[cid.Cid][]byte, map[int64]cid.Cid) {
+	r := bytes.NewReader(data)
+	headerLen, err := binary.ReadUvarint(r)
+	assert.NoError(t, err)
+	header := make([]byte, headerLen)
+	_, err = io.ReadFull(r, header)
+	assert.NoError(t, err)
+	var decoded map[string]interface{}
+	assert.NoError(t, cbor.DecodeInto(header, &decoded))
+	assert.Equal(t, 2, len(decoded))
+	assert.EqualValues(t, 1, decoded["version"])
+	var roots []cid.Cid
+	for _, root := range decoded["roots"].([]interface{}) {
+		roots = append(roots, root.(cid.Cid))
+	}
+	// DAG-CBOR requires the shortest encoding, which re-encoding with the reference implementation produces
+	reencoded, err := cbor.DumpObject(decoded)
+	assert.NoError(t, err)
+	assert.Equal(t, header, reencoded)
+
+	blocks := make(map[cid.Cid][]byte)
+	offsets := make(map[int64]cid.Cid)
+	for r.Len() > 0 {
+		offset := int64(len(data) - r.Len())
+		sectionLen, err := binary.ReadUvarint(r)
+		assert.NoError(t, err)
+		section := make([]byte, sectionLen)
+		_, err = io.ReadFull(r, section)
+		assert.NoError(t, err)
+		// all of the CIDs used in these tests are sha2-256 with single byte codecs, so CIDv0 are 34 bytes and CIDv1
+		// 36 bytes
+		cidLen := 36
+		if section[0] == 0x12 {
+			cidLen = 34
+		}
+		c, err := cid.Cast(section[:cidLen])
+		assert.NoError(t, err)
+		blocks[c] = section[cidLen:]
+		offsets[offset] = c
+	}
+	return roots, blocks, offsets
+}
+
+func TestDistinguishDeleted(t *testing.T) {
+	copyFixture(t, "js.zcar", "deleted.zcar")
+	defer os.Remove("deleted.zcar")
+	absent := dag.NewRawNode([]byte("absent")).Cid()
+
+	for _, distinguish := range []bool{false, true} {
+		opts := DefaultOptions()
+		opts.DistinguishDeleted = distinguish
+		ds, err := NewDatastoreWithOptions("deleted.zcar", &opts)
+		assert.NoError(t, err)
+		assert.NoError(t, ds.DeleteCid(rnd1.Cid()))
+		assert.NoError(t, ds.PutCid(rndz.Cid(), rndz.RawData()))
+		assert.NoError(t, ds.DeleteCid(rndz.Cid()))
+
+		expected := datastore.ErrNotFound
+		if distinguish {
+			expected = ErrDeleted
+		}
+		for _, c := range []cid.Cid{rnd1.Cid(), rndz.Cid()} {
+			_, err = ds.GetCid(c)
+			assert.Equal(t, expected, err)
+			_, err = ds.GetSizeCid(c)
+			assert.Equal(t, expected, err)
+		}
+		_, err = ds.GetCid(absent)
+		assert.Equal(t, datastore.ErrNotFound, err)
+		_, err = ds.GetSizeCid(absent)
+		assert.Equal(t, datastore.ErrNotFound, err)
+
+		// once written, the deletion is no longer known
+		assert.NoError(t, ds.Sync())
+		_, err = ds.GetCid(rnd1.Cid())
+		assert.Equal(t, datastore.ErrNotFound, err)
+		assert.NoError(t, ds.Close())
+		copyFixture(t, "js.zcar", "deleted.zcar")
+	}
+}
+
+func TestCompressWorkers(t *testing.T) {
+	defer os.Remove("workers.zcar")
+	modTime := time.Date(2019, 7, 1, 12, 30, 0, 0, time.UTC)
+	var cids []cid.Cid
+	write := func(workers int) []byte {
+		copyFixture(t, "js.zcar", "workers.zcar")
+		opts := DefaultOptions()
+		opts.CompressWorkers = workers
+		opts.ModTime = &modTime
+		opts.WriteVerificationHints = true
+		opts.WriteIntegrityManifest = true
+		ds, err := NewDatastoreWithOptions("workers.zcar", &opts)
+		assert.NoError(t, err)
+		cids = nil
+		for i := 0; i < 100; i++ {
+			node := dag.NewRawNode([]byte(strings.Repeat(fmt.Sprintf("block %d ", i), i)))
+			assert.NoError(t, ds.PutCid(node.Cid(), node.RawData()))
+			cids = append(cids, node.Cid())
+		}
+		assert.NoError(t, ds.SetEntryComment(rnd1.Cid(), "commented"))
+		assert.NoError(t, ds.Touch(rnd2.Cid(), time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)))
+		assert.NoError(t, ds.DeleteCid(rnd3.Cid()))
+		var buf bytes.Buffer
+		_, err = ds.WriteTo(&buf)
+		assert.NoError(t, err)
+		assert.NoError(t, ds.Close())
+		data, err := ioutil.ReadFile("workers.zcar")
+		assert.NoError(t, err)
+		assert.Equal(t, zipEntries(t, buf.Bytes()), zipEntries(t, data), "WriteTo() should match the rewrite")
+		return data
+	}
+
+	serial := write(0)
+	parallel := write(4)
+	assert.Equal(t, zipEntries(t, serial), zipEntries(t, parallel))
+
+	opts := DefaultOptions()
+	opts.UseVerificationHints = true
+	ds, err := NewDatastoreWithOptions("workers.zcar", &opts)
+	assert.NoError(t, err)
+	defer ds.Close()
+	assert.NoError(t, ds.VerifyIntegrityManifest())
+	report, err := ds.Check()
+	assert.NoError(t, err)
+	assert.Equal(t, 108, report.Checked)
+	assert.Equal(t, 108, report.Hinted)
+	assert.Empty(t, report.Mismatched)
+	for _, c := range cids {
+		verifyHas(t, ds, c, c.String())
+	}
+}
+
+// zipEntries describes the entries of the ZIP archive in `data`, sorted, by the fields that are independent of how
+// and in which order they were written, along with their content.
+func zipEntries(t *testing.T, data []byte) []string {
+	reader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	var entries []string
+	for _, f := range reader.File {
+		rc, err := f.Open()
+		assert.NoError(t, err)
+		content, err := ioutil.ReadAll(rc)
+		assert.NoError(t, err)
+		rc.Close()
+		entries = append(entries, fmt.Sprintf("%s method=%d size=%d compressed=%d crc=%08x modified=%s comment=%q "+
+			"hinted=%t content=%x", f.Name, f.Method, f.UncompressedSize64, f.CompressedSize64, f.CRC32,
+			f.Modified.UTC().Format(time.RFC3339), f.Comment, hasVerificationHint(f), sha256.Sum256(content)))
+	}
+	sort.Strings(entries)
+	return append(entries, fmt.Sprintf("comment=%q", reader.Comment))
+}
+
+func TestNewDatastoreFromSection(t *testing.T) {
+	archive, err := ioutil.ReadFile("js.zcar")
+	assert.NoError(t, err)
+	// a container with a header before the archive and a trailer after it
+	header := []byte("CONTAINER HEADER\n")
+	host := append(append(append([]byte{}, header...), archive...), []byte("TRAILER")...)
+	assert.NoError(t, ioutil.WriteFile("host.bin", host, 0644))
+	defer os.Remove("host.bin")
+	file, err := os.Open("host.bin")
+	assert.NoError(t, err)
+	defer file.Close()
+
+	ds, err := NewDatastoreFromSection(file, int64(len(header)), int64(len(archive)), nil)
+	assert.NoError(t, err)
+	verifyHasEntries(t, ds, false)
+	verifyRawNodes(t, ds, false)
+	verifyCborNodes(t, ds, false)
+	verifyComment(t, ds, false)
+
+	assert.Equal(t, ErrReadOnly, errors.Unwrap(ds.PutCid(rndz.Cid(), rndz.RawData())))
+	assert.Equal(t, ErrReadOnly, errors.Unwrap(ds.DeleteCid(rnd1.Cid())))
+	assert.NoError(t, ds.Close())
+
+	// the host is untouched and still open
+	_, err = file.Stat()
+	assert.NoError(t, err)
+	data, err := ioutil.ReadFile("host.bin")
+	assert.NoError(t, err)
+	assert.Equal(t, host, data)
+
+	// the wrong section isn't an archive
+	_, err = NewDatastoreFromSection(file, 0, int64(len(archive)), nil)
+	assert.Error(t, err)
+}
+
+func TestUndelete(t *testing.T) {
+	copyFixture(t, "js.zcar", "undelete.zcar")
+	defer os.Remove("undelete.zcar")
+
+	ds, err := NewDatastore("undelete.zcar")
+	assert.NoError(t, err)
+	assert.NoError(t, ds.DeleteCid(rnd1.Cid()))
+	assert.Equal(t, datastore.ErrNotFound, ds.Undelete(rnd1.Cid()), "not retained without KeepTombstoneData")
+	assert.NoError(t, ds.Close())
+
+	copyFixture(t, "js.zcar", "undelete.zcar")
+	opts := DefaultOptions()
+	opts.KeepTombstoneData = true
+	ds, err = NewDatastoreWithOptions("undelete.zcar", &opts)
+	assert.NoError(t, err)
+	assert.NoError(t, ds.SetEntryComment(rnd1.Cid(), "first"))
+	assert.NoError(t, ds.PutCid(rndz.Cid(), rndz.RawData()))
+	for _, block := range []blocks.Block{rnd1, rnd2, rndz} {
+		assert.NoError(t, ds.DeleteCid(block.Cid()))
+		_, err = ds.GetCid(block.Cid())
+		assert.Equal(t, datastore.ErrNotFound, err)
+	}
+	assert.Equal(t, datastore.ErrNotFound, ds.Undelete(rnd3.Cid()), "never deleted")
+
+	// restored from the archive and from pending blocks
+	for _, block := range []blocks.Block{rnd1, rndz} {
+		assert.NoError(t, ds.Undelete(block.Cid()))
+		data, err := ds.GetCid(block.Cid())
+		assert.NoError(t, err)
+		assert.Equal(t, block.RawData(), data)
+	}
+	assert.Equal(t, datastore.ErrNotFound, ds.Undelete(rnd1.Cid()), "already undeleted")
+	comment, err := ds.EntryComment(rnd1.Cid())
+	assert.NoError(t, err)
+	assert.Equal(t, "first", comment)
+
+	// still restorable after the deletion has been written
+	assert.NoError(t, ds.Sync())
+	has, err := ds.HasCid(rnd2.Cid())
+	assert.NoError(t, err)
+	assert.False(t, has)
+	assert.NoError(t, ds.Undelete(rnd2.Cid()))
+	assert.NoError(t, ds.DeleteCid(rnd3.Cid()))
+	assert.NoError(t, ds.Close())
+
+	ds, err = NewDatastore("undelete.zcar")
+	assert.NoError(t, err)
+	defer ds.Close()
+	for _, block := range []blocks.Block{rnd1, rnd2, rndz} {
+		verifyHas(t, ds, block.Cid(), block.Cid().String())
+	}
+	has, err = ds.HasCid(rnd3.Cid())
+	assert.NoError(t, err)
+	assert.False(t, has, "deleted blocks are excluded from the archive")
+	comment, err = ds.EntryComment(rnd1.Cid())
+	assert.NoError(t, err)
+	assert.Equal(t, "first", comment)
+}
+
+func TestCountByPrefix(t *testing.T) {
+	copyFixture(t, "js.zcar", "prefix.zcar")
+	defer os.Remove("prefix.zcar")
+
+	for _, compact := range []bool{false, true} {
+		opts := DefaultOptions()
+		opts.CompactIndex = compact
+		ds, err := NewDatastoreWithOptions("prefix.zcar", &opts)
+		assert.NoError(t, err)
+		assert.NoError(t, ds.PutCid(rndz.Cid(), rndz.RawData()))
+		assert.NoError(t, ds.DeleteCid(rnd1.Cid()))
+		_, err = ds.GetCid(rnd2.Cid()) // cached, and not counted twice
+		assert.NoError(t, err)
+
+		assert.Equal(t, map[string]int{"ba": 6, "Qm": 3}, ds.CountByPrefix(2))
+		counts := ds.CountByPrefix(7)
+		assert.Equal(t, 3, counts["bafkrei"])
+		assert.Equal(t, 3, counts["bafyrei"])
+		counts = ds.CountByPrefix(100)
+		assert.Equal(t, 9, len(counts))
+		rndzName, _ := cidToString(rndz.Cid())
+		assert.Equal(t, 1, counts[*rndzName])
+		assert.Equal(t, map[string]int{"": 9}, ds.CountByPrefix(0))
+
+		assert.NoError(t, ds.DeleteCid(rndz.Cid()))
+		assert.NoError(t, ds.PutCid(rnd1.Cid(), rnd1.RawData()))
+		assert.NoError(t, ds.Close())
+	}
+}
+
+func TestCompatibility(t *testing.T) {
+	defer os.Remove("compat.zcar")
+	modTime := time.Date(2019, 7, 1, 12, 30, 0, 0, time.UTC)
+	large := dag.NewRawNode(bytes.Repeat([]byte("large "), 100))
+
+	for _, workers := range []int{0, 4} {
+		for _, compat := range []Compatibility{CompatModern, CompatMax} {
+			copyFixture(t, "js.zcar", "compat.zcar")
+			opts := DefaultOptions()
+			opts.Compatibility = compat
+			opts.CompressWorkers = workers
+			opts.ModTime = &modTime
+			opts.WriteIntegrityManifest = true
+			ds, err := NewDatastoreWithOptions("compat.zcar", &opts)
+			assert.NoError(t, err)
+			assert.NoError(t, ds.PutCid(large.Cid(), large.RawData()))
+			assert.NoError(t, ds.Close())
+
+			reader, err := zip.OpenReader("compat.zcar")
+			assert.NoError(t, err)
+			assert.Equal(t, 11, len(reader.File))
+			for _, f := range reader.File {
+				hasTimestamp := false
+				for extra := f.Extra; len(extra) >= 4; extra = extra[4+binary.LittleEndian.Uint16(extra[2:]):] {
+					hasTimestamp = hasTimestamp || binary.LittleEndian.Uint16(extra) == 0x5455
+				}
+				if compat == CompatMax {
+					assert.Equal(t, uint16(0), f.Flags&0x8, "no data descriptor")
+					assert.False(t, hasTimestamp, "no extended timestamp")
+				} else if workers == 0 {
+					assert.Equal(t, uint16(0x8), f.Flags&0x8, "data descriptor")
+				}
+				if f.Name != IntegrityManifestName {
+					assert.True(t, modTime.Equal(f.Modified))
+				}
+			}
+			reader.Close()
+
+			ds, err = NewDatastoreWithOptions("compat.zcar", &opts)
+			assert.NoError(t, err)
+			assert.NoError(t, ds.VerifyIntegrityManifest())
+			report, err := ds.Check()
+			assert.NoError(t, err)
+			assert.Equal(t, 10, report.Checked)
+			assert.Empty(t, report.Mismatched)
+			data, err := ds.GetCid(large.Cid())
+			assert.NoError(t, err)
+			assert.Equal(t, large.RawData(), data)
+			assert.NoError(t, ds.Close())
+		}
+	}
+}
+
+func TestGetOrPut(t *testing.T) {
+	os.Remove("getorput.zcar")
+	defer os.Remove("getorput.zcar")
+	ds, err := NewDatastore("getorput.zcar")
+	assert.NoError(t, err)
+	defer ds.Close()
+	assert.NoError(t, ds.PutCid(rnd1.Cid(), rnd1.RawData()))
+
+	// present, fill isn't called
+	data, err := ds.GetOrPut(rnd1.Cid(), func() ([]byte, error) {
+		t.Error("fill should not be called for a present block")
+		return nil, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, rnd1.RawData(), data)
+
+	// concurrent callers share a single fill
+	var calls int32
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	results := make([][]byte, 8)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			data, err := ds.GetOrPut(rnd2.Cid(), func() ([]byte, error) {
+				atomic.AddInt32(&calls, 1)
+				<-release
+				return rnd2.RawData(), nil
+			})
+			assert.NoError(t, err)
+			results[i] = data
+		}(i)
+	}
+	// other operations aren't blocked while filling
+	time.Sleep(10 * time.Millisecond)
+	verifyHas(t, ds, rnd1.Cid(), "rnd1")
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(1), calls)
+	for _, data := range results {
+		assert.Equal(t, rnd2.RawData(), data)
+	}
+	verifyHas(t, ds, rnd2.Cid(), "rnd2")
+
+	// errors from fill are returned and nothing is stored, so the next caller fills again
+	failed := errors.New("fetch failed")
+	_, err = ds.GetOrPut(rnd3.Cid(), func() ([]byte, error) { return nil, failed })
+	assert.Equal(t, failed, err)
+	data, err = ds.GetOrPut(rnd3.Cid(), func() ([]byte, error) { return rnd3.RawData(), nil })
+	assert.NoError(t, err)
+	assert.Equal(t, rnd3.RawData(), data)
+
+	// a panic in fill doesn't leave the CID stuck
+	assert.Panics(t, func() {
+		ds.GetOrPut(rndz.Cid(), func() ([]byte, error) { panic("oops") })
+	})
+	data, err = ds.GetOrPut(rndz.Cid(), func() ([]byte, error) { return rndz.RawData(), nil })
+	assert.NoError(t, err)
+	assert.Equal(t, rndz.RawData(), data)
+}
+
+func TestEntryNameValidator(t *testing.T) {
+	os.Remove("validator.zcar")
+	defer os.Remove("validator.zcar")
+
+	errNotV1 := errors.New("only CIDv1")
+	var validated []string
+	opts := DefaultOptions()
+	opts.EntryNameValidator = func(name string) error {
+		validated = append(validated, name)
+		if !strings.HasPrefix(name, "b") {
+			return errNotV1
+		}
+		return nil
+	}
+
+	ds, err := NewDatastoreWithOptions("validator.zcar", &opts)
+	assert.NoError(t, err)
+	assert.NoError(t, ds.PutCid(rnd1.Cid(), rnd1.RawData()))
+	// pnd1 has a CIDv0, "Qm..."
+	err = ds.PutCid(pnd1.Cid(), pnd1.RawData())
+	assert.Equal(t, &CidError{Cid: pnd1.Cid().String(), Err: errNotV1}, err)
+	has, err := ds.HasCid(pnd1.Cid())
+	assert.NoError(t, err)
+	assert.False(t, has)
+	// identity CIDs aren't stored so aren't checked
+	validated = nil
+	identity, err := cid.Prefix{Version: 1, Codec: cid.Raw, MhType: mh.ID, MhLength: -1}.Sum([]byte("id"))
+	assert.NoError(t, err)
+	assert.NoError(t, ds.PutCid(identity, []byte("id")))
+	assert.Empty(t, validated)
+	assert.NoError(t, ds.Close())
+
+	// write pnd1 without the validator, opening then fails
+	ds, err = NewDatastore("validator.zcar")
+	assert.NoError(t, err)
+	assert.NoError(t, ds.PutCid(pnd1.Cid(), pnd1.RawData()))
+	assert.NoError(t, ds.Close())
+
+	_, err = NewDatastoreWithOptions("validator.zcar", &opts)
+	assert.Equal(t, &CidError{Cid: pnd1.Cid().String(), Err: errNotV1}, err)
+}
+
+func TestRangeCbor(t *testing.T) {
+	os.Remove("rangecbor.zcar")
+	defer os.Remove("rangecbor.zcar")
+
+	ds, err := NewDatastore("rangecbor.zcar")
+	assert.NoError(t, err)
+	defer ds.Close()
+	assert.NoError(t, ds.PutCid(cnd1.Cid(), cnd1.RawData()))
+	assert.NoError(t, ds.PutCid(rnd1.Cid(), rnd1.RawData()))
+	assert.NoError(t, ds.PutCid(pnd1.Cid(), pnd1.RawData()))
+	assert.NoError(t, ds.Sync())
+	assert.NoError(t, ds.PutCid(cnd2.Cid(), cnd2.RawData()))
+
+	// both pending and archived blocks, non-cbor blocks are skipped
+	decoded := make(map[cid.Cid]*cbor.Node)
+	err = ds.RangeCbor(context.Background(), func(c cid.Cid, node *cbor.Node) error {
+		decoded[c] = node
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(decoded))
+	for _, nd := range []*cbor.Node{cnd1, cnd2} {
+		assert.Equal(t, nd.Cid(), decoded[nd.Cid()].Cid())
+		assert.Equal(t, nd.RawData(), decoded[nd.Cid()].RawData())
+		assert.ElementsMatch(t, nd.Tree("", -1), decoded[nd.Cid()].Tree("", -1))
+		field, _, err := decoded[nd.Cid()].Resolve([]string{"s"})
+		assert.NoError(t, err)
+		expected, _, _ := nd.Resolve([]string{"s"})
+		assert.Equal(t, expected, field)
+	}
+
+	// stops at the first error
+	errStop := errors.New("stop")
+	calls := 0
+	err = ds.RangeCbor(context.Background(), func(c cid.Cid, node *cbor.Node) error {
+		calls++
+		return errStop
+	})
+	assert.Equal(t, errStop, err)
+	assert.Equal(t, 1, calls)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = ds.RangeCbor(ctx, func(c cid.Cid, node *cbor.Node) error {
+		t.Fatal("unexpected call")
+		return nil
+	})
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestExportKeysCar(t *testing.T) {
+	copyFixture(t, "js.zcar", "exportkeys.zcar")
+	defer os.Remove("exportkeys.zcar")
+	ds, err := NewDatastore("exportkeys.zcar")
+	assert.NoError(t, err)
+	defer ds.Close()
+	assert.NoError(t, ds.DeleteCid(rnd1.Cid()))
+	assert.NoError(t, ds.PutCid(rndz.Cid(), rndz.RawData()))
+
+	var buf bytes.Buffer
+	assert.NoError(t, ds.ExportKeysCar(&buf))
+	roots, blocks, _ := readCarV1(t, buf.Bytes())
+	assert.Empty(t, blocks)
+	// pending blocks first, as with Query()
+	assert.Equal(t, rndz.Cid(), roots[0])
+	assert.ElementsMatch(t, []cid.Cid{rndz.Cid(), rnd2.Cid(), rnd3.Cid(), pnd1.Cid(), pnd2.Cid(), pnd3.Cid(),
+		cnd1.Cid(), cnd2.Cid(), cnd3.Cid()}, roots)
+
+	os.Remove("exportkeys-empty.zcar")
+	defer os.Remove("exportkeys-empty.zcar")
+	empty, err := NewDatastore("exportkeys-empty.zcar")
+	assert.NoError(t, err)
+	defer empty.Close()
+	assert.Equal(t, ErrNoRoots, empty.ExportKeysCar(ioutil.Discard))
+}
+
+func TestHashFunctions(t *testing.T) {
+	copyFixture(t, "js.zcar", "hashfunctions.zcar")
+	defer os.Remove("hashfunctions.zcar")
+	ds, err := NewDatastore("hashfunctions.zcar")
+	assert.NoError(t, err)
+	defer ds.Close()
+
+	counts, err := ds.HashFunctions()
+	assert.NoError(t, err)
+	assert.Equal(t, map[uint64]int{mh.SHA2_256: 9}, counts)
+
+	stray, err := cid.Prefix{Version: 1, Codec: cid.Raw, MhType: mh.BLAKE2B_MIN + 31, MhLength: -1}.Sum([]byte("stray"))
+	assert.NoError(t, err)
+	assert.NoError(t, ds.PutCid(stray, []byte("stray")))
+	assert.NoError(t, ds.DeleteCid(rnd1.Cid()))
+	counts, err = ds.HashFunctions()
+	assert.NoError(t, err)
+	assert.Equal(t, map[uint64]int{mh.SHA2_256: 8, mh.BLAKE2B_MIN + 31: 1}, counts)
+}
+
+func TestLazyIndex(t *testing.T) {
+	copyFixture(t, "js.zcar", "lazy.zcar")
+	defer os.Remove("lazy.zcar")
+
+	opts := DefaultOptions()
+	opts.LazyIndex = true
+	ds, err := NewDatastoreWithOptions("lazy.zcar", &opts)
+	assert.NoError(t, err)
+	// operations wait for the index
+	verifyHas(t, ds, rnd1.Cid(), "rnd1")
+	assert.NoError(t, ds.WaitIndex())
+	assert.NoError(t, ds.PutCid(rndz.Cid(), rndz.RawData()))
+	assert.NoError(t, ds.Close())
+
+	data, err := ioutil.ReadFile("lazy.zcar")
+	assert.NoError(t, err)
+	ds, err = NewDatastoreFromReaderAt(bytes.NewReader(data), int64(len(data)), &opts)
+	assert.NoError(t, err)
+	assert.NoError(t, ds.WaitIndex())
+	verifyHas(t, ds, rndz.Cid(), "rndz")
+	assert.NoError(t, ds.Close())
+
+	// an archive that can't be read is left alone
+	garbage := []byte("not a zip archive")
+	assert.NoError(t, ioutil.WriteFile("lazy.zcar", garbage, 0644))
+	ds, err = NewDatastoreWithOptions("lazy.zcar", &opts)
+	assert.NoError(t, err)
+	assert.Equal(t, zip.ErrFormat, ds.WaitIndex())
+	err = ds.PutCid(rnd1.Cid(), rnd1.RawData())
+	assert.True(t, errors.Is(err, ErrReadOnly))
+	assert.NoError(t, ds.Close())
+	data, err = ioutil.ReadFile("lazy.zcar")
+	assert.NoError(t, err)
+	assert.Equal(t, garbage, data)
+}
+
+func TestContentType(t *testing.T) {
+	copyFixture(t, "js.zcar", "contenttype.zcar")
+	defer os.Remove("contenttype.zcar")
+
+	opts := DefaultOptions()
+	opts.KeepTombstoneData = true
+	ds, err := NewDatastoreWithOptions("contenttype.zcar", &opts)
+	assert.NoError(t, err)
+	contentType, err := ds.ContentType(rnd1.Cid())
+	assert.NoError(t, err)
+	assert.Equal(t, "", contentType)
+	_, err = ds.ContentType(rndz.Cid())
+	assert.Equal(t, datastore.ErrNotFound, err)
+	assert.Equal(t, datastore.ErrNotFound, ds.SetContentType(rndz.Cid(), "text/plain"))
+	assert.Equal(t, ErrContentTypeTooLong, ds.SetContentType(rnd1.Cid(), strings.Repeat("a", 256)))
+
+	assert.NoError(t, ds.SetContentType(rnd1.Cid(), "text/plain; charset=utf-8"))
+	assert.NoError(t, ds.SetContentType(cnd1.Cid(), "application/vnd.ipld.dag-cbor"))
+	assert.NoError(t, ds.SetContentType(rnd2.Cid(), "text/plain"))
+	assert.NoError(t, ds.SetContentType(rnd2.Cid(), ""))
+	assert.NoError(t, ds.SetContentType(rnd3.Cid(), "text/plain"))
+	assert.NoError(t, ds.DeleteCid(rnd3.Cid()))
+	assert.NoError(t, ds.Undelete(rnd3.Cid()))
+	assert.True(t, ds.IsModified())
+	assert.NoError(t, ds.Close())
+
+	// recorded in the archive, and carried through a rewrite alongside the verification hints
+	opts.WriteVerificationHints = true
+	ds, err = NewDatastoreWithOptions("contenttype.zcar", &opts)
+	assert.NoError(t, err)
+	for c, expected := range map[cid.Cid]string{rnd1.Cid(): "text/plain; charset=utf-8",
+		cnd1.Cid(): "application/vnd.ipld.dag-cbor", rnd2.Cid(): "", rnd3.Cid(): "text/plain"} {
+		contentType, err := ds.ContentType(c)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, contentType)
+	}
+	ds.SetComment("rewrite")
+	assert.NoError(t, ds.Close())
+
+	reader, err := zip.OpenReader("contenttype.zcar")
+	assert.NoError(t, err)
+	defer reader.Close()
+	for _, f := range reader.File {
+		if f.Name == rnd1.Cid().String() {
+			assert.True(t, hasVerificationHint(f))
+			assert.Equal(t, "text/plain; charset=utf-8", entryContentType(f))
+		}
+	}
+}
+
+func TestEstimatedSize(t *testing.T) {
+	copyFixture(t, "js.zcar", "estimate.zcar")
+	defer os.Remove("estimate.zcar")
+
+	for _, manifest := range []bool{false, true} {
+		opts := DefaultOptions()
+		opts.WriteIntegrityManifest = manifest
+		opts.WriteVerificationHints = manifest
+		ds, err := NewDatastoreWithOptions("estimate.zcar", &opts)
+		assert.NoError(t, err)
+		assert.NoError(t, ds.PutCid(rndz.Cid(), rndz.RawData()))
+		large := dag.NewRawNode(bytes.Repeat([]byte("large"), 20000))
+		assert.NoError(t, ds.PutCid(large.Cid(), large.RawData()))
+		assert.NoError(t, ds.SetEntryComment(rnd2.Cid(), "comment"))
+		assert.NoError(t, ds.SetContentType(rnd3.Cid(), "text/plain"))
+		ds.SetComment("archive comment")
+
+		estimate, err := ds.EstimatedSize()
+		assert.NoError(t, err)
+		size, err := ds.SerializedSize()
+		assert.NoError(t, err)
+		assert.True(t, estimate >= size, "estimate %d should be no less than %d", estimate, size)
+
+		assert.NoError(t, ds.DeleteCid(large.Cid()))
+		smaller, err := ds.EstimatedSize()
+		assert.NoError(t, err)
+		assert.True(t, smaller < estimate-int64(len(large.RawData())))
+		assert.NoError(t, ds.Close())
+	}
+}
+
+func TestMaxArchiveBytes(t *testing.T) {
+	os.Remove("maxarchive.zcar")
+	defer os.Remove("maxarchive.zcar")
+
+	opts := DefaultOptions()
+	opts.MaxArchiveBytes = 4096
+	ds, err := NewDatastoreWithOptions("maxarchive.zcar", &opts)
+	assert.NoError(t, err)
+	var added int
+	for i := 0; ; i++ {
+		block := dag.NewRawNode(bytes.Repeat([]byte{byte(i)}, 200))
+		if err = ds.PutCid(block.Cid(), block.RawData()); err != nil {
+			assert.Equal(t, &CidError{Cid: block.Cid().String(), Err: ErrArchiveTooLarge}, err)
+			has, err := ds.HasCid(block.Cid())
+			assert.NoError(t, err)
+			assert.False(t, has)
+			break
+		}
+		added++
+	}
+	assert.True(t, added > 5)
+	estimate, err := ds.EstimatedSize()
+	assert.NoError(t, err)
+	assert.True(t, estimate <= opts.MaxArchiveBytes)
+	assert.NoError(t, ds.Close())
+
+	fileinfo, err := os.Stat("maxarchive.zcar")
+	assert.NoError(t, err)
+	assert.True(t, fileinfo.Size() <= opts.MaxArchiveBytes)
+
+	// an existing archive is counted
+	ds, err = NewDatastoreWithOptions("maxarchive.zcar", &opts)
+	assert.NoError(t, err)
+	defer ds.Close()
+	reopened, err := ds.EstimatedSize()
+	assert.NoError(t, err)
+	assert.Equal(t, estimate, reopened)
+	block := dag.NewRawNode(bytes.Repeat([]byte("a"), 200))
+	assert.Equal(t, &CidError{Cid: block.Cid().String(), Err: ErrArchiveTooLarge}, ds.PutCid(block.Cid(), block.RawData()))
+}
+
+func TestReencodeTo(t *testing.T) {
+	os.Remove("reencode.zcar")
+	defer os.Remove("reencode.zcar")
+	defer os.Remove("reencode-store.zcar")
+	defer os.Remove("reencode-best.zcar")
+
+	ds, err := NewDatastore("reencode.zcar")
+	assert.NoError(t, err)
+	var cids []cid.Cid
+	for i := 0; i < 10; i++ {
+		block := dag.NewRawNode([]byte(strings.Repeat(fmt.Sprintf("block %d ", i), 100)))
+		assert.NoError(t, ds.PutCid(block.Cid(), block.RawData()))
+		cids = append(cids, block.Cid())
+	}
+	assert.NoError(t, ds.PutCid(rnd1.Cid(), rnd1.RawData()))
+	cids = append(cids, rnd1.Cid())
+	assert.NoError(t, ds.Sync())
+	source, err := ioutil.ReadFile("reencode.zcar")
+	assert.NoError(t, err)
+
+	stored, err := ds.ReencodeTo("reencode-store.zcar", zip.Store, 0)
+	assert.NoError(t, err)
+	best, err := ds.ReencodeTo("reencode-best.zcar", zip.Deflate, flate.BestCompression)
+	assert.NoError(t, err)
+	assert.True(t, best < stored)
+
+	_, err = ds.ReencodeTo("reencode-best.zcar", 99, 0)
+	assert.Equal(t, zip.ErrAlgorithm, err)
+	_, err = ds.ReencodeTo("reencode-best.zcar", zip.Deflate, 42)
+	assert.Error(t, err)
+	assert.NoError(t, ds.Close())
+
+	after, err := ioutil.ReadFile("reencode.zcar")
+	assert.NoError(t, err)
+	assert.Equal(t, source, after)
+
+	for path, method := range map[string]uint16{"reencode-store.zcar": zip.Store, "reencode-best.zcar": zip.Deflate} {
+		fileinfo, err := os.Stat(path)
+		assert.NoError(t, err)
+		if method == zip.Store {
+			assert.Equal(t, stored, fileinfo.Size())
+		} else {
+			assert.Equal(t, best, fileinfo.Size())
+		}
+		reader, err := zip.OpenReader(path)
+		assert.NoError(t, err)
+		for _, f := range reader.File {
+			assert.Equal(t, method, f.Method)
+		}
+		reader.Close()
+		reencoded, err := NewDatastore(path)
+		assert.NoError(t, err)
+		for _, c := range cids {
+			has, err := reencoded.HasCid(c)
+			assert.NoError(t, err)
+			assert.True(t, has)
+		}
+		assert.NoError(t, reencoded.Close())
+	}
+}
+
+func TestStrippedMultibasePrefix(t *testing.T) {
+	// stripped.zcar was written with Python's zipfile, with rnd1 named for its base32 CID without the leading "b"
+	// and rnd2 for its base58btc CID without the leading "z", alongside a README.txt
+	copyFixture(t, "stripped.zcar", "stripped-copy.zcar")
+	defer os.Remove("stripped-copy.zcar")
+
+	ds, err := NewDatastore("stripped-copy.zcar")
+	assert.NoError(t, err)
+	verifyHas(t, ds, rnd1.Cid(), "rnd1")
+	verifyHas(t, ds, rnd2.Cid(), "rnd2")
+	data, err := ds.GetCid(rnd2.Cid())
+	assert.NoError(t, err)
+	assert.Equal(t, rnd2.RawData(), data)
+	results, err := ds.Query(dsq.Query{KeysOnly: true})
+	assert.NoError(t, err)
+	entries, err := results.Rest()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(entries))
+
+	// written with their canonical names once rewritten
+	ds.SetComment("rewrite")
+	assert.NoError(t, ds.Close())
+	reader, err := zip.OpenReader("stripped-copy.zcar")
+	assert.NoError(t, err)
+	defer reader.Close()
+	var names []string
+	for _, f := range reader.File {
+		names = append(names, f.Name)
+	}
+	assert.ElementsMatch(t, []string{rnd1.Cid().String(), rnd2.Cid().String()}, names)
+}
+
+func TestMissingFrom(t *testing.T) {
+	copyFixture(t, "js.zcar", "missing-other.zcar")
+	defer os.Remove("missing-other.zcar")
+	os.Remove("missing.zcar")
+	defer os.Remove("missing.zcar")
+
+	other, err := NewDatastore("missing-other.zcar")
+	assert.NoError(t, err)
+	defer other.Close()
+	ds, err := NewDatastore("missing.zcar")
+	assert.NoError(t, err)
+	defer ds.Close()
+
+	assert.NoError(t, ds.PutCid(rnd1.Cid(), rnd1.RawData()))
+	assert.NoError(t, ds.PutCid(rndz.Cid(), rndz.RawData()))
+	assert.NoError(t, ds.Sync())
+	assert.NoError(t, ds.PutCid(pnd1.Cid(), pnd1.RawData()))
+	assert.NoError(t, other.DeleteCid(cnd3.Cid()))
+
+	missing, err := ds.MissingFrom(other)
+	assert.NoError(t, err)
+	expected := []cid.Cid{rnd2.Cid(), rnd3.Cid(), pnd2.Cid(), pnd3.Cid(), cnd1.Cid(), cnd2.Cid()}
+	sort.Slice(expected, func(i, j int) bool { return expected[i].String() < expected[j].String() })
+	assert.Equal(t, expected, missing)
+
+	// the other direction
+	missing, err = other.MissingFrom(ds)
+	assert.NoError(t, err)
+	assert.Equal(t, []cid.Cid{rndz.Cid()}, missing)
+
+	missing, err = ds.MissingFrom(ds)
+	assert.NoError(t, err)
+	assert.Empty(t, missing)
+}
+
+func TestCloseGz(t *testing.T) {
+	copyFixture(t, "js.zcar", "gz.zcar")
+	defer os.Remove("gz.zcar")
+	defer os.Remove("gz.zcar.gz")
+
+	ds, err := NewDatastore("gz.zcar")
+	assert.NoError(t, err)
+	assert.NoError(t, ds.PutCid(rndz.Cid(), rndz.RawData()))
+	assert.NoError(t, ds.CloseGz())
+
+	// the archive is written as usual, along with a compressed copy
+	archive, err := ioutil.ReadFile("gz.zcar")
+	assert.NoError(t, err)
+	file, err := os.Open("gz.zcar.gz")
+	assert.NoError(t, err)
+	gr, err := gzip.NewReader(file)
+	assert.NoError(t, err)
+	decompressed, err := ioutil.ReadAll(gr)
+	assert.NoError(t, err)
+	file.Close()
+	assert.Equal(t, archive, decompressed)
+
+	ds, err = NewDatastoreFromGzip("gz.zcar.gz", nil)
+	assert.NoError(t, err)
+	verifyHas(t, ds, rndz.Cid(), "rndz")
+	verifyCborNodes(t, ds, false)
+	assert.True(t, errors.Is(ds.PutCid(rnd1.Cid(), rnd1.RawData()), ErrReadOnly))
+	assert.NoError(t, ds.Close())
+
+	// a .gz path is replaced by its compressed form
+	assert.NoError(t, os.Rename("gz.zcar", "gz.zcar.gz"))
+	ds, err = NewDatastore("gz.zcar.gz")
+	assert.NoError(t, err)
+	assert.NoError(t, ds.DeleteCid(rndz.Cid()))
+	assert.NoError(t, ds.CloseGz())
+	_, err = NewDatastore("gz.zcar.gz")
+	assert.Error(t, err)
+	ds, err = NewDatastoreFromGzip("gz.zcar.gz", nil)
+	assert.NoError(t, err)
+	has, err := ds.HasCid(rndz.Cid())
+	assert.NoError(t, err)
+	assert.False(t, has)
+	verifyHas(t, ds, rnd1.Cid(), "rnd1")
+	// not backed by a file
+	assert.Equal(t, ErrNoFile, ds.CloseGz())
+	matches, err := filepath.Glob("gz.zcar.gz.tmp*")
+	assert.NoError(t, err)
+	assert.Empty(t, matches)
+}
+
+func TestOverlay(t *testing.T) {
+	copyFixture(t, "js.zcar", "overlay-base.zcar")
+	defer os.Remove("overlay-base.zcar")
+	os.Remove("overlay-patch.zcar")
+	defer os.Remove("overlay-patch.zcar")
+	base, err := ioutil.ReadFile("overlay-base.zcar")
+	assert.NoError(t, err)
+
+	patch, err := NewDatastore("overlay-patch.zcar")
+	assert.NoError(t, err)
+	assert.NoError(t, patch.PutCid(rndz.Cid(), rndz.RawData()))
+	assert.NoError(t, patch.PutCid(rnd1.Cid(), rnd1.RawData()))
+	assert.NoError(t, patch.Close())
+
+	overlay, err := NewOverlayDatastore("overlay-base.zcar", "overlay-patch.zcar")
+	assert.NoError(t, err)
+	for _, block := range []blocks.Block{rnd1, rnd2, rndz, cnd1, pnd3} {
+		key := dshelp.CidToDsKey(block.Cid())
+		has, err := overlay.Has(key)
+		assert.NoError(t, err)
+		assert.True(t, has)
+		data, err := overlay.Get(key)
+		assert.NoError(t, err)
+		assert.Equal(t, block.RawData(), data)
+		size, err := overlay.GetSize(key)
+		assert.NoError(t, err)
+		assert.Equal(t, len(block.RawData()), size)
+	}
+
+	// mutations are held above the archives
+	extra := dag.NewRawNode([]byte("extra"))
+	assert.NoError(t, overlay.Put(dshelp.CidToDsKey(extra.Cid()), extra.RawData()))
+	assert.NoError(t, overlay.Put(dshelp.CidToDsKey(rnd2.Cid()), rnd2.RawData()))
+	assert.NoError(t, overlay.Delete(dshelp.CidToDsKey(rnd1.Cid())))
+	has, err := overlay.Has(dshelp.CidToDsKey(rnd1.Cid()))
+	assert.NoError(t, err)
+	assert.False(t, has)
+	_, err = overlay.Get(dshelp.CidToDsKey(rnd1.Cid()))
+	assert.Equal(t, datastore.ErrNotFound, err)
+	_, err = overlay.GetSize(dshelp.CidToDsKey(rnd1.Cid()))
+	assert.Equal(t, datastore.ErrNotFound, err)
+
+	results, err := overlay.Query(dsq.Query{})
+	assert.NoError(t, err)
+	entries, err := results.Rest()
+	assert.NoError(t, err)
+	actual := make(map[string][]byte)
+	for _, entry := range entries {
+		_, dupe := actual[entry.Key]
+		assert.False(t, dupe)
+		actual[entry.Key] = entry.Value
+	}
+	expected := make(map[string][]byte)
+	for _, block := range []blocks.Block{extra, rndz, rnd2, rnd3, pnd1, pnd2, pnd3, cnd1, cnd2, cnd3} {
+		expected[dshelp.CidToDsKey(block.Cid()).String()] = block.RawData()
+	}
+	assert.Equal(t, expected, actual)
+	assert.Equal(t, dshelp.CidToDsKey(extra.Cid()).String(), entries[0].Key)
+
+	// only the new block is written as a further patch
+	var buf bytes.Buffer
+	_, err = overlay.WriteTo(&buf)
+	assert.NoError(t, err)
+	written, err := NewDatastoreFromReaderAt(bytes.NewReader(buf.Bytes()), int64(buf.Len()), nil)
+	assert.NoError(t, err)
+	results, err = written.Query(dsq.Query{KeysOnly: true})
+	assert.NoError(t, err)
+	entries, err = results.Rest()
+	assert.NoError(t, err)
+	assert.Equal(t, []dsq.Entry{{Key: dshelp.CidToDsKey(extra.Cid()).String()}}, entries)
+	assert.NoError(t, written.Close())
+
+	assert.NoError(t, overlay.Close())
+	after, err := ioutil.ReadFile("overlay-base.zcar")
+	assert.NoError(t, err)
+	assert.Equal(t, base, after)
+
+	_, err = NewOverlayDatastore("overlay-base.zcar", "overlay-missing.zcar")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestSkipCrcCheck(t *testing.T) {
+	os.Remove("skipcrc.zcar")
+	defer os.Remove("skipcrc.zcar")
+	stored := dag.NewRawNode([]byte("a block stored without compression"))
+	large := dag.NewRawNode(bytes.Repeat([]byte("large "), 20))
+
+	ds, err := NewDatastore("skipcrc.zcar")
+	assert.NoError(t, err)
+	for _, raw := range []*dag.RawNode{stored, large} {
+		assert.NoError(t, ds.PutCid(raw.Cid(), raw.RawData()))
+	}
+	assert.NoError(t, ds.Close())
+
+	// corrupt the stored block without updating its CRC
+	data, err := ioutil.ReadFile("skipcrc.zcar")
+	assert.NoError(t, err)
+	reader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	assert.NoError(t, err)
+	corrupted := append([]byte{}, stored.RawData()...)
+	corrupted[0] = 'A'
+	for _, f := range reader.File {
+		if f.Name == stored.Cid().String() {
+			assert.Equal(t, zip.Store, f.Method)
+			offset, err := f.DataOffset()
+			assert.NoError(t, err)
+			data[offset] = 'A'
+		}
+	}
+	assert.NoError(t, ioutil.WriteFile("skipcrc.zcar", data, 0644))
+
+	for _, mmap := range []bool{false, true} {
+		opts := DefaultOptions()
+		opts.Mmap = mmap
+		ds, err = NewDatastoreWithOptions("skipcrc.zcar", &opts)
+		assert.NoError(t, err)
+		_, err = ds.GetCid(stored.Cid())
+		assert.Equal(t, &CidError{Cid: stored.Cid().String(), Err: zip.ErrChecksum}, err)
+		assert.NoError(t, ds.Close())
+
+		opts.SkipCrcCheck = true
+		ds, err = NewDatastoreWithOptions("skipcrc.zcar", &opts)
+		assert.NoError(t, err)
+		value, err := ds.GetCid(stored.Cid())
+		assert.NoError(t, err)
+		assert.Equal(t, corrupted, value)
+		value, err = ds.GetCid(large.Cid())
+		assert.NoError(t, err)
+		assert.Equal(t, large.RawData(), value)
+		// still detected by an explicit check
+		report, err := ds.Check()
+		assert.NoError(t, err)
+		assert.Equal(t, []cid.Cid{stored.Cid()}, report.Mismatched)
+		assert.NoError(t, ds.Close())
+	}
+}
+
+func TestRepair(t *testing.T) {
+	defer os.Remove("repair.zcar")
+	corrupt := dag.NewRawNode([]byte("a block that will be corrupted"))
+
+	// rnd1 named as rnd2 and rnd3 named as pnd1's CIDv0 (right data, wrong name), another copy of rnd1 named as
+	// rnd3, which then duplicates the repaired rnd1, and a stored block whose data is corrupted after writing
+	var buf bytes.Buffer
+	writer := zip.NewWriter(&buf)
+	for _, entry := range []struct {
+		name string
+		data []byte
+	}{
+		{rnd2.Cid().String(), rnd1.RawData()},
+		{pnd1.Cid().String(), rnd3.RawData()},
+		{rnd3.Cid().String(), rnd1.RawData()},
+		{cnd1.Cid().String(), cnd1.RawData()},
+		{corrupt.Cid().String(), corrupt.RawData()},
+	} {
+		f, err := writer.CreateHeader(&zip.FileHeader{Name: entry.name, Method: zip.Store, Comment: "comment"})
+		assert.NoError(t, err)
+		_, err = f.Write(entry.data)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, writer.Close())
+	data := buf.Bytes()
+	data[bytes.Index(data, corrupt.RawData())] = 'A'
+	assert.NoError(t, ioutil.WriteFile("repair.zcar", data, 0644))
+
+	ds, err := NewDatastore("repair.zcar")
+	assert.NoError(t, err)
+	report, err := ds.Check()
+	assert.NoError(t, err)
+	assert.Equal(t, 4, len(report.Mismatched))
+
+	fixed, err := ds.Repair()
+	assert.Equal(t, &CorruptBlocksError{Cids: []cid.Cid{corrupt.Cid()}}, err)
+	assert.EqualError(t, err, "zipcar: blocks are corrupt: "+corrupt.Cid().String())
+	rnd3v0, err := cid.V0Builder{}.Sum(rnd3.RawData())
+	assert.NoError(t, err)
+	// the CIDv0 of pnd1 is corrected to a CIDv0, with the dag-pb codec that implies
+	assert.Equal(t, []cid.Cid{rnd1.Cid(), rnd3v0, rnd1.Cid()}, fixed)
+
+	verifyHas(t, ds, rnd1.Cid(), "rnd1")
+	verifyHas(t, ds, rnd3v0, "rnd3v0")
+	for _, c := range []cid.Cid{rnd2.Cid(), pnd1.Cid(), rnd3.Cid()} {
+		has, err := ds.HasCid(c)
+		assert.NoError(t, err)
+		assert.False(t, has)
+	}
+	comment, err := ds.EntryComment(rnd1.Cid())
+	assert.NoError(t, err)
+	assert.Equal(t, "comment", comment)
+	// the corrupt block can't be read to rewrite the archive
+	assert.Equal(t, zip.ErrChecksum, ds.Close())
+
+	ds, err = NewDatastore("repair.zcar")
+	assert.NoError(t, err)
+	_, err = ds.Repair()
+	assert.Error(t, err)
+	assert.NoError(t, ds.DeleteCid(corrupt.Cid()))
+	assert.NoError(t, ds.Close())
+
+	ds, err = NewDatastore("repair.zcar")
+	assert.NoError(t, err)
+	report, err = ds.Check()
+	assert.NoError(t, err)
+	assert.Empty(t, report.Mismatched)
+	assert.Equal(t, 3, report.Checked)
+	assert.NoError(t, ds.Close())
+}
+
+// memoryBackend is a Backend holding the archive in memory, counting the archives written to it.
+type memoryBackend struct {
+	archive []byte
+	writes  int
+}
+
+type memoryWriter struct {
+	bytes.Buffer
+	backend *memoryBackend
+}
+
+func (w *memoryWriter) Close() error {
+	w.backend.archive = w.Bytes()
+	w.backend.writes++
+	return nil
+}
+
+func (b *memoryBackend) Open() (ReaderAtCloser, int64, error) {
+	return nopCloser{bytes.NewReader(b.archive)}, int64(len(b.archive)), nil
+}
+
+func (b *memoryBackend) Create() (io.WriteCloser, error) {
+	return &memoryWriter{backend: b}, nil
+}
+
+func TestBackend(t *testing.T) {
+	backend := &memoryBackend{}
+	ds, err := NewDatastoreWithBackend(backend, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, ds.PutCid(rnd1.Cid(), rnd1.RawData()))
+	assert.NoError(t, ds.Sync())
+	assert.Equal(t, 1, backend.writes)
+
+	// still usable after a Sync(), reading from the new archive
+	verifyHas(t, ds, rnd1.Cid(), "rnd1")
+	assert.NoError(t, ds.PutCid(rnd2.Cid(), rnd2.RawData()))
+	assert.NoError(t, ds.DeleteCid(rnd1.Cid()))
+	assert.NoError(t, ds.Close())
+	assert.Equal(t, 2, backend.writes)
+
+	reader, err := zip.NewReader(bytes.NewReader(backend.archive), int64(len(backend.archive)))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(reader.File))
+	assert.Equal(t, rnd2.Cid().String(), reader.File[0].Name)
+
+	// not written again unless modified
+	ds, err = NewDatastoreWithBackend(backend, nil)
+	assert.NoError(t, err)
+	verifyHas(t, ds, rnd2.Cid(), "rnd2")
+	assert.NoError(t, ds.Close())
+	assert.Equal(t, 2, backend.writes)
+	assert.Equal(t, ErrNoFile, ds.CloseGz())
+
+	// the file backend produces the same archive as NewDatastore()
+	os.Remove("backend.zcar")
+	defer os.Remove("backend.zcar")
+	ds, err = NewDatastoreWithBackend(NewFileBackend("backend.zcar"), nil)
+	assert.NoError(t, err)
+	assert.NoError(t, ds.PutCid(rnd2.Cid(), rnd2.RawData()))
+	assert.NoError(t, ds.Close())
+	data, err := ioutil.ReadFile("backend.zcar")
+	assert.NoError(t, err)
+	assert.Equal(t, backend.archive, data)
+
+	ds, err = NewDatastore("backend.zcar")
+	assert.NoError(t, err)
+	verifyHas(t, ds, rnd2.Cid(), "rnd2")
+	assert.NoError(t, ds.Close())
+}
+
+func TestGetByPrefix(t *testing.T) {
+	copyFixture(t, "js.zcar", "prefix.zcar")
+	defer os.Remove("prefix.zcar")
+	ds, err := NewDatastore("prefix.zcar")
+	assert.NoError(t, err)
+	defer ds.Close()
+	assert.NoError(t, ds.PutCid(rnd1.Cid(), rnd1.RawData()))
+
+	for _, node := range []format.Node{rnd1, pnd2, cnd3} {
+		data, c, err := ds.GetByPrefix(node.Cid().String()[:20])
+		assert.NoError(t, err)
+		assert.Equal(t, node.Cid(), c)
+		assert.Equal(t, node.RawData(), data)
+	}
+
+	data, c, err := ds.GetByPrefix(rnd1.Cid().String()[:4])
+	assert.Equal(t, ErrAmbiguousPrefix, err)
+	assert.Nil(t, data)
+	assert.Equal(t, cid.Undef, c)
+	_, _, err = ds.GetByPrefix("")
+	assert.Equal(t, ErrAmbiguousPrefix, err)
+
+	_, _, err = ds.GetByPrefix("bafyzzzz")
+	assert.Equal(t, datastore.ErrNotFound, err)
+	assert.NoError(t, ds.DeleteCid(cnd3.Cid()))
+	_, _, err = ds.GetByPrefix(cnd3.Cid().String())
+	assert.Equal(t, datastore.ErrNotFound, err)
+}
+
+func TestRawCopy(t *testing.T) {
+	defer os.Remove("rawcopy.zcar")
+
+	// large blocks deflated at a level zipcar doesn't use, so any recompression would change the stored data
+	var nodes []*dag.RawNode
+	for i := 0; i < 3; i++ {
+		data := bytes.Repeat([]byte(fmt.Sprintf("block %d of compressible content, ", i)), 1<<15)
+		nodes = append(nodes, dag.NewRawNode(data))
+	}
+	writeArchive := func() map[string][]byte {
+		var buf bytes.Buffer
+		writer := zip.NewWriter(&buf)
+		writer.RegisterCompressor(zip.Deflate, func(w io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(w, flate.HuffmanOnly)
+		})
+		for _, node := range nodes {
+			f, err := writer.CreateHeader(&zip.FileHeader{Name: node.Cid().String(), Method: zip.Deflate})
+			assert.NoError(t, err)
+			_, err = f.Write(node.RawData())
+			assert.NoError(t, err)
+		}
+		assert.NoError(t, writer.Close())
+		assert.NoError(t, ioutil.WriteFile("rawcopy.zcar", buf.Bytes(), 0644))
+		return storedData(t, "rawcopy.zcar")
+	}
+
+	touched := time.Date(2020, 1, 2, 3, 4, 6, 0, time.UTC)
+	for _, opts := range []Options{
+		{RawCopy: true},
+		{RawCopy: true, CompressWorkers: 4},
+		{RawCopy: true, Compatibility: CompatMax},
+	} {
+		original := writeArchive()
+		fullOpts := DefaultOptions()
+		fullOpts.RawCopy = opts.RawCopy
+		fullOpts.CompressWorkers = opts.CompressWorkers
+		fullOpts.Compatibility = opts.Compatibility
+
+		ds, err := NewDatastoreWithOptions("rawcopy.zcar", &fullOpts)
+		assert.NoError(t, err)
+		assert.NoError(t, ds.PutCid(rnd1.Cid(), rnd1.RawData()))
+		assert.NoError(t, ds.SetEntryComment(nodes[0].Cid(), "comment"))
+		assert.NoError(t, ds.SetContentType(nodes[1].Cid(), "text/plain"))
+		assert.NoError(t, ds.Touch(nodes[2].Cid(), touched))
+		assert.NoError(t, ds.Sync())
+		// again, from the archive just written
+		assert.NoError(t, ds.PutCid(rnd2.Cid(), rnd2.RawData()))
+		assert.NoError(t, ds.Close())
+
+		assert.NoError(t, Validate("rawcopy.zcar", true))
+		stored := storedData(t, "rawcopy.zcar")
+		for _, node := range nodes {
+			assert.True(t, bytes.Equal(original[node.Cid().String()], stored[node.Cid().String()]),
+				"stored data copied as is")
+		}
+
+		reader, err := zip.OpenReader("rawcopy.zcar")
+		assert.NoError(t, err)
+		assert.Equal(t, 5, len(reader.File))
+		for _, f := range reader.File {
+			switch f.Name {
+			case nodes[0].Cid().String():
+				assert.Equal(t, "comment", f.Comment)
+			case nodes[1].Cid().String():
+				assert.Equal(t, "text/plain", entryContentType(f))
+			case nodes[2].Cid().String():
+				assert.True(t, touched.Equal(f.Modified))
+			}
+			if opts.Compatibility == CompatMax {
+				assert.Zero(t, f.Flags&flagDataDescriptor)
+			}
+		}
+		reader.Close()
+
+		ds, err = NewDatastore("rawcopy.zcar")
+		assert.NoError(t, err)
+		for _, node := range append(nodes, rnd1, rnd2) {
+			data, err := ds.GetCid(node.Cid())
+			assert.NoError(t, err)
+			assert.Equal(t, node.RawData(), data)
+		}
+		contentType, err := ds.ContentType(nodes[1].Cid())
+		assert.NoError(t, err)
+		assert.Equal(t, "text/plain", contentType)
+		assert.NoError(t, ds.Close())
+	}
+
+	// without RawCopy, blocks are compressed again
+	original := writeArchive()
+	ds, err := NewDatastore("rawcopy.zcar")
+	assert.NoError(t, err)
+	assert.NoError(t, ds.PutCid(rnd1.Cid(), rnd1.RawData()))
+	assert.NoError(t, ds.Close())
+	stored := storedData(t, "rawcopy.zcar")
+	assert.False(t, bytes.Equal(original[nodes[0].Cid().String()], stored[nodes[0].Cid().String()]))
+}
+
+// storedData returns the data of each entry of the archive at `path` as it is stored, by filename.
+func storedData(t *testing.T, path string) map[string][]byte {
+	reader, err := zip.OpenReader(path)
+	assert.NoError(t, err)
+	defer reader.Close()
+	stored := make(map[string][]byte)
+	for _, f := range reader.File {
+		stored[f.Name], err = readRaw(f)
+		assert.NoError(t, err)
+	}
+	return stored
+}
+
+func TestStat(t *testing.T) {
+	copyFixture(t, "js.zcar", "stat.zcar")
+	defer os.Remove("stat.zcar")
+	fileinfo, err := os.Stat("stat.zcar")
+	assert.NoError(t, err)
+
+	ds, err := NewDatastore("stat.zcar")
+	assert.NoError(t, err)
+	assert.NoError(t, ds.PutCid(dag.NewRawNode([]byte("stat")).Cid(), []byte("stat")))
+	assert.NoError(t, ds.DeleteCid(rnd1.Cid()))
+	stat, err := ds.Stat()
+	assert.NoError(t, err)
+	assert.Equal(t, ArchiveStat{
+		Path:     "stat.zcar",
+		Size:     fileinfo.Size(),
+		ModTime:  fileinfo.ModTime(),
+		Entries:  9,
+		Modified: true,
+		Comment:  ds.Comment(),
+	}, stat)
+	assert.NoError(t, ds.Close())
+
+	data, err := ioutil.ReadFile("js.zcar")
+	assert.NoError(t, err)
+	ds, err = NewDatastoreFromReaderAt(bytes.NewReader(data), int64(len(data)), nil)
+	assert.NoError(t, err)
+	stat, err = ds.Stat()
+	assert.NoError(t, err)
+	assert.Equal(t, ArchiveStat{Size: int64(len(data)), Entries: 9, Comment: ds.Comment()}, stat)
+	assert.NoError(t, ds.Close())
+}
+
+func TestRewrite(t *testing.T) {
+	copyFixture(t, "js.zcar", "rewrite.zcar")
+	defer os.Remove("rewrite.zcar")
+
+	ds, err := NewDatastore("rewrite.zcar")
+	assert.NoError(t, err)
+	added := dag.NewRawNode([]byte("rewrite"))
+	assert.NoError(t, ds.PutCid(added.Cid(), added.RawData()))
+	assert.NoError(t, ds.DeleteCid(rnd1.Cid()))
+	assert.NoError(t, ds.SetEntryComment(cnd1.Cid(), "comment"))
+
+	// readers running throughout the rewrites see every block, from either archive
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				for _, node := range []format.Node{rnd2, pnd1, cnd1, added} {
+					data, err := ds.GetCid(node.Cid())
+					assert.NoError(t, err)
+					assert.Equal(t, node.RawData(), data)
+				}
+			}
+		}()
+	}
+
+	assert.NoError(t, ds.Rewrite())
+	assert.False(t, ds.IsModified())
+	assert.NoError(t, ds.Rewrite(), "unmodified is a no-op")
+
+	// with mutations racing the rewrite, which may then fall back to Sync()
+	for i := 0; i < 10; i++ {
+		node := dag.NewRawNode([]byte(fmt.Sprintf("rewrite %d", i)))
+		done := make(chan error)
+		go func() {
+			done <- ds.Rewrite()
+		}()
+		assert.NoError(t, ds.PutCid(node.Cid(), node.RawData()))
+		assert.NoError(t, <-done)
+		assert.NoError(t, ds.Rewrite())
+		assert.False(t, ds.IsModified())
+		verifyHas(t, ds, node.Cid(), "racing put")
+	}
+	close(stop)
+	wg.Wait()
+
+	entries, err := ioutil.ReadDir(".")
+	assert.NoError(t, err)
+	for _, entry := range entries {
+		assert.False(t, strings.HasPrefix(entry.Name(), "rewrite.zcar.tmp"), "temporary file left behind")
+	}
+	assert.NoError(t, ds.Close())
+	assert.Equal(t, ErrClosed, ds.Rewrite())
+
+	ds, err = NewDatastore("rewrite.zcar")
+	assert.NoError(t, err)
+	verifyHas(t, ds, added.Cid(), "added")
+	has, err := ds.HasCid(rnd1.Cid())
+	assert.NoError(t, err)
+	assert.False(t, has)
+	comment, err := ds.EntryComment(cnd1.Cid())
+	assert.NoError(t, err)
+	assert.Equal(t, "comment", comment)
+	stat, err := ds.Stat()
+	assert.NoError(t, err)
+	assert.Equal(t, 19, stat.Entries)
+	assert.NoError(t, ds.Close())
+}
+
+func TestValidation(t *testing.T) {
+	defer os.Remove("validation.zcar")
+	// rnd1 is intact, rnd2 holds the content of rnd3
+	writeFixture(t, "validation.zcar", map[string][]byte{
+		rnd1.Cid().String(): rnd1.RawData(),
+		rnd2.Cid().String(): rnd3.RawData(),
+		"README.txt":        []byte("not a block"),
+	})
+	open := func(validation Validation) (*ZipDatastore, error) {
+		opts := DefaultOptions()
+		opts.Validation = validation
+		opts.CopyOnPut = false
+		return NewDatastoreWithOptions("validation.zcar", &opts)
+	}
+
+	for _, validation := range []Validation{ValidateKeys, ValidateStrict} {
+		_, err := open(validation)
+		assert.Equal(t, &NotZcarError{Names: []string{"README.txt"}}, err)
+	}
+
+	for _, validation := range []Validation{ValidateNone, ValidateHashes} {
+		ds, err := open(validation)
+		assert.NoError(t, err)
+		verifyHas(t, ds, rnd1.Cid(), "rnd1")
+		data, err := ds.GetCid(rnd2.Cid())
+		err2 := ds.PutCid(rnd3.Cid(), rnd2.RawData())
+		if validation == ValidateNone {
+			assert.NoError(t, err)
+			assert.Equal(t, rnd3.RawData(), data)
+			assert.NoError(t, err2)
+		} else {
+			assert.Nil(t, data)
+			assert.Equal(t, &CidError{Cid: rnd2.Cid().String(), Err: ErrHashMismatch}, err)
+			assert.Equal(t, &CidError{Cid: rnd3.Cid().String(), Err: ErrHashMismatch}, err2)
+			has, err := ds.HasCid(rnd3.Cid())
+			assert.NoError(t, err)
+			assert.False(t, has)
+		}
+		// discard the mutations
+		ds.modified = false
+		assert.NoError(t, ds.Close())
+	}
+
+	// ValidateStrict hashes blocks held in memory on every read too
+	writeFixture(t, "validation.zcar", map[string][]byte{rnd1.Cid().String(): rnd1.RawData()})
+	ds, err := open(ValidateStrict)
+	assert.NoError(t, err)
+	block := append([]byte{}, pnd1.RawData()...)
+	assert.NoError(t, ds.PutCid(pnd1.Cid(), block))
+	verifyHas(t, ds, pnd1.Cid(), "pnd1")
+	block[0]++
+	_, err = ds.GetCid(pnd1.Cid())
+	assert.Equal(t, &CidError{Cid: pnd1.Cid().String(), Err: ErrHashMismatch}, err)
+	block[0]--
+	assert.NoError(t, ds.Close())
+}
+
+func TestNewEntries(t *testing.T) {
+	copyFixture(t, "js.zcar", "new-entries.zcar")
+	defer os.Remove("new-entries.zcar")
+	defer os.Remove("delta.zcar")
+	os.Remove("delta.zcar")
+
+	opts := DefaultOptions()
+	opts.KeepTombstoneData = true
+	ds, err := NewDatastoreWithOptions("new-entries.zcar", &opts)
+	assert.NoError(t, err)
+	cids, err := ds.NewEntries()
+	assert.NoError(t, err)
+	assert.Empty(t, cids)
+
+	var nodes []*dag.RawNode
+	for i := 0; i < 4; i++ {
+		nodes = append(nodes, dag.NewRawNode([]byte(fmt.Sprintf("new entry %d", i))))
+		assert.NoError(t, ds.PutCid(nodes[i].Cid(), nodes[i].RawData()))
+	}
+	assert.NoError(t, ds.PutCid(rnd1.Cid(), rnd1.RawData()), "already present")
+	assert.NoError(t, ds.SetEntryComment(nodes[0].Cid(), "comment"))
+	assert.NoError(t, ds.Sync())
+	// deleted, then deleted and restored
+	assert.NoError(t, ds.DeleteCid(nodes[1].Cid()))
+	assert.NoError(t, ds.DeleteCid(nodes[2].Cid()))
+	assert.NoError(t, ds.Undelete(nodes[2].Cid()))
+
+	expected := []cid.Cid{nodes[0].Cid(), nodes[2].Cid(), nodes[3].Cid()}
+	sort.Slice(expected, func(i, j int) bool { return expected[i].String() < expected[j].String() })
+	cids, err = ds.NewEntries()
+	assert.NoError(t, err)
+	assert.Equal(t, expected, cids)
+
+	assert.NoError(t, ds.CopyTo("delta.zcar", cids))
+	assert.Equal(t, datastore.ErrNotFound, ds.CopyTo("delta.zcar", []cid.Cid{nodes[1].Cid()}))
+	assert.NoError(t, ds.Close())
+
+	delta, err := NewDatastore("delta.zcar")
+	assert.NoError(t, err)
+	for _, c := range expected {
+		verifyHas(t, delta, c, "new entry")
+	}
+	comment, err := delta.EntryComment(nodes[0].Cid())
+	assert.NoError(t, err)
+	assert.Equal(t, "comment", comment)
+	stat, err := delta.Stat()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, stat.Entries)
+	assert.NoError(t, delta.Close())
+}
+
+func TestFormatVersion(t *testing.T) {
+	copyFixture(t, "js.zcar", "version.zcar")
+	defer os.Remove("version.zcar")
+
+	ds, err := NewDatastore("version.zcar")
+	assert.NoError(t, err)
+	_, err = ds.FormatVersion()
+	assert.Equal(t, ErrNoFormatVersion, err)
+	assert.NoError(t, ds.Close())
+
+	opts := DefaultOptions()
+	opts.WriteFormatVersion = true
+	opts.StrictZcar = true
+	ds, err = NewDatastoreWithOptions("version.zcar", &opts)
+	assert.NoError(t, err)
+	rndz := dag.NewRawNode([]byte("format version"))
+	assert.NoError(t, ds.PutCid(rndz.Cid(), rndz.RawData()))
+	// not yet written
+	_, err = ds.FormatVersion()
+	assert.Equal(t, ErrNoFormatVersion, err)
+	estimate, err := ds.EstimatedSize()
+	assert.NoError(t, err)
+	assert.NoError(t, ds.Close())
+	fileinfo, err := os.Stat("version.zcar")
+	assert.NoError(t, err)
+	assert.True(t, fileinfo.Size() <= estimate)
+
+	// StrictZcar accepts the entry, which isn't a block
+	ds, err = NewDatastoreWithOptions("version.zcar", &opts)
+	assert.NoError(t, err)
+	version, err := ds.FormatVersion()
+	assert.NoError(t, err)
+	assert.Equal(t, ZcarFormatVersion, version)
+	results, err := ds.Query(dsq.Query{KeysOnly: true})
+	assert.NoError(t, err)
+	entries, err := results.Rest()
+	assert.NoError(t, err)
+	assert.Equal(t, 10, len(entries))
+	assert.NoError(t, ds.Close())
+
+	reader, err := zip.OpenReader("version.zcar")
+	assert.NoError(t, err)
+	for _, f := range reader.File {
+		if f.Name == FormatVersionName {
+			rc, err := f.Open()
+			assert.NoError(t, err)
+			data, err := ioutil.ReadAll(rc)
+			assert.NoError(t, err)
+			rc.Close()
+			assert.Equal(t, "format "+ZcarFormatVersion+"\nimplementation "+ImplementationName+"\n", string(data))
+		}
+	}
+	reader.Close()
+
+	// an entry without a format line
+	writeFixture(t, "version.zcar", map[string][]byte{FormatVersionName: []byte("implementation other\n")})
+	ds, err = NewDatastore("version.zcar")
+	assert.NoError(t, err)
+	_, err = ds.FormatVersion()
+	assert.Error(t, err)
+	assert.NoError(t, ds.Close())
+}
+
+func TestMalformedArchive(t *testing.T) {
+	data, err := ioutil.ReadFile("js.zcar")
+	assert.NoError(t, err)
+	defer os.Remove("malformed.zcar")
+
+	// every truncation fails cleanly
+	for n := 1; n < len(data); n++ {
+		ds, err := NewDatastoreWithBackend(&memoryBackend{archive: data[:n]}, nil)
+		if !assert.Error(t, err, "truncated to %d bytes", n) {
+			ds.Close()
+		}
+	}
+
+	// a central directory header declaring a compressed size larger than the archive
+	corrupt := append([]byte{}, data...)
+	signature := make([]byte, 4)
+	binary.LittleEndian.PutUint32(signature, 0x02014b50)
+	header := bytes.Index(corrupt, signature)
+	assert.True(t, header > 0)
+	binary.LittleEndian.PutUint32(corrupt[header+20:], 0x7fffffff)
+	assert.NoError(t, ioutil.WriteFile("malformed.zcar", corrupt, 0644))
+	ds, err := NewDatastore("malformed.zcar")
+	assert.NoError(t, err)
+	results, err := ds.Query(dsq.Query{KeysOnly: true})
+	assert.NoError(t, err)
+	entries, err := results.Rest()
+	assert.NoError(t, err)
+	failed := 0
+	for _, entry := range entries {
+		if _, err := ds.Get(datastore.RawKey(entry.Key)); err != nil {
+			assert.Equal(t, zip.ErrFormat, errors.Unwrap(err))
+			failed++
+		}
+	}
+	assert.Equal(t, 1, failed)
+	assert.NoError(t, ds.Close())
+}
+
+func TestMaxReadBytes(t *testing.T) {
+	copyFixture(t, "js.zcar", "maxread.zcar")
+	defer os.Remove("maxread.zcar")
+
+	assert.Equal(t, int64(1<<30), DefaultOptions().MaxReadBytes)
+	opts := DefaultOptions()
+	opts.MaxReadBytes = int64(len(pnd1.RawData()) - 1)
+	ds, err := NewDatastoreWithOptions("maxread.zcar", &opts)
+	assert.NoError(t, err)
+	_, err = ds.GetCid(pnd1.Cid())
+	assert.Equal(t, ErrEntryTooLarge, errors.Unwrap(err))
+	has, err := ds.HasCid(pnd1.Cid())
+	assert.NoError(t, err)
+	assert.True(t, has)
+	assert.NoError(t, ds.Close())
+
+	opts.MaxReadBytes = int64(len(pnd1.RawData()))
+	ds, err = NewDatastoreWithOptions("maxread.zcar", &opts)
+	assert.NoError(t, err)
+	verifyHas(t, ds, pnd1.Cid(), "pnd1")
+	assert.NoError(t, ds.Close())
+}
+
+func TestAllKeysChan(t *testing.T) {
+	copyFixture(t, "js.zcar", "allkeys.zcar")
+	defer os.Remove("allkeys.zcar")
+
+	for _, workers := range []int{0, 4, 20} {
+		opts := DefaultOptions()
+		opts.ScanWorkers = workers
+		ds, err := NewDatastoreWithOptions("allkeys.zcar", &opts)
+		assert.NoError(t, err)
+		assert.NoError(t, ds.DeleteCid(rnd1.Cid()))
+		rndz := dag.NewRawNode([]byte("all keys"))
+		assert.NoError(t, ds.PutCid(rndz.Cid(), rndz.RawData()))
+
+		ch, err := ds.AllKeysChan(context.Background())
+		assert.NoError(t, err)
+		var keys []string
+		for c := range ch {
+			keys = append(keys, c.String())
+		}
+		results, err := ds.Query(dsq.Query{KeysOnly: true})
+		assert.NoError(t, err)
+		entries, err := results.Rest()
+		assert.NoError(t, err)
+		var expected []string
+		for _, entry := range entries {
+			c, err := dshelp.DsKeyToCid(datastore.RawKey(entry.Key))
+			assert.NoError(t, err)
+			expected = append(expected, c.String())
+		}
+		assert.Equal(t, 9, len(keys), "workers=%d", workers)
+		if workers == 0 {
+			assert.Equal(t, expected, keys)
+		} else {
+			assert.ElementsMatch(t, expected, keys)
+		}
+
+		// a cancelled scan still closes the channel
+		ctx, cancel := context.WithCancel(context.Background())
+		ch, err = ds.AllKeysChan(ctx)
+		assert.NoError(t, err)
+		<-ch
+		cancel()
+		for range ch {
+		}
+		assert.NoError(t, ds.Close())
+		copyFixture(t, "js.zcar", "allkeys.zcar")
+	}
+}
+
+func TestMeta(t *testing.T) {
+	copyFixture(t, "js.zcar", "meta.zcar")
+	defer os.Remove("meta.zcar")
+
+	ds, err := NewDatastore("meta.zcar")
+	assert.NoError(t, err)
+	_, ok := ds.Meta("creator")
+	assert.False(t, ok)
+	assert.Equal(t, map[string]string{}, ds.AllMeta())
+	ds.SetMeta("creator", "zipcar")
+	ds.SetMeta("dataset", "test blocks")
+	ds.SetMeta("removed", "soon")
+	ds.SetMeta("removed", "")
+	assert.True(t, ds.IsModified())
+	value, ok := ds.Meta("creator")
+	assert.True(t, ok)
+	assert.Equal(t, "zipcar", value)
+	estimate, err := ds.EstimatedSize()
+	assert.NoError(t, err)
+	assert.NoError(t, ds.Close())
+	fileinfo, err := os.Stat("meta.zcar")
+	assert.NoError(t, err)
+	assert.True(t, fileinfo.Size() <= estimate)
+
+	// loaded on open, and kept apart from the blocks, which StrictZcar accepts
+	opts := DefaultOptions()
+	opts.StrictZcar = true
+	ds, err = NewDatastoreWithOptions("meta.zcar", &opts)
+	assert.NoError(t, err)
+	expected := map[string]string{"creator": "zipcar", "dataset": "test blocks"}
+	assert.Equal(t, expected, ds.AllMeta())
+	results, err := ds.Query(dsq.Query{KeysOnly: true})
+	assert.NoError(t, err)
+	entries, err := results.Rest()
+	assert.NoError(t, err)
+	assert.Equal(t, 9, len(entries))
+	assert.False(t, ds.IsModified())
+
+	// carried through a rewrite prompted by another mutation, and by Clone()
+	assert.NoError(t, ds.DeleteCid(rnd1.Cid()))
+	clone, err := ds.Clone()
+	assert.NoError(t, err)
+	assert.Equal(t, expected, clone.AllMeta())
+	clone.SetMeta("creator", "clone")
+	assert.NoError(t, ds.Close())
+	assert.NoError(t, clone.Close())
+	ds, err = NewDatastore("meta.zcar")
+	assert.NoError(t, err)
+	assert.Equal(t, expected, ds.AllMeta())
+	assert.NoError(t, ds.Close())
+
+	writeFixture(t, "meta.zcar", map[string][]byte{MetaName: []byte("not json")})
+	_, err = NewDatastore("meta.zcar")
+	assert.Error(t, err)
+}
+
+func TestNonCidKeys(t *testing.T) {
+	copyFixture(t, "js.zcar", "keys.zcar")
+	defer os.Remove("keys.zcar")
+
+	for _, lenient := range []bool{false, true} {
+		opts := DefaultOptions()
+		opts.LenientKeys = lenient
+		ds, err := NewDatastoreWithOptions("keys.zcar", &opts)
+		assert.NoError(t, err)
+		// none of these can become a filename without escaping, none are stored
+		for _, key := range []string{"/dir/file", "/back\\slash", "/ünïcödé", "/blocks/" + rnd1.Cid().String() + "/x"} {
+			assert.Error(t, ds.Put(datastore.NewKey(key), []byte("value")), key)
+			has, _ := ds.Has(datastore.NewKey(key))
+			assert.False(t, has, key)
+		}
+		assert.False(t, ds.IsModified())
+		assert.NoError(t, ds.Close())
+	}
+}
+
+func TestVerifyFast(t *testing.T) {
+	copyFixture(t, "js.zcar", "verifyfast.zcar")
+	defer os.Remove("verifyfast.zcar")
+
+	ds, err := NewDatastore("verifyfast.zcar")
+	assert.NoError(t, err)
+	c, err := ds.VerifyFast()
+	assert.NoError(t, err)
+	assert.Equal(t, cid.Undef, c)
+	// a pending block that doesn't match its CID
+	assert.NoError(t, ds.PutCid(rndz.Cid(), []byte("wrong")))
+	c, err = ds.VerifyFast()
+	assert.Equal(t, rndz.Cid(), c)
+	assert.Equal(t, ErrHashMismatch, errors.Unwrap(err))
+	assert.NoError(t, ds.DeleteCid(rndz.Cid()))
+	assert.NoError(t, ds.Close())
+
+	// a substituted entry, with a valid CRC-32, in the archive stops the scan, only the full Check() reports both
+	// mismatches
+	writeFixture(t, "verifyfast.zcar", map[string][]byte{
+		rnd1.Cid().String(): rnd1.RawData(),
+		rnd2.Cid().String(): []byte("substituted"),
+		rnd3.Cid().String(): []byte("also substituted"),
+	})
+	ds, err = NewDatastore("verifyfast.zcar")
+	assert.NoError(t, err)
+	c, err = ds.VerifyFast()
+	assert.True(t, c.Equals(rnd2.Cid()) || c.Equals(rnd3.Cid()))
+	assert.Equal(t, ErrHashMismatch, errors.Unwrap(err))
+	report, err := ds.Check()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(report.Mismatched))
+	assert.NoError(t, ds.Close())
+
+	// an entry failing its CRC-32
+	data, err := ioutil.ReadFile("js.zcar")
+	assert.NoError(t, err)
+	pos := bytes.Index(data, pnd1.RawData())
+	assert.True(t, pos > 0)
+	data[pos] ^= 0xff
+	assert.NoError(t, ioutil.WriteFile("verifyfast.zcar", data, 0644))
+	ds, err = NewDatastore("verifyfast.zcar")
+	assert.NoError(t, err)
+	c, err = ds.VerifyFast()
+	assert.Equal(t, pnd1.Cid(), c)
+	assert.Equal(t, zip.ErrChecksum, errors.Unwrap(err))
+	ds.Close()
+}
+
+func TestNewDatastoreWithSize(t *testing.T) {
+	copyFixture(t, "js.zcar", "withsize.zcar")
+	defer os.Remove("withsize.zcar")
+	fileinfo, err := os.Stat("withsize.zcar")
+	assert.NoError(t, err)
+
+	ds, err := NewDatastoreWithSize("withsize.zcar", fileinfo.Size())
+	assert.NoError(t, err)
+	verifyHasEntries(t, ds, false)
+	assert.NoError(t, ds.Close())
+
+	// the wrong size misses the end of the central directory
+	_, err = NewDatastoreWithSize("withsize.zcar", fileinfo.Size()-1)
+	assert.Error(t, err)
+	_, err = NewDatastoreWithSize("withsize.zcar", -1)
+	assert.Error(t, err)
+
+	// a new archive
+	os.Remove("withsize.zcar")
+	ds, err = NewDatastoreWithSize("withsize.zcar", 0)
+	assert.NoError(t, err)
+	assert.NoError(t, ds.PutCid(rnd1.Cid(), rnd1.RawData()))
+	assert.NoError(t, ds.Close())
+	ds, err = NewDatastore("withsize.zcar")
+	assert.NoError(t, err)
+	verifyHas(t, ds, rnd1.Cid(), "rnd1")
+	assert.NoError(t, ds.Close())
+}
+
+// writeDuplicates writes an archive to `path` holding rnd1 followed by a substitute under the same filename, pnd1
+// under its CIDv1 filename followed by an uppercase variant of it, and a substitute for rnd3 followed by rnd3.
+func writeDuplicates(t *testing.T, path string) {
+	file, err := os.Create(path)
+	assert.NoError(t, err)
+	writer := zip.NewWriter(file)
+	pnd1v1 := cid.NewCidV1(pnd1.Cid().Type(), pnd1.Cid().Hash()).String()
+	for _, entry := range []struct {
+		name string
+		data []byte
+	}{
+		{rnd1.Cid().String(), rnd1.RawData()},
+		{pnd1v1, pnd1.RawData()},
+		{rnd1.Cid().String(), []byte("substituted")},
+		{strings.ToUpper(pnd1v1), []byte("variant")},
+		{rnd2.Cid().String(), rnd2.RawData()},
+		{rnd3.Cid().String(), []byte("bad")},
+		{rnd3.Cid().String(), rnd3.RawData()},
+	} {
+		f, err := writer.Create(entry.name)
+		assert.NoError(t, err)
+		_, err = f.Write(entry.data)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, writer.Close())
+	assert.NoError(t, file.Close())
+}
+
+func TestDuplicateNames(t *testing.T) {
+	copyFixture(t, "js.zcar", "duplicates.zcar")
+	defer os.Remove("duplicates.zcar")
+
+	ds, err := NewDatastore("duplicates.zcar")
+	assert.NoError(t, err)
+	names, err := ds.DuplicateNames()
+	assert.NoError(t, err)
+	assert.Empty(t, names)
+	assert.NoError(t, ds.Close())
+
+	writeDuplicates(t, "duplicates.zcar")
+	expected := []string{
+		cid.NewCidV1(pnd1.Cid().Type(), pnd1.Cid().Hash()).String(),
+		rnd1.Cid().String(),
+		rnd3.Cid().String(),
+	}
+	sort.Strings(expected)
+	// rejected by default
+	_, err = NewDatastore("duplicates.zcar")
+	assert.Equal(t, &DuplicateNamesError{Names: expected}, err)
+
+	opts := DefaultOptions()
+	opts.DuplicatePolicy = DuplicateFirst
+	ds, err = NewDatastoreWithOptions("duplicates.zcar", &opts)
+	assert.NoError(t, err)
+	names, err = ds.DuplicateNames()
+	assert.NoError(t, err)
+	assert.Equal(t, expected, names)
+	// a rewrite keeps only the chosen entries
+	ds.SetComment("rewrite")
+	assert.NoError(t, ds.Close())
+	ds, err = NewDatastore("duplicates.zcar")
+	assert.NoError(t, err)
+	names, err = ds.DuplicateNames()
+	assert.NoError(t, err)
+	assert.Empty(t, names)
+	assert.NoError(t, ds.Close())
+
+	// a pending block isn't a duplicate
+	os.Remove("duplicates.zcar")
+	ds, err = NewDatastore("duplicates.zcar")
+	assert.NoError(t, err)
+	assert.NoError(t, ds.PutCid(rnd1.Cid(), rnd1.RawData()))
+	names, err = ds.DuplicateNames()
+	assert.NoError(t, err)
+	assert.Empty(t, names)
+	assert.NoError(t, ds.Close())
+}
+
+func TestDuplicatePolicy(t *testing.T) {
+	writeDuplicates(t, "policy.zcar")
+	defer os.Remove("policy.zcar")
+	pnd1v1 := cid.NewCidV1(pnd1.Cid().Type(), pnd1.Cid().Hash())
+
+	for _, tc := range []struct {
+		policy           DuplicatePolicy
+		rnd1, pnd1, rnd3 []byte
+	}{
+		{DuplicateFirst, rnd1.RawData(), pnd1.RawData(), []byte("bad")},
+		{DuplicateLast, []byte("substituted"), []byte("variant"), rnd3.RawData()},
+		{DuplicateLargestSize, []byte("substituted"), pnd1.RawData(), rnd3.RawData()},
+		{DuplicateVerifyHash, rnd1.RawData(), pnd1.RawData(), rnd3.RawData()},
+	} {
+		for _, compact := range []bool{false, true} {
+			opts := DefaultOptions()
+			opts.DuplicatePolicy = tc.policy
+			opts.CompactIndex = compact
+			ds, err := NewDatastoreWithOptions("policy.zcar", &opts)
+			assert.NoError(t, err)
+			for _, expected := range []struct {
+				c    cid.Cid
+				data []byte
+			}{{rnd1.Cid(), tc.rnd1}, {pnd1v1, tc.pnd1}, {rnd2.Cid(), rnd2.RawData()}, {rnd3.Cid(), tc.rnd3}} {
+				data, err := ds.GetCid(expected.c)
+				assert.NoError(t, err)
+				assert.Equal(t, expected.data, data, "policy %d, %s", tc.policy, expected.c)
+			}
+			assert.NoError(t, ds.Close())
+		}
+	}
+}
+
+func TestGetRange(t *testing.T) {
+	defer os.Remove("range.zcar")
+	os.Remove("range.zcar")
+	var buf bytes.Buffer
+	for buf.Len() < 256<<10 {
+		fmt.Fprintf(&buf, "line %d\n", buf.Len())
+	}
+	large := dag.NewRawNode(buf.Bytes())
+	ds, err := NewDatastore("range.zcar")
+	assert.NoError(t, err)
+	assert.NoError(t, ds.PutCid(large.Cid(), large.RawData()))
+	assert.NoError(t, ds.PutCid(rnd1.Cid(), rnd1.RawData()))
+	// pending
+	data, err := ds.GetRange(large.Cid(), 5, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, large.RawData()[5:15], data)
+	assert.NoError(t, ds.Close())
+
+	opts := DefaultOptions()
+	opts.DisableReadCache = true
+	ds, err = NewDatastoreWithOptions("range.zcar", &opts)
+	assert.NoError(t, err)
+	for _, r := range []struct{ offset, length, start, end int64 }{
+		{0, 10, 0, 10},
+		{1000, 4096, 1000, 5096},
+		{int64(len(large.RawData())) - 3, 10, int64(len(large.RawData())) - 3, int64(len(large.RawData()))},
+		{int64(len(large.RawData())) + 10, 10, int64(len(large.RawData())), int64(len(large.RawData()))},
+	} {
+		data, err := ds.GetRange(large.Cid(), r.offset, r.length)
+		assert.NoError(t, err)
+		assert.True(t, bytes.Equal(large.RawData()[r.start:r.end], data), "%d+%d", r.offset, r.length)
+		// the block was decompressed once and held, despite DisableReadCache
+		assert.NotNil(t, ds.inflated.f)
+		assert.Empty(t, ds.cache)
+	}
+	data, err = ds.GetRange(rnd1.Cid(), 1, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, rnd1.RawData()[1:3], data)
+	_, err = ds.GetRange(large.Cid(), -1, 2)
+	assert.Equal(t, ErrInvalidRange, err)
+	_, err = ds.GetRange(rndz.Cid(), 0, 2)
+	assert.Equal(t, datastore.ErrNotFound, err)
+
+	// the held block isn't served once deleted
+	assert.NoError(t, ds.DeleteCid(large.Cid()))
+	_, err = ds.GetRange(large.Cid(), 0, 2)
+	assert.Equal(t, datastore.ErrNotFound, err)
+	assert.NoError(t, ds.Close())
+}
+
+func TestListCidsIn(t *testing.T) {
+	cids, err := ListCidsIn("appended.zcar")
+	assert.NoError(t, err)
+	// the README is skipped
+	assert.Equal(t, 10, len(cids))
+	assert.Equal(t, rndz.Cid(), cids[9])
+
+	copyFixture(t, "appended.zcar", "list.zcar")
+	defer os.Remove("list.zcar")
+	ds, err := NewDatastore("list.zcar")
+	assert.NoError(t, err)
+	for _, c := range cids {
+		has, err := ds.HasCid(c)
+		assert.NoError(t, err)
+		assert.True(t, has, c.String())
+	}
+	assert.NoError(t, ds.Close())
+
+	// duplicates are listed once
+	writeDuplicates(t, "list.zcar")
+	cids, err = ListCidsIn("list.zcar")
+	assert.NoError(t, err)
+	assert.Equal(t, 4, len(cids))
+
+	_, err = ListCidsIn("missing.zcar")
+	assert.True(t, os.IsNotExist(err))
+	assert.NoError(t, ioutil.WriteFile("list.zcar", []byte("not a zip"), 0644))
+	_, err = ListCidsIn("list.zcar")
+	assert.Equal(t, zip.ErrFormat, err)
+}
+
+func TestCreateOpen(t *testing.T) {
+	defer os.Remove("create.zcar")
+	os.Remove("create.zcar")
+
+	_, err := Open("create.zcar")
+	assert.True(t, os.IsNotExist(err))
+	_, err = OpenReadOnly("create.zcar")
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat("create.zcar")
+	assert.True(t, os.IsNotExist(err), "not created by Open() or OpenReadOnly()")
+
+	ds, err := Create("create.zcar")
+	assert.NoError(t, err)
+	assert.NoError(t, ds.PutCid(rnd1.Cid(), rnd1.RawData()))
+	assert.NoError(t, ds.Close())
+	_, err = Create("create.zcar")
+	assert.True(t, os.IsExist(err))
+
+	ds, err = Open("create.zcar")
+	assert.NoError(t, err)
+	verifyHas(t, ds, rnd1.Cid(), "rnd1")
+	assert.NoError(t, ds.PutCid(rnd2.Cid(), rnd2.RawData()))
+	assert.NoError(t, ds.Close())
+
+	before, err := ioutil.ReadFile("create.zcar")
+	assert.NoError(t, err)
+	ds, err = OpenReadOnly("create.zcar")
+	assert.NoError(t, err)
+	verifyHas(t, ds, rnd2.Cid(), "rnd2")
+	assert.Equal(t, ErrReadOnly, errors.Unwrap(ds.PutCid(rnd3.Cid(), rnd3.RawData())))
+	stat, err := ds.Stat()
+	assert.NoError(t, err)
+	assert.Equal(t, "create.zcar", stat.Path)
+	assert.NoError(t, ds.Close())
+	after, err := ioutil.ReadFile("create.zcar")
+	assert.NoError(t, err)
+	assert.Equal(t, before, after)
+}
+
+func TestImportCar(t *testing.T) {
+	copyFixture(t, "js.zcar", "importsrc.zcar")
+	defer os.Remove("importsrc.zcar")
+	src, err := NewDatastore("importsrc.zcar")
+	assert.NoError(t, err)
+	var buf bytes.Buffer
+	assert.NoError(t, src.ExportCar([]cid.Cid{cnd3.Cid()}, &buf))
+	assert.NoError(t, src.Close())
+	car := buf.Bytes()
+	all := []blocks.Block{rnd1, rnd2, rnd3, pnd1, pnd2, pnd3, cnd1, cnd2, cnd3}
+
+	dir, err := ioutil.TempDir("", "zipcar")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "import.zcar")
+	checkpoint := filepath.Join(dir, "import.checkpoint")
+
+	// interrupted part way through, abandoning the ZipDatastore without closing it as a crash would
+	ds, err := Create(path)
+	assert.NoError(t, err)
+	interrupted := errors.New("interrupted")
+	r := io.MultiReader(bytes.NewReader(car[:len(car)*3/4]), &errorReader{interrupted})
+	imported, err := ds.ImportCar(r, checkpoint, 3)
+	assert.Equal(t, interrupted, err)
+	assert.True(t, imported >= 3, "should have imported at least a checkpoint's worth")
+	_, err = os.Stat(checkpoint)
+	assert.NoError(t, err, "should have written a checkpoint")
+
+	// a checkpoint from another import is rejected
+	other := filepath.Join(dir, "other.checkpoint")
+	assert.NoError(t, writeCheckpoint(other, 100, rndz.Cid()))
+	ds, err = Open(path)
+	assert.NoError(t, err)
+	_, err = ds.ImportCar(bytes.NewReader(car), other, 3)
+	assert.Error(t, err)
+
+	// resumed from the checkpoint, only the blocks after it are imported again
+	resumed, err := ds.ImportCar(bytes.NewReader(car), checkpoint, 3)
+	assert.NoError(t, err)
+	assert.True(t, resumed > 0 && resumed < len(all), "resumed import should skip the checkpointed blocks")
+	_, err = os.Stat(checkpoint)
+	assert.True(t, os.IsNotExist(err), "checkpoint should be removed on completion")
+	assert.NoError(t, ds.Close())
+
+	ds, err = Open(path)
+	assert.NoError(t, err)
+	defer ds.Close()
+	for _, block := range all {
+		data, err := ds.GetCid(block.Cid())
+		assert.NoError(t, err)
+		assert.Equal(t, block.RawData(), data)
+	}
+
+	// importing again adds nothing, a CARv2 is rejected
+	imported, err = ds.ImportCar(bytes.NewReader(car), "", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, imported)
+	_, err = ds.ImportCar(bytes.NewReader(carV2Pragma), "", 0)
+	assert.Equal(t, ErrNotCarV1, err)
+}
+
+// errorReader returns err from every Read()
+type errorReader struct {
+	err error
+}
+
+func (r *errorReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
+
+func TestCheckComplete(t *testing.T) {
+	copyFixture(t, "js.zcar", "complete.zcar")
+	defer os.Remove("complete.zcar")
+	ds, err := NewDatastore("complete.zcar")
+	assert.NoError(t, err)
+	defer ds.Close()
+
+	missing, err := ds.CheckComplete()
+	assert.NoError(t, err)
+	assert.Empty(t, missing)
+
+	// rnd2 is only linked from pnd2, which is itself missing, so only pnd2 is reported
+	assert.NoError(t, ds.DeleteCid(rnd2.Cid()))
+	assert.NoError(t, ds.DeleteCid(pnd2.Cid()))
+	missing, err = ds.CheckComplete()
+	assert.NoError(t, err)
+	assert.Equal(t, []cid.Cid{pnd2.Cid()}, missing)
+
+	assert.NoError(t, ds.DeleteCid(rnd3.Cid()))
+	missing, err = ds.CheckComplete()
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []cid.Cid{pnd2.Cid(), rnd3.Cid()}, missing)
+
+	// a block with a codec that has no links known to CheckComplete is a leaf
+	gitRaw, err := cid.Prefix{Version: 1, Codec: cid.GitRaw, MhType: mh.SHA2_256, MhLength: -1}.Sum([]byte("git"))
+	assert.NoError(t, err)
+	assert.NoError(t, ds.PutCid(gitRaw, []byte("git")))
+	missing, err = ds.CheckComplete()
+	assert.NoError(t, err)
+	assert.Len(t, missing, 2)
+}
+
+func TestSortEntries(t *testing.T) {
+	copyFixture(t, "js.zcar", "sorted.zcar")
+	defer os.Remove("sorted.zcar")
+	opts := DefaultOptions()
+	opts.SortEntries = true
+	opts.WriteIntegrityManifest = true
+	ds, err := NewDatastoreWithOptions("sorted.zcar", &opts)
+	assert.NoError(t, err)
+	assert.NoError(t, ds.PutCid(rndz.Cid(), rndz.RawData()))
+	_, err = ds.PutData([]byte("sorted"))
+	assert.NoError(t, err)
+	assert.NoError(t, ds.Close())
+
+	reader, err := zip.OpenReader("sorted.zcar")
+	assert.NoError(t, err)
+	defer reader.Close()
+	var names []string
+	for _, f := range reader.File {
+		names = append(names, f.Name)
+	}
+	assert.Len(t, names, 12)
+	assert.Equal(t, IntegrityManifestName, names[11], "entries that aren't blocks should follow the blocks")
+	assert.True(t, sort.StringsAreSorted(names[:11]), "block entries should be sorted by filename: %v", names)
+
+	// a binary search of the central directory finds a block
+	i := sort.SearchStrings(names[:11], rndz.Cid().String())
+	assert.Equal(t, rndz.Cid().String(), names[i])
+}
+
+func TestAppendBlock(t *testing.T) {
+	copyFixture(t, "js.zcar", "append.zcar")
+	defer os.Remove("append.zcar")
+	ds, err := NewDatastore("append.zcar")
+	assert.NoError(t, err)
+	ds.SetComment("appended to")
+	assert.NoError(t, ds.Close())
+
+	extra := dag.NewRawNode([]byte("another appended block"))
+	assert.NoError(t, AppendBlock("append.zcar", rndz.Cid(), rndz.RawData()))
+	assert.NoError(t, AppendBlock("append.zcar", extra.Cid(), extra.RawData()))
+
+	// a block already present, or with an identity CID, is not written again
+	before, err := ioutil.ReadFile("append.zcar")
+	assert.NoError(t, err)
+	assert.NoError(t, AppendBlock("append.zcar", rndz.Cid(), rndz.RawData()))
+	assert.NoError(t, AppendBlock("append.zcar", rnd1.Cid(), rnd1.RawData()))
+	inline, err := cid.Prefix{Version: 1, Codec: cid.Raw, MhType: mh.ID, MhLength: -1}.Sum([]byte("inline"))
+	assert.NoError(t, err)
+	assert.NoError(t, AppendBlock("append.zcar", inline, []byte("inline")))
+	after, err := ioutil.ReadFile("append.zcar")
+	assert.NoError(t, err)
+	assert.Equal(t, before, after)
+
+	comment, err := ReadComment("append.zcar")
+	assert.NoError(t, err)
+	assert.Equal(t, "appended to", comment)
+	reader, err := zip.OpenReader("append.zcar")
+	assert.NoError(t, err)
+	assert.Len(t, reader.File, 11)
+	assert.Equal(t, extra.Cid().String(), reader.File[10].Name)
+	assert.NoError(t, reader.Close())
+
+	ds, err = NewDatastore("append.zcar")
+	assert.NoError(t, err)
+	verifyHasEntries(t, ds, false)
+	verifyHas(t, ds, rndz.Cid(), "rndz")
+	data, err := ds.GetCid(extra.Cid())
+	assert.NoError(t, err)
+	assert.Equal(t, extra.RawData(), data)
+	report, err := ds.Check()
+	assert.NoError(t, err)
+	assert.Equal(t, 11, report.Checked)
+	assert.Empty(t, report.Mismatched)
+	assert.NoError(t, ds.Close())
+
+	// data preceding the first entry can't be appended after in place, the archive is rewritten instead
+	fixture, err := ioutil.ReadFile("js.zcar")
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile("append.zcar", append([]byte("prefix"), fixture...), 0644))
+	assert.NoError(t, AppendBlock("append.zcar", rndz.Cid(), rndz.RawData()))
+	ds, err = NewDatastore("append.zcar")
+	assert.NoError(t, err)
+	verifyHasEntries(t, ds, false)
+	verifyHas(t, ds, rndz.Cid(), "rndz")
+	assert.NoError(t, ds.Close())
+
+	// an empty file becomes an archive of the block, a missing file is an error
+	assert.NoError(t, ioutil.WriteFile("append.zcar", nil, 0644))
+	assert.NoError(t, AppendBlock("append.zcar", rnd1.Cid(), rnd1.RawData()))
+	ds, err = NewDatastore("append.zcar")
+	assert.NoError(t, err)
+	verifyHas(t, ds, rnd1.Cid(), "rnd1")
+	assert.NoError(t, ds.Close())
+	assert.NoError(t, os.Remove("append.zcar"))
+	assert.True(t, os.IsNotExist(AppendBlock("append.zcar", rnd1.Cid(), rnd1.RawData())))
+}
+
+func TestLogger(t *testing.T) {
+	copyFixture(t, "js.zcar", "logged.zcar")
+	defer os.Remove("logged.zcar")
+	logger := &recordingLogger{}
+	opts := DefaultOptions()
+	opts.Logger = logger
+	ds, err := NewDatastoreWithOptions("logged.zcar", &opts)
+	assert.NoError(t, err)
+	assert.NoError(t, ds.PutCid(rndz.Cid(), rndz.RawData()))
+	assert.NoError(t, ds.Sync())
+	assert.NoError(t, ds.Close())
+
+	// sizes and durations vary so only the start of each line is compared
+	expected := []string{
+		`INFO zipcar: opened archive "logged.zcar" of `,
+		`DEBUG zipcar: rewriting archive "logged.zcar" with 10 blocks`,
+		`INFO zipcar: rewrote archive "logged.zcar" with 10 blocks in `,
+		`INFO zipcar: opened archive "logged.zcar" of `,
+		`DEBUG zipcar: dropped 10 blocks held in memory now that they are in the archive`,
+		`INFO zipcar: closing archive "logged.zcar", modified: false`,
+	}
+	assert.Len(t, logger.lines, len(expected))
+	for i, line := range logger.lines {
+		if i < len(expected) {
+			assert.True(t, strings.HasPrefix(line, expected[i]), "line %d: %s", i, line)
+		}
+	}
+	assert.True(t, strings.HasSuffix(logger.lines[0], " holding 9 blocks"), logger.lines[0])
+}
+
+// recordingLogger is a Logger that records each message prefixed with its level
+type recordingLogger struct {
+	lines []string
+}
+
+func (l *recordingLogger) Debugf(format string, args ...interface{}) {
+	l.lines = append(l.lines, "DEBUG "+fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) Infof(format string, args ...interface{}) {
+	l.lines = append(l.lines, "INFO "+fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) Warnf(format string, args ...interface{}) {
+	l.lines = append(l.lines, "WARN "+fmt.Sprintf(format, args...))
+}
+
 func TestTeardown(t *testing.T) {
 	os.Remove("test.zcar")
 }
 
+func BenchmarkRewriteSmallBlocks(b *testing.B) {
+	const count = 20000
+	defer os.Remove("bench.zcar")
+
+	for _, bufferSize := range []int{0, DefaultOptions().WriteBufferSize} {
+		name := "unbuffered"
+		if bufferSize > 0 {
+			name = "buffered"
+		}
+		b.Run(name, func(b *testing.B) {
+			opts := DefaultOptions()
+			opts.WriteBufferSize = bufferSize
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				os.Remove("bench.zcar")
+				ds, err := NewDatastoreWithOptions("bench.zcar", &opts)
+				if err != nil {
+					b.Fatal(err)
+				}
+				for j := 0; j < count; j++ {
+					if _, err = ds.PutData([]byte(fmt.Sprintf("%d", j))); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.StartTimer()
+				if err = ds.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkCompressWorkers(b *testing.B) {
+	const count = 2000
+	opts := DefaultOptions()
+	ds, err := NewDatastoreWithOptions("bench.zcar", &opts)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.Remove("bench.zcar")
+	for i := 0; i < count; i++ {
+		// 32 KiB of compressible but not trivially repetitive data per block
+		var buf bytes.Buffer
+		for buf.Len() < 32<<10 {
+			fmt.Fprintf(&buf, "block %d line %d\n", i, buf.Len()*7919%1000003)
+		}
+		node := dag.NewRawNode(buf.Bytes())
+		if err = ds.PutCid(node.Cid(), node.RawData()); err != nil {
+			b.Fatal(err)
+		}
+	}
+	defer ds.Close()
+
+	for _, workers := range []int{0, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			ds.opts.CompressWorkers = workers
+			for i := 0; i < b.N; i++ {
+				if _, err := ds.WriteTo(ioutil.Discard); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkAllKeysChan(b *testing.B) {
+	const count = 100000
+	defer os.Remove("bench.zcar")
+	os.Remove("bench.zcar")
+	ds, err := NewDatastore("bench.zcar")
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < count; i++ {
+		if _, err = ds.PutData([]byte(fmt.Sprintf("%d", i))); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err = ds.Close(); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, workers := range []int{0, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			opts := DefaultOptions()
+			opts.ScanWorkers = workers
+			ds, err := NewDatastoreWithOptions("bench.zcar", &opts)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer ds.Close()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				ch, err := ds.AllKeysChan(context.Background())
+				if err != nil {
+					b.Fatal(err)
+				}
+				n := 0
+				for range ch {
+					n++
+				}
+				if n != count {
+					b.Fatalf("expected %d keys, got %d", count, n)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkGetRange(b *testing.B) {
+	defer os.Remove("bench.zcar")
+	os.Remove("bench.zcar")
+	var buf bytes.Buffer
+	for buf.Len() < 4<<20 {
+		fmt.Fprintf(&buf, "line %d of a large compressible block\n", buf.Len())
+	}
+	large := dag.NewRawNode(buf.Bytes())
+	ds, err := NewDatastore("bench.zcar")
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err = ds.PutCid(large.Cid(), large.RawData()); err != nil {
+		b.Fatal(err)
+	}
+	if err = ds.Close(); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, cached := range []bool{false, true} {
+		b.Run(fmt.Sprintf("cached=%v", cached), func(b *testing.B) {
+			opts := DefaultOptions()
+			opts.DisableReadCache = true
+			ds, err := NewDatastoreWithOptions("bench.zcar", &opts)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer ds.Close()
+			for i := 0; i < b.N; i++ {
+				if !cached {
+					ds.inflated = inflatedEntry{}
+				}
+				offset := int64(i*7919) % int64(len(large.RawData()))
+				if _, err := ds.GetRange(large.Cid(), offset, 4096); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkGetCrcCheck(b *testing.B) {
+	defer os.Remove("bench.zcar")
+	os.Remove("bench.zcar")
+	ds, err := NewDatastore("bench.zcar")
+	if err != nil {
+		b.Fatal(err)
+	}
+	// 4 MiB blocks, stored and deflated
+	var compressible bytes.Buffer
+	for compressible.Len() < 4<<20 {
+		fmt.Fprintf(&compressible, "line %d\n", compressible.Len()*7919%1000003)
+	}
+	random := make([]byte, 4<<20)
+	rand.New(rand.NewSource(1)).Read(random)
+	nodes := map[string]*dag.RawNode{
+		"stored":   dag.NewRawNode(random),
+		"deflated": dag.NewRawNode(compressible.Bytes()),
+	}
+	for _, node := range nodes {
+		if err = ds.PutCid(node.Cid(), node.RawData()); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err = ds.Close(); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, skip := range []bool{false, true} {
+		opts := DefaultOptions()
+		opts.DisableReadCache = true
+		opts.SkipCrcCheck = skip
+		ds, err := NewDatastoreWithOptions("bench.zcar", &opts)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for _, name := range []string{"stored", "deflated"} {
+			node := nodes[name]
+			b.Run(fmt.Sprintf("%s/skip=%t", name, skip), func(b *testing.B) {
+				b.SetBytes(int64(len(node.RawData())))
+				for i := 0; i < b.N; i++ {
+					if _, err := ds.GetCid(node.Cid()); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+		ds.Close()
+	}
+}
+
+func BenchmarkHas(b *testing.B) {
+	ds, err := NewDatastore("js.zcar")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer ds.Close()
+	c := rnd1.Cid()
+
+	b.Run("HasCid", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if has, _ := ds.HasCid(c); !has {
+				b.Fatal("rnd1 not found")
+			}
+		}
+	})
+	b.Run("HasRaw", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if !ds.HasRaw(c) {
+				b.Fatal("rnd1 not found")
+			}
+		}
+	})
+}
+
+func writeFixture(t *testing.T, path string, entries map[string][]byte) {
+	file, err := os.Create(path)
+	assert.NoError(t, err)
+	defer file.Close()
+
+	writer := zip.NewWriter(file)
+	for name, data := range entries {
+		f, err := writer.Create(name)
+		assert.NoError(t, err)
+		_, err = f.Write(data)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, writer.Close())
+}
+
+func copyFixture(t *testing.T, src string, dst string) {
+	data, err := ioutil.ReadFile(src)
+	assert.NoError(t, err)
+	err = ioutil.WriteFile(dst, data, 0644)
+	assert.NoError(t, err)
+}
+
+// hideFile stops the next rewrite of `ds` using its open descriptor, which is unaffected by the path moving, so
+// the rewrite reopens the path as it does when there is no open file.
+func hideFile(ds *ZipDatastore) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	ds.file = nopCloser{ds.file}
+}
+
 func verifyHas(t *testing.T, ds *ZipDatastore, cid cid.Cid, name string) {
 	var has bool
 	var err error